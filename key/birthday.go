@@ -0,0 +1,54 @@
+package key
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// birthdayDateFormat means the format of the date which can be given as birthday.
+const birthdayDateFormat = "2006-01-02"
+
+// Birthday means when the key was created, as a time or a block height.
+// Blocks before the birthday don't have transactions of the key, so they are not scanned.
+type Birthday struct {
+	Time   time.Time // zero値ならHeightを使う
+	Height uint32
+}
+
+// NewBirthdayAt create new birthday of the time.
+func NewBirthdayAt(t time.Time) *Birthday {
+	return &Birthday{Time: t.UTC().Truncate(time.Second)}
+}
+
+// NewBirthdayHeight create new birthday of the block height.
+func NewBirthdayHeight(height uint32) *Birthday {
+	return &Birthday{Height: height}
+}
+
+// ParseBirthday parse a block height, a date (2006-01-02) or RFC3339 time.
+func ParseBirthday(s string) (*Birthday, error) {
+	if height, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return NewBirthdayHeight(uint32(height)), nil
+	}
+	if t, err := time.Parse(birthdayDateFormat, s); err == nil {
+		return NewBirthdayAt(t), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return NewBirthdayAt(t), nil
+	}
+	return nil, fmt.Errorf("Invalid birthday %s, expected height or date", s)
+}
+
+// IsHeight checks the birthday is a block height.
+func (b *Birthday) IsHeight() bool {
+	return b.Time.IsZero()
+}
+
+// String stringify the birthday in the format ParseBirthday accepts.
+func (b *Birthday) String() string {
+	if b.IsHeight() {
+		return strconv.FormatUint(uint64(b.Height), 10)
+	}
+	return b.Time.Format(time.RFC3339)
+}
@@ -46,9 +46,23 @@ func DecodeWIF(wif string) []byte {
 //
 // refer: https://en.bitcoin.it/w/index.php?title=Technical_background_of_version_1_Bitcoin_addresses
 func EncodeBitcoinAddr(publicKeyBytes []byte) string {
+	return EncodePubKeyHashAddr(util.Hash160(publicKeyBytes))
+}
+
+// EncodePubKeyHashAddr encode public key hash to P2PKH address.
+func EncodePubKeyHashAddr(pubKeyHash []byte) string {
+	return encodeAddr(0x6F, pubKeyHash) // This means that, this address is for testnet.
+}
+
+// EncodeScriptHashAddr encode script hash to P2SH address.
+func EncodeScriptHashAddr(scriptHash []byte) string {
+	return encodeAddr(0xC4, scriptHash) // testnetのP2SHアドレス
+}
+
+func encodeAddr(version byte, hash []byte) string {
 	bs := bytes.Join([][]byte{
-		[]byte{0x6F}, // This means that, this address is for testnet.
-		util.Hash160(publicKeyBytes),
+		[]byte{version},
+		hash,
 	},
 		[]byte{})
 	checksum := util.Hash256(bs)[:4]
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
+	"strings"
+	"time"
 
 	secp256k1 "github.com/toxeus/go-secp256k1"
 
@@ -17,24 +19,68 @@ const (
 )
 
 // ReadOrGeneratePrivateKey read or generate private key.
+// The birthday of new key is the current time.
 func ReadOrGeneratePrivateKey() ([]byte, error) {
 	_, err := os.Stat(secretKeyFilePath)
 	if err == nil {
-		data, err := ioutil.ReadFile(secretKeyFilePath)
+		wif, _, err := readKeyFile()
 		if err != nil {
 			return []byte{}, err
 		}
-		return DecodeWIF(string(data)), nil
+		return DecodeWIF(wif), nil
 	}
 	priv := GeneratePrivateKey()
-	wif := EncodeWIF(priv)
-	err = ioutil.WriteFile(secretKeyFilePath, []byte(wif), 0666)
-	if err != nil {
+	if err := writeKeyFile(EncodeWIF(priv), NewBirthdayAt(time.Now())); err != nil {
 		return []byte{}, err
 	}
 	return priv, nil
 }
 
+// ReadBirthday read the birthday of the key, or nil if it is unknown.
+func ReadBirthday() (*Birthday, error) {
+	_, birthday, err := readKeyFile()
+	if err != nil {
+		return nil, err
+	}
+	return birthday, nil
+}
+
+// SetBirthday save the birthday with the key.
+func SetBirthday(birthday *Birthday) error {
+	wif, _, err := readKeyFile()
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(wif, birthday)
+}
+
+// readKeyFile read the WIF in the first line and the birthday in the optional second line.
+// Key files created before the birthday was introduced only have the WIF.
+func readKeyFile() (string, *Birthday, error) {
+	data, err := ioutil.ReadFile(secretKeyFilePath)
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	wif := strings.TrimSpace(lines[0])
+	if len(lines) < 2 {
+		return wif, nil, nil
+	}
+	birthday, err := ParseBirthday(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid key file %s: %v", secretKeyFilePath, err)
+	}
+	return wif, birthday, nil
+}
+
+func writeKeyFile(wif string, birthday *Birthday) error {
+	data := wif
+	if birthday != nil {
+		data += "\n" + birthday.String()
+	}
+	return ioutil.WriteFile(secretKeyFilePath, []byte(data+"\n"), 0600)
+}
+
 // GeneratePrivateKey generate new private key.
 func GeneratePrivateKey() []byte {
 	var privateKeyBytes32 [32]byte
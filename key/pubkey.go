@@ -0,0 +1,48 @@
+package key
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/tanishiking/btcwallet/util/curve"
+)
+
+// CompressPubKey return the 33 bytes compressed form of the public key.
+func CompressPubKey(pubKey []byte) ([]byte, error) {
+	switch {
+	case len(pubKey) == 33 && (pubKey[0] == 0x02 || pubKey[0] == 0x03):
+		return append([]byte{}, pubKey...), nil
+	case len(pubKey) == 65 && pubKey[0] == 0x04:
+		// yの偶奇をprefixにする
+		prefix := byte(0x02) | pubKey[64]&0x01
+		return append([]byte{prefix}, pubKey[1:33]...), nil
+	}
+	return nil, fmt.Errorf("Invalid public key: %d bytes", len(pubKey))
+}
+
+// TaprootOutputKey return the x-only output key of BIP86 key path only taproot output.
+// The internal key is tweaked by its own tagged hash without script tree.
+// https://github.com/bitcoin/bips/blob/master/bip-0086.mediawiki
+func TaprootOutputKey(pubKey []byte) ([]byte, error) {
+	compressed, err := CompressPubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	xOnly := compressed[1:]
+	internal := curve.LiftX(new(big.Int).SetBytes(xOnly))
+	if internal == nil {
+		return nil, fmt.Errorf("Public key is not on the curve")
+	}
+	tweak := curve.TaggedHash([]byte("TapTweak"), xOnly)
+	t := new(big.Int).SetBytes(tweak[:])
+	if t.Cmp(curve.N) >= 0 {
+		return nil, fmt.Errorf("Taproot tweak is out of range")
+	}
+	q := curve.Add(internal, curve.ScalarBaseMult(t))
+	if q == nil {
+		return nil, fmt.Errorf("Taproot output key is infinity")
+	}
+	res := make([]byte, 32)
+	q.X.FillBytes(res)
+	return res, nil
+}
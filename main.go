@@ -1,67 +1,249 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/tanishiking/btcwallet/key"
 	"github.com/tanishiking/btcwallet/protocol"
 )
 
+// stringsFlag is flag.Value which can be specified multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func main() {
 	usage := fmt.Sprintf(`
 Usage of %s
-	%s [SUBCOMMAND]
+	%s [OPTIONS] [SUBCOMMAND]
+OPTIONS
+	-uacomment <comment>
+		Append comment to the user agent (BIP14). Can be specified multiple times.
+	-proxy <[socks5://][user:pass@]host:port>
+		Connect to peers through the SOCKS5 proxy (e.g. Tor at 127.0.0.1:9050).
+	-proxyrandomize
+		Use random proxy credentials per connection for Tor stream isolation (default true).
+	-v2transport
+		Try BIP324 encrypted transport first and fallback to v1 (default true).
+	-bantime <duration>
+		How long misbehaving peers are banned (default 24h).
+	-checkpointsync
+		Start header sync from the checkpoint the wallet is scanned after instead of the genesis (default true).
+	-cfilters
+		Sync with BIP157/158 compact block filters, or BIP37 bloom filters if false (default true).
 SUBCOMMAND
 	show
 		Show/Generate bitcoin address.
 	balance
 		Show balance.
-	send <address> <amount> <fee>
-		Send bitcoin.
+	history [--json]
+		Show the wallet transactions with confirmations, amounts and fees.
+	send [--coin-selection <auto|bnb|knapsack|srd|largest>] [--max-fee <satoshis>] <address> <amount> <feerate>
+		Send bitcoin at the fee rate in sat/vB. Coin selection takes the least waste of bnb, knapsack and srd by default.
+		The transaction is not sent if the fee exceeds max fee (default 0.1 BTC).
+	bumpfee [--max-fee <satoshis>] <txid> --feerate <feerate>
+		Replace the unconfirmed transaction with one paying at the fee rate in sat/vB. (BIP125)
+		The fee is taken from the change, or confirmed outputs are added if the change is not enough.
+	estimatefee <blocks>
+		Estimate the fee rate in sat/vB to confirm within the blocks from the relayed transactions seen before.
+	listbanned
+		List banned peers.
+	clearbanned [host]
+		Unban the host, or all banned peers if host is omitted.
+	exportcheckpoint
+		Print the tip of the synced headers as a checkpoint.
+	gettxoutproof <txid> <blockhash>
+		Print the hex proof that the transaction is included in the block, like gettxoutproof of bitcoin core.
+	verifyproof <proof>
+		Verify the hex proof of gettxoutproof against the synced headers.
+	rescan --from <height|date>
+		Forget the transactions after the height or the date (2006-01-02) and scan the blocks again.
 `, os.Args[0], os.Args[0])
 
-	if len(os.Args) < 2 {
+	var uaComments stringsFlag
+	flag.Var(&uaComments, "uacomment", "user agent comment")
+	proxy := flag.String("proxy", "", "SOCKS5 proxy")
+	proxyRandomize := flag.Bool("proxyrandomize", true, "randomize proxy credentials")
+	v2Transport := flag.Bool("v2transport", true, "use BIP324 v2 transport")
+	banTime := flag.Duration("bantime", protocol.DefaultConfig().BanDuration, "ban duration")
+	checkpointSync := flag.Bool("checkpointsync", true, "start header sync from checkpoint")
+	cfilters := flag.Bool("cfilters", true, "sync with compact block filters instead of bloom filters")
+	flag.Usage = func() { fmt.Println(usage) }
+	flag.Parse()
+	args := append([]string{os.Args[0]}, flag.Args()...)
+
+	if len(args) < 2 {
 		fmt.Println(usage)
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
+	cfg := protocol.DefaultConfig()
+	cfg.UserAgentComments = uaComments
+	cfg.V2Transport = *v2Transport
+	cfg.BanDuration = *banTime
+	cfg.CheckpointSync = *checkpointSync
+	cfg.SetCompactFilters(*cfilters)
+	if _, err := cfg.UserAgent(); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if *proxy != "" {
+		dialer, err := protocol.ParseProxy(*proxy, *proxyRandomize)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		cfg.Dialer = dialer
+	}
+	protocol.SetConfig(cfg)
+
+	command := args[1]
 	switch command {
 	case "balance":
-		showBalance()
+		exitIfError(showBalance())
+	case "history":
+		historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+		jsonFormat := historyFlags.Bool("json", false, "print history as JSON")
+		historyFlags.Usage = func() { fmt.Println(usage) }
+		historyFlags.Parse(args[2:])
+		if historyFlags.NArg() != 0 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(protocol.History(*jsonFormat))
 	case "show":
 		generateNewBitcoinAddress()
 	case "send":
-		if len(os.Args) != 5 {
+		sendFlags := flag.NewFlagSet("send", flag.ExitOnError)
+		coinSelection := sendFlags.String("coin-selection", "auto", "coin selection strategy")
+		maxFee := sendFlags.Uint64("max-fee", protocol.DefaultMaxFee, "max fee in satoshis")
+		sendFlags.Usage = func() { fmt.Println(usage) }
+		sendFlags.Parse(args[2:])
+		if sendFlags.NArg() != 3 {
 			fmt.Println(usage)
 			os.Exit(1)
 		}
-		addr := os.Args[2]
-		amount, err := strconv.Atoi(os.Args[3])
+		selector, err := protocol.NewCoinSelector(*coinSelection)
 		if err != nil {
-			fmt.Printf("Invalid input amount %v\n", os.Args[3])
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		addr := sendFlags.Arg(0)
+		amount, err := strconv.ParseUint(sendFlags.Arg(1), 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid input amount %v\n", sendFlags.Arg(1))
 			fmt.Println(usage)
+			os.Exit(1)
 		}
-		fee, err := strconv.Atoi(os.Args[4])
+		feeRate, err := strconv.ParseUint(sendFlags.Arg(2), 10, 64)
 		if err != nil {
-			fmt.Printf("Invalid input amount %v\n", os.Args[4])
+			fmt.Printf("Invalid input fee rate %v\n", sendFlags.Arg(2))
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(sendBitcoin(addr, amount, feeRate, *maxFee, selector))
+	case "bumpfee":
+		bumpFlags := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+		feeRate := bumpFlags.Uint64("feerate", 0, "fee rate of the replacement in sat/vB")
+		maxFee := bumpFlags.Uint64("max-fee", protocol.DefaultMaxFee, "max fee in satoshis")
+		bumpFlags.Usage = func() { fmt.Println(usage) }
+		bumpFlags.Parse(args[2:])
+		if bumpFlags.NArg() < 1 {
 			fmt.Println(usage)
+			os.Exit(1)
 		}
-		sendBitcoin(addr, amount, fee)
+		// txidの後のflagも読む
+		txID := bumpFlags.Arg(0)
+		bumpFlags.Parse(bumpFlags.Args()[1:])
+		if bumpFlags.NArg() != 0 || *feeRate == 0 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(protocol.BumpFee(txID, *feeRate, *maxFee))
+	case "estimatefee":
+		if len(args) != 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		blocks, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			fmt.Printf("Invalid input blocks %v\n", args[2])
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(protocol.EstimateFee(uint32(blocks)))
+	case "listbanned":
+		exitIfError(protocol.ListBanned())
+	case "clearbanned":
+		if len(args) > 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		host := ""
+		if len(args) == 3 {
+			host = args[2]
+		}
+		exitIfError(protocol.ClearBanned(host))
+	case "exportcheckpoint":
+		exitIfError(protocol.ExportCheckpoint())
+	case "gettxoutproof":
+		if len(args) != 4 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(protocol.GetTxOutProof(args[2], args[3]))
+	case "verifyproof":
+		if len(args) != 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		exitIfError(protocol.VerifyProof(args[2]))
+	case "rescan":
+		rescanFlags := flag.NewFlagSet("rescan", flag.ExitOnError)
+		from := rescanFlags.String("from", "", "height or date to rescan from")
+		rescanFlags.Usage = func() { fmt.Println(usage) }
+		rescanFlags.Parse(args[2:])
+		if *from == "" || rescanFlags.NArg() != 0 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		birthday, err := key.ParseBirthday(*from)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		exitIfError(protocol.Rescan(birthday))
 	default:
 		fmt.Println(usage)
 	}
 }
 
-func showBalance() {
-	protocol.Balance()
+// exitIfError print the error of the subcommand and exit with status 1.
+func exitIfError(err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+func showBalance() error {
+	return protocol.Balance()
 }
 
-func sendBitcoin(addr string, amount int, fee int) {
-	// protocol.Send("2N8hwP1WmJrFF5QWABn38y63uYLhnJYJYTF", 20000000, 10000000)
-	protocol.Send(addr, amount, fee)
+func sendBitcoin(addr string, amount uint64, feeRate uint64, maxFee uint64, selector protocol.CoinSelector) error {
+	// protocol.Send("2N8hwP1WmJrFF5QWABn38y63uYLhnJYJYTF", 20000000, 10, protocol.DefaultMaxFee, selector)
+	return protocol.Send(addr, amount, feeRate, maxFee, selector)
 }
 
 func generateNewBitcoinAddress() {
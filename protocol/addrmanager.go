@@ -0,0 +1,362 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+const (
+	addrManagerFilePath = "peers.json"
+
+	// newBucketCount, triedBucketCount and bucketSize follow bitcoin core's addrman.
+	// https://github.com/bitcoin/bitcoin/blob/master/src/addrman_impl.h
+	newBucketCount   = 1024
+	triedBucketCount = 256
+	bucketSize       = 64
+
+	// 何回接続に失敗したら捨てるか
+	maxFailures = 10
+
+	// これより古いアドレスは捨てる
+	horizon = 30 * 24 * time.Hour
+)
+
+// KnownAddress means the address of the peer which we know with its history.
+type KnownAddress struct {
+	Addr        *common.NetAddrV2
+	Source      *common.NetAddrV2 // このアドレスを教えてくれたpeer
+	LastSeen    time.Time         // 最後にaddrで広告されたか接続できた時刻
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Attempts    int
+	Tried       bool
+}
+
+// isBad checks the address is not worth keeping.
+func (ka *KnownAddress) isBad(now time.Time) bool {
+	if ka.LastSeen.After(now.Add(10 * time.Minute)) {
+		return true
+	}
+	if now.Sub(ka.LastSeen) > horizon {
+		return true
+	}
+	if ka.LastSuccess.IsZero() && ka.Attempts >= 3 {
+		return true
+	}
+	return now.Sub(ka.LastSuccess) > 7*24*time.Hour && ka.Attempts >= maxFailures
+}
+
+// chance return relative chance to select this address.
+func (ka *KnownAddress) chance(now time.Time) float64 {
+	c := 1.0
+	if now.Sub(ka.LastAttempt) < 10*time.Minute {
+		c *= 0.01
+	}
+	for i := 0; i < ka.Attempts && i < 8; i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+// AddrManager is the peer address book with tried/new buckets.
+// Newly learned addresses go to the new table and move to the tried table
+// once we connected to them successfully.
+type AddrManager struct {
+	mtx          sync.Mutex
+	filePath     string
+	key          [32]byte // バケット決定に使う秘密のランダム値
+	addrIndex    map[string]*KnownAddress
+	newBuckets   [newBucketCount]map[string]*KnownAddress
+	triedBuckets [triedBucketCount]map[string]*KnownAddress
+}
+
+// serializedAddrManager is on-disk format of AddrManager.
+type serializedAddrManager struct {
+	Version   int
+	Key       [32]byte
+	Addresses []*KnownAddress
+}
+
+// NewAddrManager create new empty AddrManager which is saved to filePath.
+func NewAddrManager(filePath string) *AddrManager {
+	m := &AddrManager{
+		filePath:  filePath,
+		addrIndex: map[string]*KnownAddress{},
+	}
+	rand.Read(m.key[:])
+	for i := range m.newBuckets {
+		m.newBuckets[i] = map[string]*KnownAddress{}
+	}
+	for i := range m.triedBuckets {
+		m.triedBuckets[i] = map[string]*KnownAddress{}
+	}
+	return m
+}
+
+// LoadAddrManager read AddrManager from the file, or create new one if the file doesn't exist.
+func LoadAddrManager(filePath string) (*AddrManager, error) {
+	m := NewAddrManager(filePath)
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s serializedAddrManager
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Failed to load address book %s: %v", filePath, err)
+	}
+	m.key = s.Key
+	for _, ka := range s.Addresses {
+		if ka.Addr == nil || !ka.Addr.IsKnownNetwork() {
+			continue
+		}
+		m.addrIndex[ka.Addr.Key()] = ka
+		if ka.Tried {
+			m.triedBuckets[m.triedBucket(ka.Addr)][ka.Addr.Key()] = ka
+		} else {
+			m.newBuckets[m.newBucket(ka.Addr, ka.Source)][ka.Addr.Key()] = ka
+		}
+	}
+	return m, nil
+}
+
+// Save write the address book to the file.
+func (m *AddrManager) Save() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	s := serializedAddrManager{
+		Version:   1,
+		Key:       m.key,
+		Addresses: []*KnownAddress{},
+	}
+	for _, ka := range m.addrIndex {
+		s.Addresses = append(s.Addresses, ka)
+	}
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	tmp := m.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.filePath)
+}
+
+// NumAddresses return the number of known addresses.
+func (m *AddrManager) NumAddresses() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return len(m.addrIndex)
+}
+
+// AddAddresses add addresses learned from src to the new table.
+func (m *AddrManager) AddAddresses(addrs []*common.NetAddrV2, src *common.NetAddrV2) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, addr := range addrs {
+		m.addAddress(addr, src)
+	}
+}
+
+// AddAddress add the address learned from src to the new table.
+func (m *AddrManager) AddAddress(addr *common.NetAddrV2, src *common.NetAddrV2) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.addAddress(addr, src)
+}
+
+func (m *AddrManager) addAddress(addr *common.NetAddrV2, src *common.NetAddrV2) {
+	if !addr.IsKnownNetwork() || addr.Port == 0 {
+		return
+	}
+	now := time.Now()
+	lastSeen := time.Unix(int64(addr.Timestamp), 0)
+	if lastSeen.After(now.Add(10*time.Minute)) || now.Sub(lastSeen) > horizon {
+		// 未来や古すぎるタイムスタンプの場合は5日前に見たものとして扱う
+		lastSeen = now.Add(-5 * 24 * time.Hour)
+	}
+	if ka, ok := m.addrIndex[addr.Key()]; ok {
+		if lastSeen.After(ka.LastSeen) {
+			ka.LastSeen = lastSeen
+		}
+		ka.Addr.Services |= addr.Services
+		return
+	}
+	ka := &KnownAddress{
+		Addr:     addr,
+		Source:   src,
+		LastSeen: lastSeen,
+	}
+	bucket := m.newBuckets[m.newBucket(addr, src)]
+	if len(bucket) >= bucketSize {
+		m.expireNew(bucket)
+	}
+	bucket[addr.Key()] = ka
+	m.addrIndex[addr.Key()] = ka
+}
+
+// expireNew remove bad addresses from the bucket, or the oldest one if there is nothing bad.
+func (m *AddrManager) expireNew(bucket map[string]*KnownAddress) {
+	now := time.Now()
+	var oldest *KnownAddress
+	for k, ka := range bucket {
+		if ka.isBad(now) {
+			delete(bucket, k)
+			delete(m.addrIndex, k)
+			continue
+		}
+		if oldest == nil || ka.LastSeen.Before(oldest.LastSeen) {
+			oldest = ka
+		}
+	}
+	if len(bucket) >= bucketSize && oldest != nil {
+		delete(bucket, oldest.Addr.Key())
+		delete(m.addrIndex, oldest.Addr.Key())
+	}
+}
+
+// Attempt mark the address as we tried to connect.
+func (m *AddrManager) Attempt(addr *common.NetAddrV2) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ka, ok := m.addrIndex[addr.Key()]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = time.Now()
+	ka.Attempts++
+}
+
+// Good mark the address as we successfully connected, and move it to the tried table.
+func (m *AddrManager) Good(addr *common.NetAddrV2) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ka, ok := m.addrIndex[addr.Key()]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		m.addrIndex[addr.Key()] = ka
+	}
+	now := time.Now()
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.LastAttempt = now
+	ka.Attempts = 0
+	if ka.Tried {
+		return
+	}
+	delete(m.newBuckets[m.newBucket(ka.Addr, ka.Source)], addr.Key())
+
+	bucket := m.triedBuckets[m.triedBucket(ka.Addr)]
+	if len(bucket) >= bucketSize {
+		// triedが一杯の場合は最も古いものをnewに戻す
+		var oldest *KnownAddress
+		for _, other := range bucket {
+			if oldest == nil || other.LastSuccess.Before(oldest.LastSuccess) {
+				oldest = other
+			}
+		}
+		delete(bucket, oldest.Addr.Key())
+		oldest.Tried = false
+		newBucket := m.newBuckets[m.newBucket(oldest.Addr, oldest.Source)]
+		if len(newBucket) >= bucketSize {
+			m.expireNew(newBucket)
+		}
+		newBucket[oldest.Addr.Key()] = oldest
+	}
+	ka.Tried = true
+	bucket[addr.Key()] = ka
+}
+
+// GetAddress return an address to connect, choosing from tried and new table.
+// Only addresses which reachable returns true are chosen if reachable is not nil.
+// It returns nil if there is no known address.
+func (m *AddrManager) GetAddress(reachable func(*common.NetAddrV2) bool) *KnownAddress {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	tried := []*KnownAddress{}
+	fresh := []*KnownAddress{}
+	for _, ka := range m.addrIndex {
+		if reachable != nil && !reachable(ka.Addr) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+	if len(tried)+len(fresh) == 0 {
+		return nil
+	}
+	candidates := fresh
+	if len(fresh) == 0 || (len(tried) > 0 && mrand.Intn(2) == 0) {
+		candidates = tried
+	}
+	// chanceによる重み付きで選択する
+	for i := 0; i < 100; i++ {
+		ka := candidates[mrand.Intn(len(candidates))]
+		if mrand.Float64() < ka.chance(now) {
+			return ka
+		}
+	}
+	return candidates[mrand.Intn(len(candidates))]
+}
+
+// newBucket calculate the new bucket index for the address learned from src.
+func (m *AddrManager) newBucket(addr *common.NetAddrV2, src *common.NetAddrV2) int {
+	srcGroup := []byte{}
+	if src != nil {
+		srcGroup = groupKey(src)
+	}
+	h1 := hashUint64(m.key[:], groupKey(addr), srcGroup)
+	h2 := hashUint64(m.key[:], srcGroup, uint64Bytes(h1%64))
+	return int(h2 % newBucketCount)
+}
+
+// triedBucket calculate the tried bucket index for the address.
+func (m *AddrManager) triedBucket(addr *common.NetAddrV2) int {
+	h1 := hashUint64(m.key[:], []byte(addr.Key()))
+	h2 := hashUint64(m.key[:], groupKey(addr), uint64Bytes(h1%8))
+	return int(h2 % triedBucketCount)
+}
+
+// groupKey return the network group of the address,
+// /16 for IPv4, /32 for IPv6 and first 4 bytes for other networks.
+func groupKey(addr *common.NetAddrV2) []byte {
+	prefix := 4
+	if addr.NetworkID == common.NetworkIPv4 {
+		prefix = 2
+	}
+	if len(addr.Addr) < prefix {
+		prefix = len(addr.Addr)
+	}
+	return append([]byte{addr.NetworkID}, addr.Addr[:prefix]...)
+}
+
+func hashUint64(data ...[]byte) uint64 {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil)[:8])
+}
+
+func uint64Bytes(u uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, u)
+	return b
+}
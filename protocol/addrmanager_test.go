@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+func testAddr(b byte) *common.NetAddrV2 {
+	return &common.NetAddrV2{
+		Timestamp: uint32(time.Now().Unix()),
+		Services:  uint64(1),
+		NetworkID: common.NetworkIPv4,
+		Addr:      []byte{10, b, 0, 1},
+		Port:      testnetPort,
+	}
+}
+
+func TestAddrManagerGoodAndPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addrmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	m := NewAddrManager(path)
+	m.AddAddresses([]*common.NetAddrV2{testAddr(1), testAddr(2), testAddr(3)}, nil)
+	if m.NumAddresses() != 3 {
+		t.Errorf("expected: %d, actual: %d", 3, m.NumAddresses())
+	}
+	m.Good(testAddr(2))
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadAddrManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NumAddresses() != 3 {
+		t.Errorf("expected: %d, actual: %d", 3, loaded.NumAddresses())
+	}
+	ka := loaded.addrIndex[testAddr(2).Key()]
+	if ka == nil || !ka.Tried || ka.LastSuccess.IsZero() {
+		t.Errorf("address should be in tried table: %v", ka)
+	}
+	if loaded.GetAddress(nil) == nil {
+		t.Errorf("GetAddress should return an address")
+	}
+}
+
+func TestAddrManagerReachable(t *testing.T) {
+	m := NewAddrManager("")
+	onion := &common.NetAddrV2{
+		Timestamp: uint32(time.Now().Unix()),
+		NetworkID: common.NetworkTorV3,
+		Addr:      make([]byte, common.OnionV3PubKeyLen),
+		Port:      testnetPort,
+	}
+	m.AddAddress(onion, nil)
+	if m.GetAddress(NewDirectDialer().Reachable) != nil {
+		t.Errorf("onion address should not be reachable without proxy")
+	}
+	socks := &SOCKS5Dialer{}
+	if ka := m.GetAddress(socks.Reachable); ka == nil || !ka.Addr.IsOnion() {
+		t.Errorf("onion address should be reachable via proxy: %v", ka)
+	}
+}
+
+func TestAddrManagerIgnoreUnknownNetwork(t *testing.T) {
+	m := NewAddrManager("")
+	m.AddAddress(&common.NetAddrV2{NetworkID: 0x42, Addr: []byte{1, 2, 3}, Port: 1}, nil)
+	if m.NumAddresses() != 0 {
+		t.Errorf("expected: %d, actual: %d", 0, m.NumAddresses())
+	}
+}
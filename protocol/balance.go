@@ -2,104 +2,210 @@ package protocol
 
 import (
 	"bytes"
-	"encoding/hex"
 	"fmt"
-	"io"
-	"net"
-	"os"
 	"time"
 
 	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
 	"github.com/tanishiking/btcwallet/protocol/common"
 	"github.com/tanishiking/btcwallet/protocol/message"
-	"github.com/tanishiking/btcwallet/util"
 )
 
+// txRecvTimeout means how long to wait for the transactions confirmed in the merkleblocks.
+const txRecvTimeout = 30 * time.Second
+
 type utxo struct {
 	tx    *message.Transaction
 	index uint32
 }
 
+func (u *utxo) value() uint64 {
+	return u.tx.TxOut[u.index].Value
+}
+
 func (u *utxo) equal(other *utxo) bool {
 	return bytes.Equal(u.tx.Encode(), other.tx.Encode()) && u.index == other.index
 }
 
 // Balance show the balance of this wallet.
-func Balance() {
-	fn := func(conn net.Conn, v *message.Version) {
-		utxos := collectUTXO(conn, v)
-		balance := uint64(0)
-		for _, utxo := range utxos {
-			balance += utxo.tx.TxOut[utxo.index].Value
+func Balance() error {
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		wallet, err := syncWallet(p, c, nil)
+		if err != nil {
+			return err
 		}
-		fmt.Println("残高: ", balance)
+		printUTXOs(wallet.UTXOs())
+		printBalances(wallet.Balances())
+		return nil
 	}
-	WithBitcoinConnection(fn)
+	return WithBitcoinConnection(fn)
+}
+
+func printUTXOs(utxos []*utxo) {
+	for _, unspent := range utxos {
+		fmt.Println(encodeTxID(unspent.tx.ID()))
+		fmt.Println(unspent.tx.TxOut[unspent.index].Value)
+	}
+}
+
+func printBalances(b *Balances) {
+	fmt.Println("残高: ", b.Confirmed)
+	fmt.Println("未承認: ", b.Unconfirmed)
+	fmt.Println("未成熟: ", b.Immature)
 }
 
-func collectUTXO(conn net.Conn, v *message.Version) []*utxo {
+// syncWallet sync the headers and apply the blocks which are not scanned yet to the wallet.
+// If rescanFrom is not nil, the wallet forgets the transactions after it and scans the blocks again.
+func syncWallet(p *Peer, headerChain *chain.HeaderChain, rescanFrom *key.Birthday) (*Wallet, error) {
+	headersCh := make(chan *message.Headers)
 	blockCh := make(chan *message.Merkleblock)
 	txCh := make(chan *message.Transaction)
+	cfCh := newCFChannels()
 
 	// 各種メッセージを受け取るgoroutineを立ち上げておく
-	go dispatch(conn, blockCh, txCh)
+	go dispatch(p, headerChain, headersCh, blockCh, txCh, cfCh)
+
+	// 初回はgenesisからではなく信頼できるcheckpointから同期する
+	if config.CheckpointSync {
+		if err := startFromCheckpoint(p, headerChain, headersCh); err != nil {
+			return nil, err
+		}
+	}
+	// merkleblockを検証するためにブロックヘッダを先に同期する
+	if err := syncHeaders(p, headerChain, headersCh); err != nil {
+		return nil, err
+	}
 
 	// 鍵の準備
 	fromPrivateKey, err := key.ReadOrGeneratePrivateKey()
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 	fromPublicKey, err := key.GeneratePubKey(fromPrivateKey)
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
-	fromPublicKeyHash := util.Hash160(fromPublicKey)
 
-	startBlockHash, err := hex.DecodeString("0000000000000657bda6681e1a3d1aac92d09d31721e8eedbca98cac73e93226")
+	// ヘッダで承認が確定したtxだけを数えるwallet
+	// 前回保存したwalletの走査済みのブロックの続きから走査する
+	wallet, err := LoadWallet(walletFilePath, headerChain, fromPublicKey, func(n *TxNotification) {
+		fmt.Println(n.String())
+	})
 	if err != nil {
+		return nil, err
+	}
+	// reorgで切り離されたブロックのtxを巻き戻す
+	headerChain.AddListener(wallet.HandleTipChange)
+
+	// 初回は鍵の誕生日から、誕生日が不明なら最新のcheckpointの次のブロックから走査する
+	birthday, err := key.ReadBirthday()
+	if err != nil {
+		return nil, err
+	}
+	startBlock := wallet.SyncTip()
+	if rescanFrom != nil {
+		if startBlock, err = birthdayStart(headerChain, rescanFrom); err != nil {
+			return nil, err
+		}
+		wallet.Rewind(startBlock)
+		fmt.Printf("Rescan from height %d\n", startBlock.Height+1)
+		// 誕生日が不明な鍵はrescanの開始点を誕生日とする
+		if birthday == nil {
+			if err := key.SetBirthday(rescanFrom); err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+	} else if startBlock == nil {
+		if startBlock, err = scanStart(headerChain, birthday); err != nil {
+			return nil, err
+		}
+	}
+
+	// relayされたtxの承認までのブロック数から手数料率を推定する
+	estimator, err := LoadFeeEstimator(feeEstimatesFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CompactFilters {
+		// 初回同期後に通知されたブロックのヘッダを受け取り続ける
+		go followHeaders(p, headerChain, headersCh)
+		// relayされたtxは同期中から受け取る
+		go trackUnconfirmed(p, headerChain, wallet, estimator, txCh)
+		err = syncWithCompactFilters(p, headerChain, startBlock, wallet, cfCh)
+		if err == nil {
+			// 初回同期後に繋がったブロックもフィルタで走査する
+			go followFilters(p, headerChain, startBlock, wallet, cfCh)
+		}
+	} else {
+		err = syncWithBloomFilter(p, headerChain, startBlock, wallet, headersCh, blockCh, txCh)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// mempoolの未承認のtxを受け取る
+	requested, err := requestMempool(p)
+	if err != nil {
+		fmt.Println(err.Error())
+	} else if !requested {
+		// compact filtersを提供するpeerはNODE_BLOOMを提供しないことが多い
+		fmt.Printf("%s doesn't offer NODE_BLOOM, unconfirmed transactions are received only when they are relayed\n", p)
+	}
+	if requested {
+		time.Sleep(mempoolWait)
+	}
+	if err := wallet.Save(); err != nil {
 		fmt.Println(err.Error())
-		os.Exit(1)
 	}
-	var arr [32]byte
-	copy(arr[:], util.ReverseBytes(startBlockHash))
+	// bloom filterでは一部のtxしかrelayされないので推定に使わない
+	if config.CompactFilters {
+		cfCh.mtx.Lock()
+		err := updateFeeEstimates(p, headerChain, estimator, cfCh.block)
+		cfCh.mtx.Unlock()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		if err := estimator.Save(); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	return wallet, nil
+}
 
-	leftBlocks := v.StartHeight - uint32(1261780)
+// syncWithBloomFilter load the bloom filter of the key to the peer and apply
+// the merkleblocks of the blocks after start to the wallet.
+func syncWithBloomFilter(p *Peer, headerChain *chain.HeaderChain, start *chain.HeaderNode, wallet *Wallet,
+	headersCh chan *message.Headers, blockCh chan *message.Merkleblock, txCh chan *message.Transaction) error {
+	queue := newMerkleBlockQueue(headerChain, start)
 
-	// merkleblockの送信要請のためgetblocksを送信
-	SendMessage(conn, message.NewFilterload(1024, 10, [][]byte{fromPublicKeyHash}))
-	getBlocksMessage := message.NewGetBlocks(uint32(70015), [][32]byte{arr}, message.ZeroHash)
-	SendMessage(conn, getBlocksMessage)
+	// merkleblockを要求する前にfilterを設定する
+	filters := newFilterManager(p, bloomFalsePositiveRate, message.BloomUpdateAll)
+	if err := filters.AddElements(wallet.FilterElements()...); err != nil {
+		return err
+	}
+	if err := filters.Load(); err != nil {
+		return err
+	}
+
+	fmt.Println("left blocks: ", queue.Left())
 
-	fmt.Println("left blocks: ", leftBlocks)
+	// 新しいブロックのmerkleblockはqueueの不足分として要求される
+	headerChain.AddListener(queue.HandleTipChange)
+	// 初回同期後に通知されたブロックのヘッダを受け取り続ける
+	go followHeaders(p, headerChain, headersCh)
 
-	txs := []*message.Transaction{}
 	txRecvDoneCh := make(chan struct{})
-	go getTxs(conn, txCh, txRecvDoneCh, &txs)
+	go getTxs(wallet, filters, txCh, txRecvDoneCh)
 
 	// merkleblockを受信
-	merkleBlocks := []*message.Merkleblock{}
 	blockRecvDoneCh := make(chan struct{})
 	// goroutineでmerkleblockを受信、受信完了までブロック
-	go getBlocks(conn, blockCh, leftBlocks, blockRecvDoneCh, &merkleBlocks)
+	go getBlocks(p, queue, start.Height, wallet, blockCh, blockRecvDoneCh)
 	<-blockRecvDoneCh
 
-	// merkleblockからトランザクションIDを取り出す
-	targetTxIDs := [][32]byte{}
-	for _, m := range merkleBlocks {
-		matchedTxs := m.Validate()
-		for _, h := range matchedTxs {
-			targetTxIDs = append(targetTxIDs, h)
-		}
-	}
-	fmt.Println("want transactions: ", len(targetTxIDs))
-
-	receivedTxIDs := [][32]byte{}
-	for _, tx := range txs {
-		receivedTxIDs = append(receivedTxIDs, tx.ID())
-	}
-	unkowns := util.SubTxIDs(targetTxIDs, receivedTxIDs)
+	// merkleblockで承認されたトランザクションのうち未受信のもの
+	unkowns := wallet.MissingTxIDs()
+	fmt.Println("want transactions: ", len(unkowns))
 
 	// 受け取ったTxIDからtrasactionを受信するためにgetDataを送信
 	inventory := []*message.InvVect{}
@@ -108,186 +214,270 @@ func collectUTXO(conn net.Conn, v *message.Version) []*utxo {
 		inventory = append(inventory, invvect)
 	}
 	getData := message.NewGetData(inventory)
-	SendMessage(conn, getData)
+	p.SendMessage(getData)
 
 	// 受け取りたいトランザクションを全て受け取るまでループ
-Loop:
-	for {
-		receivedTxIDs = [][32]byte{}
-		for _, tx := range txs {
-			receivedTxIDs = append(receivedTxIDs, tx.ID())
-		}
-		unkowns := util.SubTxIDs(targetTxIDs, receivedTxIDs)
-		if len(unkowns) == 0 {
-			txRecvDoneCh <- struct{}{}
-			break Loop
+	deadline := time.Now().Add(txRecvTimeout)
+	for len(wallet.MissingTxIDs()) > 0 {
+		if time.Now().After(deadline) {
+			fmt.Printf("%d transactions were not received\n", len(wallet.MissingTxIDs()))
+			break
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
+	close(txRecvDoneCh)
+	return nil
+}
 
-	utxos := []*utxo{}
-	for _, tx := range txs {
-		txID := tx.ID()
-		fmt.Println(hex.EncodeToString(txID[:]))
-		index, err := tx.FindP2khIndex(fromPublicKeyHash)
-		if err != nil {
-			continue
+// getBlocks request the merkleblocks of the best chain after the start block and
+// apply them to the wallet in the order of the chain.
+// doneCh is closed when all blocks up to the tip are processed, and new blocks
+// are kept processing after that.
+func getBlocks(p *Peer, queue *merkleBlockQueue, start uint32, wallet *Wallet, blockCh chan *message.Merkleblock, doneCh chan struct{}) {
+	done := false
+	// 全て処理済みならdoneChを閉じる、そうでなければ不足分を要求する
+	progress := func() {
+		if !done && queue.Left() == 0 {
+			done = true
+			close(doneCh)
 		}
-		fmt.Println(tx.TxOut[index].Value)
-		outPoint := &message.OutPoint{
-			Hash:  txID,
-			Index: uint32(index),
-		}
-		spend := false
-		for _, otherTx := range txs {
-			if otherTx.HasOutPoint(outPoint) {
-				spend = true
-				break
-			}
-		}
-		if !spend {
-			unspent := &utxo{
-				tx:    tx,
-				index: uint32(index),
-			}
-			utxos = append(utxos, unspent)
+		if hashes := queue.Missing(time.Now()); len(hashes) > 0 {
+			p.SendMessage(newFilteredBlockGetData(hashes))
 		}
 	}
-	return utxos
-}
-
-func getBlocks(conn net.Conn, blockCh chan *message.Merkleblock, leftBlocks uint32, doneCh chan struct{}, blocks *[]*message.Merkleblock) {
-	merkleBlocks := message.NewMerkleBlocks()
-
-	// fmt.Println("left blocks: ", leftBlocks)
-
-	// zeroHash を使ってgetblocksを送信した場合最大500個のmerkleblockが送信される
-	bunch := 500
-Loop:
+	progress()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		if uint32(merkleBlocks.Size()) >= leftBlocks {
-			doneCh <- struct{}{}
-			break Loop
-		}
-		if merkleBlocks.Size() >= bunch {
-			// 500blocks受信したら
-			// 受信したmerkleblockのうち最新のblockHashを使ってgetblocksを再度送る
-			bunch += 500
-			latestBlockHash := merkleBlocks.LatestBlock().BlockHash()
-
-			getBlocksMessage := message.NewGetBlocks(uint32(70015), [][32]byte{latestBlockHash}, message.ZeroHash)
-			SendMessage(conn, getBlocksMessage)
-		}
 		select {
 		case mb := <-blockCh:
-			fmt.Println(merkleBlocks.Size())
-			merkleBlocks.Add(mb)
-			*blocks = append(*blocks, mb)
-		case <-time.After(time.Second * 10):
-			// 途中で詰まることがよくあるので
-			// 3秒merkleblockが送られて来なかった場合は再度getblocksを送信
-			bunch = merkleBlocks.Size() + 500
-			latestBlock := merkleBlocks.LatestBlock()
-			if latestBlock != nil {
-				latestBlockHash := latestBlock.BlockHash()
-				getBlocksMessage := message.NewGetBlocks(uint32(70015), [][32]byte{latestBlockHash}, message.ZeroHash)
-				SendMessage(conn, getBlocksMessage)
-			} else {
-				doneCh <- struct{}{}
-				break Loop
+			txIDs, err := mb.Validate()
+			if err != nil {
+				// banされた場合はp.quitで終了する
+				p.Misbehaving(banThreshold, "invalid merkleblock: "+err.Error())
+				continue
 			}
+			blocks, err := queue.Add(mb, txIDs)
+			if err != nil {
+				// PoWを検証したヘッダのチェーンに含まれないブロックは信用しない
+				p.Misbehaving(10, err.Error())
+				continue
+			}
+			for _, b := range blocks {
+				wallet.ConnectBlock(b.node, b.txIDs)
+			}
+			if len(blocks) > 0 {
+				height := blocks[len(blocks)-1].node.Height
+				fmt.Printf("Merkleblock processed: %s\n", scanProgress(start, height, height+queue.Left()))
+			}
+			progress()
+		case <-ticker.C:
+			// 届かなかったmerkleblockを要求し直す
+			progress()
+		case <-p.quit:
+			// peerが切断された
+			if !done {
+				close(doneCh)
+			}
+			return
 		}
 	}
-	for {
-		// 以降はmerkleblockを受け取っては捨て続ける
-		<-blockCh
-	}
 }
 
-func getTxs(conn net.Conn, txCh chan *message.Transaction, doneCh chan struct{}, txs *[]*message.Transaction) {
+func getTxs(wallet *Wallet, filters *filterManager, txCh chan *message.Transaction, doneCh chan struct{}) {
 Loop:
 	for {
 		select {
 		case tx := <-txCh:
-			*txs = append(*txs, tx)
+			wallet.AddTx(tx)
+			processTxForFilter(wallet, filters, tx)
 		case <-doneCh:
 			fmt.Println("tx receive done")
 			break Loop
-		case <-time.After(time.Second * 30):
+		case <-time.After(txRecvTimeout):
 			fmt.Println("Fail got transactions")
 			break Loop
 		}
 	}
 	for {
-		// 以降はtransactionを受け取っては捨て続ける
-		<-txCh
+		// 以降はrelayされたtransactionでフィルタを更新し、未承認のtxとして追跡する
+		tx := <-txCh
+		processTxForFilter(wallet, filters, tx)
+		// タイムアウト後に届いたmerkleblockのtxは偽陽性でも追加する
+		if wallet.IsMissing(tx.ID()) {
+			wallet.AddTx(tx)
+			continue
+		}
+		addUnconfirmedTx(wallet, tx)
 	}
 }
 
-func dispatch(conn net.Conn, blockCh chan *message.Merkleblock, txCh chan *message.Transaction) {
-	var header [common.MessageHeaderLen]byte
-	buf := make([]byte, common.MessageHeaderLen)
-	t := time.NewTicker(100 * time.Millisecond)
-Loop:
+// processTxForFilter update the filter with the transaction relayed by the peer.
+// Outputs paying to the wallet are added, so transactions spending them are matched
+// even after the filter is reloaded.
+func processTxForFilter(wallet *Wallet, filters *filterManager, tx *message.Transaction) {
+	if err := filters.ProcessTx(tx); err != nil {
+		fmt.Println(err.Error())
+	}
+	for _, index := range wallet.OutputIndexes(tx) {
+		if err := filters.AddOutPoint(&message.OutPoint{Hash: tx.ID(), Index: index}); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// dispatch receive messages from the peer and pass them to the channels.
+// Malformed messages increase the misbehavior score of the peer and
+// dispatch stops when the peer is disconnected.
+func dispatch(p *Peer, headerChain *chain.HeaderChain, headersCh chan *message.Headers, blockCh chan *message.Merkleblock, txCh chan *message.Transaction, cfCh *cfChannels) {
 	for {
-		select {
-		case <-t.C:
-			n, err := conn.Read(buf)
-			if err != nil && err != io.EOF {
-				fmt.Println(err.Error())
-				break Loop
-			}
-			if n == common.MessageHeaderLen {
-				copy(header[:], buf)
-				mh := common.DecodeMessageHeader(header)
-				fmt.Printf("Recv: %s %d bytes\n", string(mh.Command[:]), mh.Length)
-				msgBytes, err := RecvMessage(conn, mh.Length)
-				if err != nil {
-					fmt.Println(err.Error())
-					break Loop
+		command, msgBytes, err := p.ReadMessage()
+		if err != nil {
+			fmt.Println(err.Error())
+			p.Disconnect()
+			return
+		}
+		fmt.Printf("Recv: %s %d bytes\n", command, len(msgBytes))
+		switch command {
+		case "inv":
+			inv, err := message.DecodeInv(msgBytes)
+			if err != nil {
+				if p.Misbehaving(20, "malformed inv: "+err.Error()) {
+					return
 				}
-				if bytes.HasPrefix(mh.Command[:], []byte("inv")) {
-					inv, err := message.DecodeInv(msgBytes)
-					if err != nil {
-						fmt.Println(err.Error())
-						break Loop
-					}
-					inventory := []*message.InvVect{}
-					for _, invvect := range inv.Inventory {
-						if invvect.InvType == message.InvTypeMsgBlock {
-							inventory = append(inventory, message.NewInvVect(message.InvTypeMsgFilteredBlock, invvect.Hash))
-						} else {
-							inventory = append(inventory, invvect)
-						}
-					}
-					getData := message.NewGetData(inventory)
-					SendMessage(conn, getData)
-				} else if bytes.HasPrefix(mh.Command[:], []byte("merkleblock")) {
-					merkleBlock, err := message.DecodeMerkleBlock(msgBytes)
-					if err != nil {
-						fmt.Println(err.Error())
-						break Loop
-					}
-					blockCh <- merkleBlock
-				} else if bytes.HasPrefix(mh.Command[:], []byte("tx")) {
-					transaction, err := message.DecodeTransaction(msgBytes)
-					if err != nil {
-						fmt.Println(err.Error())
-						break Loop
-					}
-					txID := transaction.ID()
-					fmt.Println(hex.EncodeToString(txID[:]))
-					txCh <- transaction
-				} else if bytes.HasPrefix(mh.Command[:], []byte("reject")) {
-					reject, err := message.DecodeReject(msgBytes)
-					if err != nil {
-						fmt.Println(err.Error())
-						break Loop
+				continue
+			}
+			inventory := []*message.InvVect{}
+			newBlock := false
+			for _, invvect := range inv.Inventory {
+				if invvect.InvType == message.InvTypeMsgBlock {
+					// 新しいブロックはヘッダを検証してからmerkleblockを要求する
+					if headerChain.Lookup(invvect.Hash) == nil {
+						newBlock = true
 					}
-					fmt.Println(reject.String())
 				} else {
-					continue
+					inventory = append(inventory, invvect)
+				}
+			}
+			if newBlock {
+				p.SendMessage(message.NewGetHeaders(message.ProtocolVersion, headerChain.BlockLocator(), message.ZeroHash))
+			}
+			if len(inventory) > 0 {
+				p.SendMessage(message.NewGetData(inventory))
+			}
+		case "headers":
+			headers, err := message.DecodeHeaders(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed headers: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			headersCh <- headers
+		case "merkleblock":
+			merkleBlock, err := message.DecodeMerkleBlock(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed merkleblock: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			blockCh <- merkleBlock
+		case "cfcheckpt":
+			cfcheckpt, err := message.DecodeCFCheckpt(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed cfcheckpt: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			cfCh.cfcheckpt <- cfcheckpt
+		case "cfheaders":
+			cfheaders, err := message.DecodeCFHeaders(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed cfheaders: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			cfCh.cfheaders <- cfheaders
+		case "cfilter":
+			cfilter, err := message.DecodeCFilter(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed cfilter: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			cfCh.cfilter <- cfilter
+		case "block":
+			block, err := message.DecodeBlock(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed block: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			// 要求していないブロックで受信が止まらないように、受け取れなければ捨てる
+			select {
+			case cfCh.block <- block:
+			default:
+				if p.Misbehaving(10, "unrequested block") {
+					return
+				}
+			}
+		case "tx":
+			transaction, err := message.DecodeTransaction(msgBytes)
+			if err != nil {
+				if p.Misbehaving(banThreshold, "malformed tx: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			fmt.Println(encodeTxID(transaction.ID()))
+			txCh <- transaction
+		case "reject":
+			reject, err := message.DecodeReject(msgBytes)
+			if err != nil {
+				if p.Misbehaving(10, "malformed reject: "+err.Error()) {
+					return
 				}
+				continue
 			}
+			p.handleReject(reject)
+		case "feefilter":
+			feeFilter, err := message.DecodeFeeFilter(msgBytes)
+			if err != nil {
+				if p.Misbehaving(10, "malformed feefilter: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			p.handleFeeFilter(feeFilter)
+		case "addr":
+			addr, err := message.DecodeAddr(msgBytes)
+			if err != nil {
+				if p.Misbehaving(20, "malformed addr: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			addrs := []*common.NetAddrV2{}
+			for _, a := range addr.AddrList {
+				addrs = append(addrs, a.ToV2())
+			}
+			p.handleAddr(addrs)
+		case "addrv2":
+			addrV2, err := message.DecodeAddrV2(msgBytes)
+			if err != nil {
+				if p.Misbehaving(20, "malformed addrv2: "+err.Error()) {
+					return
+				}
+				continue
+			}
+			p.handleAddr(addrV2.AddrList)
+		default:
+			continue
 		}
 	}
 }
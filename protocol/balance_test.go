@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestGetTxsAfterDone(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+	p := newPeer(nil, &recordTransport{}, testAddr(1), DefaultConfig())
+	filters := newFilterManager(p, 0.01, message.BloomUpdateAll)
+
+	// merkleblockでマッチした偽陽性のtxがタイムアウト後に届く
+	falsePositive := p2pkhTx([32]byte{0x01}, 1000)
+	falsePositive.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x22}, 20)))
+	w.ConnectBlock(mineBlock(t, c, c.Tip(), 0), []message.TxID{falsePositive.ID()})
+	txCh := make(chan *message.Transaction)
+	doneCh := make(chan struct{})
+	close(doneCh)
+	go getTxs(w, filters, txCh, doneCh)
+	txCh <- falsePositive
+
+	deadline := time.Now().Add(time.Second)
+	for len(w.MissingTxIDs()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("missing tx should be added after the first loop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatchUnrequestedBlock(t *testing.T) {
+	s := newCFServer(t, 1, nil)
+	conn, _ := net.Pipe()
+	p := newPeer(conn, s, testAddr(1), DefaultConfig())
+	block := s.blocks[s.chain.Tip().Hash]
+	// 誰も受け取らないブロックをバッファより多く送る
+	for i := 0; i < maxFullBlocksInFlight+2; i++ {
+		s.send(block)
+	}
+	tx := p2pkhTx([32]byte{0x01}, 1000)
+	s.send(tx)
+	txCh := make(chan *message.Transaction)
+	go dispatch(p, s.chain, nil, nil, txCh, newCFChannels())
+
+	select {
+	case received := <-txCh:
+		if received.ID() != tx.ID() {
+			t.Errorf("unexpected tx: %x", received.ID())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("dispatch should not block on unrequested blocks")
+	}
+	if p.banScore != 20 {
+		t.Errorf("unrequested blocks should be counted, score: %d", p.banScore)
+	}
+}
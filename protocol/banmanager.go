@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+const (
+	banListFilePath = "banlist.json"
+
+	// defaultBanDuration follows bitcoin core's DEFAULT_MISBEHAVING_BANTIME.
+	defaultBanDuration = 24 * time.Hour
+)
+
+// BanEntry means a banned host.
+type BanEntry struct {
+	Host     string // IPアドレスもしくはonionアドレス
+	BannedAt time.Time
+	Until    time.Time
+	Reason   string
+}
+
+// BanManager holds the banned hosts and persist them to the file.
+// Bans are per host, so all ports of the host are banned.
+type BanManager struct {
+	mtx      sync.Mutex
+	filePath string
+	bans     map[string]*BanEntry
+}
+
+// NewBanManager create new empty BanManager which is saved to filePath.
+func NewBanManager(filePath string) *BanManager {
+	return &BanManager{
+		filePath: filePath,
+		bans:     map[string]*BanEntry{},
+	}
+}
+
+// LoadBanManager read BanManager from the file, or create new one if the file doesn't exist.
+// Expired bans are dropped.
+func LoadBanManager(filePath string) (*BanManager, error) {
+	m := NewBanManager(filePath)
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*BanEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Failed to load ban list %s: %v", filePath, err)
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Until.After(now) {
+			m.bans[e.Host] = e
+		}
+	}
+	return m, nil
+}
+
+// Save write the ban list to the file.
+// The ban list without the file path is kept only in memory.
+func (m *BanManager) Save() error {
+	if m.filePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.filePath)
+}
+
+// Ban ban the host for the duration and save the ban list.
+// If the host is already banned, the longer one is kept.
+// The ban list is saved at once, so the ban is kept even if the process exits before
+// the connection is closed.
+func (m *BanManager) Ban(host string, duration time.Duration, reason string) error {
+	m.mtx.Lock()
+	now := time.Now()
+	until := now.Add(duration)
+	if e, ok := m.bans[host]; ok && e.Until.After(until) {
+		m.mtx.Unlock()
+		return nil
+	}
+	m.bans[host] = &BanEntry{
+		Host:     host,
+		BannedAt: now,
+		Until:    until,
+		Reason:   reason,
+	}
+	m.mtx.Unlock()
+	return m.Save()
+}
+
+// IsBanned checks the host is banned now.
+func (m *BanManager) IsBanned(host string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	e, ok := m.bans[host]
+	if !ok {
+		return false
+	}
+	if !e.Until.After(time.Now()) {
+		delete(m.bans, host)
+		return false
+	}
+	return true
+}
+
+// IsBannedAddr checks the host of the address is banned now.
+func (m *BanManager) IsBannedAddr(addr *common.NetAddrV2) bool {
+	return m.IsBanned(addr.Host())
+}
+
+// Unban remove the host from the ban list.
+// It returns false if the host was not banned.
+func (m *BanManager) Unban(host string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.bans[host]; !ok {
+		return false
+	}
+	delete(m.bans, host)
+	return true
+}
+
+// Clear remove all bans.
+func (m *BanManager) Clear() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.bans = map[string]*BanEntry{}
+}
+
+// List return active bans sorted by the expiration time.
+func (m *BanManager) List() []*BanEntry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := time.Now()
+	res := []*BanEntry{}
+	for _, e := range m.bans {
+		if e.Until.After(now) {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Until.Before(res[j].Until)
+	})
+	return res
+}
+
+// ListBanned print the banned hosts.
+func ListBanned() error {
+	m, err := LoadBanManager(banListFilePath)
+	if err != nil {
+		return err
+	}
+	entries := m.List()
+	if len(entries) == 0 {
+		fmt.Println("No banned peers")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%s\tbanned at: %s\tuntil: %s\treason: %s\n",
+			e.Host, e.BannedAt.Format(time.RFC3339), e.Until.Format(time.RFC3339), e.Reason)
+	}
+	return nil
+}
+
+// ClearBanned remove the host from the ban list, or all bans if host is empty.
+func ClearBanned(host string) error {
+	m, err := LoadBanManager(banListFilePath)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		m.Clear()
+	} else if !m.Unban(host) {
+		fmt.Printf("%s is not banned\n", host)
+		return nil
+	}
+	if err := m.Save(); err != nil {
+		return err
+	}
+	fmt.Println("Ban list cleared")
+	return nil
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestBanManagerPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "banlist.json")
+
+	m := NewBanManager(path)
+	if err := m.Ban("10.1.0.1", time.Hour, "test"); err != nil {
+		t.Fatal(err)
+	}
+	m.Ban("10.2.0.1", -time.Hour, "expired")
+	if !m.IsBannedAddr(testAddr(1)) {
+		t.Errorf("10.1.0.1 should be banned")
+	}
+	if m.IsBanned("10.2.0.1") {
+		t.Errorf("expired ban should be ignored")
+	}
+
+	// Saveを呼ばなくてもbanした時点で保存されている
+	loaded, err := LoadBanManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := loaded.List()
+	if len(entries) != 1 || entries[0].Host != "10.1.0.1" || entries[0].Reason != "test" {
+		t.Errorf("unexpected ban list: %v", entries)
+	}
+	if !loaded.Unban("10.1.0.1") {
+		t.Errorf("Unban should return true for banned host")
+	}
+	if loaded.IsBanned("10.1.0.1") {
+		t.Errorf("10.1.0.1 should be unbanned")
+	}
+}
+
+func TestConnectKnownAddressSkipBanned(t *testing.T) {
+	m := NewAddrManager("")
+	m.AddAddresses([]*common.NetAddrV2{testAddr(1)}, nil)
+	bans := NewBanManager("")
+	bans.Ban(testAddr(1).Host(), time.Hour, "test")
+	if _, err := connectKnownAddress(m, bans, DefaultConfig()); err == nil {
+		t.Errorf("banned address should not be connected")
+	}
+	if ka := m.addrIndex[testAddr(1).Key()]; ka.Attempts != 0 {
+		t.Errorf("banned address should not be attempted")
+	}
+}
+
+func TestMisbehaving(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	bans := NewBanManager("")
+	p := newPeer(local, newV1Transport(local), testAddr(1), DefaultConfig())
+	p.banManager = bans
+
+	if p.Misbehaving(50, "first") {
+		t.Errorf("peer should not be disconnected with score 50")
+	}
+	if !p.Misbehaving(50, "second") {
+		t.Errorf("peer should be disconnected with score 100")
+	}
+	if !bans.IsBannedAddr(testAddr(1)) {
+		t.Errorf("peer should be banned")
+	}
+	select {
+	case <-p.quit:
+	default:
+		t.Errorf("quit should be closed")
+	}
+}
+
+func TestHandleReject(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	p := newPeer(local, newV1Transport(local), testAddr(1), DefaultConfig())
+	p.banManager = NewBanManager("")
+
+	txReject := &message.Reject{
+		Message: common.NewVarStr([]byte("tx")),
+		Code:    message.RejectInsufficientFee,
+		Reason:  common.NewVarStr([]byte("min relay fee not met")),
+		Data:    make([]byte, 32),
+	}
+	p.handleReject(txReject)
+	if p.banScore != 0 {
+		t.Errorf("rejecting our tx is not misbehavior, score: %d", p.banScore)
+	}
+
+	unknown := &message.Reject{
+		Message: common.NewVarStr([]byte("tx")),
+		Code:    0x99,
+		Reason:  common.NewVarStr([]byte("")),
+		Data:    make([]byte, 32),
+	}
+	p.handleReject(unknown)
+	if p.banScore != 10 {
+		t.Errorf("expected: %d, actual: %d", 10, p.banScore)
+	}
+
+	obsolete := &message.Reject{
+		Message: common.NewVarStr([]byte("version")),
+		Code:    message.RejectObsolete,
+		Reason:  common.NewVarStr([]byte("Version must be 70001 or greater")),
+	}
+	p.handleReject(obsolete)
+	if !p.banManager.IsBannedAddr(testAddr(1)) {
+		t.Errorf("peer which rejects our version should be banned")
+	}
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const (
+	// maxBlocksInFlight means how many merkleblocks are requested at once.
+	maxBlocksInFlight = 500
+
+	// blockRequestTimeout means how long to wait for the requested merkleblock before requesting it again.
+	blockRequestTimeout = 10 * time.Second
+)
+
+// filteredBlock means a validated merkleblock linked to the header chain.
+type filteredBlock struct {
+	node        *chain.HeaderNode
+	merkleBlock *message.Merkleblock
+	txIDs       []message.TxID // マッチしたtx
+}
+
+// merkleBlockQueue orders merkleblocks by the best header chain instead of their timestamps.
+// Merkleblocks can arrive out of order or be dropped by the peer, so blocks whose
+// parent is not processed yet are kept until the gap is filled, and only the
+// blocks not received yet are requested.
+type merkleBlockQueue struct {
+	mtx       sync.Mutex
+	chain     *chain.HeaderChain
+	last      *chain.HeaderNode           // 順番に処理した最後のブロック
+	pending   map[[32]byte]*filteredBlock // 親の処理を待っているブロック
+	requested map[[32]byte]time.Time      // 要求して未受信のブロック
+}
+
+// newMerkleBlockQueue create new queue which processes the blocks after start in the best chain.
+func newMerkleBlockQueue(c *chain.HeaderChain, start *chain.HeaderNode) *merkleBlockQueue {
+	return &merkleBlockQueue{
+		chain:     c,
+		last:      start,
+		pending:   map[[32]byte]*filteredBlock{},
+		requested: map[[32]byte]time.Time{},
+	}
+}
+
+// Add add the received merkleblock with its matched transactions, and return
+// the blocks which can be processed in order.
+// It returns error if the block is not in the header chain.
+func (q *merkleBlockQueue) Add(mb *message.Merkleblock, txIDs []message.TxID) ([]*filteredBlock, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	hash := mb.BlockHash()
+	delete(q.requested, hash)
+	node := q.chain.Lookup(hash)
+	if node == nil {
+		return nil, fmt.Errorf("Merkleblock is not in the header chain")
+	}
+	// reorgで切り離されたブロックと処理済みのブロックは無視する
+	if !q.chain.IsInBestChain(hash) || node.Height <= q.last.Height {
+		return nil, nil
+	}
+	q.pending[hash] = &filteredBlock{node: node, merkleBlock: mb, txIDs: txIDs}
+
+	res := []*filteredBlock{}
+	for {
+		next := q.chain.NodeByHeight(q.last.Height + 1)
+		if next == nil || next.Parent != q.last {
+			break
+		}
+		b, ok := q.pending[next.Hash]
+		if !ok {
+			break
+		}
+		delete(q.pending, next.Hash)
+		res = append(res, b)
+		q.last = next
+	}
+	return res, nil
+}
+
+// Missing return the hashes of the blocks to request, in the order of the height.
+// Blocks not received within blockRequestTimeout are requested again.
+func (q *merkleBlockQueue) Missing(now time.Time) [][32]byte {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	inFlight := 0
+	for hash, at := range q.requested {
+		if now.Sub(at) < blockRequestTimeout {
+			inFlight++
+		} else {
+			delete(q.requested, hash)
+		}
+	}
+	res := [][32]byte{}
+	tip := q.chain.Tip()
+	for height := q.last.Height + 1; height <= tip.Height && inFlight+len(res) < maxBlocksInFlight; height++ {
+		node := q.chain.NodeByHeight(height)
+		if node == nil {
+			break
+		}
+		if _, ok := q.pending[node.Hash]; ok {
+			continue
+		}
+		if _, ok := q.requested[node.Hash]; ok {
+			continue
+		}
+		q.requested[node.Hash] = now
+		res = append(res, node.Hash)
+	}
+	return res
+}
+
+// Left return the number of blocks not processed yet.
+func (q *merkleBlockQueue) Left() uint32 {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	tip := q.chain.Tip()
+	if tip.Height <= q.last.Height {
+		return 0
+	}
+	return tip.Height - q.last.Height
+}
+
+// HandleTipChange rewind the queue to the fork point if processed blocks were disconnected,
+// and drop the blocks which are no longer in the best chain.
+func (q *merkleBlockQueue) HandleTipChange(change *chain.TipChange) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for _, node := range change.Disconnected {
+		if node == q.last {
+			q.last = change.Fork
+		}
+		delete(q.pending, node.Hash)
+		delete(q.requested, node.Hash)
+	}
+}
+
+// newFilteredBlockGetData create getdata of merkleblocks for the hashes.
+func newFilteredBlockGetData(hashes [][32]byte) *message.GetData {
+	inventory := []*message.InvVect{}
+	for _, hash := range hashes {
+		inventory = append(inventory, message.NewInvVect(message.InvTypeMsgFilteredBlock, hash))
+	}
+	return message.NewGetData(inventory)
+}
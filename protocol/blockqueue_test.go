@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// merkleBlockOf create empty merkleblock of the header.
+func merkleBlockOf(node *chain.HeaderNode) *message.Merkleblock {
+	return &message.Merkleblock{BlockHeader: *node.Header}
+}
+
+func TestMerkleBlockQueueOrder(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	start := mineBlock(t, c, c.Tip(), 0)
+	nodes := []*chain.HeaderNode{}
+	for i, parent := 0, start; i < 4; i++ {
+		parent = mineBlock(t, c, parent, uint32(i+1))
+		nodes = append(nodes, parent)
+	}
+	q := newMerkleBlockQueue(c, start)
+	now := time.Now()
+	if missing := q.Missing(now); len(missing) != 4 || missing[0] != nodes[0].Hash {
+		t.Fatalf("all blocks after start should be requested: %d", len(missing))
+	}
+
+	// 後のブロックが先に届いた場合は親が届くまで待つ
+	for _, i := range []int{2, 1} {
+		blocks, err := q.Add(merkleBlockOf(nodes[i]), nil)
+		if err != nil || len(blocks) != 0 {
+			t.Fatalf("block %d should wait for its parent", i)
+		}
+	}
+	// 要求し直すのは届いていない間のブロックだけ
+	missing := q.Missing(now.Add(blockRequestTimeout))
+	if len(missing) != 2 || missing[0] != nodes[0].Hash || missing[1] != nodes[3].Hash {
+		t.Fatalf("only missing blocks should be requested again: %d", len(missing))
+	}
+	blocks, err := q.Add(merkleBlockOf(nodes[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || blocks[0].node != nodes[0] || blocks[2].node != nodes[2] {
+		t.Fatalf("blocks should be processed in the chain order: %d", len(blocks))
+	}
+	// 処理済みのブロックは無視する
+	if blocks, _ := q.Add(merkleBlockOf(nodes[1]), nil); len(blocks) != 0 {
+		t.Errorf("duplicated block should be ignored")
+	}
+	if q.Left() != 1 {
+		t.Errorf("expected: %d left, actual: %d", 1, q.Left())
+	}
+
+	unknown := merkleBlockOf(nodes[3])
+	unknown.Nonce++
+	if _, err := q.Add(unknown, nil); err == nil {
+		t.Errorf("block not in the header chain should be rejected")
+	}
+}
+
+func TestMerkleBlockQueueReorg(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	fork := mineBlock(t, c, c.Tip(), 0)
+	stale := mineBlock(t, c, fork, 1)
+	q := newMerkleBlockQueue(c, fork)
+	c.AddListener(q.HandleTipChange)
+	if blocks, _ := q.Add(merkleBlockOf(stale), nil); len(blocks) != 1 {
+		t.Fatalf("stale block should be processed before reorg")
+	}
+
+	a := mineBlock(t, c, fork, 2)
+	b := mineBlock(t, c, a, 3)
+	if q.Left() != 2 {
+		t.Fatalf("queue should be rewound to the fork point, left: %d", q.Left())
+	}
+	if blocks, _ := q.Add(merkleBlockOf(stale), nil); len(blocks) != 0 {
+		t.Errorf("disconnected block should be ignored")
+	}
+	missing := q.Missing(time.Now())
+	if len(missing) != 2 || missing[0] != a.Hash || missing[1] != b.Hash {
+		t.Errorf("blocks of the new best chain should be requested")
+	}
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// incrementalRelayFeeRate follows bitcoin core's DEFAULT_INCREMENTAL_RELAY_FEE in sat/vB.
+// A replacement must pay for its own size at this rate over the fee of the original. (BIP125 rule 4)
+const incrementalRelayFeeRate = 1
+
+// signalsRBF checks the transaction opts in to replacement by an input sequence. (BIP125)
+func signalsRBF(tx *message.Transaction) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence < 0xFFFFFFFE {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceableTx return the unconfirmed wallet transaction which can be replaced and the outputs it spends.
+// All inputs must be signable outputs of the wallet, and no wallet transaction may spend its outputs,
+// because the replacement would evict them.
+func (w *Wallet) replaceableTx(txID message.TxID) (*message.Transaction, []*utxo, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	wtx, ok := w.txs[txID]
+	if !ok || wtx.tx == nil {
+		return nil, nil, fmt.Errorf("Transaction %s is not in the wallet", encodeTxID(txID))
+	}
+	if wtx.block != nil {
+		return nil, nil, fmt.Errorf("Transaction %s is already confirmed", encodeTxID(txID))
+	}
+	if !signalsRBF(wtx.tx) {
+		return nil, nil, fmt.Errorf("Transaction %s doesn't signal replaceability", encodeTxID(txID))
+	}
+	script := p2pkhScript(util.Hash160(w.pubKey))
+	inputs := []*utxo{}
+	for _, txIn := range wtx.tx.TxIn {
+		prev, ok := w.txs[txIn.PreviousOutput.Hash]
+		if !ok || prev.tx == nil || int(txIn.PreviousOutput.Index) >= len(prev.tx.TxOut) ||
+			!bytes.Equal(prev.tx.TxOut[txIn.PreviousOutput.Index].PkScript.Data, script) {
+			return nil, nil, fmt.Errorf("Transaction %s spends an output the wallet can't sign", encodeTxID(txID))
+		}
+		inputs = append(inputs, &utxo{tx: prev.tx, index: txIn.PreviousOutput.Index})
+	}
+	for id, other := range w.txs {
+		if other.tx == nil || id == txID {
+			continue
+		}
+		for _, txIn := range other.tx.TxIn {
+			if txIn.PreviousOutput.Hash == txID {
+				return nil, nil, fmt.Errorf("Transaction %s has descendant %s", encodeTxID(txID), encodeTxID(id))
+			}
+		}
+	}
+	return wtx.tx, inputs, nil
+}
+
+// bumpPlan means the inputs and outputs of the replacement transaction and its fee.
+type bumpPlan struct {
+	Inputs []*utxo
+	TxOut  []*message.TxOut
+	Fee    uint64
+}
+
+// planBumpFee build the replacement of the transaction at the fee rate, which satisfies BIP125.
+// The fee is taken from the change output first, and the change is dropped if it would be dust.
+// Otherwise the extra outputs are added largest first, they must be confirmed, because the
+// replacement may not have new unconfirmed inputs.
+func planBumpFee(tx *message.Transaction, inputs, extra []*utxo, input *inputSize, feeRate uint64,
+	changeScript []byte) (*bumpPlan, error) {
+	inValue := uint64(0)
+	for _, u := range inputs {
+		inValue += u.value()
+	}
+	outValue := uint64(0)
+	for _, txOut := range tx.TxOut {
+		outValue += txOut.Value
+	}
+	if inValue < outValue {
+		return nil, fmt.Errorf("Transaction spends more than its inputs")
+	}
+	oldFee := inValue - outValue
+	if feeRate*tx.VSize() <= oldFee {
+		return nil, fmt.Errorf("Fee rate %d sat/vB doesn't exceed the original %.1f sat/vB",
+			feeRate, float64(oldFee)/float64(tx.VSize()))
+	}
+
+	// 最後のおつりの出力以外の支払いは変えない
+	payments := []*message.TxOut{}
+	changeIndex := -1
+	for i, txOut := range tx.TxOut {
+		if bytes.Equal(txOut.PkScript.Data, changeScript) {
+			changeIndex = i
+		}
+	}
+	scripts := [][]byte{}
+	payValue := uint64(0)
+	for i, txOut := range tx.TxOut {
+		if i == changeIndex {
+			continue
+		}
+		payments = append(payments, txOut)
+		scripts = append(scripts, txOut.PkScript.Data)
+		payValue += txOut.Value
+	}
+	// 新しい手数料率と、元のtxの手数料に自身のサイズ分の手数料を加えたものの大きい方
+	required := func(vsize uint64) uint64 {
+		fee := feeRate * vsize
+		if min := oldFee + incrementalRelayFeeRate*vsize; fee < min {
+			fee = min
+		}
+		return fee
+	}
+
+	selected := append([]*utxo{}, inputs...)
+	candidates := append([]*utxo{}, extra...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].value() > candidates[j].value()
+	})
+	for {
+		sizes := []*inputSize{}
+		for range selected {
+			sizes = append(sizes, input)
+		}
+		withChange := required(estimateVSize(sizes, append(append([][]byte{}, scripts...), changeScript)))
+		if inValue >= payValue+withChange+dustThreshold {
+			change := inValue - payValue - withChange
+			txOut := append([]*message.TxOut{}, payments...)
+			txOut = append(txOut, &message.TxOut{Value: change, PkScript: common.NewVarStr(changeScript)})
+			return &bumpPlan{Inputs: selected, TxOut: txOut, Fee: withChange}, nil
+		}
+		// おつりがdustになるなら手数料に含める
+		if inValue >= payValue+required(estimateVSize(sizes, scripts)) {
+			return &bumpPlan{Inputs: selected, TxOut: payments, Fee: inValue - payValue}, nil
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("Insufficient funds to bump the fee to %d sat/vB", feeRate)
+		}
+		selected = append(selected, candidates[0])
+		inValue += candidates[0].value()
+		candidates = candidates[1:]
+	}
+}
+
+// BumpFee replace the unconfirmed wallet transaction with one paying at the fee rate in sat/vB.
+// The fee over maxFee is rejected.
+func BumpFee(txIDHex string, feeRate uint64, maxFee uint64) error {
+	txID, err := decodeTxID(txIDHex)
+	if err != nil {
+		return err
+	}
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		if feeRate < minRelayFeeRate {
+			return fmt.Errorf("Fee rate %d sat/vB is below min relay fee rate %d sat/vB", feeRate, minRelayFeeRate)
+		}
+		wallet, err := syncWallet(p, c, nil)
+		if err != nil {
+			return err
+		}
+		if floor := p.FeeFilterRate(); feeRate < floor {
+			return fmt.Errorf("Fee rate %d sat/vB is below the fee filter of the peer %d sat/vB", feeRate, floor)
+		}
+		if replacedBy, ok := wallet.ReplacedBy(txID); ok {
+			return fmt.Errorf("Transaction %s is already replaced by %s", txIDHex, encodeTxID(replacedBy))
+		}
+		tx, inputs, err := wallet.replaceableTx(txID)
+		if err != nil {
+			return err
+		}
+		input, err := estimateInputSize(ScriptP2PKH, wallet.pubKey)
+		if err != nil {
+			return err
+		}
+		// 追加する入力は承認済みの出力だけ
+		plan, err := planBumpFee(tx, inputs, wallet.SignableUTXOs(), input, feeRate, p2pkhScript(util.Hash160(wallet.pubKey)))
+		if err != nil {
+			return err
+		}
+		if plan.Fee > maxFee {
+			return fmt.Errorf("Fee %d exceeds max fee %d", plan.Fee, maxFee)
+		}
+		fmt.Printf("Replacing with %d inputs and %d outputs, fee %d\n", len(plan.Inputs), len(plan.TxOut), plan.Fee)
+
+		txIn, err := createTxIn(plan.Inputs, plan.TxOut)
+		if err != nil {
+			return err
+		}
+		transaction := message.NewTransaction(uint32(1), txIn, plan.TxOut, uint32(0))
+		fmt.Printf("Transaction %s %d vB, %.1f sat/vB\n", encodeTxID(transaction.ID()),
+			transaction.VSize(), float64(plan.Fee)/float64(transaction.VSize()))
+
+		// 送信したtxを追加すると元のtxは置き換えられたことになる
+		broadcastTx(p, wallet, transaction)
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// rbfTx create a transaction spending the funding output, which pays amount to P2SH and change to testPubKeyHash.
+// The signature script is filled with the size of P2PKH signature, so the size is close to the signed one.
+func rbfTx(funding *message.Transaction, amount, change uint64) *message.Transaction {
+	txIn := &message.TxIn{
+		PreviousOutput:  &message.OutPoint{Hash: funding.ID(), Index: 0},
+		SignatureScript: common.NewVarStr(make([]byte, 1+maxSigSize+1+65)),
+		Sequence:        rbfSequence,
+	}
+	txOut := []*message.TxOut{{Value: amount, PkScript: common.NewVarStr(p2shScript(bytes.Repeat([]byte{0x22}, 20)))}}
+	if change > 0 {
+		txOut = append(txOut, &message.TxOut{Value: change, PkScript: common.NewVarStr(p2pkhScript(testPubKeyHash))})
+	}
+	return message.NewTransaction(uint32(1), []*message.TxIn{txIn}, txOut, uint32(0))
+}
+
+func TestPlanBumpFee(t *testing.T) {
+	input, _ := estimateInputSize(ScriptP2PKH, testPubKey)
+	changeScript := p2pkhScript(testPubKeyHash)
+	funding := p2pkhTx([32]byte{0x01}, 100000)
+	inputs := []*utxo{{tx: funding, index: 0}}
+
+	// おつりから手数料を払う
+	original := rbfTx(funding, 60000, 39000)
+	plan, err := planBumpFee(original, inputs, nil, input, 20, changeScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vsize := estimateVSize([]*inputSize{input}, [][]byte{original.TxOut[0].PkScript.Data, changeScript})
+	if len(plan.Inputs) != 1 || len(plan.TxOut) != 2 || plan.Fee != 20*vsize {
+		t.Errorf("change should be reduced: %+v", plan)
+	}
+	if plan.TxOut[0].Value != 60000 || plan.TxOut[1].Value != 100000-60000-plan.Fee {
+		t.Errorf("payment should be kept and change reduced: %d %d", plan.TxOut[0].Value, plan.TxOut[1].Value)
+	}
+
+	// おつりがdustになるなら手数料に含める
+	original = rbfTx(funding, 98400, 600)
+	plan, err = planBumpFee(original, inputs, nil, input, 5, changeScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.TxOut) != 1 || plan.Fee != 1600 {
+		t.Errorf("dust change should be dropped: %+v", plan)
+	}
+
+	// おつりが足りなければ大きい出力から追加する
+	original = rbfTx(funding, 99000, 0)
+	plan, err = planBumpFee(original, inputs, testUTXOs(5000, 50000), input, 20, changeScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Inputs) != 2 || plan.Inputs[1].value() != 50000 || len(plan.TxOut) != 2 {
+		t.Errorf("largest output should be added with change: %+v", plan)
+	}
+	if plan.Fee <= 1000+incrementalRelayFeeRate*original.VSize() {
+		t.Errorf("fee %d should exceed the original fee and the incremental relay fee", plan.Fee)
+	}
+
+	if _, err := planBumpFee(original, inputs, nil, input, 20, changeScript); err == nil {
+		t.Errorf("insufficient funds should be error")
+	}
+	if _, err := planBumpFee(original, inputs, nil, input, 1, changeScript); err == nil {
+		t.Errorf("fee rate not exceeding the original should be error")
+	}
+}
+
+func TestReplaceableTx(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+	funding := p2pkhTx([32]byte{0x01}, 100000)
+	other := p2pkhTx([32]byte{0x02}, 100000)
+	w.AddTx(funding)
+	w.AddTx(other)
+	w.ConnectBlock(mineBlock(t, c, c.Tip(), 0), []message.TxID{funding.ID(), other.ID()})
+
+	original := rbfTx(funding, 60000, 39000)
+	w.AddTx(original)
+	tx, inputs, err := w.replaceableTx(original.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx != original || len(inputs) != 1 || inputs[0].value() != 100000 {
+		t.Errorf("original tx and its inputs should be returned")
+	}
+
+	// 子のtxがあると置き換えられない
+	w.AddTx(p2pkhTx(original.ID(), 30000))
+	if _, _, err := w.replaceableTx(original.ID()); err == nil {
+		t.Errorf("tx with descendant should not be replaced")
+	}
+	// RBFを示さないtx
+	final := p2pkhTx(other.ID(), 90000)
+	w.AddTx(final)
+	if signalsRBF(final) {
+		t.Errorf("final sequence should not signal RBF")
+	}
+	if _, _, err := w.replaceableTx(final.ID()); err == nil {
+		t.Errorf("tx not signaling RBF should not be replaced")
+	}
+	if _, _, err := w.replaceableTx(funding.ID()); err == nil {
+		t.Errorf("confirmed tx should not be replaced")
+	}
+	if _, _, err := w.replaceableTx(message.TxID{0xff}); err == nil {
+		t.Errorf("unknown tx should be error")
+	}
+}
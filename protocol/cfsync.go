@@ -0,0 +1,446 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/gcs"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+const (
+	// cfilterTimeout means how long to wait for the response of compact filter requests.
+	cfilterTimeout = 30 * time.Second
+
+	// filterCheckPeers means how many other peers are asked for the filter headers to cross check.
+	filterCheckPeers = 2
+
+	// maxFullBlocksInFlight means how many full blocks are requested at once.
+	maxFullBlocksInFlight = 16
+)
+
+// cfChannels means the channels of the messages for the compact filter based sync.
+// Only the holder of mtx requests filters and blocks, so responses are not taken by others.
+type cfChannels struct {
+	mtx       sync.Mutex
+	cfheaders chan *message.CFHeaders
+	cfcheckpt chan *message.CFCheckpt
+	cfilter   chan *message.CFilter
+	block     chan *message.Block
+}
+
+func newCFChannels() *cfChannels {
+	return &cfChannels{
+		cfheaders: make(chan *message.CFHeaders),
+		cfcheckpt: make(chan *message.CFCheckpt),
+		cfilter:   make(chan *message.CFilter),
+		// 要求したブロックは全て受け取れるようにしておく
+		block: make(chan *message.Block, maxFullBlocksInFlight),
+	}
+}
+
+// syncWithCompactFilters scan the blocks after start with BIP157/158 compact filters
+// and apply the matched blocks to the wallet.
+// Unlike bloom filters, the peer doesn't learn our scripts, and the filters are
+// verified by the filter headers which other peers must agree with.
+// Only the blocks matching the filters are downloaded.
+// The sync tip of the wallet is moved to the tip after all blocks are applied.
+func syncWithCompactFilters(p *Peer, c *chain.HeaderChain, start *chain.HeaderNode, wallet *Wallet, ch *cfChannels) error {
+	tip := c.Tip()
+	// startが古い分岐に残っていれば、tipとの分岐点から走査する
+	for start.Height > tip.Height || tip.Ancestor(start.Height) != start {
+		start = start.Parent
+	}
+	if tip.Height <= start.Height {
+		return nil
+	}
+	checkpoints, err := fetchFilterCheckpoints(p, tip, ch.cfcheckpt)
+	if err != nil {
+		return err
+	}
+
+	// checkpointの間隔ごとにフィルタヘッダを検証してからフィルタを受け取る
+	// genesisの前のフィルタヘッダは0
+	next := uint32(0)
+	prev := [32]byte{}
+	if base := start.Height / message.CFCheckptInterval; base > 0 {
+		next = base*message.CFCheckptInterval + 1
+		prev = checkpoints[base-1]
+	}
+	scripts := wallet.Scripts()
+	matched := []*chain.HeaderNode{}
+	for next <= tip.Height {
+		stopHeight := (next/message.CFCheckptInterval + 1) * message.CFCheckptInterval
+		if stopHeight > tip.Height {
+			stopHeight = tip.Height
+		}
+		stop := c.NodeByHeight(stopHeight)
+		if stop == nil {
+			return fmt.Errorf("Block %d is not in the best header chain", stopHeight)
+		}
+		hashes, err := fetchFilterHashes(p, next, stop, prev, checkpoints, ch.cfheaders)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			prev = gcs.MakeHeader(hash, prev)
+		}
+		// startまでのブロックはフィルタヘッダを繋げるためだけに使う
+		from := next
+		if from <= start.Height {
+			from = start.Height + 1
+		}
+		nodes, err := fetchMatchedFilters(p, from, stop, hashes[from-next:], scripts, ch.cfilter)
+		if err != nil {
+			return err
+		}
+		matched = append(matched, nodes...)
+		fmt.Printf("Filters scanned: %s, matched blocks %d\n", scanProgress(start.Height, stopHeight, tip.Height), len(matched))
+		next = stopHeight + 1
+	}
+
+	if err := crossCheckFilterHeaders(p, tip, checkpoints, prev); err != nil {
+		return err
+	}
+	if err := fetchMatchedBlocks(p, matched, wallet, ch.block); err != nil {
+		return err
+	}
+	// マッチしなかったブロックも含めてtipまで走査済み
+	wallet.SetSyncTip(tip)
+	return nil
+}
+
+// followFilters scan the blocks connected after the initial sync with compact filters.
+// The wallet only rolls back the disconnected blocks of a reorg, so the blocks on
+// the new branch are scanned again from the fork point.
+// start is used until the wallet scans any block.
+func followFilters(p *Peer, c *chain.HeaderChain, start *chain.HeaderNode, wallet *Wallet, ch *cfChannels) {
+	changed := make(chan struct{}, 1)
+	c.AddListener(func(*chain.TipChange) {
+		// 走査中に届いた変更はまとめて次の走査で扱う
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	for {
+		if wallet.SyncTip() != nil {
+			start = rewindToBestChain(c, wallet)
+		}
+		ch.mtx.Lock()
+		err := syncWithCompactFilters(p, c, start, wallet, ch)
+		ch.mtx.Unlock()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		select {
+		case <-changed:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// rewindToBestChain disconnect the scanned blocks which are not in the best chain
+// and return the last scanned block in it.
+// Blocks applied while the reorg was notified can be left on the old branch.
+func rewindToBestChain(c *chain.HeaderChain, wallet *Wallet) *chain.HeaderNode {
+	node := wallet.SyncTip()
+	for !c.IsInBestChain(node.Hash) {
+		wallet.DisconnectBlock(node)
+		node = node.Parent
+	}
+	return node
+}
+
+// fetchFilterCheckpoints download the filter headers at every CFCheckptInterval blocks up to stop.
+func fetchFilterCheckpoints(p *Peer, stop *chain.HeaderNode, cfcheckptCh chan *message.CFCheckpt) ([][32]byte, error) {
+	if err := p.SendMessage(message.NewGetCFCheckpt(message.FilterTypeBasic, stop.Hash)); err != nil {
+		return nil, err
+	}
+	select {
+	case checkpt := <-cfcheckptCh:
+		if err := checkCFCheckpt(checkpt, stop); err != nil {
+			p.Misbehaving(20, err.Error())
+			return nil, err
+		}
+		return checkpt.FilterHeaders, nil
+	case <-p.quit:
+		return nil, fmt.Errorf("Peer disconnected during filter sync")
+	case <-time.After(cfilterTimeout):
+		return nil, fmt.Errorf("Filter sync timed out")
+	}
+}
+
+// checkCFCheckpt checks the cfcheckpt is the response for the stop block.
+func checkCFCheckpt(checkpt *message.CFCheckpt, stop *chain.HeaderNode) error {
+	if checkpt.FilterType != message.FilterTypeBasic || checkpt.StopHash != stop.Hash {
+		return fmt.Errorf("Unexpected cfcheckpt")
+	}
+	if len(checkpt.FilterHeaders) != int(stop.Height/message.CFCheckptInterval) {
+		return fmt.Errorf("Cfcheckpt has %d headers for height %d", len(checkpt.FilterHeaders), stop.Height)
+	}
+	return nil
+}
+
+// fetchFilterHashes download the filter hashes of the blocks from the height up to stop.
+// prev is the filter header of the block before them, and the calculated filter
+// headers must match the checkpoints the peer committed to.
+func fetchFilterHashes(p *Peer, from uint32, stop *chain.HeaderNode, prev [32]byte, checkpoints [][32]byte, cfheadersCh chan *message.CFHeaders) ([][32]byte, error) {
+	if err := p.SendMessage(message.NewGetCFHeaders(message.FilterTypeBasic, from, stop.Hash)); err != nil {
+		return nil, err
+	}
+	select {
+	case cfheaders := <-cfheadersCh:
+		if cfheaders.FilterType != message.FilterTypeBasic || cfheaders.StopHash != stop.Hash ||
+			len(cfheaders.FilterHashes) != int(stop.Height-from+1) {
+			p.Misbehaving(20, "unexpected cfheaders")
+			return nil, fmt.Errorf("Peer didn't return the requested filter headers")
+		}
+		if cfheaders.PreviousFilterHead != prev {
+			p.Misbehaving(banThreshold, "cfheaders doesn't connect to the filter headers")
+			return nil, fmt.Errorf("Filter headers don't connect at height %d", from)
+		}
+		header := prev
+		for i, hash := range cfheaders.FilterHashes {
+			header = gcs.MakeHeader(hash, header)
+			h := from + uint32(i)
+			if h == 0 || h%message.CFCheckptInterval != 0 || int(h/message.CFCheckptInterval) > len(checkpoints) {
+				continue
+			}
+			if checkpoints[h/message.CFCheckptInterval-1] != header {
+				p.Misbehaving(banThreshold, "cfheaders doesn't match cfcheckpt")
+				return nil, fmt.Errorf("Filter header at height %d doesn't match the checkpoint", h)
+			}
+		}
+		return cfheaders.FilterHashes, nil
+	case <-p.quit:
+		return nil, fmt.Errorf("Peer disconnected during filter sync")
+	case <-time.After(cfilterTimeout):
+		return nil, fmt.Errorf("Filter sync timed out")
+	}
+}
+
+// fetchMatchedFilters download the filters of the blocks from the height up to stop,
+// verify them by the filter hashes and return the blocks matching the scripts.
+func fetchMatchedFilters(p *Peer, from uint32, stop *chain.HeaderNode, hashes [][32]byte, scripts [][]byte, cfilterCh chan *message.CFilter) ([]*chain.HeaderNode, error) {
+	nodes := make([]*chain.HeaderNode, stop.Height-from+1)
+	for node := stop; node.Height >= from; node = node.Parent {
+		nodes[node.Height-from] = node
+	}
+	if err := p.SendMessage(message.NewGetCFilters(message.FilterTypeBasic, from, stop.Hash)); err != nil {
+		return nil, err
+	}
+	// cfilterはブロックの順に送られてくる
+	matched := []*chain.HeaderNode{}
+	for i, node := range nodes {
+		select {
+		case cfilter := <-cfilterCh:
+			if cfilter.FilterType != message.FilterTypeBasic || cfilter.BlockHash != node.Hash {
+				p.Misbehaving(20, "unexpected cfilter")
+				return nil, fmt.Errorf("Peer didn't return the requested filter at height %d", node.Height)
+			}
+			var hash [32]byte
+			copy(hash[:], util.Hash256(cfilter.Filter))
+			if hash != hashes[i] {
+				p.Misbehaving(banThreshold, "cfilter doesn't match the filter header")
+				return nil, fmt.Errorf("Filter at height %d doesn't match the filter header", node.Height)
+			}
+			// フィルタヘッダで約束したフィルタが壊れているのは正直なpeerではない
+			filter, err := gcs.DecodeBasicFilter(cfilter.Filter)
+			if err != nil {
+				p.Misbehaving(banThreshold, "malformed cfilter: "+err.Error())
+				return nil, err
+			}
+			match, err := filter.MatchAny(gcs.BasicKey(node.Hash), scripts)
+			if err != nil {
+				p.Misbehaving(banThreshold, "malformed cfilter: "+err.Error())
+				return nil, err
+			}
+			if match {
+				matched = append(matched, node)
+			}
+		case <-p.quit:
+			return nil, fmt.Errorf("Peer disconnected during filter sync")
+		case <-time.After(cfilterTimeout):
+			return nil, fmt.Errorf("Filter sync timed out")
+		}
+	}
+	return matched, nil
+}
+
+// crossCheckFilterHeaders checks other peers agree with the filter headers of the peer.
+// Filter headers are not committed in blocks, so a peer could hide our transactions
+// by false filters. We can't tell which peer is honest when they disagree,
+// so the sync stops in that case.
+func crossCheckFilterHeaders(p *Peer, tip *chain.HeaderNode, checkpoints [][32]byte, tipHeader [32]byte) error {
+	if p.addrManager == nil {
+		return nil
+	}
+	checked := 0
+	for i := 0; i < maxConnectAttempts && checked < filterCheckPeers; i++ {
+		other, err := connectPeer(p.addrManager, p.banManager, config)
+		if err != nil {
+			fmt.Println(err.Error())
+			break
+		}
+		if other.String() == p.String() {
+			other.Disconnect()
+			continue
+		}
+		agree, err := compareFilterHeaders(other, tip, checkpoints, tipHeader)
+		other.Disconnect()
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if !agree {
+			return fmt.Errorf("Filter headers of %s and %s conflict", p, other)
+		}
+		checked++
+	}
+	if checked == 0 {
+		fmt.Println("No other peer cross checked the filter headers")
+	}
+	return nil
+}
+
+// compareFilterHeaders checks the checkpoints and the filter header of the tip of the other peer.
+// It returns error if the peer doesn't give them.
+func compareFilterHeaders(other *Peer, tip *chain.HeaderNode, checkpoints [][32]byte, tipHeader [32]byte) (bool, error) {
+	if err := other.SendMessage(message.NewGetCFCheckpt(message.FilterTypeBasic, tip.Hash)); err != nil {
+		return false, err
+	}
+	msg, err := waitMessage(other, "cfcheckpt", cfilterTimeout)
+	if err != nil {
+		return false, err
+	}
+	checkpt, err := message.DecodeCFCheckpt(msg)
+	if err != nil {
+		return false, err
+	}
+	if err := checkCFCheckpt(checkpt, tip); err != nil {
+		return false, err
+	}
+	for i := range checkpoints {
+		if checkpt.FilterHeaders[i] != checkpoints[i] {
+			return false, nil
+		}
+	}
+
+	// 最後のcheckpoint以降のヘッダは先端のヘッダを比べる
+	if err := other.SendMessage(message.NewGetCFHeaders(message.FilterTypeBasic, tip.Height, tip.Hash)); err != nil {
+		return false, err
+	}
+	msg, err = waitMessage(other, "cfheaders", cfilterTimeout)
+	if err != nil {
+		return false, err
+	}
+	cfheaders, err := message.DecodeCFHeaders(msg)
+	if err != nil {
+		return false, err
+	}
+	if cfheaders.StopHash != tip.Hash || len(cfheaders.FilterHashes) != 1 {
+		return false, fmt.Errorf("Unexpected cfheaders from %s", other)
+	}
+	return gcs.MakeHeader(cfheaders.FilterHashes[0], cfheaders.PreviousFilterHead) == tipHeader, nil
+}
+
+// waitMessage read messages from the peer until the command arrives, ignoring others.
+// It is used for the peers which dispatch doesn't run for.
+func waitMessage(p *Peer, command string, timeout time.Duration) ([]byte, error) {
+	msgCh := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			c, msg, err := p.ReadMessage()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if c == command {
+				msgCh <- msg
+				return
+			}
+		}
+	}()
+	select {
+	case msg := <-msgCh:
+		return msg, nil
+	case err := <-errCh:
+		return nil, err
+	case <-time.After(timeout):
+		// 切断すれば読み込み中のgoroutineも終わる
+		p.Disconnect()
+		return nil, fmt.Errorf("%s from %s timed out", command, p)
+	}
+}
+
+// fetchMatchedBlocks download the full blocks and apply their wallet transactions
+// in the order of the height, so spends of the outputs found in earlier blocks are detected.
+func fetchMatchedBlocks(p *Peer, nodes []*chain.HeaderNode, wallet *Wallet, blockCh chan *message.Block) error {
+	return fetchBlocks(p, nodes, blockCh, func(node *chain.HeaderNode, block *message.Block) {
+		connectFullBlock(wallet, node, block)
+	})
+}
+
+// fetchBlocks download and validate the full blocks, and pass them to fn in the order of the height.
+func fetchBlocks(p *Peer, nodes []*chain.HeaderNode, blockCh chan *message.Block, fn func(*chain.HeaderNode, *message.Block)) error {
+	for i := 0; i < len(nodes); i += maxFullBlocksInFlight {
+		end := i + maxFullBlocksInFlight
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		batch := nodes[i:end]
+		requested := map[[32]byte]bool{}
+		hashes := [][32]byte{}
+		for _, node := range batch {
+			requested[node.Hash] = true
+			hashes = append(hashes, node.Hash)
+		}
+		// witnessがあればcoinbaseのcommitmentまで検証できる
+		witness := p.version != nil && p.version.HasServices(message.SFNodeWitness)
+		if err := p.SendMessage(message.NewBlockGetData(hashes, witness)); err != nil {
+			return err
+		}
+		blocks := map[[32]byte]*message.Block{}
+		for len(blocks) < len(batch) {
+			select {
+			case block := <-blockCh:
+				hash := block.BlockHash()
+				if !requested[hash] {
+					continue
+				}
+				if err := block.Validate(witness); err != nil {
+					p.Misbehaving(banThreshold, "invalid block: "+err.Error())
+					return err
+				}
+				blocks[hash] = block
+			case <-p.quit:
+				return fmt.Errorf("Peer disconnected during block download")
+			case <-time.After(cfilterTimeout):
+				return fmt.Errorf("Block download timed out")
+			}
+		}
+		for _, node := range batch {
+			fn(node, blocks[node.Hash])
+		}
+		fmt.Printf("Block processed: height %d\n", batch[len(batch)-1].Height)
+	}
+	return nil
+}
+
+// connectFullBlock add the wallet transactions in the block to the wallet.
+func connectFullBlock(wallet *Wallet, node *chain.HeaderNode, block *message.Block) {
+	txIDs := []message.TxID{}
+	for _, tx := range block.Transactions {
+		if wallet.IsRelevant(tx) {
+			wallet.AddTx(tx)
+			txIDs = append(txIDs, tx.ID())
+		}
+	}
+	wallet.ConnectBlock(node, txIDs)
+}
@@ -0,0 +1,248 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/gcs"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// cfServer answers the compact filter requests like a full node serving the blocks.
+type cfServer struct {
+	chain     *chain.HeaderChain
+	blocks    map[[32]byte]*message.Block
+	filters   map[[32]byte][]byte   // peerが送るフィルタ
+	committed map[[32]byte][32]byte // フィルタヘッダで約束したフィルタハッシュ
+	scripts   map[message.OutPoint][]byte
+	requested [][32]byte // getdataで要求されたブロック
+	recv      chan [2][]byte
+}
+
+func (s *cfServer) WriteMessage(command string, payload []byte) error {
+	switch command {
+	case "getcfcheckpt":
+		var stopHash [32]byte
+		copy(stopHash[:], payload[1:33])
+		stop := s.chain.Lookup(stopHash)
+		headers := [][32]byte{}
+		for h := uint32(message.CFCheckptInterval); h <= stop.Height; h += message.CFCheckptInterval {
+			headers = append(headers, s.filterHeader(h))
+		}
+		s.send(message.NewCFCheckpt(message.FilterTypeBasic, stopHash, headers))
+	case "getcfheaders":
+		from := binary.LittleEndian.Uint32(payload[1:5])
+		var stopHash [32]byte
+		copy(stopHash[:], payload[5:37])
+		prev := [32]byte{}
+		if from > 0 {
+			prev = s.filterHeader(from - 1)
+		}
+		hashes := [][32]byte{}
+		for h := from; h <= s.chain.Lookup(stopHash).Height; h++ {
+			hashes = append(hashes, s.committed[s.chain.NodeByHeight(h).Hash])
+		}
+		s.send(message.NewCFHeaders(message.FilterTypeBasic, stopHash, prev, hashes))
+	case "getcfilters":
+		from := binary.LittleEndian.Uint32(payload[1:5])
+		var stopHash [32]byte
+		copy(stopHash[:], payload[5:37])
+		for h := from; h <= s.chain.Lookup(stopHash).Height; h++ {
+			hash := s.chain.NodeByHeight(h).Hash
+			s.send(message.NewCFilter(message.FilterTypeBasic, hash, s.filters[hash]))
+		}
+	case "getdata":
+		getData, _ := message.DecodeGetData(payload)
+		for _, invvect := range getData.Inventory {
+			s.requested = append(s.requested, invvect.Hash)
+			s.send(s.blocks[invvect.Hash])
+		}
+	}
+	return nil
+}
+
+func (s *cfServer) ReadMessage() (string, []byte, error) {
+	msg := <-s.recv
+	return string(msg[0]), msg[1], nil
+}
+
+func (s *cfServer) send(msg Message) {
+	s.recv <- [2][]byte{[]byte(msg.CommandName()), msg.Encode()}
+}
+
+func (s *cfServer) filterHeader(height uint32) [32]byte {
+	header := [32]byte{}
+	for h := uint32(0); h <= height; h++ {
+		header = gcs.MakeHeader(s.committed[s.chain.NodeByHeight(h).Hash], header)
+	}
+	return header
+}
+
+// newCFServer mine the blocks including the transactions at the heights.
+// Each block has a coinbase not related to the wallet.
+func newCFServer(t *testing.T, height uint32, txs map[uint32][]*message.Transaction) *cfServer {
+	s := &cfServer{
+		chain:     chain.NewHeaderChain(chain.RegressionNetParams),
+		blocks:    map[[32]byte]*message.Block{},
+		filters:   map[[32]byte][]byte{},
+		committed: map[[32]byte][32]byte{},
+		scripts:   map[message.OutPoint][]byte{},
+		recv:      make(chan [2][]byte, 4096),
+	}
+	s.addBlock(s.chain.Tip().Hash, nil)
+	for h := uint32(1); h <= height; h++ {
+		s.mine(t, s.chain.Tip(), txs[h])
+	}
+	return s
+}
+
+// mine add the block including the transactions on the parent.
+// The block and its filter are served before the header is added to the chain.
+func (s *cfServer) mine(t *testing.T, parent *chain.HeaderNode, txs []*message.Transaction) *chain.HeaderNode {
+	h := parent.Height + 1
+	coinbase := p2pkhTx(message.ZeroHash, 1)
+	coinbase.TxIn[0].PreviousOutput.Index = 0xFFFFFFFF
+	coinbase.TxIn[0].SignatureScript = common.NewVarStr([]byte{byte(h), byte(h >> 8)})
+	coinbase.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x22}, 20)))
+	blockTxs := append([]*message.Transaction{coinbase}, txs...)
+	txIDs := [][32]byte{}
+	for _, tx := range blockTxs {
+		txIDs = append(txIDs, tx.ID())
+	}
+	header := &message.BlockHeader{
+		Version:    4,
+		PrevBlock:  parent.Hash,
+		MerkleRoot: message.CalcMerkleRoot(txIDs),
+		Timestamp:  parent.Header.Timestamp + 600,
+		Bits:       chain.RegressionNetParams.PowLimitBits,
+	}
+	for chain.CheckProofOfWork(header.BlockHash(), header.Bits, chain.RegressionNetParams.PowLimit) != nil {
+		header.Nonce++
+	}
+	s.addBlock(header.BlockHash(), message.NewBlock(header, blockTxs))
+	node, err := s.chain.AddHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func (s *cfServer) addBlock(hash [32]byte, block *message.Block) {
+	items := [][]byte{}
+	if block != nil {
+		for _, tx := range block.Transactions {
+			for _, txIn := range tx.TxIn {
+				if script, ok := s.scripts[*txIn.PreviousOutput]; ok {
+					items = append(items, script)
+				}
+			}
+			for i, txOut := range tx.TxOut {
+				items = append(items, txOut.PkScript.Data)
+				s.scripts[message.OutPoint{Hash: tx.ID(), Index: uint32(i)}] = txOut.PkScript.Data
+			}
+		}
+		s.blocks[hash] = block
+	}
+	filter := gcs.BuildBasicFilter(hash, items)
+	s.filters[hash] = filter.NBytes()
+	s.committed[hash] = filter.Hash()
+}
+
+func TestSyncWithCompactFilters(t *testing.T) {
+	tx1 := p2pkhTx([32]byte{0x01}, 1000)
+	tx2 := p2pkhTx([32]byte{0x02}, 2000)
+	spend := p2pkhTx(tx1.ID(), 900)
+	spend.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x33}, 20)))
+	s := newCFServer(t, 1005, map[uint32][]*message.Transaction{3: {tx1}, 500: {tx2}, 1002: {spend}})
+
+	conn, _ := net.Pipe()
+	p := newPeer(conn, s, testAddr(1), DefaultConfig())
+	ch := newCFChannels()
+	go dispatch(p, s.chain, make(chan *message.Headers), make(chan *message.Merkleblock), make(chan *message.Transaction), ch)
+	w := NewWallet(testPubKey, nil)
+	if err := syncWithCompactFilters(p, s.chain, s.chain.NodeByHeight(0), w, ch); err != nil {
+		t.Fatal(err)
+	}
+	// マッチしたブロックだけをダウンロードする
+	expected := [][32]byte{s.chain.NodeByHeight(3).Hash, s.chain.NodeByHeight(500).Hash, s.chain.NodeByHeight(1002).Hash}
+	if len(s.requested) != len(expected) {
+		t.Fatalf("expected %d blocks requested, actual %d", len(expected), len(s.requested))
+	}
+	for i := range expected {
+		if s.requested[i] != expected[i] {
+			t.Errorf("unexpected block requested: %d", i)
+		}
+	}
+	utxos := w.UTXOs()
+	if len(utxos) != 1 || utxos[0].tx.ID() != tx2.ID() {
+		t.Errorf("only tx2 should be unspent: %d", len(utxos))
+	}
+	if w.SyncTip() != s.chain.Tip() {
+		t.Errorf("all blocks should be scanned")
+	}
+}
+
+func TestSyncWithCompactFiltersFalseFilter(t *testing.T) {
+	tx := p2pkhTx([32]byte{0x01}, 1000)
+	s := newCFServer(t, 10, map[uint32][]*message.Transaction{5: {tx}})
+	// フィルタヘッダと違うフィルタでtxを隠す
+	node := s.chain.NodeByHeight(5)
+	s.filters[node.Hash] = gcs.BuildBasicFilter(node.Hash, nil).NBytes()
+
+	conn, _ := net.Pipe()
+	p := newPeer(conn, s, testAddr(1), DefaultConfig())
+	ch := newCFChannels()
+	go dispatch(p, s.chain, make(chan *message.Headers), make(chan *message.Merkleblock), make(chan *message.Transaction), ch)
+	if err := syncWithCompactFilters(p, s.chain, s.chain.NodeByHeight(0), NewWallet(testPubKey, nil), ch); err == nil {
+		t.Fatalf("filter which doesn't match the filter header should be rejected")
+	}
+	if p.banScore < banThreshold {
+		t.Errorf("peer serving false filter should be banned: %d", p.banScore)
+	}
+}
+
+func TestFollowFiltersReorg(t *testing.T) {
+	tx := p2pkhTx([32]byte{0x01}, 1000)
+	s := newCFServer(t, 10, map[uint32][]*message.Transaction{10: {tx}})
+
+	conn, _ := net.Pipe()
+	p := newPeer(conn, s, testAddr(1), DefaultConfig())
+	ch := newCFChannels()
+	go dispatch(p, s.chain, make(chan *message.Headers), make(chan *message.Merkleblock), make(chan *message.Transaction), ch)
+	notifications := make(chan *TxNotification, 10)
+	w := NewWallet(testPubKey, func(n *TxNotification) {
+		notifications <- n
+	})
+	start := s.chain.NodeByHeight(0)
+	if err := syncWithCompactFilters(p, s.chain, start, w, ch); err != nil {
+		t.Fatal(err)
+	}
+	<-notifications
+	s.chain.AddListener(w.HandleTipChange)
+	go followFilters(p, s.chain, start, w, ch)
+
+	// txを含むブロックを、別のtxも含む別の分岐のブロックで置き換える
+	fork := s.mine(t, s.chain.NodeByHeight(9), []*message.Transaction{tx, p2pkhTx([32]byte{0x02}, 2000)})
+	tip := s.mine(t, fork, nil)
+	deadline := time.After(time.Second)
+	for confirmed := false; !confirmed; {
+		select {
+		case n := <-notifications:
+			confirmed = n.Type == TxConfirmed && n.TxID == tx.ID() && n.BlockHash == fork.Hash
+		case <-deadline:
+			t.Fatalf("tx should be confirmed again in the new branch")
+		}
+	}
+	for w.SyncTip() != tip {
+		select {
+		case <-deadline:
+			t.Fatalf("blocks on the new branch should be scanned")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
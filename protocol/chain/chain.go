@@ -0,0 +1,456 @@
+// Package chain validates block headers and tracks the best header chain.
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const (
+	// medianTimeBlocks means the number of blocks to calculate median time past.
+	medianTimeBlocks = 11
+
+	// maxTimeOffset means how far in the future the block timestamp can be.
+	maxTimeOffset = 2 * time.Hour
+)
+
+// ErrUnconnectedHeader is returned when the previous block of the header is unknown.
+var ErrUnconnectedHeader = errors.New("Previous block of the header is unknown")
+
+// ErrTimeTooNew is returned when the header timestamp is too far ahead of the local clock.
+// It follows bitcoin core's "time-too-new", the header may be valid later or the local clock
+// may be behind, so it is not a misbehavior of the peer.
+var ErrTimeTooNew = errors.New("Block timestamp is too far in the future")
+
+// HeaderNode means a validated block header in the chain.
+type HeaderNode struct {
+	Header *message.BlockHeader
+	Hash   [32]byte
+	Height uint32
+	Work   *big.Int // genesisからこのブロックまでの累計work
+	Parent *HeaderNode
+}
+
+// Ancestor return the ancestor of the node at the height, or nil if it doesn't exist.
+func (n *HeaderNode) Ancestor(height uint32) *HeaderNode {
+	if height > n.Height {
+		return nil
+	}
+	node := n
+	for node != nil && node.Height > height {
+		node = node.Parent
+	}
+	return node
+}
+
+// MedianTimePast return the median timestamp of the last 11 blocks up to this node.
+func (n *HeaderNode) MedianTimePast() uint32 {
+	timestamps := []uint32{}
+	for node := n; node != nil && len(timestamps) < medianTimeBlocks; node = node.Parent {
+		timestamps = append(timestamps, node.Header.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// TipChange means the change of the best chain.
+// Disconnected is the blocks from the old tip down to the fork point, and
+// Connected is the blocks from the fork point up to the new tip.
+// Both exclude the fork point itself.
+type TipChange struct {
+	Fork         *HeaderNode
+	Disconnected []*HeaderNode
+	Connected    []*HeaderNode
+}
+
+// IsReorg checks some blocks in the old best chain were disconnected.
+func (t *TipChange) IsReorg() bool {
+	return len(t.Disconnected) > 0
+}
+
+// newTipChange calculate the change of the best chain from oldTip to newTip.
+func newTipChange(oldTip, newTip *HeaderNode) *TipChange {
+	a, b := oldTip, newTip
+	for a.Height > b.Height {
+		a = a.Parent
+	}
+	for b.Height > a.Height {
+		b = b.Parent
+	}
+	for a != b {
+		a, b = a.Parent, b.Parent
+	}
+	change := &TipChange{Fork: a}
+	for n := oldTip; n != a; n = n.Parent {
+		change.Disconnected = append(change.Disconnected, n)
+	}
+	for n := newTip; n != a; n = n.Parent {
+		change.Connected = append([]*HeaderNode{n}, change.Connected...)
+	}
+	return change
+}
+
+// HeaderChain holds the tree of validated headers and its best chain.
+// The best chain is the one with the most cumulative work.
+type HeaderChain struct {
+	mtx       sync.RWMutex
+	params    *Params
+	index     map[[32]byte]*HeaderNode // 全ての分岐のヘッダ
+	root      *HeaderNode              // genesisもしくは同期を始めたcheckpoint
+	bestChain []*HeaderNode            // best chainの高さ順のヘッダ、rootの高さから始まる
+	tip       *HeaderNode
+	store     *headerStore // nilの場合はメモリ上だけに保持する
+	now       func() time.Time
+
+	listeners      []func(*TipChange)
+	pendingChanges []*TipChange // ロックを外した後に通知する変更
+}
+
+// NewHeaderChain create new chain which has only the genesis header.
+func NewHeaderChain(params *Params) *HeaderChain {
+	genesis := &HeaderNode{
+		Header: params.GenesisHeader,
+		Hash:   params.GenesisHeader.BlockHash(),
+		Height: 0,
+		Work:   CalcWork(params.GenesisHeader.Bits),
+	}
+	c := &HeaderChain{
+		params: params,
+		now:    time.Now,
+	}
+	c.setRoot(genesis)
+	return c
+}
+
+// NewHeaderChainFromCheckpoint create new chain which starts from the header of the checkpoint.
+// The ancestors of the checkpoint are not known, so the difficulty of the blocks
+// which depends on them is trusted until the next difficulty adjustment.
+func NewHeaderChainFromCheckpoint(params *Params, cp *Checkpoint, header *message.BlockHeader) (*HeaderChain, error) {
+	root, err := newCheckpointNode(params, cp, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &HeaderChain{
+		params: params,
+		now:    time.Now,
+	}
+	c.setRoot(root)
+	return c, nil
+}
+
+func newCheckpointNode(params *Params, cp *Checkpoint, header *message.BlockHeader) (*HeaderNode, error) {
+	hash := header.BlockHash()
+	if hash != cp.Hash {
+		return nil, fmt.Errorf("Header doesn't match the checkpoint %s", cp.String())
+	}
+	if err := CheckProofOfWork(hash, header.Bits, params.PowLimit); err != nil {
+		return nil, err
+	}
+	// checkpointより前のworkは分からないが、全てのヘッダが同じcheckpointから始まるので比較には困らない
+	return &HeaderNode{
+		Header: header,
+		Hash:   hash,
+		Height: cp.Height,
+		Work:   CalcWork(header.Bits),
+	}, nil
+}
+
+// setRoot discard all headers and restart the chain from root.
+func (c *HeaderChain) setRoot(root *HeaderNode) {
+	c.index = map[[32]byte]*HeaderNode{root.Hash: root}
+	c.root = root
+	c.bestChain = []*HeaderNode{root}
+	c.tip = root
+}
+
+// Params return the network parameters of the chain.
+func (c *HeaderChain) Params() *Params {
+	return c.params
+}
+
+// Root return the first node of the chain, which is the genesis or the checkpoint the chain started from.
+func (c *HeaderChain) Root() *HeaderNode {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.root
+}
+
+// Tip return the last node of the best chain.
+func (c *HeaderChain) Tip() *HeaderNode {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.tip
+}
+
+// Lookup return the node of the hash, or nil if it is unknown.
+func (c *HeaderChain) Lookup(hash [32]byte) *HeaderNode {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.index[hash]
+}
+
+// IsInBestChain checks the block is in the best chain.
+func (c *HeaderChain) IsInBestChain(hash [32]byte) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	node, ok := c.index[hash]
+	if !ok {
+		return false
+	}
+	return c.bestChainAt(node.Height) == node
+}
+
+// NodeByHeight return the node at the height in the best chain, or nil if the height
+// is beyond the tip or before the root.
+func (c *HeaderChain) NodeByHeight(height uint32) *HeaderNode {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.bestChainAt(height)
+}
+
+func (c *HeaderChain) bestChainAt(height uint32) *HeaderNode {
+	if height < c.root.Height || int(height-c.root.Height) >= len(c.bestChain) {
+		return nil
+	}
+	return c.bestChain[height-c.root.Height]
+}
+
+// BlockLocator return the block locator from the tip of the best chain.
+func (c *HeaderChain) BlockLocator() [][32]byte {
+	return c.BlockLocatorFrom(c.Tip())
+}
+
+// BlockLocatorFrom return the block locator from the node. The hashes are
+// dense for the last 10 blocks and then go back exponentially to the genesis
+// (or the checkpoint the chain started from), so the peer can find the fork
+// point even if we are on a stale branch.
+// https://en.bitcoin.it/wiki/Protocol_documentation#getblocks
+func (c *HeaderChain) BlockLocatorFrom(node *HeaderNode) [][32]byte {
+	locator := [][32]byte{}
+	step := uint32(1)
+	for node != nil {
+		locator = append(locator, node.Hash)
+		if node.Parent == nil {
+			break
+		}
+		height := uint32(0)
+		if node.Height > step {
+			height = node.Height - step
+		}
+		next := node.Ancestor(height)
+		if next == nil {
+			// checkpointより前のブロックは持っていないので最後はrootを入れる
+			for next = node; next.Parent != nil; next = next.Parent {
+			}
+		}
+		node = next
+		if len(locator) > 10 {
+			step *= 2
+		}
+	}
+	return locator
+}
+
+// AddHeader validate the header and add it to the chain.
+// It returns ErrUnconnectedHeader if the previous block is unknown.
+func (c *HeaderChain) AddHeader(header *message.BlockHeader) (*HeaderNode, error) {
+	if err := c.AddHeaders([]*message.BlockHeader{header}); err != nil {
+		return nil, err
+	}
+	return c.Lookup(header.BlockHash()), nil
+}
+
+// addHeader add the header to the chain. If fullCheck is false, only proof of work
+// is checked, which is used to restore the headers validated before from the store.
+func (c *HeaderChain) addHeader(header *message.BlockHeader, fullCheck bool) (*HeaderNode, error) {
+	hash := header.BlockHash()
+	if node, ok := c.index[hash]; ok {
+		return node, nil
+	}
+	parent, ok := c.index[header.PrevBlock]
+	if !ok {
+		return nil, ErrUnconnectedHeader
+	}
+	if fullCheck {
+		if err := c.checkHeader(parent, header, hash); err != nil {
+			return nil, err
+		}
+	} else if err := CheckProofOfWork(hash, header.Bits, c.params.PowLimit); err != nil {
+		return nil, err
+	}
+	node := &HeaderNode{
+		Header: header,
+		Hash:   hash,
+		Height: parent.Height + 1,
+		Work:   new(big.Int).Add(parent.Work, CalcWork(header.Bits)),
+		Parent: parent,
+	}
+	if c.store != nil {
+		if err := c.store.append(header); err != nil {
+			return nil, err
+		}
+	}
+	c.index[hash] = node
+	if node.Work.Cmp(c.tip.Work) > 0 {
+		c.setTip(node)
+	}
+	return node, nil
+}
+
+// setTip change the best chain to the one ending with node.
+func (c *HeaderChain) setTip(node *HeaderNode) {
+	if len(c.listeners) > 0 {
+		c.pendingChanges = append(c.pendingChanges, newTipChange(c.tip, node))
+	}
+	// 分岐点までのbest chainを置き換える
+	length := int(node.Height-c.root.Height) + 1
+	if length < len(c.bestChain) {
+		c.bestChain = c.bestChain[:length]
+	} else {
+		c.bestChain = append(c.bestChain, make([]*HeaderNode, length-len(c.bestChain))...)
+	}
+	for n := node; n != nil && c.bestChain[n.Height-c.root.Height] != n; n = n.Parent {
+		c.bestChain[n.Height-c.root.Height] = n
+	}
+	c.tip = node
+}
+
+// AddHeaders add headers in order, and stop at the first invalid header.
+// Accepted headers are flushed to the store, and then listeners are
+// notified of the changes of the best chain.
+func (c *HeaderChain) AddHeaders(headers []*message.BlockHeader) error {
+	c.mtx.Lock()
+	var err error
+	for _, header := range headers {
+		if _, err = c.addHeader(header, true); err != nil {
+			break
+		}
+	}
+	if c.store != nil {
+		if flushErr := c.store.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	changes := c.pendingChanges
+	c.pendingChanges = nil
+	listeners := c.listeners
+	c.mtx.Unlock()
+
+	// listenerがchainを参照できるようにロックを外してから通知する
+	for _, change := range changes {
+		for _, listener := range listeners {
+			listener(change)
+		}
+	}
+	return err
+}
+
+// AddListener register the function called when the best chain changes.
+func (c *HeaderChain) AddListener(listener func(*TipChange)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.listeners = append(c.listeners, listener)
+}
+
+// checkHeader checks proof of work, difficulty and timestamp of the header.
+func (c *HeaderChain) checkHeader(parent *HeaderNode, header *message.BlockHeader, hash [32]byte) error {
+	if err := CheckProofOfWork(hash, header.Bits, c.params.PowLimit); err != nil {
+		return err
+	}
+	if err := c.checkCheckpoint(parent.Height+1, hash); err != nil {
+		return err
+	}
+	// checkpointから同期した直後は祖先が無く難易度を計算できないことがある
+	required, ok := c.nextWorkRequired(parent, header)
+	if ok && header.Bits != required {
+		return fmt.Errorf("Block %d has unexpected difficulty bits %08x, required: %08x", parent.Height+1, header.Bits, required)
+	}
+	if header.Timestamp <= parent.MedianTimePast() {
+		return fmt.Errorf("Block %d timestamp %d is not after median time past %d", parent.Height+1, header.Timestamp, parent.MedianTimePast())
+	}
+	if time.Unix(int64(header.Timestamp), 0).After(c.now().Add(maxTimeOffset)) {
+		return ErrTimeTooNew
+	}
+	return nil
+}
+
+// checkCheckpoint checks the block at the height doesn't conflict with the checkpoints.
+// Once the best chain passed a checkpoint, any fork below it is rejected.
+func (c *HeaderChain) checkCheckpoint(height uint32, hash [32]byte) error {
+	if cp := c.params.CheckpointAt(height); cp != nil && cp.Hash != hash {
+		return fmt.Errorf("Block %d doesn't match the checkpoint %s", height, cp.String())
+	}
+	if cp := c.lastCheckpoint(); cp != nil && height <= cp.Height {
+		return fmt.Errorf("Block %d forks before the checkpoint %s", height, cp.String())
+	}
+	return nil
+}
+
+// lastCheckpoint return the highest checkpoint in the best chain, or nil if there is none.
+func (c *HeaderChain) lastCheckpoint() *Checkpoint {
+	for i := len(c.params.Checkpoints) - 1; i >= 0; i-- {
+		cp := &c.params.Checkpoints[i]
+		if node := c.bestChainAt(cp.Height); node != nil && node.Hash == cp.Hash {
+			return cp
+		}
+	}
+	return nil
+}
+
+// nextWorkRequired calculate the difficulty bits of the block after last.
+// It returns false if it can't be calculated because the ancestors are before the root.
+// https://github.com/bitcoin/bitcoin/blob/master/src/pow.cpp
+func (c *HeaderChain) nextWorkRequired(last *HeaderNode, header *message.BlockHeader) (uint32, bool) {
+	params := c.params
+	interval := params.RetargetInterval()
+	if (last.Height+1)%interval != 0 {
+		if params.ReduceMinDifficulty {
+			// testnetでは前のブロックから20分以上経過していれば最低難易度で良い
+			allowMinTime := int64(last.Header.Timestamp) + int64(params.MinDiffReductionTime/time.Second)
+			if int64(header.Timestamp) > allowMinTime {
+				return params.PowLimitBits, true
+			}
+			// 最低難易度でない最後のブロックの難易度を使う
+			node := last
+			for node.Parent != nil && node.Height%interval != 0 && node.Header.Bits == params.PowLimitBits {
+				node = node.Parent
+			}
+			if node.Parent == nil && node.Height%interval != 0 && node.Header.Bits == params.PowLimitBits {
+				return 0, false
+			}
+			return node.Header.Bits, true
+		}
+		return last.Header.Bits, true
+	}
+	if params.PowNoRetargeting {
+		return last.Header.Bits, true
+	}
+
+	first := last.Ancestor(last.Height - (interval - 1))
+	if first == nil {
+		return 0, false
+	}
+	actualTimespan := int64(last.Header.Timestamp) - int64(first.Header.Timestamp)
+	targetTimespan := int64(params.TargetTimespan / time.Second)
+	if actualTimespan < targetTimespan/4 {
+		actualTimespan = targetTimespan / 4
+	}
+	if actualTimespan > targetTimespan*4 {
+		actualTimespan = targetTimespan * 4
+	}
+	newTarget := CompactToBig(last.Header.Bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(params.PowLimit) > 0 {
+		newTarget.Set(params.PowLimit)
+	}
+	return BigToCompact(newTarget), true
+}
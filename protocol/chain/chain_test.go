@@ -0,0 +1,325 @@
+package chain
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// testParams is regtest with difficulty adjustment every 10 blocks.
+var testParams = &Params{
+	Name:                 "test",
+	GenesisHeader:        RegressionNetParams.GenesisHeader,
+	PowLimit:             RegressionNetParams.PowLimit,
+	PowLimitBits:         RegressionNetParams.PowLimitBits,
+	TargetTimespan:       100 * time.Minute,
+	TargetSpacing:        10 * time.Minute,
+	ReduceMinDifficulty:  false,
+	MinDiffReductionTime: 20 * time.Minute,
+}
+
+// mine find nonce of the header which satisfies bits.
+func mine(t *testing.T, parent *HeaderNode, timestamp uint32, bits uint32) *message.BlockHeader {
+	header := &message.BlockHeader{
+		Version:   4,
+		PrevBlock: parent.Hash,
+		Timestamp: timestamp,
+		Bits:      bits,
+	}
+	for ; header.Nonce < 10000; header.Nonce++ {
+		if CheckProofOfWork(header.BlockHash(), bits, new(big.Int).Lsh(big.NewInt(1), 256)) == nil {
+			return header
+		}
+	}
+	t.Fatal("failed to mine header")
+	return nil
+}
+
+// extend mine n blocks on parent with interval seconds and return the last node.
+func extend(t *testing.T, c *HeaderChain, parent *HeaderNode, n int, interval uint32) *HeaderNode {
+	node := parent
+	for i := 0; i < n; i++ {
+		bits, ok := c.nextWorkRequired(node, &message.BlockHeader{Timestamp: node.Header.Timestamp + interval})
+		if !ok {
+			bits = node.Header.Bits
+		}
+		header := mine(t, node, node.Header.Timestamp+interval, bits)
+		var err error
+		node, err = c.AddHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return node
+}
+
+func TestGenesisHash(t *testing.T) {
+	tests := []struct {
+		params   *Params
+		expected string
+	}{
+		{TestNet3Params, "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943"},
+		{RegressionNetParams, "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206"},
+	}
+	for _, tt := range tests {
+		hash := tt.params.GenesisHeader.BlockHash()
+		actual := hex.EncodeToString(util.ReverseBytes(hash[:]))
+		if actual != tt.expected {
+			t.Errorf("%s: expected: %s, actual: %s", tt.params.Name, tt.expected, actual)
+		}
+		if err := CheckProofOfWork(tt.params.GenesisHeader.BlockHash(), tt.params.GenesisHeader.Bits, tt.params.PowLimit); err != nil {
+			t.Errorf("%s: %v", tt.params.Name, err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x1b0404cb, "404cb000000000000000000000000000000000000000000000000"},
+		{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+	}
+	for _, tt := range tests {
+		target := CompactToBig(tt.compact)
+		if target.Text(16) != tt.target {
+			t.Errorf("expected: %s, actual: %s", tt.target, target.Text(16))
+		}
+		if BigToCompact(target) != tt.compact {
+			t.Errorf("expected: %08x, actual: %08x", tt.compact, BigToCompact(target))
+		}
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	c := NewHeaderChain(RegressionNetParams)
+	genesis := c.Tip()
+	tip := extend(t, c, genesis, 20, 600)
+	if c.Tip() != tip || tip.Height != 20 {
+		t.Errorf("expected height: %d, actual: %d", 20, c.Tip().Height)
+	}
+
+	// PoWを満たさない
+	bad := mine(t, tip, tip.Header.Timestamp+600, RegressionNetParams.PowLimitBits)
+	for CheckProofOfWork(bad.BlockHash(), bad.Bits, RegressionNetParams.PowLimit) == nil {
+		bad.Nonce++
+	}
+	if _, err := c.AddHeader(bad); err == nil {
+		t.Errorf("header without enough work should be rejected")
+	}
+
+	// 難易度が違う
+	wrongBits := mine(t, tip, tip.Header.Timestamp+600, 0x1f7fffff)
+	if _, err := c.AddHeader(wrongBits); err == nil {
+		t.Errorf("header with wrong bits should be rejected")
+	}
+
+	// median time past以前
+	old := mine(t, tip, tip.MedianTimePast(), RegressionNetParams.PowLimitBits)
+	if _, err := c.AddHeader(old); err == nil {
+		t.Errorf("header before median time past should be rejected")
+	}
+
+	// 未来すぎる
+	future := mine(t, tip, uint32(time.Now().Add(3*time.Hour).Unix()), RegressionNetParams.PowLimitBits)
+	if _, err := c.AddHeader(future); err != ErrTimeTooNew {
+		t.Errorf("header too far in the future should be rejected with ErrTimeTooNew: %v", err)
+	}
+
+	unconnected := mine(t, tip, tip.Header.Timestamp+600, RegressionNetParams.PowLimitBits)
+	unconnected.PrevBlock = [32]byte{0x01}
+	if _, err := c.AddHeader(unconnected); err != ErrUnconnectedHeader {
+		t.Errorf("expected: %v, actual: %v", ErrUnconnectedHeader, err)
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	c := NewHeaderChain(testParams)
+	// 目標の半分の間隔で生成するとtargetが小さくなる
+	// 最初の区間は9ブロック分の間隔なので 9*300 / 6000 倍
+	tip := extend(t, c, c.Tip(), 9, 300)
+	next, _ := c.nextWorkRequired(tip, &message.BlockHeader{Timestamp: tip.Header.Timestamp + 300})
+	expected := new(big.Int).Div(new(big.Int).Mul(CompactToBig(testParams.PowLimitBits), big.NewInt(9*300)), big.NewInt(6000))
+	if next != BigToCompact(expected) {
+		t.Errorf("expected: %08x, actual: %08x", BigToCompact(expected), next)
+	}
+
+	// 次の区間では最低難易度より大きいtargetにはならない
+	tip = extend(t, c, tip, 10, 6000)
+	next, _ = c.nextWorkRequired(tip, &message.BlockHeader{Timestamp: tip.Header.Timestamp + 600})
+	if CompactToBig(next).Cmp(testParams.PowLimit) > 0 {
+		t.Errorf("target should not exceed pow limit: %08x", next)
+	}
+}
+
+func TestMinDifficultyRule(t *testing.T) {
+	params := *testParams
+	params.ReduceMinDifficulty = true
+	c := NewHeaderChain(&params)
+	tip := extend(t, c, c.Tip(), 10, 150)
+	hardBits := tip.Header.Bits
+	if hardBits == params.PowLimitBits {
+		t.Fatalf("difficulty should be increased")
+	}
+
+	// 20分以上経過したブロックは最低難易度で良い
+	minDiff := mine(t, tip, tip.Header.Timestamp+21*60, params.PowLimitBits)
+	minDiffNode, err := c.AddHeader(minDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// その次のブロックは最低難易度でない最後のブロックの難易度に戻る
+	if _, err := c.AddHeader(mine(t, minDiffNode, minDiffNode.Header.Timestamp+60, params.PowLimitBits)); err == nil {
+		t.Errorf("min difficulty block within 20 minutes should be rejected")
+	}
+	if _, err := c.AddHeader(mine(t, minDiffNode, minDiffNode.Header.Timestamp+60, hardBits)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBestChainByWork(t *testing.T) {
+	c := NewHeaderChain(RegressionNetParams)
+	genesis := c.Tip()
+	fork := extend(t, c, genesis, 5, 600)
+	a := extend(t, c, fork, 3, 600)
+	b := extend(t, c, fork, 2, 601)
+	if c.Tip() != a {
+		t.Errorf("longer branch should be the best chain")
+	}
+	if c.IsInBestChain(b.Hash) {
+		t.Errorf("shorter branch should not be in the best chain")
+	}
+	b = extend(t, c, b, 2, 601)
+	if c.Tip() != b || !c.IsInBestChain(fork.Hash) || c.IsInBestChain(a.Hash) {
+		t.Errorf("best chain should switch to the branch with more work")
+	}
+}
+
+func TestBlockLocator(t *testing.T) {
+	c := NewHeaderChain(RegressionNetParams)
+	tip := extend(t, c, c.Tip(), 100, 600)
+	locator := c.BlockLocator()
+	expectedHeights := []uint32{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 90, 89, 87, 83, 75, 59, 27, 0}
+	if len(locator) != len(expectedHeights) {
+		t.Fatalf("expected: %d hashes, actual: %d", len(expectedHeights), len(locator))
+	}
+	for i, height := range expectedHeights {
+		if locator[i] != tip.Ancestor(height).Hash {
+			t.Errorf("locator[%d] should be block at height %d", i, height)
+		}
+	}
+	if n := c.NodeByHeight(50); n == nil || n != tip.Ancestor(50) {
+		t.Errorf("NodeByHeight returned wrong node")
+	}
+}
+
+func TestTipChangeListener(t *testing.T) {
+	c := NewHeaderChain(RegressionNetParams)
+	fork := extend(t, c, c.Tip(), 3, 600)
+	a := extend(t, c, fork, 2, 600)
+	changes := []*TipChange{}
+	c.AddListener(func(change *TipChange) {
+		changes = append(changes, change)
+	})
+	b := extend(t, c, fork, 3, 601)
+	// 2ブロック目で同じwork、3ブロック目でbest chainが切り替わる
+	if len(changes) != 1 {
+		t.Fatalf("expected: %d changes, actual: %d", 1, len(changes))
+	}
+	change := changes[0]
+	if !change.IsReorg() || change.Fork != fork {
+		t.Errorf("reorg from the fork point should be notified")
+	}
+	if len(change.Disconnected) != 2 || change.Disconnected[0] != a || change.Disconnected[1] != a.Parent {
+		t.Errorf("disconnected blocks should be from the old tip: %v", change.Disconnected)
+	}
+	if len(change.Connected) != 3 || change.Connected[2] != b || change.Connected[0].Parent != fork {
+		t.Errorf("connected blocks should be up to the new tip: %v", change.Connected)
+	}
+	extend(t, c, b, 1, 600)
+	if len(changes) != 2 || changes[1].IsReorg() || len(changes[1].Connected) != 1 {
+		t.Errorf("extension of the tip should be notified without reorg")
+	}
+}
+
+// headersOf return the headers from the block after from up to to.
+func headersOf(from, to *HeaderNode) []*message.BlockHeader {
+	headers := []*message.BlockHeader{}
+	for n := to; n != from; n = n.Parent {
+		headers = append([]*message.BlockHeader{n.Header}, headers...)
+	}
+	return headers
+}
+
+func TestCheckpoints(t *testing.T) {
+	base := NewHeaderChain(RegressionNetParams)
+	tip := extend(t, base, base.Tip(), 10, 600)
+	params := *RegressionNetParams
+	params.Checkpoints = []Checkpoint{{Height: 5, Hash: tip.Ancestor(5).Hash}}
+	if params.CheckpointBefore(4) != nil || params.CheckpointBefore(5).Height != 5 || params.CheckpointBefore(10).Height != 5 {
+		t.Errorf("CheckpointBefore should return the checkpoint at or below the height")
+	}
+
+	// checkpointと違うブロックは拒否する
+	c := NewHeaderChain(&params)
+	if err := c.AddHeaders(headersOf(base.Root(), tip.Ancestor(4))); err != nil {
+		t.Fatal(err)
+	}
+	conflict := mine(t, c.Tip(), c.Tip().Header.Timestamp+601, params.PowLimitBits)
+	if _, err := c.AddHeader(conflict); err == nil {
+		t.Errorf("header conflicting with the checkpoint should be rejected")
+	}
+
+	// checkpointを通過した後はそれより前からの分岐を拒否する
+	if err := c.AddHeaders(headersOf(tip.Ancestor(4), tip)); err != nil {
+		t.Fatal(err)
+	}
+	below := mine(t, tip.Ancestor(3), tip.Ancestor(3).Header.Timestamp+601, params.PowLimitBits)
+	if _, err := c.AddHeader(below); err == nil {
+		t.Errorf("fork below the checkpoint should be rejected")
+	}
+	above := mine(t, tip.Ancestor(6), tip.Ancestor(6).Header.Timestamp+601, params.PowLimitBits)
+	if _, err := c.AddHeader(above); err != nil {
+		t.Errorf("fork after the checkpoint should be accepted: %v", err)
+	}
+}
+
+func TestStartFromCheckpoint(t *testing.T) {
+	base := NewHeaderChain(testParams)
+	tip := extend(t, base, base.Tip(), 25, 300)
+	anchor := tip.Ancestor(13)
+	params := *testParams
+	params.Checkpoints = []Checkpoint{{Height: 13, Hash: anchor.Hash}}
+
+	if _, err := NewHeaderChainFromCheckpoint(&params, &params.Checkpoints[0], anchor.Parent.Header); err == nil {
+		t.Errorf("header which doesn't match the checkpoint should be rejected")
+	}
+	c, err := NewHeaderChainFromCheckpoint(&params, &params.Checkpoints[0], anchor.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 高さ20の難易度調整は祖先が無いので検証できないが、その後のブロックは検証する
+	if err := c.AddHeaders(headersOf(anchor, tip)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip().Hash != tip.Hash || c.Tip().Height != 25 {
+		t.Errorf("expected height: %d, actual: %d", 25, c.Tip().Height)
+	}
+	wrongBits := mine(t, c.Tip(), c.Tip().Header.Timestamp+300, params.PowLimitBits)
+	if _, err := c.AddHeader(wrongBits); err == nil {
+		t.Errorf("header with wrong bits should be rejected")
+	}
+	if c.NodeByHeight(12) != nil || c.NodeByHeight(13) != c.Root() || c.NodeByHeight(20).Hash != tip.Ancestor(20).Hash {
+		t.Errorf("NodeByHeight returned wrong node")
+	}
+	locator := c.BlockLocator()
+	if locator[len(locator)-1] != anchor.Hash {
+		t.Errorf("block locator should end with the checkpoint")
+	}
+}
@@ -0,0 +1,75 @@
+package chain
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// Checkpoint means a block in the main chain which is known to be valid.
+// Headers conflicting with checkpoints are rejected, and the header sync
+// can start from a checkpoint instead of the genesis.
+type Checkpoint struct {
+	Height uint32
+	Hash   [32]byte
+}
+
+// String stringify the checkpoint in the form of the checkpoint table.
+func (cp *Checkpoint) String() string {
+	hash := cp.Hash
+	return fmt.Sprintf("{%d, \"%s\"}", cp.Height, hex.EncodeToString(util.ReverseBytes(hash[:])))
+}
+
+func newCheckpoint(height uint32, hash string) Checkpoint {
+	return Checkpoint{Height: height, Hash: mustDecodeHash(hash)}
+}
+
+// testNet3Checkpoints is the checkpoints of testnet3, same as btcd.
+var testNet3Checkpoints = []Checkpoint{
+	newCheckpoint(546, "000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70"),
+	newCheckpoint(100000, "00000000009e2958c15ff9290d571bf9459e93b19765c6801ddeccadbb160a1e"),
+	newCheckpoint(200000, "0000000000287bffd321963ef05feab753ebe274e1d78b2fd4e2bfe9ad3aa6f2"),
+	newCheckpoint(300001, "0000000000004829474748f3d1bc8fcf893c88be255e6d7f571c548aff57abf4"),
+	newCheckpoint(400002, "0000000005e2c73b8ecb82ae2dbc2e8274614ebad7172b53528aba7501f5a089"),
+	newCheckpoint(500011, "00000000000929f63977fbac92ff570a9bd9e7715401ee96f2848f7b07750b02"),
+	newCheckpoint(600002, "000000000001f471389afd6ee94dcace5ccc44adc18e8bff402443f034b07240"),
+	newCheckpoint(700000, "000000000000406178b12a4dea3b27e13b3c4fe4510994fd667d7c1e6a3f4dc1"),
+	newCheckpoint(800010, "000000000017ed35296433190b6829db01e657d80631d43f5983fa403bfdb4c1"),
+	newCheckpoint(900000, "0000000000356f8d8924556e765b7a94aaebc6b5c8685dcfa2b1ee8b41acd89b"),
+	newCheckpoint(1000007, "00000000001ccb893d8a1f25b70ad173ce955e5f50124261bbbc50379a612ddf"),
+	newCheckpoint(1100007, "00000000000abc7b2cd18768ab3dee20857326a818d1946ed6796f42d66dd1e8"),
+	newCheckpoint(1200007, "00000000000004f2dc41845771909db57e04191714ed8c963f7e56713a7b6cea"),
+	newCheckpoint(1300007, "0000000072eab69d54df75107c052b26b0395b44f77578184293bf1bb1dbd9fa"),
+}
+
+// CheckpointBefore return the checkpoint with the highest height at or below the height, or nil if there is none.
+func (p *Params) CheckpointBefore(height uint32) *Checkpoint {
+	var res *Checkpoint
+	for i := range p.Checkpoints {
+		if p.Checkpoints[i].Height <= height {
+			res = &p.Checkpoints[i]
+		}
+	}
+	return res
+}
+
+// CheckpointAt return the checkpoint at the height, or nil if there is none.
+func (p *Params) CheckpointAt(height uint32) *Checkpoint {
+	for i := range p.Checkpoints {
+		if p.Checkpoints[i].Height == height {
+			return &p.Checkpoints[i]
+		}
+	}
+	return nil
+}
+
+// CheckpointByHash return the checkpoint of the hash, or nil if there is none.
+func (p *Params) CheckpointByHash(hash [32]byte) *Checkpoint {
+	for i := range p.Checkpoints {
+		if p.Checkpoints[i].Hash == hash {
+			return &p.Checkpoints[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"encoding/hex"
+	"math/big"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// Params means consensus parameters of the network related to block headers.
+type Params struct {
+	Name          string
+	GenesisHeader *message.BlockHeader
+	PowLimit      *big.Int // 最も低い難易度のtarget
+	PowLimitBits  uint32   // PowLimitのcompact表現
+
+	TargetTimespan time.Duration // 難易度調整の期間
+	TargetSpacing  time.Duration // ブロック生成間隔の目標
+
+	// ReduceMinDifficulty allows the block with PowLimit if it is generated
+	// MinDiffReductionTime after the previous block. (testnet only)
+	ReduceMinDifficulty  bool
+	MinDiffReductionTime time.Duration
+
+	// PowNoRetargeting disables difficulty adjustment. (regtest only)
+	PowNoRetargeting bool
+
+	// Checkpoints must be sorted by height.
+	Checkpoints []Checkpoint
+}
+
+// RetargetInterval return the number of blocks between difficulty adjustments (2016).
+func (p *Params) RetargetInterval() uint32 {
+	return uint32(p.TargetTimespan / p.TargetSpacing)
+}
+
+// genesisMerkleRoot is the merkle root of genesis block which is same in all networks.
+var genesisMerkleRoot = mustDecodeHash("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+
+// TestNet3Params is parameters of testnet3.
+var TestNet3Params = &Params{
+	Name: "testnet3",
+	GenesisHeader: &message.BlockHeader{
+		Version:    1,
+		PrevBlock:  message.ZeroHash,
+		MerkleRoot: genesisMerkleRoot,
+		Timestamp:  1296688602,
+		Bits:       0x1d00ffff,
+		Nonce:      414098458,
+	},
+	PowLimit:             new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 224), big.NewInt(1)),
+	PowLimitBits:         0x1d00ffff,
+	TargetTimespan:       14 * 24 * time.Hour,
+	TargetSpacing:        10 * time.Minute,
+	ReduceMinDifficulty:  true,
+	MinDiffReductionTime: 20 * time.Minute,
+	Checkpoints:          testNet3Checkpoints,
+}
+
+// RegressionNetParams is parameters of regtest.
+var RegressionNetParams = &Params{
+	Name: "regtest",
+	GenesisHeader: &message.BlockHeader{
+		Version:    1,
+		PrevBlock:  message.ZeroHash,
+		MerkleRoot: genesisMerkleRoot,
+		Timestamp:  1296688602,
+		Bits:       0x207fffff,
+		Nonce:      2,
+	},
+	PowLimit:             new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(1)),
+	PowLimitBits:         0x207fffff,
+	TargetTimespan:       14 * 24 * time.Hour,
+	TargetSpacing:        10 * time.Minute,
+	ReduceMinDifficulty:  true,
+	MinDiffReductionTime: 20 * time.Minute,
+	PowNoRetargeting:     true,
+}
+
+// mustDecodeHash decode hash in RPC byte order (reversed) to internal byte order.
+func mustDecodeHash(s string) [32]byte {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		panic("invalid hash: " + s)
+	}
+	var res [32]byte
+	copy(res[:], util.ReverseBytes(b))
+	return res
+}
@@ -0,0 +1,86 @@
+package chain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// CompactToBig convert compact representation of target (bits) to big integer.
+// https://en.bitcoin.it/wiki/Difficulty
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// BigToCompact convert big integer to compact representation of target.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+	// 符号bitと衝突する場合は指数を1つ上げる
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// CalcWork return expected number of hashes to find the block with bits, 2^256 / (target + 1).
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Div(oneLsh256, new(big.Int).Add(target, big.NewInt(1)))
+}
+
+// HashToBig interpret block hash as little endian 256 bit integer.
+func HashToBig(hash [32]byte) *big.Int {
+	return new(big.Int).SetBytes(util.ReverseBytes(hash[:]))
+}
+
+// CheckProofOfWork checks the hash satisfies the target of bits.
+func CheckProofOfWork(hash [32]byte, bits uint32, powLimit *big.Int) error {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("Target %08x is not positive", bits)
+	}
+	if target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("Target %08x is higher than pow limit", bits)
+	}
+	if HashToBig(hash).Cmp(target) > 0 {
+		return fmt.Errorf("Block hash %x is higher than target %08x", util.ReverseBytes(hash[:]), bits)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package chain
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// HeaderFilePath means default path of the header store.
+const HeaderFilePath = "headers.dat"
+
+// headerStore is append only flat file of 80 bytes headers.
+// Headers are written in the order they are accepted, so the parent
+// always comes before its children. The index by hash and height is
+// rebuilt in memory from the file when it is opened.
+// If the chain started from a checkpoint, the first header is the checkpoint.
+type headerStore struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// openHeaderStore open the flat file and read all headers in it.
+// A partially written header at the end of the file is truncated.
+func openHeaderStore(path string) (*headerStore, []*message.BlockHeader, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := []*message.BlockHeader{}
+	reader := bufio.NewReader(file)
+	buf := make([]byte, message.BlockHeaderLen)
+	for {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			file.Close()
+			return nil, nil, err
+		}
+		header, err := message.DecodeBlockHeader(buf)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		headers = append(headers, header)
+	}
+	size := int64(len(headers) * message.BlockHeaderLen)
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &headerStore{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, headers, nil
+}
+
+func (s *headerStore) append(header *message.BlockHeader) error {
+	_, err := s.writer.Write(header.Encode())
+	return err
+}
+
+func (s *headerStore) flush() error {
+	return s.writer.Flush()
+}
+
+func (s *headerStore) close() error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// LoadHeaderChain open the header store at path and restore the chain from it.
+// New headers added to the chain are appended to the store.
+func LoadHeaderChain(params *Params, path string) (*HeaderChain, error) {
+	store, headers, err := openHeaderStore(path)
+	if err != nil {
+		return nil, err
+	}
+	c := NewHeaderChain(params)
+	if len(headers) > 0 {
+		if cp := params.CheckpointByHash(headers[0].BlockHash()); cp != nil {
+			root, err := newCheckpointNode(params, cp, headers[0])
+			if err != nil {
+				store.close()
+				return nil, err
+			}
+			c.setRoot(root)
+			headers = headers[1:]
+		}
+	}
+	for i, header := range headers {
+		if _, err := c.addHeader(header, false); err != nil {
+			store.close()
+			return nil, fmt.Errorf("Header store %s is broken at %d: %v", path, i, err)
+		}
+	}
+	c.store = store
+	return c, nil
+}
+
+// StartFromCheckpoint restart the empty chain from the header of the checkpoint,
+// so the headers before the checkpoint don't need to be downloaded.
+func (c *HeaderChain) StartFromCheckpoint(cp *Checkpoint, header *message.BlockHeader) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.tip != c.root || c.root.Height != 0 {
+		return fmt.Errorf("Chain already has headers up to %d", c.tip.Height)
+	}
+	root, err := newCheckpointNode(c.params, cp, header)
+	if err != nil {
+		return err
+	}
+	if c.store != nil {
+		if err := c.store.append(header); err != nil {
+			return err
+		}
+		if err := c.store.flush(); err != nil {
+			return err
+		}
+	}
+	c.setRoot(root)
+	return nil
+}
+
+// Close flush and close the header store.
+func (c *HeaderChain) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.store == nil {
+		return nil
+	}
+	err := c.store.close()
+	c.store = nil
+	return err
+}
@@ -0,0 +1,106 @@
+package chain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestLoadHeaderChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headerstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers.dat")
+
+	c, err := LoadHeaderChain(RegressionNetParams, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := extend(t, c, c.Tip(), 10, 600)
+	extend(t, c, fork, 2, 601)
+	tip := extend(t, c, fork, 5, 600)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 書き込み途中で落ちた場合を再現する
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 30))
+	f.Close()
+
+	loaded, err := LoadHeaderChain(RegressionNetParams, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Tip().Hash != tip.Hash || loaded.Tip().Height != 15 {
+		t.Errorf("tip should be restored, height: %d", loaded.Tip().Height)
+	}
+	if len(loaded.index) != 1+10+2+5 {
+		t.Errorf("stale branch should be restored, actual: %d", len(loaded.index))
+	}
+	next := extend(t, loaded, loaded.Tip(), 1, 600)
+	loaded.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(18*message.BlockHeaderLen) {
+		t.Errorf("expected: %d bytes, actual: %d", 18*message.BlockHeaderLen, info.Size())
+	}
+	reloaded, err := LoadHeaderChain(RegressionNetParams, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Tip().Hash != next.Hash {
+		t.Errorf("appended header should be restored")
+	}
+}
+
+func TestLoadHeaderChainFromCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headerstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers.dat")
+
+	base := NewHeaderChain(RegressionNetParams)
+	anchor := extend(t, base, base.Tip(), 10, 600)
+	params := *RegressionNetParams
+	params.Checkpoints = []Checkpoint{{Height: 10, Hash: anchor.Hash}}
+
+	c, err := LoadHeaderChain(&params, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartFromCheckpoint(&params.Checkpoints[0], anchor.Header); err != nil {
+		t.Fatal(err)
+	}
+	tip := extend(t, c, c.Tip(), 5, 600)
+	if err := c.StartFromCheckpoint(&params.Checkpoints[0], anchor.Header); err == nil {
+		t.Errorf("chain with headers should not be restarted")
+	}
+	c.Close()
+
+	loaded, err := LoadHeaderChain(&params, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if loaded.Root().Hash != anchor.Hash || loaded.Root().Height != 10 {
+		t.Errorf("chain should start from the checkpoint, height: %d", loaded.Root().Height)
+	}
+	if loaded.Tip().Hash != tip.Hash || loaded.Tip().Height != 15 {
+		t.Errorf("tip should be restored, height: %d", loaded.Tip().Height)
+	}
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// startFromCheckpoint start the empty header chain from the checkpoint which the wallet is scanned after,
+// so the headers before it are not downloaded.
+// It does nothing if the chain already has headers or the network has no checkpoint.
+func startFromCheckpoint(p *Peer, c *chain.HeaderChain, headersCh chan *message.Headers) error {
+	cp := scanCheckpoint(c.Params())
+	if cp == nil || c.Tip() != c.Root() || c.Root().Height != 0 {
+		return nil
+	}
+	header, err := fetchHeader(p, cp.Hash, headersCh)
+	if err != nil {
+		return err
+	}
+	if err := c.StartFromCheckpoint(cp, header); err != nil {
+		return err
+	}
+	fmt.Printf("Header sync starts from checkpoint %d\n", cp.Height)
+	return nil
+}
+
+// fetchHeader download the header of the block.
+// getheaders with empty block locator returns only the header of hashStop.
+func fetchHeader(p *Peer, hash [32]byte, headersCh chan *message.Headers) (*message.BlockHeader, error) {
+	if err := p.SendMessage(message.NewGetHeaders(message.ProtocolVersion, [][32]byte{}, hash)); err != nil {
+		return nil, err
+	}
+	select {
+	case headers := <-headersCh:
+		if len(headers.Headers) != 1 || headers.Headers[0].BlockHash() != hash {
+			p.Misbehaving(20, "unexpected headers for hashStop")
+			return nil, fmt.Errorf("Peer didn't return the requested header")
+		}
+		return headers.Headers[0], nil
+	case <-p.quit:
+		return nil, fmt.Errorf("Peer disconnected during header sync")
+	case <-time.After(headersTimeout):
+		return nil, fmt.Errorf("Header sync timed out")
+	}
+}
+
+// ExportCheckpoint print the tip of the synced header chain in the form of the checkpoint table.
+func ExportCheckpoint() error {
+	c, err := chain.LoadHeaderChain(chain.TestNet3Params, chain.HeaderFilePath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tip := c.Tip()
+	if tip == c.Root() {
+		fmt.Println("No headers synced, run balance first")
+		return nil
+	}
+	cp := &chain.Checkpoint{Height: tip.Height, Hash: tip.Hash}
+	fmt.Printf("%s // %s\n", cp.String(), time.Unix(int64(tip.Header.Timestamp), 0).UTC().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,353 @@
+package protocol
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"sort"
+)
+
+const (
+	// dustThreshold means the smallest change which is worth creating, Core's dust limit of P2PKH.
+	dustThreshold = 546
+	// bnbMaxTries follows bitcoin core's TOTAL_TRIES of branch and bound.
+	bnbMaxTries = 100000
+	// knapsackIterations follows bitcoin core's ApproximateBestSubset.
+	knapsackIterations = 1000
+)
+
+// CoinSelectionParams means the amount to select and the fee costs of inputs and change.
+type CoinSelectionParams struct {
+	Target          uint64 // 送金額と入力以外の手数料
+	FeeRate         uint64 // 今の手数料率 sat/vB
+	LongTermFeeRate uint64 // 後で入力を使う時の手数料率、wasteの計算に使う
+	InputSize       uint64 // 入力1つのvsize
+	ChangeFee       uint64 // おつりの出力を追加する手数料
+	CostOfChange    uint64 // おつりの出力を作って後で使うまでの手数料
+	MinChange       uint64 // これ未満のおつりは作らず手数料にする
+}
+
+// inputFee return the fee to spend an input at the fee rate.
+func (p *CoinSelectionParams) inputFee() uint64 {
+	return p.FeeRate * p.InputSize
+}
+
+// inputWaste return the extra fee to spend an input now rather than at the long term fee rate.
+// It is negative when the fee rate is lower than the long term.
+func (p *CoinSelectionParams) inputWaste() int64 {
+	return int64(p.FeeRate*p.InputSize) - int64(p.LongTermFeeRate*p.InputSize)
+}
+
+// changeTarget return the least excess which can create change.
+func (p *CoinSelectionParams) changeTarget() uint64 {
+	return p.ChangeFee + p.MinChange
+}
+
+// effectiveValue return the value of the output minus the fee to spend it.
+func (p *CoinSelectionParams) effectiveValue(u *utxo) int64 {
+	return int64(u.value()) - int64(p.inputFee())
+}
+
+// CoinSelection means the inputs selected for the target and the change.
+type CoinSelection struct {
+	Inputs []*utxo
+	Value  uint64 // 入力の合計
+	Fee    uint64 // 入力とおつりの手数料、おつりにしない端数も含む
+	Change uint64 // 0ならおつりを作らない
+	Waste  int64
+}
+
+// newCoinSelection decide the change of the inputs and calculate the waste.
+// The waste follows bitcoin core's GetSelectionWaste, the extra fee of inputs
+// against the long term fee rate plus the cost of change or the excess given up as fee.
+func newCoinSelection(inputs []*utxo, params *CoinSelectionParams, allowChange bool) *CoinSelection {
+	s := &CoinSelection{Inputs: inputs}
+	effective := int64(0)
+	for _, u := range inputs {
+		s.Value += u.value()
+		effective += params.effectiveValue(u)
+		s.Waste += params.inputWaste()
+	}
+	s.Fee = params.inputFee() * uint64(len(inputs))
+	excess := uint64(effective - int64(params.Target))
+	if allowChange && excess >= params.changeTarget() {
+		s.Change = excess - params.ChangeFee
+		s.Fee += params.ChangeFee
+		s.Waste += int64(params.CostOfChange)
+	} else {
+		s.Fee += excess
+		s.Waste += int64(excess)
+	}
+	return s
+}
+
+// CoinSelector choose the outputs of the wallet to fund the target.
+type CoinSelector interface {
+	Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error)
+}
+
+// coinSelectors means the strategies which can be chosen by name.
+var coinSelectors = map[string]CoinSelector{
+	"bnb":      branchAndBound{},
+	"knapsack": knapsack{},
+	"srd":      singleRandomDraw{},
+	"largest":  largestFirst{},
+}
+
+// NewCoinSelector return the coin selection strategy of the name.
+// "auto" tries bnb, knapsack and srd like bitcoin core, and takes the selection with the least waste.
+func NewCoinSelector(name string) (CoinSelector, error) {
+	if name == "auto" {
+		return autoSelector{selectors: []CoinSelector{branchAndBound{}, knapsack{}, singleRandomDraw{}}}, nil
+	}
+	if selector, ok := coinSelectors[name]; ok {
+		return selector, nil
+	}
+	return nil, fmt.Errorf("Unknown coin selection %s, use auto, bnb, knapsack, srd or largest", name)
+}
+
+// errInsufficientFunds return the error when the outputs can't fund the target.
+func errInsufficientFunds(utxos []*utxo, params *CoinSelectionParams) error {
+	balance := int64(0)
+	for _, u := range utxos {
+		if v := params.effectiveValue(u); v > 0 {
+			balance += v
+		}
+	}
+	return fmt.Errorf("Balance is not enough, spendable: %d, target: %d", balance, params.Target)
+}
+
+// spendableUTXOs return the outputs worth more than the fee to spend them, in descending order of effective value.
+func spendableUTXOs(utxos []*utxo, params *CoinSelectionParams) []*utxo {
+	res := []*utxo{}
+	for _, u := range utxos {
+		if params.effectiveValue(u) > 0 {
+			res = append(res, u)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return params.effectiveValue(res[i]) > params.effectiveValue(res[j])
+	})
+	return res
+}
+
+type autoSelector struct {
+	selectors []CoinSelector
+}
+
+func (a autoSelector) Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error) {
+	var best *CoinSelection
+	var lastErr error
+	for _, selector := range a.selectors {
+		s, err := selector.Select(utxos, params)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// wasteが同じなら入力の多い方が後の手数料を減らせる
+		if best == nil || s.Waste < best.Waste || (s.Waste == best.Waste && len(s.Inputs) > len(best.Inputs)) {
+			best = s
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// branchAndBound searches the changeless selection which effective value is between
+// the target and the target plus the cost of change, with the least waste.
+// https://github.com/bitcoin/bitcoin/blob/master/src/wallet/coinselection.cpp
+type branchAndBound struct{}
+
+func (branchAndBound) Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error) {
+	pool := spendableUTXOs(utxos, params)
+	s := &bnbSearch{
+		values:     make([]int64, len(pool)),
+		target:     int64(params.Target),
+		upper:      int64(params.Target + params.CostOfChange),
+		inputWaste: params.inputWaste(),
+	}
+	available := int64(0)
+	for i, u := range pool {
+		s.values[i] = params.effectiveValue(u)
+		available += s.values[i]
+	}
+	if available < s.target {
+		return nil, errInsufficientFunds(utxos, params)
+	}
+	s.search(0, 0, available, 0)
+	if s.best == nil {
+		return nil, fmt.Errorf("No changeless selection is found")
+	}
+	inputs := []*utxo{}
+	for _, i := range s.best {
+		inputs = append(inputs, pool[i])
+	}
+	return newCoinSelection(inputs, params, false), nil
+}
+
+type bnbSearch struct {
+	values     []int64 // 実効値の降順
+	target     int64
+	upper      int64
+	inputWaste int64
+	tries      int
+	selected   []int
+	best       []int
+	bestWaste  int64
+}
+
+// search decide whether to include the i-th output with depth first search.
+// available means the sum of the outputs not decided yet.
+func (s *bnbSearch) search(i int, value, available, waste int64) {
+	if s.tries >= bnbMaxTries {
+		return
+	}
+	s.tries++
+	if value+available < s.target || value > s.upper {
+		return
+	}
+	// 手数料率が長期より高い間は入力を増やすほどwasteが増える
+	if s.inputWaste > 0 && s.best != nil && waste > s.bestWaste {
+		return
+	}
+	if value >= s.target {
+		if total := waste + value - s.target; s.best == nil || total <= s.bestWaste {
+			s.best = append([]int{}, s.selected...)
+			s.bestWaste = total
+		}
+		return
+	}
+	if i >= len(s.values) {
+		return
+	}
+	v := s.values[i]
+	s.selected = append(s.selected, i)
+	s.search(i+1, value+v, available-v, waste+s.inputWaste)
+	s.selected = s.selected[:len(s.selected)-1]
+	// 同じ値の出力を除外する枝は含める枝と同じ結果になるのでまとめて除外する
+	next := i + 1
+	available -= v
+	for next < len(s.values) && s.values[next] == v {
+		available -= s.values[next]
+		next++
+	}
+	s.search(next, value, available, waste)
+}
+
+// knapsack follows bitcoin core's KnapsackSolver. It takes an exact match if any,
+// otherwise the random subset of smaller outputs closest to the target plus min change,
+// or the smallest larger output if it is closer.
+type knapsack struct{}
+
+func (knapsack) Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error) {
+	target := int64(params.Target)
+	changeTarget := int64(params.changeTarget())
+	var lowestLarger *utxo
+	smaller := []*utxo{}
+	smallerValues := []int64{}
+	total := int64(0)
+	for _, u := range spendableUTXOs(utxos, params) {
+		v := params.effectiveValue(u)
+		switch {
+		case v == target:
+			return newCoinSelection([]*utxo{u}, params, true), nil
+		case v < target+changeTarget:
+			smaller = append(smaller, u)
+			smallerValues = append(smallerValues, v)
+			total += v
+		case lowestLarger == nil || v < params.effectiveValue(lowestLarger):
+			lowestLarger = u
+		}
+	}
+	if total == target {
+		return newCoinSelection(smaller, params, true), nil
+	}
+	if total < target {
+		if lowestLarger == nil {
+			return nil, errInsufficientFunds(utxos, params)
+		}
+		return newCoinSelection([]*utxo{lowestLarger}, params, true), nil
+	}
+
+	best, bestValue := approximateBestSubset(smallerValues, total, target)
+	if bestValue != target && total >= target+changeTarget {
+		best, bestValue = approximateBestSubset(smallerValues, total, target+changeTarget)
+	}
+	// 小さい出力の組み合わせでおつりを作れず、大きい出力の方が近い場合
+	if lowestLarger != nil && ((bestValue != target && bestValue < target+changeTarget) || params.effectiveValue(lowestLarger) <= bestValue) {
+		return newCoinSelection([]*utxo{lowestLarger}, params, true), nil
+	}
+	inputs := []*utxo{}
+	for i, included := range best {
+		if included {
+			inputs = append(inputs, smaller[i])
+		}
+	}
+	return newCoinSelection(inputs, params, true), nil
+}
+
+// approximateBestSubset return the random subset of the values which sum is the least at or above the target.
+// values must be sorted in descending order and sum up to total.
+func approximateBestSubset(values []int64, total, target int64) ([]bool, int64) {
+	best := make([]bool, len(values))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := total
+	for rep := 0; rep < knapsackIterations && bestValue != target; rep++ {
+		included := make([]bool, len(values))
+		value := int64(0)
+		reached := false
+		// 1周目はランダムに、2周目は残りを順に加える
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i, v := range values {
+				if included[i] || (pass == 0 && mrand.Intn(2) == 0) {
+					continue
+				}
+				value += v
+				included[i] = true
+				if value >= target {
+					reached = true
+					if value < bestValue {
+						bestValue = value
+						copy(best, included)
+					}
+					value -= v
+					included[i] = false
+				}
+			}
+		}
+	}
+	return best, bestValue
+}
+
+// singleRandomDraw adds the outputs in random order until they fund the target and change.
+type singleRandomDraw struct{}
+
+func (singleRandomDraw) Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error) {
+	pool := spendableUTXOs(utxos, params)
+	mrand.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+	return accumulate(pool, utxos, params, params.Target+params.changeTarget())
+}
+
+// largestFirst adds the outputs in descending order of effective value until they fund the target.
+type largestFirst struct{}
+
+func (largestFirst) Select(utxos []*utxo, params *CoinSelectionParams) (*CoinSelection, error) {
+	return accumulate(spendableUTXOs(utxos, params), utxos, params, params.Target)
+}
+
+// accumulate select the outputs of the pool in order until the effective value reaches the goal.
+func accumulate(pool, utxos []*utxo, params *CoinSelectionParams, goal uint64) (*CoinSelection, error) {
+	inputs := []*utxo{}
+	value := int64(0)
+	for _, u := range pool {
+		inputs = append(inputs, u)
+		value += params.effectiveValue(u)
+		if value >= int64(goal) {
+			return newCoinSelection(inputs, params, true), nil
+		}
+	}
+	return nil, errInsufficientFunds(utxos, params)
+}
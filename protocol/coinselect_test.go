@@ -0,0 +1,122 @@
+package protocol
+
+import "testing"
+
+// testUTXOs create the outputs of the values.
+func testUTXOs(values ...uint64) []*utxo {
+	utxos := []*utxo{}
+	for i, v := range values {
+		utxos = append(utxos, &utxo{tx: p2pkhTx([32]byte{byte(i + 1)}, v), index: 0})
+	}
+	return utxos
+}
+
+func selectedValues(s *CoinSelection) []uint64 {
+	values := []uint64{}
+	for _, u := range s.Inputs {
+		values = append(values, u.value())
+	}
+	return values
+}
+
+// testSelectionParams means 1 sat/vB now and 3 sat/vB in the long term, so more inputs are cheaper.
+func testSelectionParams(target uint64) *CoinSelectionParams {
+	return &CoinSelectionParams{
+		Target:          target,
+		FeeRate:         1,
+		LongTermFeeRate: 3,
+		InputSize:       100,
+		ChangeFee:       34,
+		CostOfChange:    34 + 100*3,
+		MinChange:       dustThreshold,
+	}
+}
+
+func TestBranchAndBound(t *testing.T) {
+	utxos := testUTXOs(1100, 2100, 3100, 5100)
+	// 実効値は1000, 2000, 3000, 5000
+	s, err := branchAndBound{}.Select(utxos, testSelectionParams(6000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Change != 0 || s.Value-s.Fee != 6000 {
+		t.Errorf("exact changeless selection is expected: %+v", s)
+	}
+	// 長期の手数料率が高いので入力の多い1000+2000+3000を選ぶ
+	if len(s.Inputs) != 3 {
+		t.Errorf("selection with more inputs has less waste: %v", selectedValues(s))
+	}
+	if s.Waste != -600 {
+		t.Errorf("expected waste -600, actual %d", s.Waste)
+	}
+
+	if _, err := (branchAndBound{}).Select(utxos, testSelectionParams(500)); err == nil {
+		t.Errorf("no changeless selection should be found for 500")
+	}
+	if _, err := (branchAndBound{}).Select(utxos, testSelectionParams(20000)); err == nil {
+		t.Errorf("insufficient funds should be error")
+	}
+}
+
+func TestKnapsack(t *testing.T) {
+	params := testSelectionParams(3000)
+	s, err := knapsack{}.Select(testUTXOs(1100, 2100, 3100, 5100), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Inputs) != 1 || s.Inputs[0].value() != 3100 {
+		t.Errorf("exact match should be selected: %v", selectedValues(s))
+	}
+
+	// 小さい出力だけでは足りないので一番小さい大きな出力
+	s, err = knapsack{}.Select(testUTXOs(1100, 1100, 10100, 20100), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Inputs) != 1 || s.Inputs[0].value() != 10100 {
+		t.Errorf("lowest larger output should be selected: %v", selectedValues(s))
+	}
+	if s.Change != 10000-3000-params.ChangeFee {
+		t.Errorf("unexpected change %d", s.Change)
+	}
+}
+
+func TestSelectorsFundTarget(t *testing.T) {
+	utxos := testUTXOs(1100, 2100, 3100, 5100, 8100, 13100)
+	for _, name := range []string{"auto", "bnb", "knapsack", "srd", "largest"} {
+		selector, err := NewCoinSelector(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := testSelectionParams(7000)
+		s, err := selector.Select(utxos, params)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if s.Value != 7000+s.Fee+s.Change {
+			t.Errorf("%s: value should be target + fee + change: %+v", name, s)
+		}
+		if s.Change != 0 && s.Change < params.MinChange {
+			t.Errorf("%s: change below min change: %d", name, s.Change)
+		}
+	}
+	if _, err := NewCoinSelector("unknown"); err == nil {
+		t.Errorf("unknown selector should be error")
+	}
+}
+
+func TestLargestFirst(t *testing.T) {
+	s, err := largestFirst{}.Select(testUTXOs(1100, 5100, 3100), testSelectionParams(7000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := selectedValues(s)
+	if len(values) != 2 || values[0] != 5100 || values[1] != 3100 {
+		t.Errorf("largest outputs should be selected first: %v", values)
+	}
+	// 入力の手数料より小さい出力は使わない
+	if _, err := (largestFirst{}).Select(testUTXOs(50, 80), testSelectionParams(10)); err == nil {
+		t.Errorf("uneconomical outputs should not be selected")
+	}
+}
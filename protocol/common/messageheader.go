@@ -32,6 +32,11 @@ func DecodeMessageHeader(b [MessageHeaderLen]byte) *MessageHeader {
 	}
 }
 
+// CommandName return command name of the message without trailing NUL bytes.
+func (header *MessageHeader) CommandName() string {
+	return string(bytes.TrimRight(header.Command[:], "\x00"))
+}
+
 // Encode encode messageheader.
 func (header *MessageHeader) Encode() []byte {
 	var (
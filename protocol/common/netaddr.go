@@ -2,8 +2,16 @@ package common
 
 import (
 	"encoding/binary"
+	"net"
+	"strconv"
 )
 
+// NetAddrLen means NetAddr's byte length (without timestamp).
+const NetAddrLen = 26
+
+// TimedNetAddrLen means TimedNetAddr's byte length.
+const TimedNetAddrLen = 30
+
 // NetAddr means network address.
 type NetAddr struct {
 	Services uint64   // versionのserviceと同様
@@ -11,6 +19,17 @@ type NetAddr struct {
 	Port     uint16   // ポート番号 big endian
 }
 
+// NewNetAddr create NetAddr from net.IP and port.
+func NewNetAddr(services uint64, ip net.IP, port uint16) *NetAddr {
+	var arr [16]byte
+	copy(arr[:], ip.To16())
+	return &NetAddr{
+		Services: services,
+		IP:       arr,
+		Port:     port,
+	}
+}
+
 // DecodeNetAddr decodes byte array to NetAddr
 func DecodeNetAddr(b [26]byte) *NetAddr {
 	var ip [16]byte
@@ -30,3 +49,55 @@ func (addr *NetAddr) Encode() [26]byte {
 	binary.BigEndian.PutUint16(b[24:26], addr.Port)
 	return b
 }
+
+// String return "host:port" style string of the address.
+func (addr *NetAddr) String() string {
+	return net.JoinHostPort(net.IP(addr.IP[:]).String(), strconv.Itoa(int(addr.Port)))
+}
+
+// TimedNetAddr means network address with timestamp used in addr message.
+// https://en.bitcoin.it/wiki/Protocol_documentation#Network_address
+type TimedNetAddr struct {
+	Timestamp uint32 // 最後にそのノードを見かけたUNIXタイムスタンプ
+	NetAddr   *NetAddr
+}
+
+// DecodeTimedNetAddr decodes byte array to TimedNetAddr.
+func DecodeTimedNetAddr(b [TimedNetAddrLen]byte) *TimedNetAddr {
+	var addr [NetAddrLen]byte
+	copy(addr[:], b[4:])
+	return &TimedNetAddr{
+		Timestamp: binary.LittleEndian.Uint32(b[0:4]),
+		NetAddr:   DecodeNetAddr(addr),
+	}
+}
+
+// Encode encode TimedNetAddr to byte array.
+func (addr *TimedNetAddr) Encode() [TimedNetAddrLen]byte {
+	var b [TimedNetAddrLen]byte
+	binary.LittleEndian.PutUint32(b[0:4], addr.Timestamp)
+	netAddr := addr.NetAddr.Encode()
+	copy(b[4:], netAddr[:])
+	return b
+}
+
+// ToV2 convert TimedNetAddr to BIP155 NetAddrV2.
+func (addr *TimedNetAddr) ToV2() *NetAddrV2 {
+	ip := net.IP(addr.NetAddr.IP[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		return &NetAddrV2{
+			Timestamp: addr.Timestamp,
+			Services:  addr.NetAddr.Services,
+			NetworkID: NetworkIPv4,
+			Addr:      []byte(ip4),
+			Port:      addr.NetAddr.Port,
+		}
+	}
+	return &NetAddrV2{
+		Timestamp: addr.Timestamp,
+		Services:  addr.NetAddr.Services,
+		NetworkID: NetworkIPv6,
+		Addr:      append([]byte{}, addr.NetAddr.IP[:]...),
+		Port:      addr.NetAddr.Port,
+	}
+}
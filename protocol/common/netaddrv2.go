@@ -0,0 +1,179 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	// NetworkIPv4 means BIP155 network id of IPv4.
+	NetworkIPv4 = uint8(1)
+
+	// NetworkIPv6 means BIP155 network id of IPv6.
+	NetworkIPv6 = uint8(2)
+
+	// NetworkTorV2 means BIP155 network id of Tor v2 (deprecated).
+	NetworkTorV2 = uint8(3)
+
+	// NetworkTorV3 means BIP155 network id of Tor v3.
+	NetworkTorV3 = uint8(4)
+
+	// NetworkI2P means BIP155 network id of I2P.
+	NetworkI2P = uint8(5)
+
+	// NetworkCJDNS means BIP155 network id of CJDNS.
+	NetworkCJDNS = uint8(6)
+
+	// MaxNetAddrV2AddrLen means the max length of address in addrv2 message.
+	MaxNetAddrV2AddrLen = 512
+)
+
+// netAddrV2Lengths means the address length of each known network.
+var netAddrV2Lengths = map[uint8]int{
+	NetworkIPv4:  4,
+	NetworkIPv6:  16,
+	NetworkTorV2: 10,
+	NetworkTorV3: 32,
+	NetworkI2P:   32,
+	NetworkCJDNS: 16,
+}
+
+// NetAddrV2 means network address used in addrv2 message.
+// https://github.com/bitcoin/bips/blob/master/bip-0155.mediawiki
+type NetAddrV2 struct {
+	Timestamp uint32 // 最後にそのノードを見かけたUNIXタイムスタンプ
+	Services  uint64 // versionのserviceと同様、CompactSizeでエンコードされる
+	NetworkID uint8  // アドレスのネットワーク種別
+	Addr      []byte // ネットワーク種別ごとのアドレス
+	Port      uint16 // ポート番号 big endian
+}
+
+// DecodeNetAddrV2 decode byte slice to NetAddrV2.
+func DecodeNetAddrV2(b []byte) (*NetAddrV2, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Decode NetAddrV2 failed, invalid input: %v", b)
+	}
+	timestamp := binary.LittleEndian.Uint32(b[0:4])
+	b = b[4:]
+
+	services, err := DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	b = b[len(services.Encode()):]
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Decode NetAddrV2 failed, missing network id")
+	}
+	networkID := b[0]
+	b = b[1:]
+
+	addr, err := DecodeVarStr(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(addr.Data) > MaxNetAddrV2AddrLen {
+		return nil, fmt.Errorf("Decode NetAddrV2 failed, address too long: %d", len(addr.Data))
+	}
+	if expected, ok := netAddrV2Lengths[networkID]; ok && expected != len(addr.Data) {
+		return nil, fmt.Errorf("Decode NetAddrV2 failed, invalid address length %d for network %d", len(addr.Data), networkID)
+	}
+	b = b[len(addr.Encode()):]
+	if len(b) < 2 {
+		return nil, fmt.Errorf("Decode NetAddrV2 failed, missing port")
+	}
+	return &NetAddrV2{
+		Timestamp: timestamp,
+		Services:  services.Data,
+		NetworkID: networkID,
+		Addr:      addr.Data,
+		Port:      binary.BigEndian.Uint16(b[0:2]),
+	}, nil
+}
+
+// Encode encode NetAddrV2 to byte slice.
+func (addr *NetAddrV2) Encode() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, addr.Timestamp)
+	b = append(b, NewVarInt(addr.Services).Encode()...)
+	b = append(b, addr.NetworkID)
+	b = append(b, NewVarStr(addr.Addr).Encode()...)
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, addr.Port)
+	return append(b, port...)
+}
+
+// IsKnownNetwork checks the address belongs to the network we understand.
+func (addr *NetAddrV2) IsKnownNetwork() bool {
+	expected, ok := netAddrV2Lengths[addr.NetworkID]
+	return ok && expected == len(addr.Addr)
+}
+
+// ToV1 convert NetAddrV2 to legacy NetAddr.
+// Only IPv4 and IPv6 address can be converted.
+func (addr *NetAddrV2) ToV1() (*TimedNetAddr, error) {
+	switch addr.NetworkID {
+	case NetworkIPv4, NetworkIPv6:
+		return &TimedNetAddr{
+			Timestamp: addr.Timestamp,
+			NetAddr:   NewNetAddr(addr.Services, net.IP(addr.Addr), addr.Port),
+		}, nil
+	}
+	return nil, fmt.Errorf("Network %d can not be converted to legacy address", addr.NetworkID)
+}
+
+// Host return host part of the address.
+func (addr *NetAddrV2) Host() string {
+	switch addr.NetworkID {
+	case NetworkIPv4, NetworkIPv6:
+		return net.IP(addr.Addr).String()
+	case NetworkTorV3:
+		return EncodeOnionV3(addr.Addr)
+	}
+	return hex.EncodeToString(addr.Addr)
+}
+
+// ParseNetAddrV2 parse "host:port" style string (IPv4, IPv6 or Tor v3 onion) to NetAddrV2.
+func ParseNetAddrV2(hostport string, services uint64) (*NetAddrV2, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s: %v", portStr, err)
+	}
+	addr := &NetAddrV2{
+		Services: services,
+		Port:     uint16(port),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			addr.NetworkID = NetworkIPv4
+			addr.Addr = []byte(ip4)
+		} else {
+			addr.NetworkID = NetworkIPv6
+			addr.Addr = []byte(ip.To16())
+		}
+		return addr, nil
+	}
+	pubKey, err := DecodeOnionV3(host)
+	if err != nil {
+		return nil, err
+	}
+	addr.NetworkID = NetworkTorV3
+	addr.Addr = pubKey
+	return addr, nil
+}
+
+// String return "host:port" style string of the address.
+func (addr *NetAddrV2) String() string {
+	return net.JoinHostPort(addr.Host(), strconv.Itoa(int(addr.Port)))
+}
+
+// Key return the key which identify the address regardless of timestamp and services.
+func (addr *NetAddrV2) Key() string {
+	return fmt.Sprintf("%d/%s", addr.NetworkID, addr.String())
+}
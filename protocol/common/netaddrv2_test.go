@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNetAddrV2Encode(t *testing.T) {
+	addr := &NetAddrV2{
+		Timestamp: uint32(0x01020304),
+		Services:  uint64(1),
+		NetworkID: NetworkIPv4,
+		Addr:      []byte{0x7F, 0x00, 0x00, 0x01},
+		Port:      uint16(8333),
+	}
+	expected := []byte{
+		0x04, 0x03, 0x02, 0x01, // time
+		0x01,                         // services
+		0x01,                         // network id
+		0x04, 0x7F, 0x00, 0x00, 0x01, // addr
+		0x20, 0x8D, // port
+	}
+	if !bytes.Equal(addr.Encode(), expected) {
+		t.Errorf("expected: %x, actual: %x", expected, addr.Encode())
+	}
+	decoded, err := DecodeNetAddrV2(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != "127.0.0.1:8333" {
+		t.Errorf("expected: %s, actual: %s", "127.0.0.1:8333", decoded.String())
+	}
+}
+
+func TestDecodeNetAddrV2InvalidLength(t *testing.T) {
+	b := []byte{
+		0x00, 0x00, 0x00, 0x00,
+		0x01,
+		0x01,
+		0x05, 0x7F, 0x00, 0x00, 0x01, 0x01, // IPv4 with 5 bytes
+		0x20, 0x8D,
+	}
+	if _, err := DecodeNetAddrV2(b); err == nil {
+		t.Errorf("DecodeNetAddrV2 should fail for invalid IPv4 length")
+	}
+}
+
+func TestTimedNetAddrToV2(t *testing.T) {
+	addr := &TimedNetAddr{
+		Timestamp: uint32(1),
+		NetAddr:   NewNetAddr(uint64(1), net.ParseIP("192.168.0.1"), 18333),
+	}
+	encoded := addr.Encode()
+	decoded := DecodeTimedNetAddr(encoded)
+	v2 := decoded.ToV2()
+	if v2.NetworkID != NetworkIPv4 || v2.String() != "192.168.0.1:18333" {
+		t.Errorf("expected: %s, actual: %s", "192.168.0.1:18333", v2.String())
+	}
+	v1, err := v2.ToV1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.NetAddr.IP != addr.NetAddr.IP {
+		t.Errorf("expected: %v, actual: %v", addr.NetAddr.IP, v1.NetAddr.IP)
+	}
+}
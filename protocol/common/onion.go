@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// OnionV3PubKeyLen means length of ed25519 public key in Tor v3 address.
+	OnionV3PubKeyLen = 32
+
+	onionV3Version  = byte(0x03)
+	onionSuffix     = ".onion"
+	onionChecksumID = ".onion checksum"
+)
+
+var onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// onionV3Checksum calculate checksum of Tor v3 address.
+// CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+// https://gitlab.torproject.org/tpo/core/torspec/-/blob/main/rend-spec-v3.txt
+func onionV3Checksum(pubKey []byte) []byte {
+	h := sha3.Sum256(bytes.Join([][]byte{
+		[]byte(onionChecksumID),
+		pubKey,
+		[]byte{onionV3Version},
+	}, []byte{}))
+	return h[:2]
+}
+
+// EncodeOnionV3 encode ed25519 public key to Tor v3 ".onion" host name.
+func EncodeOnionV3(pubKey []byte) string {
+	b := bytes.Join([][]byte{
+		pubKey,
+		onionV3Checksum(pubKey),
+		[]byte{onionV3Version},
+	}, []byte{})
+	return strings.ToLower(onionEncoding.EncodeToString(b)) + onionSuffix
+}
+
+// DecodeOnionV3 decode Tor v3 ".onion" host name to ed25519 public key.
+func DecodeOnionV3(host string) ([]byte, error) {
+	if !strings.HasSuffix(host, onionSuffix) {
+		return nil, fmt.Errorf("Not an onion address: %s", host)
+	}
+	b, err := onionEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(host, onionSuffix)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid onion address %s: %v", host, err)
+	}
+	if len(b) != OnionV3PubKeyLen+3 {
+		return nil, fmt.Errorf("Only Tor v3 onion address is supported: %s", host)
+	}
+	pubKey := b[:OnionV3PubKeyLen]
+	if b[OnionV3PubKeyLen+2] != onionV3Version {
+		return nil, fmt.Errorf("Invalid onion address version %d: %s", b[OnionV3PubKeyLen+2], host)
+	}
+	if !bytes.Equal(b[OnionV3PubKeyLen:OnionV3PubKeyLen+2], onionV3Checksum(pubKey)) {
+		return nil, fmt.Errorf("Invalid onion address checksum: %s", host)
+	}
+	return pubKey, nil
+}
+
+// IsOnion checks the address is Tor address.
+func (addr *NetAddrV2) IsOnion() bool {
+	return addr.NetworkID == NetworkTorV3 || addr.NetworkID == NetworkTorV2
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOnionV3RoundTrip(t *testing.T) {
+	pubKey := make([]byte, OnionV3PubKeyLen)
+	for i := range pubKey {
+		pubKey[i] = byte(i)
+	}
+	host := EncodeOnionV3(pubKey)
+	if len(host) != 56+len(".onion") {
+		t.Errorf("invalid onion address length: %s", host)
+	}
+	decoded, err := DecodeOnionV3(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, pubKey) {
+		t.Errorf("expected: %x, actual: %x", pubKey, decoded)
+	}
+
+	addr, err := ParseNetAddrV2(host+":18333", uint64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.NetworkID != NetworkTorV3 || addr.String() != host+":18333" {
+		t.Errorf("expected: %s, actual: %s", host+":18333", addr.String())
+	}
+}
+
+func TestDecodeOnionV3InvalidChecksum(t *testing.T) {
+	host := EncodeOnionV3(make([]byte, OnionV3PubKeyLen))
+	// 公開鍵部分の先頭1文字を書き換える
+	broken := "b" + host[1:]
+	if _, err := DecodeOnionV3(broken); err == nil {
+		t.Errorf("DecodeOnionV3 should reject invalid checksum: %s", broken)
+	}
+}
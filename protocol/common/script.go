@@ -3,6 +3,7 @@ package common
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 )
 
@@ -21,6 +22,27 @@ const (
 
 	// OpCheckSig checks signature.
 	OpCheckSig = 0xac
+
+	// OpCheckMultiSig checks m of n signatures.
+	OpCheckMultiSig = 0xae
+
+	// OpPushData1 push data which length is the next byte.
+	OpPushData1 = 0x4c
+
+	// OpPushData2 push data which length is the next 2 bytes.
+	OpPushData2 = 0x4d
+
+	// OpPushData4 push data which length is the next 4 bytes.
+	OpPushData4 = 0x4e
+
+	// Op1 push number 1, Op2 to Op16 follow it.
+	Op1 = 0x51
+
+	// Op16 push number 16.
+	Op16 = 0x60
+
+	// OpReturn marks the output as unspendable, used to store data.
+	OpReturn = 0x6a
 )
 
 // OpPushData return script to push data.
@@ -61,3 +83,83 @@ func OpPushData(data []byte) []byte {
 	// TODO: error if data is too large
 	return []byte{}
 }
+
+// ScriptOp means an opcode of the script and the data it pushes.
+type ScriptOp struct {
+	Opcode byte
+	Data   []byte // push以外の命令ではnil
+}
+
+// ParseScript split the script into opcodes.
+// If the script is malformed, it returns the opcodes parsed before the error.
+func ParseScript(script []byte) ([]*ScriptOp, error) {
+	ops := []*ScriptOp{}
+	for len(script) > 0 {
+		opcode := script[0]
+		script = script[1:]
+		var size int
+		switch {
+		case opcode >= 0x01 && opcode <= 0x4b:
+			size = int(opcode)
+		case opcode == OpPushData1:
+			if len(script) < 1 {
+				return ops, fmt.Errorf("Script is truncated at OP_PUSHDATA1")
+			}
+			size = int(script[0])
+			script = script[1:]
+		case opcode == OpPushData2:
+			if len(script) < 2 {
+				return ops, fmt.Errorf("Script is truncated at OP_PUSHDATA2")
+			}
+			size = int(binary.LittleEndian.Uint16(script[:2]))
+			script = script[2:]
+		case opcode == OpPushData4:
+			if len(script) < 4 {
+				return ops, fmt.Errorf("Script is truncated at OP_PUSHDATA4")
+			}
+			size = int(binary.LittleEndian.Uint32(script[:4]))
+			script = script[4:]
+		default:
+			ops = append(ops, &ScriptOp{Opcode: opcode})
+			continue
+		}
+		if size < 0 || len(script) < size {
+			return ops, fmt.Errorf("Script push of %d bytes is truncated", size)
+		}
+		ops = append(ops, &ScriptOp{Opcode: opcode, Data: script[:size]})
+		script = script[size:]
+	}
+	return ops, nil
+}
+
+// IsPayToPubKey checks the script is <pubkey> OP_CHECKSIG.
+func IsPayToPubKey(script []byte) bool {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) != 2 {
+		return false
+	}
+	return (len(ops[0].Data) == 33 || len(ops[0].Data) == 65) && ops[1].Opcode == OpCheckSig
+}
+
+// IsMultiSig checks the script is bare multisig, OP_m <pubkey>... OP_n OP_CHECKMULTISIG.
+func IsMultiSig(script []byte) bool {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) < 4 {
+		return false
+	}
+	first, last := ops[0].Opcode, ops[len(ops)-2].Opcode
+	if first < Op1 || first > Op16 || last < Op1 || last > Op16 || ops[len(ops)-1].Opcode != OpCheckMultiSig {
+		return false
+	}
+	m, n := int(first-Op1+1), int(last-Op1+1)
+	pubKeys := ops[1 : len(ops)-2]
+	if m > n || n != len(pubKeys) {
+		return false
+	}
+	for _, op := range pubKeys {
+		if len(op.Data) != 33 && len(op.Data) != 65 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseScript(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 80)
+	script := bytes.Join([][]byte{
+		{OpDup},
+		{0x02, 0x01, 0x02},
+		{OpPushData1, byte(len(data))}, data,
+		{OpPushData2, 0x03, 0x00, 0x01, 0x02, 0x03},
+	}, []byte{})
+	ops, err := ParseScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 4 || ops[0].Opcode != OpDup || ops[0].Data != nil {
+		t.Fatalf("unexpected opcodes: %d", len(ops))
+	}
+	if !bytes.Equal(ops[1].Data, []byte{0x01, 0x02}) || !bytes.Equal(ops[2].Data, data) || !bytes.Equal(ops[3].Data, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("pushed data mismatch")
+	}
+
+	ops, err = ParseScript([]byte{OpDup, 0x05, 0x01})
+	if err == nil || len(ops) != 1 {
+		t.Errorf("truncated push should be rejected after parsed opcodes")
+	}
+}
+
+func TestScriptTemplates(t *testing.T) {
+	pubKey := bytes.Repeat([]byte{0x02}, 33)
+	p2pk := append(OpPushData(pubKey), OpCheckSig)
+	multisig := bytes.Join([][]byte{{Op1}, OpPushData(pubKey), OpPushData(pubKey), {Op1 + 1, OpCheckMultiSig}}, []byte{})
+	p2pkh := bytes.Join([][]byte{{OpDup, OpHash160}, OpPushData(make([]byte, 20)), {OpEqualVerify, OpCheckSig}}, []byte{})
+	if !IsPayToPubKey(p2pk) || IsPayToPubKey(p2pkh) || IsPayToPubKey(multisig) {
+		t.Errorf("IsPayToPubKey mismatch")
+	}
+	if !IsMultiSig(multisig) || IsMultiSig(p2pk) || IsMultiSig(p2pkh) {
+		t.Errorf("IsMultiSig mismatch")
+	}
+	// mがnより大きい
+	invalid := bytes.Join([][]byte{{Op1 + 2}, OpPushData(pubKey), OpPushData(pubKey), {Op1 + 1, OpCheckMultiSig}}, []byte{})
+	if IsMultiSig(invalid) {
+		t.Errorf("multisig with m > n should not match")
+	}
+}
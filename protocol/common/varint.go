@@ -23,16 +23,25 @@ func NewVarInt(u uint64) *VarInt {
 // https://en.bitcoin.it/wiki/Protocol_documentation#Variable_length_integer
 func DecodeVarInt(bs []byte) (*VarInt, error) {
 	if bytes.HasPrefix(bs, []byte{0xff}) {
+		if len(bs) < 9 {
+			return nil, fmt.Errorf("Decode VarInt failed, invalid input: %v", bs)
+		}
 		return &VarInt{
 			Data: binary.LittleEndian.Uint64(bs[1:9]),
 		}, nil
 	}
 	if bytes.HasPrefix(bs, []byte{0xfe}) {
+		if len(bs) < 5 {
+			return nil, fmt.Errorf("Decode VarInt failed, invalid input: %v", bs)
+		}
 		return &VarInt{
 			Data: uint64(binary.LittleEndian.Uint32(bs[1:5])),
 		}, nil
 	}
 	if bytes.HasPrefix(bs, []byte{0xfd}) {
+		if len(bs) < 3 {
+			return nil, fmt.Errorf("Decode VarInt failed, invalid input: %v", bs)
+		}
 		return &VarInt{
 			Data: uint64(binary.LittleEndian.Uint16(bs[1:3])),
 		}, nil
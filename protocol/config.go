@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const (
+	userAgentName    = "btcwallet"
+	userAgentVersion = "0.1.0"
+
+	// maxUserAgentLen follows bitcoin core's MAX_SUBVERSION_LENGTH.
+	maxUserAgentLen = 256
+
+	// minPeerProtocolVersion means the oldest protocol version we talk to.
+	// 70011 is the version NODE_BLOOM service bit became mandatory for bloom filtering.
+	minPeerProtocolVersion = uint32(70011)
+)
+
+// Config means the configuration of the connection to peers.
+type Config struct {
+	UserAgentComments []string      // BIP14 user agentに付与するコメント
+	StartHeight       uint32        // versionで広告する自分の持っているブロックの高さ
+	RequiredServices  uint64        // 接続先peerに要求するservice
+	Dialer            Dialer        // peerへの接続方法、proxyを使う場合はSOCKS5Dialer
+	V2Transport       bool          // BIP324 v2 transportを試すか、失敗した場合はv1で接続し直す
+	BanDuration       time.Duration // misbehaviorでbanしたpeerに接続しない期間
+	CheckpointSync    bool          // ヘッダをgenesisではなく最新のcheckpointから同期するか
+	CompactFilters    bool          // bloom filterではなくBIP157/158のcompact filterで同期するか
+}
+
+// DefaultConfig return the default configuration.
+// Compact filters are used to sync, so we need NODE_COMPACT_FILTERS, and NODE_WITNESS
+// to get the witness of the blocks which spend segwit outputs of the wallet.
+// StartHeight is set to the tip of the stored headers when connecting.
+func DefaultConfig() *Config {
+	return &Config{
+		UserAgentComments: []string{},
+		StartHeight:       uint32(0),
+		RequiredServices:  message.SFNodeNetwork | message.SFNodeWitness | message.SFNodeCompactFilters,
+		Dialer:            NewDirectDialer(),
+		V2Transport:       true,
+		BanDuration:       defaultBanDuration,
+		CheckpointSync:    true,
+		CompactFilters:    true,
+	}
+}
+
+// SetCompactFilters choose compact filters or bloom filters to sync,
+// and require the service for it to peers.
+func (c *Config) SetCompactFilters(enabled bool) {
+	c.CompactFilters = enabled
+	c.RequiredServices &^= message.SFNodeBloom | message.SFNodeCompactFilters
+	if enabled {
+		c.RequiredServices |= message.SFNodeCompactFilters
+	} else {
+		// filterload/merkleblockにはNODE_BLOOMが必要
+		c.RequiredServices |= message.SFNodeBloom
+	}
+}
+
+var config = DefaultConfig()
+
+// SetConfig replace the configuration used by WithBitcoinConnection.
+func SetConfig(c *Config) {
+	config = c
+}
+
+// UserAgent build BIP14 user agent string like "/btcwallet:0.1.0(comment1; comment2)/".
+// https://github.com/bitcoin/bips/blob/master/bip-0014.mediawiki
+func (c *Config) UserAgent() (string, error) {
+	for _, comment := range c.UserAgentComments {
+		if strings.ContainsAny(comment, "/:()") {
+			return "", fmt.Errorf("Invalid user agent comment: %s", comment)
+		}
+	}
+	ua := fmt.Sprintf("/%s:%s", userAgentName, userAgentVersion)
+	if len(c.UserAgentComments) > 0 {
+		ua += "(" + strings.Join(c.UserAgentComments, "; ") + ")"
+	}
+	ua += "/"
+	if len(ua) > maxUserAgentLen {
+		return "", fmt.Errorf("User agent is too long: %d bytes", len(ua))
+	}
+	return ua, nil
+}
@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// Dialer opens connections to peers.
+type Dialer interface {
+	// Dial connect to "host:port". host may be a domain name or onion address.
+	Dial(addr string) (net.Conn, error)
+	// Reachable checks the dialer can connect to the address.
+	Reachable(addr *common.NetAddrV2) bool
+	// ResolvesNames checks host names should be passed to the dialer as they are,
+	// instead of resolving them locally.
+	ResolvesNames() bool
+}
+
+// DirectDialer connect to peers directly via TCP.
+type DirectDialer struct {
+	Timeout time.Duration
+}
+
+// NewDirectDialer create new DirectDialer.
+func NewDirectDialer() *DirectDialer {
+	return &DirectDialer{Timeout: dialTimeout}
+}
+
+// Dial connect to the address directly.
+func (d *DirectDialer) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, d.Timeout)
+}
+
+// Reachable return true for IPv4 and IPv6 addresses.
+func (d *DirectDialer) Reachable(addr *common.NetAddrV2) bool {
+	return addr.NetworkID == common.NetworkIPv4 || addr.NetworkID == common.NetworkIPv6
+}
+
+// ResolvesNames return false, host names are resolved locally.
+func (d *DirectDialer) ResolvesNames() bool {
+	return false
+}
+
+const (
+	socks5Version = byte(0x05)
+
+	socks5AuthNone         = byte(0x00)
+	socks5AuthPassword     = byte(0x02)
+	socks5AuthNoAcceptable = byte(0xFF)
+
+	socks5PasswordVersion = byte(0x01)
+
+	socks5CmdConnect = byte(0x01)
+
+	socks5AtypIPv4   = byte(0x01)
+	socks5AtypDomain = byte(0x03)
+	socks5AtypIPv6   = byte(0x04)
+
+	socks5Succeeded = byte(0x00)
+)
+
+var socks5Errors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connect to peers via SOCKS5 proxy such as Tor.
+// https://tools.ietf.org/html/rfc1928
+type SOCKS5Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	// 認証情報が指定されていない場合、接続ごとにランダムな認証情報を使う
+	// TorはSOCKSの認証情報ごとに異なるcircuitを使う(IsolateSOCKSAuth)ので接続が分離される
+	Randomize bool
+	Timeout   time.Duration
+}
+
+// ParseProxy parse proxy option like "[socks5://][user:pass@]host:port" to SOCKS5Dialer.
+func ParseProxy(proxy string, randomize bool) (*SOCKS5Dialer, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("socks5://" + proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy %s: %v", proxy, err)
+		}
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("Invalid proxy %s: %v", proxy, err)
+	}
+	d := &SOCKS5Dialer{
+		ProxyAddr: u.Host,
+		Randomize: randomize,
+		Timeout:   dialTimeout * 2,
+	}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+// Reachable return true for IP and Tor v3 addresses.
+func (d *SOCKS5Dialer) Reachable(addr *common.NetAddrV2) bool {
+	switch addr.NetworkID {
+	case common.NetworkIPv4, common.NetworkIPv6, common.NetworkTorV3:
+		return true
+	}
+	return false
+}
+
+// ResolvesNames return true, the proxy resolves host names to avoid DNS leak.
+func (d *SOCKS5Dialer) ResolvesNames() bool {
+	return true
+}
+
+// Dial connect to the address via SOCKS5 proxy.
+func (d *SOCKS5Dialer) Dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.ProxyAddr, d.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %v", d.ProxyAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	username, password := d.Username, d.Password
+	if username == "" && d.Randomize {
+		username, password = randomCredential(), randomCredential()
+	}
+	if err := socks5Connect(conn, addr, username, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func randomCredential() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// socks5Connect negotiate with SOCKS5 proxy and request CONNECT to addr.
+func socks5Connect(conn net.Conn, addr string, username string, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port %s: %v", portStr, err)
+	}
+
+	// 1. greeting
+	methods := []byte{socks5AuthNone}
+	if username != "" {
+		methods = []byte{socks5AuthPassword}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("SOCKS5 proxy returned invalid version %d", resp[0])
+	}
+
+	// 2. authentication
+	// https://tools.ietf.org/html/rfc1929
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 username/password is too long")
+		}
+		req := []byte{socks5PasswordVersion, byte(len(username))}
+		req = append(req, []byte(username)...)
+		req = append(req, byte(len(password)))
+		req = append(req, []byte(password)...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 proxy authentication failed")
+		}
+	case socks5AuthNoAcceptable:
+		return fmt.Errorf("SOCKS5 proxy has no acceptable authentication method")
+	default:
+		return fmt.Errorf("SOCKS5 proxy selected unknown authentication method %d", resp[1])
+	}
+
+	// 3. connect request
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("Too long host name: %s", host)
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, []byte(host)...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	req = append(req, portBytes...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 4. reply
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socks5Succeeded {
+		msg, ok := socks5Errors[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown error %d", reply[1])
+		}
+		return fmt.Errorf("SOCKS5 proxy failed to connect to %s: %s", addr, msg)
+	}
+	// bound addressは使わないので読み捨てる
+	var addrLen int
+	switch reply[3] {
+	case socks5AtypIPv4:
+		addrLen = net.IPv4len
+	case socks5AtypIPv6:
+		addrLen = net.IPv6len
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy returned unknown address type %d", reply[3])
+	}
+	bound := make([]byte, addrLen+2)
+	_, err = io.ReadFull(conn, bound)
+	return err
+}
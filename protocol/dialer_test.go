@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// socks5Request is the CONNECT request received by the test SOCKS5 server.
+type socks5Request struct {
+	username string
+	password string
+	host     string
+	port     uint16
+}
+
+// startSOCKS5Server start in-process SOCKS5 server which connects every request to target.
+// It sends received requests to the channel.
+func startSOCKS5Server(t *testing.T, target string, requireAuth bool, requests chan *socks5Request) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(t, conn, target, requireAuth, requests)
+		}
+	}()
+	return l
+}
+
+func serveSOCKS5(t *testing.T, conn net.Conn, target string, requireAuth bool, requests chan *socks5Request) {
+	defer conn.Close()
+	req := &socks5Request{}
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	io.ReadFull(conn, methods)
+	method := socks5AuthNoAcceptable
+	for _, m := range methods {
+		if (requireAuth && m == socks5AuthPassword) || (!requireAuth && m == socks5AuthNone) {
+			method = m
+		}
+	}
+	conn.Write([]byte{socks5Version, method})
+	if method == socks5AuthNoAcceptable {
+		return
+	}
+	if method == socks5AuthPassword {
+		io.ReadFull(conn, head[:])
+		username := make([]byte, head[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, head[:1])
+		password := make([]byte, head[0])
+		io.ReadFull(conn, password)
+		req.username, req.password = string(username), string(password)
+		conn.Write([]byte{socks5PasswordVersion, 0x00})
+	}
+	var cmd [4]byte
+	io.ReadFull(conn, cmd[:])
+	switch cmd[3] {
+	case socks5AtypIPv4:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		req.host = net.IP(ip).String()
+	case socks5AtypIPv6:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		req.host = net.IP(ip).String()
+	case socks5AtypDomain:
+		io.ReadFull(conn, head[:1])
+		host := make([]byte, head[0])
+		io.ReadFull(conn, host)
+		req.host = string(host)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	req.port = binary.BigEndian.Uint16(port[:])
+	requests <- req
+
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{socks5Version, 0x05, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	conn.Write([]byte{socks5Version, socks5Succeeded, 0x00, socks5AtypIPv4, 127, 0, 0, 1, 0, 0})
+	go io.Copy(remote, conn)
+	io.Copy(conn, remote)
+}
+
+// startEchoServer start TCP server which echoes back received data.
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func dialAndEcho(t *testing.T, d Dialer, addr string) {
+	conn, err := d.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected: %s, actual: %s", "ping", string(buf))
+	}
+}
+
+func TestSOCKS5DialerOnion(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	requests := make(chan *socks5Request, 1)
+	proxy := startSOCKS5Server(t, echo.Addr().String(), false, requests)
+	defer proxy.Close()
+
+	d, err := ParseProxy(proxy.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := common.EncodeOnionV3(make([]byte, common.OnionV3PubKeyLen))
+	dialAndEcho(t, d, net.JoinHostPort(onion, strconv.Itoa(testnetPort)))
+	req := <-requests
+	if req.host != onion || req.port != testnetPort {
+		t.Errorf("expected: %s:%d, actual: %s:%d", onion, testnetPort, req.host, req.port)
+	}
+	if req.username != "" {
+		t.Errorf("username should not be sent without auth: %s", req.username)
+	}
+}
+
+func TestSOCKS5DialerStreamIsolation(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	requests := make(chan *socks5Request, 2)
+	proxy := startSOCKS5Server(t, echo.Addr().String(), true, requests)
+	defer proxy.Close()
+
+	d, err := ParseProxy("socks5://"+proxy.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialAndEcho(t, d, "10.0.0.1:18333")
+	dialAndEcho(t, d, "10.0.0.1:18333")
+	first, second := <-requests, <-requests
+	if first.username == "" || first.username == second.username {
+		t.Errorf("each connection should use different credentials: %s, %s", first.username, second.username)
+	}
+	if first.host != "10.0.0.1" {
+		t.Errorf("expected: %s, actual: %s", "10.0.0.1", first.host)
+	}
+}
+
+func TestSOCKS5DialerPassword(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	requests := make(chan *socks5Request, 1)
+	proxy := startSOCKS5Server(t, echo.Addr().String(), true, requests)
+	defer proxy.Close()
+
+	d, err := ParseProxy("socks5://alice:secret@"+proxy.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialAndEcho(t, d, "[2001:db8::1]:18333")
+	req := <-requests
+	if req.username != "alice" || req.password != "secret" {
+		t.Errorf("expected: alice/secret, actual: %s/%s", req.username, req.password)
+	}
+	if req.host != "2001:db8::1" {
+		t.Errorf("expected: %s, actual: %s", "2001:db8::1", req.host)
+	}
+}
+
+func TestSOCKS5DialerNoAcceptableAuth(t *testing.T) {
+	requests := make(chan *socks5Request, 1)
+	proxy := startSOCKS5Server(t, "127.0.0.1:1", true, requests)
+	defer proxy.Close()
+
+	d, err := ParseProxy(proxy.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dial("10.0.0.1:18333"); err == nil {
+		t.Errorf("Dial should fail when the proxy requires authentication")
+	}
+}
@@ -0,0 +1,432 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const (
+	feeEstimatesFilePath = "fee_estimates.json"
+
+	// minBucketFeeRate and maxBucketFeeRate follow bitcoin core's MIN_BUCKET_FEERATE and MAX_BUCKET_FEERATE in sat/vB.
+	minBucketFeeRate = 1.0
+	maxBucketFeeRate = 10000.0
+	// feeSpacing follows bitcoin core's FEE_SPACING, each bucket is 5% higher than the previous.
+	feeSpacing = 1.05
+	// maxConfirmTarget follows the horizon of bitcoin core's medium term stats.
+	maxConfirmTarget = 48
+	// feeStatsDecay follows bitcoin core's MED_DECAY, the stats are decayed at every block.
+	feeStatsDecay = 0.9952
+	// successThreshold follows bitcoin core's SUCCESS_PCT.
+	successThreshold = 0.85
+	// sufficientTxs follows bitcoin core's SUFFICIENT_FEETXS, transactions per block needed for an estimate.
+	sufficientTxs = 0.1
+	// feeEstimateBlocks means how many recent blocks are downloaded for the first time,
+	// their outputs give the fees of the transactions spending them.
+	feeEstimateBlocks = 6
+)
+
+// trackedTx means a relayed transaction waiting for the confirmation.
+type trackedTx struct {
+	Height uint32 // 最初に見た時のtipの高さ
+	Bucket int
+}
+
+// FeeEstimator estimates the fee rate to confirm a transaction within the target blocks
+// from how long relayed transactions of each fee rate took to be confirmed, like bitcoin core's
+// CBlockPolicyEstimator. SPV clients don't have the UTXO set, so the fee is known only if
+// the outputs the transaction spends were seen in relayed transactions or downloaded blocks.
+type FeeEstimator struct {
+	mtx        sync.Mutex
+	filePath   string
+	buckets    []float64   // 各bucketの手数料率の上限
+	txCounts   []float64   // bucketごとの承認されたtxの数、ブロックごとに減衰する
+	confirmed  [][]float64 // [target-1][bucket] targetブロック以内に承認されたtxの数
+	failed     [][]float64 // [target-1][bucket] targetブロック以内に承認されなかったtxの数
+	bestHeight uint32      // 処理した最後のブロックの高さ
+	tracked    map[message.TxID]*trackedTx
+	pending    map[message.TxID]*pendingTx // 手数料がまだ分からないtx
+	outputs    map[message.OutPoint]uint64 // 見たtxの出力の額
+}
+
+type pendingTx struct {
+	tx     *message.Transaction
+	height uint32
+}
+
+// serializedFeeEstimates means the format of the fee estimates file.
+type serializedFeeEstimates struct {
+	Buckets    []float64
+	TxCounts   []float64
+	Confirmed  [][]float64
+	Failed     [][]float64
+	BestHeight uint32
+	Tracked    map[string]*trackedTx // txid
+}
+
+// NewFeeEstimator create new FeeEstimator without data which is saved to filePath.
+func NewFeeEstimator(filePath string) *FeeEstimator {
+	buckets := []float64{}
+	for r := minBucketFeeRate; r < maxBucketFeeRate; r *= feeSpacing {
+		buckets = append(buckets, r)
+	}
+	buckets = append(buckets, maxBucketFeeRate)
+	e := &FeeEstimator{
+		filePath: filePath,
+		buckets:  buckets,
+		txCounts: make([]float64, len(buckets)),
+		tracked:  map[message.TxID]*trackedTx{},
+		pending:  map[message.TxID]*pendingTx{},
+		outputs:  map[message.OutPoint]uint64{},
+	}
+	for i := 0; i < maxConfirmTarget; i++ {
+		e.confirmed = append(e.confirmed, make([]float64, len(buckets)))
+		e.failed = append(e.failed, make([]float64, len(buckets)))
+	}
+	return e
+}
+
+// LoadFeeEstimator read FeeEstimator from the file, or create new one if the file doesn't exist.
+// Stats of different buckets are dropped.
+func LoadFeeEstimator(filePath string) (*FeeEstimator, error) {
+	e := NewFeeEstimator(filePath)
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &serializedFeeEstimates{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Failed to load fee estimates %s: %v", filePath, err)
+	}
+	if !e.compatible(s) {
+		fmt.Println("Fee estimates are reset because the buckets changed")
+		return e, nil
+	}
+	e.txCounts, e.confirmed, e.failed, e.bestHeight = s.TxCounts, s.Confirmed, s.Failed, s.BestHeight
+	for id, t := range s.Tracked {
+		txID, err := decodeStoredTxID(id)
+		if err != nil {
+			return nil, err
+		}
+		e.tracked[txID] = t
+	}
+	return e, nil
+}
+
+// compatible checks the saved stats have the same shape as the estimator.
+func (e *FeeEstimator) compatible(s *serializedFeeEstimates) bool {
+	if len(s.Buckets) != len(e.buckets) || len(s.TxCounts) != len(e.buckets) ||
+		len(s.Confirmed) != maxConfirmTarget || len(s.Failed) != maxConfirmTarget {
+		return false
+	}
+	for i := range s.Buckets {
+		if math.Abs(s.Buckets[i]-e.buckets[i]) > 1e-9 {
+			return false
+		}
+	}
+	for i := range s.Confirmed {
+		if len(s.Confirmed[i]) != len(e.buckets) || len(s.Failed[i]) != len(e.buckets) {
+			return false
+		}
+	}
+	for _, t := range s.Tracked {
+		if t.Bucket < 0 || t.Bucket >= len(e.buckets) {
+			return false
+		}
+	}
+	return true
+}
+
+// Save write the stats and the transactions waiting for the confirmation to the file.
+func (e *FeeEstimator) Save() error {
+	e.mtx.Lock()
+	s := &serializedFeeEstimates{
+		Buckets:    e.buckets,
+		TxCounts:   e.txCounts,
+		Confirmed:  e.confirmed,
+		Failed:     e.failed,
+		BestHeight: e.bestHeight,
+		Tracked:    map[string]*trackedTx{},
+	}
+	for txID, t := range e.tracked {
+		s.Tracked[encodeStoredTxID(txID)] = t
+	}
+	data, err := json.Marshal(s)
+	e.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := e.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.filePath)
+}
+
+// BestHeight return the height of the last block processed.
+func (e *FeeEstimator) BestHeight() uint32 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.bestHeight
+}
+
+// ProcessTx start tracking the relayed transaction first seen when the tip is at the height.
+// Transactions which fee is unknown yet wait for the outputs they spend.
+func (e *FeeEstimator) ProcessTx(tx *message.Transaction, height uint32) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.addOutputs(tx)
+	txID := tx.ID()
+	if _, ok := e.tracked[txID]; ok {
+		return
+	}
+	if _, ok := e.pending[txID]; ok {
+		return
+	}
+	e.pending[txID] = &pendingTx{tx: tx, height: height}
+	e.resolvePending()
+}
+
+// ProcessBlock record the confirmations of the tracked transactions in the block at the height.
+// Blocks at or below the best height only provide the outputs.
+func (e *FeeEstimator) ProcessBlock(height uint32, block *message.Block) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, tx := range block.Transactions {
+		e.addOutputs(tx)
+	}
+	if height > e.bestHeight {
+		e.decay()
+		for _, tx := range block.Transactions {
+			txID := tx.ID()
+			t, ok := e.tracked[txID]
+			if !ok {
+				continue
+			}
+			delete(e.tracked, txID)
+			if height <= t.Height {
+				continue
+			}
+			// blocks以上の全てのtargetで承認されたことになる
+			blocks := int(height - t.Height)
+			for target := blocks; target <= maxConfirmTarget; target++ {
+				e.confirmed[target-1][t.Bucket]++
+			}
+			e.txCounts[t.Bucket]++
+		}
+		// 期間内に承認されなかったtxは全てのtargetで失敗とする
+		for txID, t := range e.tracked {
+			if height > t.Height+maxConfirmTarget {
+				for target := 1; target <= maxConfirmTarget; target++ {
+					e.failed[target-1][t.Bucket]++
+				}
+				delete(e.tracked, txID)
+			}
+		}
+		e.bestHeight = height
+	}
+	for _, tx := range block.Transactions {
+		delete(e.tracked, tx.ID())
+		delete(e.pending, tx.ID())
+	}
+	e.resolvePending()
+}
+
+// Skip forget the transactions which confirmations before the height are unknown
+// because the blocks were not processed.
+func (e *FeeEstimator) Skip(height uint32) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if height <= e.bestHeight {
+		return
+	}
+	for txID, t := range e.tracked {
+		if t.Height < height {
+			delete(e.tracked, txID)
+		}
+	}
+	for txID, p := range e.pending {
+		if p.height < height {
+			delete(e.pending, txID)
+		}
+	}
+	e.bestHeight = height
+}
+
+// EstimateFee return the fee rate in sat/vB with which transactions were confirmed within the target blocks.
+// Like bitcoin core's EstimateMedianVal, it groups buckets from the highest fee rate until each group
+// has enough transactions, and takes the median of the lowest group which succeeded.
+func (e *FeeEstimator) EstimateFee(target uint32) (float64, error) {
+	if target < 1 || target > maxConfirmTarget {
+		return 0, fmt.Errorf("Confirmation target must be between 1 and %d", maxConfirmTarget)
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	// target以上待っている未承認のtxも失敗に数える
+	extra := make([]float64, len(e.buckets))
+	for _, t := range e.tracked {
+		if e.bestHeight >= t.Height+target {
+			extra[t.Bucket]++
+		}
+	}
+	sufficient := sufficientTxs / (1 - feeStatsDecay)
+	confNum, totalNum, failNum, extraNum := 0.0, 0.0, 0.0, 0.0
+	passLow, passHigh := -1, -1
+	high := len(e.buckets) - 1
+	for b := len(e.buckets) - 1; b >= 0; b-- {
+		confNum += e.confirmed[target-1][b]
+		totalNum += e.txCounts[b]
+		failNum += e.failed[target-1][b]
+		extraNum += extra[b]
+		if totalNum < sufficient {
+			continue
+		}
+		if confNum/(totalNum+failNum+extraNum) < successThreshold {
+			break
+		}
+		passLow, passHigh = b, high
+		confNum, totalNum, failNum, extraNum = 0, 0, 0, 0
+		high = b - 1
+	}
+	if passLow < 0 {
+		return 0, fmt.Errorf("Insufficient data to estimate fee for %d blocks", target)
+	}
+	// 通過したbucketのうち承認されたtxの中央のbucket
+	total := 0.0
+	for b := passLow; b <= passHigh; b++ {
+		total += e.txCounts[b]
+	}
+	sum := 0.0
+	for b := passLow; b <= passHigh; b++ {
+		sum += e.txCounts[b]
+		if sum >= total/2 {
+			return e.buckets[b], nil
+		}
+	}
+	return e.buckets[passHigh], nil
+}
+
+// decay reduce the weight of the past stats.
+func (e *FeeEstimator) decay() {
+	for b := range e.buckets {
+		e.txCounts[b] *= feeStatsDecay
+		for t := 0; t < maxConfirmTarget; t++ {
+			e.confirmed[t][b] *= feeStatsDecay
+			e.failed[t][b] *= feeStatsDecay
+		}
+	}
+}
+
+func (e *FeeEstimator) addOutputs(tx *message.Transaction) {
+	txID := tx.ID()
+	for i, txOut := range tx.TxOut {
+		e.outputs[message.OutPoint{Hash: txID, Index: uint32(i)}] = txOut.Value
+	}
+}
+
+// resolvePending track the pending transactions which fee became known.
+func (e *FeeEstimator) resolvePending() {
+	for txID, p := range e.pending {
+		feeRate, ok := e.feeRate(p.tx)
+		if !ok {
+			continue
+		}
+		delete(e.pending, txID)
+		e.tracked[txID] = &trackedTx{Height: p.height, Bucket: e.bucketIndex(feeRate)}
+	}
+}
+
+// feeRate return the fee rate of the transaction in sat/vB if all outputs it spends are known.
+func (e *FeeEstimator) feeRate(tx *message.Transaction) (float64, bool) {
+	in := uint64(0)
+	for _, txIn := range tx.TxIn {
+		value, ok := e.outputs[*txIn.PreviousOutput]
+		if !ok {
+			return 0, false
+		}
+		in += value
+	}
+	out := uint64(0)
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if in < out {
+		return 0, false
+	}
+	return float64(in-out) / float64(tx.VSize()), true
+}
+
+// bucketIndex return the bucket of the fee rate, rates over the max are in the last bucket.
+func (e *FeeEstimator) bucketIndex(feeRate float64) int {
+	i := sort.SearchFloat64s(e.buckets, feeRate)
+	if i >= len(e.buckets) {
+		return len(e.buckets) - 1
+	}
+	return i
+}
+
+// updateFeeEstimates download the blocks after the best height of the estimator, at most
+// maxConfirmTarget blocks, and record the confirmations of the tracked transactions.
+func updateFeeEstimates(p *Peer, c *chain.HeaderChain, estimator *FeeEstimator, blockCh chan *message.Block) error {
+	tip := c.Tip()
+	best := estimator.BestHeight()
+	start := best + 1
+	if best == 0 && tip.Height > feeEstimateBlocks {
+		start = tip.Height - feeEstimateBlocks + 1
+	} else if tip.Height >= maxConfirmTarget && start < tip.Height-maxConfirmTarget+1 {
+		start = tip.Height - maxConfirmTarget + 1
+	}
+	if start > tip.Height {
+		return nil
+	}
+	if start > best+1 {
+		estimator.Skip(start - 1)
+	}
+	nodes := []*chain.HeaderNode{}
+	for h := start; h <= tip.Height; h++ {
+		nodes = append(nodes, c.NodeByHeight(h))
+	}
+	return fetchBlocks(p, nodes, blockCh, func(node *chain.HeaderNode, block *message.Block) {
+		estimator.ProcessBlock(node.Height, block)
+	})
+}
+
+// EstimateFee show the fee rate in sat/vB to confirm a transaction within the blocks.
+// The fee filter of the peer is the floor, because it doesn't relay transactions below it.
+func EstimateFee(blocks uint32) error {
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		if _, err := syncWallet(p, c, nil); err != nil {
+			return err
+		}
+		estimator, err := LoadFeeEstimator(feeEstimatesFilePath)
+		if err != nil {
+			return err
+		}
+		estimate, err := estimator.EstimateFee(blocks)
+		if err != nil {
+			return err
+		}
+		feeRate := uint64(math.Ceil(estimate))
+		if floor := p.FeeFilterRate(); feeRate < floor {
+			fmt.Printf("Estimate %d sat/vB is raised to the fee filter of the peer\n", feeRate)
+			feeRate = floor
+		}
+		if feeRate < minRelayFeeRate {
+			feeRate = minRelayFeeRate
+		}
+		fmt.Printf("%d sat/vB\n", feeRate)
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// relayedTxs create n funding transactions and the transactions spending them with the fee.
+// p2pkhTx is 85 vbytes, so the fee rate is fee / 85.
+func relayedTxs(n int, salt byte, fee uint64) ([]*message.Transaction, []*message.Transaction) {
+	parents, children := []*message.Transaction{}, []*message.Transaction{}
+	for i := 0; i < n; i++ {
+		parent := p2pkhTx([32]byte{salt, byte(i)}, 100000)
+		parents = append(parents, parent)
+		children = append(children, p2pkhTx(parent.ID(), 100000-fee))
+	}
+	return parents, children
+}
+
+func testFullBlock(txs ...*message.Transaction) *message.Block {
+	return message.NewBlock(&message.BlockHeader{Version: 4}, txs)
+}
+
+func TestFeeEstimator(t *testing.T) {
+	e := NewFeeEstimator("")
+	fastParents, fast := relayedTxs(40, 0x01, 850) // 10 sat/vB
+	slowParents, slow := relayedTxs(40, 0x02, 170) // 2 sat/vB
+	e.ProcessBlock(10, testFullBlock(append(fastParents, slowParents...)...))
+	for _, tx := range append(fast, slow...) {
+		e.ProcessTx(tx, 10)
+	}
+	if len(e.tracked) != 80 {
+		t.Fatalf("expected 80 tracked txs, actual %d", len(e.tracked))
+	}
+	// 高い手数料のtxは次のブロック、低い手数料のtxは5ブロック後に承認される
+	e.ProcessBlock(11, testFullBlock(fast...))
+	for h := uint32(12); h < 15; h++ {
+		e.ProcessBlock(h, testFullBlock())
+	}
+	e.ProcessBlock(15, testFullBlock(slow...))
+
+	fastRate, err := e.EstimateFee(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fastRate < 10 || fastRate > 10*feeSpacing {
+		t.Errorf("expected about 10 sat/vB for 1 block, actual %f", fastRate)
+	}
+	slowRate, err := e.EstimateFee(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slowRate < 2 || slowRate > 2*feeSpacing {
+		t.Errorf("expected about 2 sat/vB for 5 blocks, actual %f", slowRate)
+	}
+	if _, err := e.EstimateFee(0); err == nil {
+		t.Errorf("target 0 should be error")
+	}
+	if _, err := NewFeeEstimator("").EstimateFee(1); err == nil {
+		t.Errorf("estimator without data should be error")
+	}
+}
+
+func TestFeeEstimatorPending(t *testing.T) {
+	e := NewFeeEstimator("")
+	parents, children := relayedTxs(1, 0x01, 850)
+	// 親の出力が分かるまで手数料は分からない
+	e.ProcessTx(children[0], 10)
+	if len(e.tracked) != 0 || len(e.pending) != 1 {
+		t.Fatalf("tx should be pending until its inputs are known")
+	}
+	e.ProcessTx(parents[0], 10)
+	if len(e.tracked) != 1 {
+		t.Errorf("tx should be tracked after its parent is relayed")
+	}
+
+	// 期間内に承認されなければ失敗として数える
+	e.ProcessBlock(10+maxConfirmTarget+1, testFullBlock())
+	if len(e.tracked) != 0 {
+		t.Errorf("expired tx should be dropped")
+	}
+	bucket := e.bucketIndex(10)
+	if math.Abs(e.failed[0][bucket]-1) > 1e-9 {
+		t.Errorf("expired tx should be counted as failure: %f", e.failed[0][bucket])
+	}
+}
+
+func TestFeeEstimatorPersist(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	e := NewFeeEstimator(path)
+	parents, children := relayedTxs(2, 0x01, 850)
+	e.ProcessBlock(10, testFullBlock(parents...))
+	e.ProcessTx(children[0], 10)
+	e.ProcessTx(children[1], 10)
+	e.ProcessBlock(11, testFullBlock(children[0]))
+	if err := e.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadFeeEstimator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.BestHeight() != 11 || len(loaded.tracked) != 1 {
+		t.Errorf("best height and tracked txs should be restored: %d %d", loaded.BestHeight(), len(loaded.tracked))
+	}
+	bucket := e.bucketIndex(10)
+	if loaded.txCounts[bucket] != e.txCounts[bucket] || loaded.confirmed[0][bucket] != e.confirmed[0][bucket] {
+		t.Errorf("stats should be restored")
+	}
+	// 保存後のセッションで承認されたtxも数える
+	loaded.ProcessBlock(12, testFullBlock(children[1]))
+	if loaded.confirmed[1][bucket] <= e.confirmed[1][bucket] {
+		t.Errorf("tx tracked in the previous session should be confirmed")
+	}
+
+	// 処理していないブロックの後はどこで承認されたか分からない
+	loaded.tracked[children[0].ID()] = &trackedTx{Height: 12, Bucket: bucket}
+	loaded.Skip(20)
+	if len(loaded.tracked) != 0 || loaded.BestHeight() != 20 {
+		t.Errorf("txs before skipped blocks should be dropped")
+	}
+}
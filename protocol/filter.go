@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const (
+	// bloomFalsePositiveRate means the false positive rate of the wallet's bloom filter.
+	bloomFalsePositiveRate = 0.0001
+
+	// bloomExtraElements means the room for the outpoints the peer adds to the filter.
+	bloomExtraElements = 100
+
+	// bloomRefreshFactor means how much the estimated false positive rate can degrade
+	// before the filter is created again.
+	bloomRefreshFactor = 2
+)
+
+// filterManager keeps the bloom filter loaded to the peer up to date.
+// It holds the copy of the peer's filter, which is updated by the received
+// transactions in the same way as the peer, to estimate its false positive rate.
+// New elements are sent with filteradd, and the filter is reloaded when its
+// false positive rate degrades too much.
+type filterManager struct {
+	mtx      sync.Mutex
+	p        *Peer
+	fpRate   float64
+	flags    uint8
+	elements [][]byte             // フィルタを作り直す時に入れる要素
+	filter   *message.BloomFilter // peerに設定したフィルタの写し、未設定の場合はnil
+}
+
+// newFilterManager create new filterManager for the peer.
+func newFilterManager(p *Peer, fpRate float64, flags uint8) *filterManager {
+	return &filterManager{
+		p:        p,
+		fpRate:   fpRate,
+		flags:    flags,
+		elements: [][]byte{},
+	}
+}
+
+// AddOutPoint add the outpoint to the filter, so transactions spending it are matched.
+func (m *filterManager) AddOutPoint(op *message.OutPoint) error {
+	return m.AddElements(op.Encode())
+}
+
+// AddElements add the elements to the filter, like the keys and the scripts of the wallet.
+// Elements added after the filter is loaded are sent with filteradd.
+func (m *filterManager) AddElements(elements ...[]byte) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.elements = append(m.elements, elements...)
+	if m.filter == nil {
+		return nil
+	}
+	// 写しが既にマッチする要素はpeerのフィルタもマッチするので送らなくて良い
+	adds := [][]byte{}
+	for _, e := range elements {
+		if !m.filter.Matches(e) {
+			m.filter.Add(e)
+			adds = append(adds, e)
+		}
+	}
+	if m.degraded() {
+		return m.load()
+	}
+	for _, e := range adds {
+		filteradd, err := message.NewFilteradd(e)
+		if err != nil {
+			return err
+		}
+		if err := m.p.SendMessage(filteradd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load create new filter of all elements and send it to the peer.
+func (m *filterManager) Load() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.load()
+}
+
+func (m *filterManager) load() error {
+	tweak := make([]byte, 4)
+	if _, err := rand.Read(tweak); err != nil {
+		return err
+	}
+	filter := message.NewBloomFilter(uint32(len(m.elements))+bloomExtraElements, m.fpRate, binary.LittleEndian.Uint32(tweak), m.flags)
+	for _, e := range m.elements {
+		filter.Add(e)
+	}
+	m.filter = filter
+	return m.p.SendMessage(filter.Filterload())
+}
+
+// ProcessTx update the copy of the filter with the transaction relayed by the peer,
+// and reload the filter if its false positive rate degraded.
+func (m *filterManager) ProcessTx(tx *message.Transaction) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.filter == nil {
+		return nil
+	}
+	m.filter.MatchTxAndUpdate(tx)
+	if m.degraded() {
+		return m.load()
+	}
+	return nil
+}
+
+func (m *filterManager) degraded() bool {
+	return m.filter.FalsePositiveRate() > m.fpRate*bloomRefreshFactor
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// recordTransport records the messages sent to the peer.
+type recordTransport struct {
+	commands []string
+}
+
+func (t *recordTransport) WriteMessage(command string, payload []byte) error {
+	t.commands = append(t.commands, command)
+	return nil
+}
+
+func (t *recordTransport) ReadMessage() (string, []byte, error) {
+	select {}
+}
+
+func TestFilterManager(t *testing.T) {
+	transport := &recordTransport{}
+	p := newPeer(nil, transport, testAddr(1), DefaultConfig())
+	m := newFilterManager(p, 0.01, message.BloomUpdateAll)
+	pubKey := bytes.Repeat([]byte{0x02}, 33)
+	if err := m.AddElements(pubKey, util.Hash160(pubKey)); err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.commands) != 0 {
+		t.Fatalf("nothing should be sent before the filter is loaded")
+	}
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.filter.Matches(pubKey) || !m.filter.Matches(util.Hash160(pubKey)) {
+		t.Errorf("loaded filter should match the key")
+	}
+
+	// 新しい鍵はfilteraddで追加する
+	newPubKey := bytes.Repeat([]byte{0x03}, 33)
+	if err := m.AddElements(newPubKey, util.Hash160(newPubKey)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"filterload", "filteradd", "filteradd"}
+	if len(transport.commands) != len(expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, transport.commands)
+	}
+
+	// 誤検出率が悪化したらフィルタを作り直す
+	for i := 0; transport.commands[len(transport.commands)-1] != "filterload"; i++ {
+		if i > 1000 {
+			t.Fatalf("filter should be reloaded")
+		}
+		if err := m.AddOutPoint(&message.OutPoint{Hash: [32]byte{byte(i), byte(i >> 8)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.filter.FalsePositiveRate() > 0.01 {
+		t.Errorf("reloaded filter should have the target false positive rate: %f", m.filter.FalsePositiveRate())
+	}
+}
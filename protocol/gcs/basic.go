@@ -0,0 +1,50 @@
+package gcs
+
+import (
+	"bytes"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+const (
+	// BasicFilterP means the Golomb-Rice parameter of the basic filter. (BIP158)
+	BasicFilterP = 19
+
+	// BasicFilterM means the inverse of the false positive rate of the basic filter. (BIP158)
+	BasicFilterM = 784931
+)
+
+// BasicKey return the key of the basic filter, the first 16 bytes of the block hash.
+func BasicKey(blockHash [32]byte) [KeySize]byte {
+	var key [KeySize]byte
+	copy(key[:], blockHash[:KeySize])
+	return key
+}
+
+// BuildBasicFilter build the basic filter of the block from the output scripts
+// and the scripts of the outputs spent in the block.
+// Empty scripts and OP_RETURN outputs are not inserted.
+func BuildBasicFilter(blockHash [32]byte, scripts [][]byte) *Filter {
+	items := [][]byte{}
+	for _, script := range scripts {
+		if len(script) == 0 || script[0] == common.OpReturn {
+			continue
+		}
+		items = append(items, script)
+	}
+	return NewFilter(BasicFilterP, BasicFilterM, BasicKey(blockHash), items)
+}
+
+// DecodeBasicFilter decode the basic filter sent by the peer.
+func DecodeBasicFilter(b []byte) (*Filter, error) {
+	return FromNBytes(BasicFilterP, BasicFilterM, b)
+}
+
+// MakeHeader return the filter header, which commits to the filter hash and the previous header.
+// The previous header of the genesis block is zero.
+func MakeHeader(filterHash [32]byte, prevHeader [32]byte) [32]byte {
+	var res [32]byte
+	copy(res[:], util.Hash256(bytes.Join([][]byte{filterHash[:], prevHeader[:]}, []byte{})))
+	return res
+}
@@ -0,0 +1,213 @@
+package gcs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// KeySize means the byte size of the SipHash key.
+const KeySize = 16
+
+// Filter means Golomb-coded set, the compact probabilistic set of the items.
+// Items are hashed to [0, N*M) and the sorted differences of the hashes are
+// encoded by Golomb-Rice coding with the parameter P.
+// https://github.com/bitcoin/bips/blob/master/bip-0158.mediawiki
+type Filter struct {
+	n    uint32
+	p    uint8
+	m    uint64
+	data []byte // Golomb-Rice符号化した差分のbit列
+}
+
+// NewFilter build the filter of the items with the key.
+// Duplicated items are inserted only once.
+func NewFilter(p uint8, m uint64, key [KeySize]byte, items [][]byte) *Filter {
+	// 重複を除いた要素数がNになる
+	unique := map[string]struct{}{}
+	for _, item := range items {
+		unique[string(item)] = struct{}{}
+	}
+	f := &Filter{n: uint32(len(unique)), p: p, m: m}
+	values := make([]uint64, 0, len(unique))
+	for item := range unique {
+		values = append(values, f.hashToRange(key, []byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	w := &bitWriter{}
+	last := uint64(0)
+	for _, v := range values {
+		delta := v - last
+		last = v
+		// 商をunaryで、余りをPbitで書く
+		for q := delta >> p; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, p)
+	}
+	f.data = w.data
+	return f
+}
+
+// FromNBytes decode the serialized filter, the number of items as compact size
+// followed by the encoded bits.
+func FromNBytes(p uint8, m uint64, b []byte) (*Filter, error) {
+	n, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if n.Data > 0xffffffff {
+		return nil, fmt.Errorf("Too many items in filter: %d", n.Data)
+	}
+	data := b[len(n.Encode()):]
+	// 各要素は少なくともP+1bitを使う
+	if n.Data*uint64(p+1) > uint64(len(data))*8 {
+		return nil, fmt.Errorf("Filter is too short for %d items: %d bytes", n.Data, len(data))
+	}
+	return &Filter{n: uint32(n.Data), p: p, m: m, data: data}, nil
+}
+
+// N return the number of items in the filter.
+func (f *Filter) N() uint32 {
+	return f.n
+}
+
+// NBytes serialize the filter.
+func (f *Filter) NBytes() []byte {
+	return append(common.NewVarInt(uint64(f.n)).Encode(), f.data...)
+}
+
+// Hash return the filter hash, which is committed by the filter header.
+func (f *Filter) Hash() [32]byte {
+	var res [32]byte
+	copy(res[:], util.Hash256(f.NBytes()))
+	return res
+}
+
+// Match checks the item may be in the filter.
+func (f *Filter) Match(key [KeySize]byte, item []byte) (bool, error) {
+	return f.MatchAny(key, [][]byte{item})
+}
+
+// MatchAny checks any of the items may be in the filter.
+// It returns error if the filter can't be decoded.
+func (f *Filter) MatchAny(key [KeySize]byte, items [][]byte) (bool, error) {
+	if f.n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	queries := make([]uint64, 0, len(items))
+	for _, item := range items {
+		queries = append(queries, f.hashToRange(key, item))
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i] < queries[j] })
+
+	// フィルタの値とクエリの値をどちらも昇順に比べる
+	r := &bitReader{data: f.data}
+	value := uint64(0)
+	qi := 0
+	for i := uint32(0); i < f.n; i++ {
+		delta, err := f.readDelta(r)
+		if err != nil {
+			return false, err
+		}
+		value += delta
+		for qi < len(queries) && queries[qi] < value {
+			qi++
+		}
+		if qi == len(queries) {
+			return false, nil
+		}
+		if queries[qi] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hashToRange map the item to [0, N*M) by multiplying SipHash and N*M, instead of modulo.
+func (f *Filter) hashToRange(key [KeySize]byte, item []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	hi, _ := bits.Mul64(SipHash24(k0, k1, item), uint64(f.n)*f.m)
+	return hi
+}
+
+// readDelta read one Golomb-Rice encoded value.
+func (f *Filter) readDelta(r *bitReader) (uint64, error) {
+	q := uint64(0)
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	rem, err := r.readBits(f.p)
+	if err != nil {
+		return 0, err
+	}
+	return q<<f.p | rem, nil
+}
+
+// bitWriter write bits from the most significant bit of each byte.
+type bitWriter struct {
+	data []byte
+	used uint8 // 最後のbyteで使ったbit数
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 || w.used == 8 {
+		w.data = append(w.data, 0)
+		w.used = 0
+	}
+	if bit {
+		w.data[len(w.data)-1] |= 1 << (7 - w.used)
+	}
+	w.used++
+}
+
+// writeBits write the lower n bits of v from the most significant one.
+func (w *bitWriter) writeBits(v uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<uint(i)) != 0)
+	}
+}
+
+// bitReader read bits written by bitWriter.
+type bitReader struct {
+	data []byte
+	pos  int // 読んだbit数
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, fmt.Errorf("Filter ends unexpectedly")
+	}
+	bit := r.data[r.pos/8]&(1<<uint(7-r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint8) (uint64, error) {
+	v := uint64(0)
+	for i := uint8(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
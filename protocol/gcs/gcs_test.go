@@ -0,0 +1,114 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// decodeHash decode the hash shown by RPC into the internal byte order.
+func decodeHash(t *testing.T, s string) [32]byte {
+	var res [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(res[:], util.ReverseBytes(b))
+	return res
+}
+
+func TestSipHash24(t *testing.T) {
+	// SipHash論文のAppendix Aのテストベクタ
+	msg := []byte{}
+	for i := 0; i < 15; i++ {
+		msg = append(msg, byte(i))
+	}
+	actual := SipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, msg)
+	if actual != 0xa129ca6149be45e5 {
+		t.Errorf("expected a129ca6149be45e5, actual %x", actual)
+	}
+}
+
+func TestBuildBasicFilter(t *testing.T) {
+	// BIP158のテストベクタ、testnet3のgenesis block
+	blockHash := decodeHash(t, "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+	script, _ := hex.DecodeString("4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac")
+	f := BuildBasicFilter(blockHash, [][]byte{script, {}, {0x6a, 0x01, 0x00}})
+	if actual := hex.EncodeToString(f.NBytes()); actual != "019dfca8" {
+		t.Errorf("expected 019dfca8, actual %s", actual)
+	}
+	header := MakeHeader(f.Hash(), [32]byte{})
+	expected := decodeHash(t, "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750")
+	if header != expected {
+		t.Errorf("expected header %x, actual %x", expected, header)
+	}
+	if match, err := f.Match(BasicKey(blockHash), script); err != nil || !match {
+		t.Errorf("script should match: %v", err)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	key := [KeySize]byte{1, 2, 3}
+	items := [][]byte{}
+	for i := 0; i < 100; i++ {
+		items = append(items, []byte(fmt.Sprintf("item %d", i)))
+	}
+	// 重複した要素は1つとして数える
+	f := NewFilter(BasicFilterP, BasicFilterM, key, append(items, items[0]))
+	if f.N() != 100 {
+		t.Errorf("expected 100 items, actual %d", f.N())
+	}
+	decoded, err := DecodeBasicFilter(f.NBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.NBytes(), f.NBytes()) {
+		t.Errorf("decoded filter differs")
+	}
+	for _, item := range items {
+		if match, err := decoded.Match(key, item); err != nil || !match {
+			t.Errorf("%s should match: %v", item, err)
+		}
+	}
+	if match, _ := decoded.MatchAny(key, [][]byte{[]byte("other"), items[50]}); !match {
+		t.Errorf("items should match")
+	}
+	if match, _ := decoded.MatchAny(key, [][]byte{[]byte("other 1"), []byte("other 2")}); match {
+		t.Errorf("other items should not match")
+	}
+	// 鍵が違えば別のフィルタになる
+	if match, _ := decoded.MatchAny([KeySize]byte{}, items); match {
+		t.Errorf("items should not match with other key")
+	}
+}
+
+func TestEmptyFilter(t *testing.T) {
+	f := NewFilter(BasicFilterP, BasicFilterM, [KeySize]byte{}, nil)
+	if !bytes.Equal(f.NBytes(), []byte{0x00}) {
+		t.Errorf("expected 00, actual %x", f.NBytes())
+	}
+	if match, err := f.Match([KeySize]byte{}, []byte{}); err != nil || match {
+		t.Errorf("empty filter should not match: %v", err)
+	}
+}
+
+func TestMalformedFilter(t *testing.T) {
+	if _, err := DecodeBasicFilter([]byte{}); err == nil {
+		t.Errorf("empty input should be error")
+	}
+	// 10要素には少なくとも200bit必要
+	if _, err := DecodeBasicFilter([]byte{0x0a, 0x00}); err == nil {
+		t.Errorf("too short filter should be error")
+	}
+	// 全て1のunary符号は終わらない
+	f, err := DecodeBasicFilter(append([]byte{0x01}, bytes.Repeat([]byte{0xff}, 3)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Match([KeySize]byte{}, []byte{0x01}); err == nil {
+		t.Errorf("truncated filter should be error")
+	}
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const handshakeTimeout = 5 * time.Second
+
+// localNonces holds nonces of version messages we sent,
+// to detect that we connected to ourselves.
+var localNonces = struct {
+	sync.Mutex
+	m map[uint64]struct{}
+}{m: map[uint64]struct{}{}}
+
+func newLocalNonce() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	nonce := binary.LittleEndian.Uint64(b[:])
+	localNonces.Lock()
+	localNonces.m[nonce] = struct{}{}
+	localNonces.Unlock()
+	return nonce, nil
+}
+
+func isLocalNonce(nonce uint64) bool {
+	localNonces.Lock()
+	defer localNonces.Unlock()
+	_, ok := localNonces.m[nonce]
+	return ok
+}
+
+func forgetLocalNonce(nonce uint64) {
+	localNonces.Lock()
+	delete(localNonces.m, nonce)
+	localNonces.Unlock()
+}
+
+// newVersion create version message to send to the remote peer.
+func newVersion(cfg *Config, remoteAddr net.Addr, nonce uint64) (*message.Version, error) {
+	ua, err := cfg.UserAgent()
+	if err != nil {
+		return nil, err
+	}
+	addrRecv := &common.NetAddr{}
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		addrRecv = common.NewNetAddr(uint64(0), tcpAddr.IP, uint16(tcpAddr.Port))
+	}
+	// 自分は listen しないので addrFrom は未指定のアドレスにする
+	addrFrom := &common.NetAddr{Services: uint64(0)}
+	return &message.Version{
+		Version:     message.ProtocolVersion,
+		Services:    uint64(0), // SPVなので何も提供しない
+		Timestamp:   uint64(time.Now().Unix()),
+		AddrRecv:    addrRecv,
+		AddrFrom:    addrFrom,
+		Nonce:       nonce,
+		UserAgent:   common.NewVarStr([]byte(ua)),
+		StartHeight: cfg.StartHeight,
+		Relay:       cfg.CompactFilters, // bloom filterの場合はfilterloadでrelayが始まる
+	}, nil
+}
+
+// handshake exchange version/verack with the remote peer over the transport.
+// https://en.bitcoin.it/wiki/Version_Handshake
+func handshake(conn net.Conn, transport Transport, remoteAddr *common.NetAddrV2, cfg *Config) (*Peer, error) {
+	nonce, err := newLocalNonce()
+	if err != nil {
+		return nil, err
+	}
+	defer forgetLocalNonce(nonce)
+
+	v, err := newVersion(cfg, conn.RemoteAddr(), nonce)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	p := newPeer(conn, transport, remoteAddr, cfg)
+	if err := p.SendMessage(v); err != nil {
+		return nil, err
+	}
+	recvVerack := false
+	for p.version == nil || !recvVerack {
+		command, payload, err := p.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("Peer Connection: version/verack failed: %v", err)
+		}
+		fmt.Printf("Recv: %s %d\n", command, len(payload))
+		switch command {
+		case "version":
+			if p.version != nil {
+				return nil, fmt.Errorf("Peer sent duplicate version message")
+			}
+			remote, err := message.DecodeVersion(payload)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.acceptVersion(remote, cfg); err != nil {
+				return nil, err
+			}
+			// feature negotiation messages must be sent before verack.
+			if p.protocolVersion >= message.WtxidRelayVersion {
+				if err := p.SendMessage(&message.WtxidRelay{}); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.SendMessage(&message.SendAddrV2{}); err != nil {
+				return nil, err
+			}
+			if err := p.SendMessage(&message.Verack{}); err != nil {
+				return nil, err
+			}
+		case "verack":
+			if p.version == nil {
+				return nil, fmt.Errorf("Peer sent verack before version")
+			}
+			recvVerack = true
+		case "wtxidrelay":
+			p.wtxidRelay = true
+		case "sendaddrv2":
+			p.sendAddrV2 = true
+		}
+	}
+	fmt.Printf("Handshake done: %s version=%d services=%x height=%d\n",
+		string(p.version.UserAgent.Data), p.protocolVersion, p.version.Services, p.version.StartHeight)
+	return p, nil
+}
+
+// acceptVersion validate the version message from the remote peer and negotiate protocol version.
+func (p *Peer) acceptVersion(remote *message.Version, cfg *Config) error {
+	if isLocalNonce(remote.Nonce) {
+		return fmt.Errorf("Connected to myself, disconnecting")
+	}
+	if remote.Version < minPeerProtocolVersion {
+		return fmt.Errorf("Peer protocol version %d is too old, minimum: %d", remote.Version, minPeerProtocolVersion)
+	}
+	if !remote.HasServices(cfg.RequiredServices) {
+		return fmt.Errorf("Peer doesn't support required services, required: %x, advertised: %x", cfg.RequiredServices, remote.Services)
+	}
+	p.version = remote
+	p.protocolVersion = message.ProtocolVersion
+	if remote.Version < p.protocolVersion {
+		p.protocolVersion = remote.Version
+	}
+	return nil
+}
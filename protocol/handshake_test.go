@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// fakeRemotePeer answer our version handshake on the other side of the pipe
+// and send received command names to the channel.
+// If remote.Nonce is 0, it echoes our nonce back to reproduce self connection.
+func fakeRemotePeer(t *testing.T, conn net.Conn, remote *message.Version, commands chan string) {
+	nonceCh := make(chan uint64, 1)
+	go func() {
+		for {
+			mh, payload, err := ReadMessage(conn)
+			if err != nil {
+				close(commands)
+				return
+			}
+			if mh.CommandName() == "version" {
+				v, err := message.DecodeVersion(payload)
+				if err != nil {
+					t.Error(err)
+				}
+				nonceCh <- v.Nonce
+			}
+			commands <- mh.CommandName()
+		}
+	}()
+	go func() {
+		localNonce := <-nonceCh
+		if remote.Nonce == 0 {
+			remote.Nonce = localNonce
+		}
+		SendMessage(conn, remote)
+		SendMessage(conn, &message.Verack{})
+	}()
+}
+
+func remoteVersion(version uint32, services uint64, nonce uint64) *message.Version {
+	return &message.Version{
+		Version:     version,
+		Services:    services,
+		Timestamp:   uint64(time.Now().Unix()),
+		AddrRecv:    &common.NetAddr{},
+		AddrFrom:    &common.NetAddr{},
+		Nonce:       nonce,
+		UserAgent:   common.NewVarStr([]byte("/Satoshi:25.0.0/")),
+		StartHeight: uint32(2500000),
+		Relay:       true,
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	commands := make(chan string, 10)
+	fakeRemotePeer(t, remote, remoteVersion(70016, message.SFNodeNetwork|message.SFNodeCompactFilters|message.SFNodeWitness, 42), commands)
+
+	cfg := DefaultConfig()
+	cfg.UserAgentComments = []string{"test"}
+	p, err := handshake(local, newV1Transport(local), nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.protocolVersion != 70016 {
+		t.Errorf("expected: %d, actual: %d", 70016, p.protocolVersion)
+	}
+	expected := []string{"version", "wtxidrelay", "sendaddrv2", "verack"}
+	for _, e := range expected {
+		select {
+		case c := <-commands:
+			if c != e {
+				t.Errorf("expected: %s, actual: %s", e, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not sent", e)
+		}
+	}
+}
+
+func TestHandshakeNegotiateVersion(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	commands := make(chan string, 10)
+	fakeRemotePeer(t, remote, remoteVersion(70015, message.SFNodeNetwork|message.SFNodeCompactFilters|message.SFNodeWitness, 42), commands)
+
+	p, err := handshake(local, newV1Transport(local), nil, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.protocolVersion != 70015 {
+		t.Errorf("expected: %d, actual: %d", 70015, p.protocolVersion)
+	}
+	for c := range commands {
+		if c == "wtxidrelay" {
+			t.Errorf("wtxidrelay should not be sent to peer with version 70015")
+		}
+		if c == "verack" {
+			break
+		}
+	}
+}
+
+func TestHandshakeMissingServices(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	fakeRemotePeer(t, remote, remoteVersion(70016, message.SFNodeNetwork, 42), make(chan string, 10))
+
+	if _, err := handshake(local, newV1Transport(local), nil, DefaultConfig()); err == nil {
+		t.Errorf("handshake should fail when the peer doesn't support NODE_COMPACT_FILTERS")
+	}
+
+	// segwitの出力を使うブロックのwitnessを取得できないpeer
+	local2, remote2 := net.Pipe()
+	defer local2.Close()
+	defer remote2.Close()
+	fakeRemotePeer(t, remote2, remoteVersion(70016, message.SFNodeNetwork|message.SFNodeCompactFilters, 42), make(chan string, 10))
+	if _, err := handshake(local2, newV1Transport(local2), nil, DefaultConfig()); err == nil {
+		t.Errorf("handshake should fail when the peer doesn't support NODE_WITNESS")
+	}
+}
+
+func TestHandshakeSelfConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	fakeRemotePeer(t, remote, remoteVersion(70016, message.SFNodeNetwork|message.SFNodeCompactFilters|message.SFNodeWitness, 0), make(chan string, 10))
+
+	if _, err := handshake(local, newV1Transport(local), nil, DefaultConfig()); err == nil {
+		t.Errorf("handshake should detect self connection")
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UserAgentComments = []string{"a", "b"}
+	ua, err := cfg.UserAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua != "/btcwallet:0.1.0(a; b)/" {
+		t.Errorf("expected: %s, actual: %s", "/btcwallet:0.1.0(a; b)/", ua)
+	}
+	cfg.UserAgentComments = []string{"bad/comment"}
+	if _, err := cfg.UserAgent(); err == nil {
+		t.Errorf("comment with '/' should be rejected")
+	}
+}
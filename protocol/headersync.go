@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+const headersTimeout = 30 * time.Second
+
+// syncHeaders download headers from the peer with getheaders until the peer has no more,
+// and add them to the chain after validation.
+// Invalid headers increase the misbehavior score of the peer.
+// Headers too far in the future stop the sync without the score, because the local clock can be behind.
+func syncHeaders(p *Peer, c *chain.HeaderChain, headersCh chan *message.Headers) error {
+	for {
+		getHeaders := message.NewGetHeaders(message.ProtocolVersion, c.BlockLocator(), message.ZeroHash)
+		if err := p.SendMessage(getHeaders); err != nil {
+			return err
+		}
+		select {
+		case headers := <-headersCh:
+			if err := c.AddHeaders(headers.Headers); err != nil {
+				if err == chain.ErrTimeTooNew {
+					// その前までのヘッダで同期を続ける
+					fmt.Printf("Headers synced: height %d, stopped at the header too far in the future\n", c.Tip().Height)
+					return nil
+				}
+				if err == chain.ErrUnconnectedHeader {
+					p.Misbehaving(20, "unconnected headers")
+				} else {
+					p.Misbehaving(banThreshold, "invalid header: "+err.Error())
+				}
+				return err
+			}
+			fmt.Printf("Headers synced: height %d\n", c.Tip().Height)
+			if len(headers.Headers) < message.MaxHeadersPerMsg {
+				return nil
+			}
+		case <-p.quit:
+			return fmt.Errorf("Peer disconnected during header sync")
+		case <-time.After(headersTimeout):
+			return fmt.Errorf("Header sync timed out")
+		}
+	}
+}
+
+// followHeaders keep adding headers announced after the initial sync.
+// Listeners of the chain are notified of the new blocks.
+func followHeaders(p *Peer, c *chain.HeaderChain, headersCh chan *message.Headers) {
+	for {
+		select {
+		case headers := <-headersCh:
+			if err := c.AddHeaders(headers.Headers); err != nil {
+				if err == chain.ErrUnconnectedHeader {
+					// 分岐点が分からないのでlocatorを付けて取り直す
+					if p.Misbehaving(1, "unconnected headers") {
+						return
+					}
+					p.SendMessage(message.NewGetHeaders(message.ProtocolVersion, c.BlockLocator(), message.ZeroHash))
+					continue
+				}
+				if err == chain.ErrTimeTooNew {
+					// 次に通知されたときに取り直す
+					fmt.Println(err.Error())
+					continue
+				}
+				p.Misbehaving(banThreshold, "invalid header: "+err.Error())
+				return
+			}
+			if len(headers.Headers) == message.MaxHeadersPerMsg {
+				p.SendMessage(message.NewGetHeaders(message.ProtocolVersion, c.BlockLocator(), message.ZeroHash))
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
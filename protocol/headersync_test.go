@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestFollowHeadersTimeTooNew(t *testing.T) {
+	s := newCFServer(t, 1, nil)
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	conn, _ := net.Pipe()
+	p := newPeer(conn, s, testAddr(1), DefaultConfig())
+
+	// ローカルの時計が遅れているとpeerの正しいヘッダが未来に見える
+	header := &message.BlockHeader{
+		Version:   4,
+		PrevBlock: c.Tip().Hash,
+		Timestamp: uint32(time.Now().Add(3 * time.Hour).Unix()),
+		Bits:      chain.RegressionNetParams.PowLimitBits,
+	}
+	for chain.CheckProofOfWork(header.BlockHash(), header.Bits, chain.RegressionNetParams.PowLimit) != nil {
+		header.Nonce++
+	}
+	headersCh := make(chan *message.Headers)
+	done := make(chan struct{})
+	go func() {
+		followHeaders(p, c, headersCh)
+		close(done)
+	}()
+	headersCh <- &message.Headers{Headers: []*message.BlockHeader{header}}
+	p.Disconnect()
+	<-done
+	if c.Tip().Height != 0 {
+		t.Errorf("header too far in the future should not be added")
+	}
+	if p.banScore != 0 {
+		t.Errorf("peer should not be punished for the local clock: %d", p.banScore)
+	}
+}
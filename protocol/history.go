@@ -0,0 +1,225 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// TxCategory means how the transaction moves the coins of the wallet.
+type TxCategory string
+
+const (
+	// TxReceive means the transaction pays to the wallet without spending its outputs.
+	TxReceive TxCategory = "receive"
+	// TxSend means the transaction spends the outputs of the wallet and pays to others.
+	TxSend TxCategory = "send"
+	// TxSelf means the transaction spends the outputs of the wallet and pays only to the wallet.
+	TxSelf TxCategory = "self"
+)
+
+// HistoryEntry means a transaction of the wallet in the history.
+// Block fields are empty if the transaction is unconfirmed.
+type HistoryEntry struct {
+	TxID           string     `json:"txid"`
+	Height         uint32     `json:"height,omitempty"`
+	BlockHash      string     `json:"blockhash,omitempty"`
+	BlockTime      uint32     `json:"blocktime,omitempty"`
+	Confirmations  uint32     `json:"confirmations"`
+	Amount         int64      `json:"amount"`        // walletの残高の増減
+	Fee            *uint64    `json:"fee,omitempty"` // 全ての入力が既知の場合のみ
+	Counterparties []string   `json:"counterparties"`
+	Category       TxCategory `json:"category"`
+}
+
+// History show the history of the wallet transactions, as a table or JSON.
+func History(jsonFormat bool) error {
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		wallet, err := syncWallet(p, c, nil)
+		if err != nil {
+			return err
+		}
+		entries := wallet.History(wallet.SyncTip())
+		if jsonFormat {
+			data, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+		printHistory(entries)
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
+
+func printHistory(entries []*HistoryEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TXID\tHEIGHT\tTIME\tCONF\tCATEGORY\tAMOUNT\tFEE\tCOUNTERPARTIES")
+	for _, e := range entries {
+		height, blockTime, fee := "-", "-", "-"
+		if e.BlockHash != "" {
+			height = fmt.Sprint(e.Height)
+			blockTime = time.Unix(int64(e.BlockTime), 0).UTC().Format("2006-01-02 15:04:05")
+		}
+		if e.Fee != nil {
+			fee = fmt.Sprint(*e.Fee)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%+d\t%s\t%s\n",
+			e.TxID, height, blockTime, e.Confirmations, e.Category, e.Amount, fee, strings.Join(e.Counterparties, ","))
+	}
+	w.Flush()
+}
+
+// History return the transactions of the wallet in the order of the height, unconfirmed ones last.
+// Confirmations are counted up to the tip.
+// Transactions which neither pay to nor spend from the wallet are skipped, like the false positives
+// of the bloom filter and the previous transactions kept to know the input values.
+func (w *Wallet) History(tip *chain.HeaderNode) []*HistoryEntry {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	wtxs := []*walletTx{}
+	for _, wtx := range w.txs {
+		if wtx.tx != nil {
+			wtxs = append(wtxs, wtx)
+		}
+	}
+	sort.Slice(wtxs, func(i, j int) bool {
+		a, b := wtxs[i].block, wtxs[j].block
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.Height < b.Height
+	})
+	entries := []*HistoryEntry{}
+	for _, wtx := range wtxs {
+		if e := w.historyEntry(wtx, tip); e != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// historyEntry return the entry of the transaction, or nil if it doesn't move the wallet's outputs.
+func (w *Wallet) historyEntry(wtx *walletTx, tip *chain.HeaderNode) *HistoryEntry {
+	tx := wtx.tx
+	e := &HistoryEntry{
+		TxID:           encodeTxID(tx.ID()),
+		Counterparties: []string{},
+	}
+	if wtx.block != nil {
+		hash := wtx.block.Hash
+		e.Height = wtx.block.Height
+		e.BlockHash = hex.EncodeToString(util.ReverseBytes(hash[:]))
+		e.BlockTime = wtx.block.Header.Timestamp
+		if tip != nil && tip.Height >= wtx.block.Height {
+			e.Confirmations = tip.Height - wtx.block.Height + 1
+		}
+	}
+
+	// 入力のうち前のtxが分かるものを集計する
+	inputValue, spent := uint64(0), uint64(0)
+	inputsKnown := true
+	senders := []string{}
+	inputs := tx.TxIn
+	// coinbaseの入力は送金元ではない
+	if tx.IsCoinBase() {
+		inputs = nil
+		inputsKnown = false
+	}
+	for _, txIn := range inputs {
+		prev, ok := w.txs[txIn.PreviousOutput.Hash]
+		if !ok || prev.tx == nil || int(txIn.PreviousOutput.Index) >= len(prev.tx.TxOut) {
+			inputsKnown = false
+			senders = append(senders, scriptSigAddress(txIn.SignatureScript.Data))
+			continue
+		}
+		prevOut := prev.tx.TxOut[txIn.PreviousOutput.Index]
+		inputValue += prevOut.Value
+		if _, ok := w.matcher.Match(prevOut.PkScript.Data); ok {
+			spent += prevOut.Value
+		} else {
+			senders = append(senders, scriptAddress(prevOut.PkScript.Data))
+		}
+	}
+	outputValue, received := uint64(0), uint64(0)
+	recipients := []string{}
+	for _, txOut := range tx.TxOut {
+		outputValue += txOut.Value
+		if _, ok := w.matcher.Match(txOut.PkScript.Data); ok {
+			received += txOut.Value
+		} else {
+			recipients = append(recipients, scriptAddress(txOut.PkScript.Data))
+		}
+	}
+	if received == 0 && spent == 0 {
+		return nil
+	}
+	e.Amount = int64(received) - int64(spent)
+	if inputsKnown && inputValue >= outputValue {
+		fee := inputValue - outputValue
+		e.Fee = &fee
+	}
+
+	switch {
+	case spent == 0:
+		e.Category = TxReceive
+		e.Counterparties = appendAddresses(e.Counterparties, senders)
+	case len(recipients) == 0:
+		e.Category = TxSelf
+	default:
+		e.Category = TxSend
+		e.Counterparties = appendAddresses(e.Counterparties, recipients)
+	}
+	return e
+}
+
+// scriptAddress return the address of the P2PKH or P2SH output script, or empty string.
+func scriptAddress(script []byte) string {
+	ops, err := common.ParseScript(script)
+	if err != nil {
+		return ""
+	}
+	if len(ops) == 5 && ops[0].Opcode == common.OpDup && ops[1].Opcode == common.OpHash160 &&
+		len(ops[2].Data) == 20 && ops[3].Opcode == common.OpEqualVerify && ops[4].Opcode == common.OpCheckSig {
+		return key.EncodePubKeyHashAddr(ops[2].Data)
+	}
+	if len(ops) == 3 && ops[0].Opcode == common.OpHash160 && len(ops[1].Data) == 20 && ops[2].Opcode == common.OpEqual {
+		return key.EncodeScriptHashAddr(ops[1].Data)
+	}
+	return ""
+}
+
+// scriptSigAddress return the address of the public key in P2PKH signature script, or empty string.
+func scriptSigAddress(scriptSig []byte) string {
+	ops, err := common.ParseScript(scriptSig)
+	if err != nil || len(ops) != 2 {
+		return ""
+	}
+	pubKey := ops[1].Data
+	if len(pubKey) != 33 && len(pubKey) != 65 {
+		return ""
+	}
+	return key.EncodeBitcoinAddr(pubKey)
+}
+
+// appendAddresses append the known addresses which are not in the list yet.
+func appendAddresses(list []string, addrs []string) []string {
+	for _, addr := range addrs {
+		if addr != "" && !containsString(list, addr) {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestWalletHistory(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+
+	// 他人の鍵で署名されたP2PKHの入力から受け取る
+	senderPubKey := append([]byte{0x02}, bytes.Repeat([]byte{0x44}, 32)...)
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	funding.TxIn[0].SignatureScript = common.NewVarStr(append(common.OpPushData(bytes.Repeat([]byte{0x30}, 71)), common.OpPushData(senderPubKey)...))
+	// P2SHに600送ってお釣りを300受け取る
+	scriptHash := bytes.Repeat([]byte{0x55}, 20)
+	send := p2pkhTx(funding.ID(), 300)
+	send.TxOut = append([]*message.TxOut{{
+		Value:    600,
+		PkScript: common.NewVarStr(append(append([]byte{common.OpHash160}, common.OpPushData(scriptHash)...), common.OpEqual)),
+	}}, send.TxOut...)
+	send.TxOut[1].Value = 300
+	self := p2pkhTx(send.ID(), 250)
+	self.TxIn[0].PreviousOutput.Index = 1
+	unconfirmed := p2pkhTx([32]byte{0x02}, 2000)
+	// bloom filterの偽陽性でwalletと関係ないtxも追加される
+	unrelated := p2pkhTx([32]byte{0x03}, 3000)
+	unrelated.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x66}, 20)))
+	for _, tx := range []*message.Transaction{unconfirmed, funding, send, self, unrelated} {
+		w.AddTx(tx)
+	}
+	b1 := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(b1, []message.TxID{funding.ID()})
+	b2 := mineBlock(t, c, b1, 1)
+	w.ConnectBlock(b2, []message.TxID{send.ID(), self.ID(), unrelated.ID()})
+	tip := mineBlock(t, c, b2, 2)
+
+	entries := w.History(tip)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries without unrelated tx, actual %d", len(entries))
+	}
+	e := entries[0]
+	if e.TxID != encodeTxID(funding.ID()) || e.Category != TxReceive || e.Amount != 1000 || e.Confirmations != 3 || e.Fee != nil {
+		t.Errorf("unexpected receive entry: %+v", e)
+	}
+	if len(e.Counterparties) != 1 || e.Counterparties[0] != key.EncodeBitcoinAddr(senderPubKey) {
+		t.Errorf("sender address should be shown: %v", e.Counterparties)
+	}
+	sendEntry, selfEntry := entries[1], entries[2]
+	if sendEntry.TxID != encodeTxID(send.ID()) {
+		sendEntry, selfEntry = selfEntry, sendEntry
+	}
+	if sendEntry.Category != TxSend || sendEntry.Amount != -700 || sendEntry.Fee == nil || *sendEntry.Fee != 100 || sendEntry.Confirmations != 2 {
+		t.Errorf("unexpected send entry: %+v", sendEntry)
+	}
+	if len(sendEntry.Counterparties) != 1 || sendEntry.Counterparties[0] != key.EncodeScriptHashAddr(scriptHash) {
+		t.Errorf("recipient address should be shown: %v", sendEntry.Counterparties)
+	}
+	if selfEntry.Category != TxSelf || selfEntry.Amount != -50 || selfEntry.Fee == nil || *selfEntry.Fee != 50 {
+		t.Errorf("unexpected self entry: %+v", selfEntry)
+	}
+	last := entries[3]
+	if last.TxID != encodeTxID(unconfirmed.ID()) || last.BlockHash != "" || last.Confirmations != 0 {
+		t.Errorf("unconfirmed transaction should be last: %+v", last)
+	}
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bytes"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// ScriptType means the type of the output script paying to the wallet.
+type ScriptType int
+
+const (
+	// ScriptP2PK means <pubkey> OP_CHECKSIG.
+	ScriptP2PK ScriptType = iota
+	// ScriptP2PKH means OP_DUP OP_HASH160 <pubkey hash> OP_EQUALVERIFY OP_CHECKSIG.
+	ScriptP2PKH
+	// ScriptP2WPKH means OP_0 <compressed pubkey hash>. (BIP141)
+	ScriptP2WPKH
+	// ScriptP2SHP2WPKH means P2WPKH wrapped in P2SH.
+	ScriptP2SHP2WPKH
+	// ScriptP2TR means OP_1 <output key> of BIP86 key path only taproot.
+	ScriptP2TR
+	// ScriptMultiSig means bare multisig which the wallet keys can spend alone.
+	ScriptMultiSig
+)
+
+var scriptTypeNames = map[ScriptType]string{
+	ScriptP2PK:       "p2pk",
+	ScriptP2PKH:      "p2pkh",
+	ScriptP2WPKH:     "p2wpkh",
+	ScriptP2SHP2WPKH: "p2sh-p2wpkh",
+	ScriptP2TR:       "p2tr",
+	ScriptMultiSig:   "multisig",
+}
+
+// String return the name of the script type.
+func (t ScriptType) String() string {
+	return scriptTypeNames[t]
+}
+
+// outputMatcher finds the outputs paying to the public key in any script type.
+type outputMatcher struct {
+	scripts  map[string]ScriptType // 公開鍵から導出した出力スクリプト
+	ordered  [][]byte              // 導出した順の出力スクリプト
+	pubKeys  [][]byte              // 圧縮/非圧縮の公開鍵、multisigで探す
+	elements [][]byte              // 出力スクリプトでpushされるデータ
+}
+
+// newOutputMatcher create new matcher of the scripts derived from the public key.
+// Segwit scripts are derived only if the key can be compressed.
+func newOutputMatcher(pubKey []byte) *outputMatcher {
+	m := &outputMatcher{scripts: map[string]ScriptType{}}
+	m.addKey(pubKey)
+	compressed, err := key.CompressPubKey(pubKey)
+	if err != nil {
+		return m
+	}
+	if !bytes.Equal(compressed, pubKey) {
+		m.addKey(compressed)
+	}
+	// segwitは圧縮公開鍵だけを使う
+	keyHash := util.Hash160(compressed)
+	p2wpkh := append([]byte{0x00}, common.OpPushData(keyHash)...)
+	m.add(ScriptP2WPKH, p2wpkh)
+	scriptHash := util.Hash160(p2wpkh)
+	m.add(ScriptP2SHP2WPKH, p2shScript(scriptHash), scriptHash)
+	if outputKey, err := key.TaprootOutputKey(compressed); err == nil {
+		m.add(ScriptP2TR, append([]byte{common.Op1}, common.OpPushData(outputKey)...), outputKey)
+	}
+	return m
+}
+
+func (m *outputMatcher) addKey(pubKey []byte) {
+	m.pubKeys = append(m.pubKeys, pubKey)
+	m.add(ScriptP2PK, append(common.OpPushData(pubKey), common.OpCheckSig), pubKey)
+	pubKeyHash := util.Hash160(pubKey)
+	m.add(ScriptP2PKH, p2pkhScript(pubKeyHash), pubKeyHash)
+}
+
+func (m *outputMatcher) add(scriptType ScriptType, script []byte, elements ...[]byte) {
+	m.scripts[string(script)] = scriptType
+	m.ordered = append(m.ordered, script)
+	m.elements = append(m.elements, elements...)
+}
+
+// Match return the type of the script if it pays to the wallet.
+func (m *outputMatcher) Match(script []byte) (ScriptType, bool) {
+	if scriptType, ok := m.scripts[string(script)]; ok {
+		return scriptType, true
+	}
+	if m.matchMultiSig(script) {
+		return ScriptMultiSig, true
+	}
+	return 0, false
+}
+
+// matchMultiSig checks the bare multisig has enough wallet keys to satisfy the threshold.
+func (m *outputMatcher) matchMultiSig(script []byte) bool {
+	if !common.IsMultiSig(script) {
+		return false
+	}
+	ops, _ := common.ParseScript(script)
+	required := int(ops[0].Opcode-common.Op1) + 1
+	owned := 0
+	for _, op := range ops[1 : len(ops)-2] {
+		for _, pubKey := range m.pubKeys {
+			if bytes.Equal(op.Data, pubKey) {
+				owned++
+				break
+			}
+		}
+	}
+	return owned >= required
+}
+
+// MatchTx return the indexes of all outputs of the transaction paying to the wallet.
+func (m *outputMatcher) MatchTx(tx *message.Transaction) []uint32 {
+	indexes := []uint32{}
+	for i, txOut := range tx.TxOut {
+		if _, ok := m.Match(txOut.PkScript.Data); ok {
+			indexes = append(indexes, uint32(i))
+		}
+	}
+	return indexes
+}
+
+// Scripts return the output scripts derived from the key.
+// Multisig scripts can't be enumerated, so they are not included.
+func (m *outputMatcher) Scripts() [][]byte {
+	return m.ordered
+}
+
+// FilterElements return the data pushed by the output scripts of the wallet,
+// which bloom filters match against. (BIP37)
+func (m *outputMatcher) FilterElements() [][]byte {
+	return m.elements
+}
+
+// p2shScript return the P2SH output script of the script hash.
+func p2shScript(scriptHash []byte) []byte {
+	return bytes.Join([][]byte{
+		{common.OpHash160},
+		common.OpPushData(scriptHash),
+		{common.OpEqual},
+	}, []byte{})
+}
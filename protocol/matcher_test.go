@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+func TestOutputMatcher(t *testing.T) {
+	m := newOutputMatcher(testPubKey)
+	compressed, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	p2wpkh := append([]byte{0x00}, common.OpPushData(util.Hash160(compressed))...)
+	other, _ := hex.DecodeString("02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5")
+	multisig := func(m byte, keys ...[]byte) []byte {
+		script := []byte{common.Op1 + m - 1}
+		for _, k := range keys {
+			script = append(script, common.OpPushData(k)...)
+		}
+		return append(script, common.Op1+byte(len(keys))-1, common.OpCheckMultiSig)
+	}
+
+	tests := []struct {
+		name     string
+		script   []byte
+		expected ScriptType
+		match    bool
+	}{
+		{"p2pk", append(common.OpPushData(testPubKey), common.OpCheckSig), ScriptP2PK, true},
+		{"p2pk compressed", append(common.OpPushData(compressed), common.OpCheckSig), ScriptP2PK, true},
+		{"p2pkh", p2pkhScript(testPubKeyHash), ScriptP2PKH, true},
+		{"p2pkh compressed", p2pkhScript(util.Hash160(compressed)), ScriptP2PKH, true},
+		{"p2wpkh", p2wpkh, ScriptP2WPKH, true},
+		{"p2sh-p2wpkh", p2shScript(util.Hash160(p2wpkh)), ScriptP2SHP2WPKH, true},
+		{"1-of-2 multisig", multisig(1, other, compressed), ScriptMultiSig, true},
+		{"2-of-2 multisig", multisig(2, other, compressed), 0, false},
+		{"other p2pkh", p2pkhScript(util.Hash160(other)), 0, false},
+		{"p2wpkh of uncompressed key", append([]byte{0x00}, common.OpPushData(testPubKeyHash)...), 0, false},
+	}
+	for _, tt := range tests {
+		scriptType, ok := m.Match(tt.script)
+		if ok != tt.match || (ok && scriptType != tt.expected) {
+			t.Errorf("%s: expected %v %v, actual %v %v", tt.name, tt.expected, tt.match, scriptType, ok)
+		}
+	}
+}
+
+func TestOutputMatcherTaproot(t *testing.T) {
+	// BIP86のテストベクタ
+	internalKey, _ := hex.DecodeString("02cc8a4bc64d897bddc5fbc2f670f7a8ba0b386779106cf1223c6fc5d7cd6fc115")
+	outputKey, _ := hex.DecodeString("a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c")
+	m := newOutputMatcher(internalKey)
+	scriptType, ok := m.Match(append([]byte{common.Op1}, common.OpPushData(outputKey)...))
+	if !ok || scriptType != ScriptP2TR {
+		t.Errorf("BIP86 output should match as p2tr: %v %v", scriptType, ok)
+	}
+	found := false
+	for _, e := range m.FilterElements() {
+		found = found || bytes.Equal(e, outputKey)
+	}
+	if !found {
+		t.Errorf("filter elements should include the output key")
+	}
+}
+
+func TestOutputMatcherMatchTx(t *testing.T) {
+	m := newOutputMatcher(testPubKey)
+	base := p2pkhTx([32]byte{0x01}, 1000)
+	other := &message.TxOut{Value: 500, PkScript: common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x22}, 20)))}
+	tx := withOutputs(base, other, base.TxOut[0])
+	indexes := m.MatchTx(tx)
+	if len(indexes) != 2 || indexes[0] != 0 || indexes[1] != 2 {
+		t.Errorf("expected outputs 0 and 2, actual %v", indexes)
+	}
+}
+
+func TestWalletMultipleOutputs(t *testing.T) {
+	w := NewWallet(testPubKey, nil)
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	// P2PKHと最後に導出したP2TRに支払うtx
+	scripts := w.Scripts()
+	funding := withOutputs(p2pkhTx([32]byte{0x01}, 1000), &message.TxOut{
+		Value:    300,
+		PkScript: common.NewVarStr(scripts[len(scripts)-1]),
+	})
+	w.AddTx(funding)
+	w.ConnectBlock(mineBlock(t, c, c.Tip(), 0), []message.TxID{funding.ID()})
+	if b := w.Balances(); b.Confirmed != 1300 {
+		t.Errorf("both outputs should be counted: %+v", b)
+	}
+
+	// 2つ目の出力だけを使うtx
+	spending := p2pkhTx([32]byte{0x02}, 100)
+	spending.TxIn[0].PreviousOutput = &message.OutPoint{Hash: funding.ID(), Index: 1}
+	spending.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x22}, 20)))
+	if !w.IsRelevant(spending) {
+		t.Errorf("tx spending the second output should be relevant")
+	}
+	w.AddTx(spending)
+	w.ConnectBlock(mineBlock(t, c, c.Tip(), 1), []message.TxID{spending.ID()})
+	if b := w.Balances(); b.Confirmed != 1000 {
+		t.Errorf("only the first output should be left: %+v", b)
+	}
+	if len(w.SignableUTXOs()) != 1 {
+		t.Errorf("p2pkh output should be signable")
+	}
+}
+
+// withOutputs return the copy of the transaction with the outputs appended.
+func withOutputs(tx *message.Transaction, txOuts ...*message.TxOut) *message.Transaction {
+	return message.NewTransaction(tx.Version, tx.TxIn, append(tx.TxOut, txOuts...), tx.LockTime)
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+// mempoolWait means how long to wait for the transactions announced for the mempool request.
+const mempoolWait = 5 * time.Second
+
+// requestMempool ask the peer to announce the transactions in its mempool. (BIP35)
+// Only peers offering NODE_BLOOM accept mempool message, others disconnect us.
+// It returns false if the peer doesn't support it.
+func requestMempool(p *Peer) (bool, error) {
+	if p.version == nil || !p.version.HasServices(message.SFNodeBloom) {
+		return false, nil
+	}
+	if err := p.SendMessage(&message.MemPool{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// trackUnconfirmed add the transactions relayed by the peer to the wallet if they are related to it.
+// They are counted as unconfirmed until a block including them is applied.
+// All relayed transactions are also tracked by the fee estimator.
+func trackUnconfirmed(p *Peer, c *chain.HeaderChain, wallet *Wallet, estimator *FeeEstimator, txCh chan *message.Transaction) {
+	for {
+		select {
+		case tx := <-txCh:
+			addUnconfirmedTx(wallet, tx)
+			estimator.ProcessTx(tx, c.Tip().Height)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// addUnconfirmedTx add the transaction to the wallet if it pays to the wallet or spends an output of it.
+func addUnconfirmedTx(wallet *Wallet, tx *message.Transaction) {
+	if !wallet.IsRelevant(tx) {
+		return
+	}
+	wallet.AddTx(tx)
+	fmt.Printf("tx %s received unconfirmed\n", encodeTxID(tx.ID()))
+}
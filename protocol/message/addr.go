@@ -0,0 +1,69 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// MaxAddrPerMsg means the max number of addresses in addr/addrv2 message.
+const MaxAddrPerMsg = 1000
+
+// Addr means addr message.
+// https://en.bitcoin.it/wiki/Protocol_documentation#addr
+type Addr struct {
+	Count    *common.VarInt
+	AddrList []*common.TimedNetAddr
+}
+
+// NewAddr create new addr message.
+func NewAddr(addrList []*common.TimedNetAddr) *Addr {
+	return &Addr{
+		Count:    common.NewVarInt(uint64(len(addrList))),
+		AddrList: addrList,
+	}
+}
+
+// DecodeAddr decode byte slice to Addr.
+func DecodeAddr(b []byte) (*Addr, error) {
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if count.Data > MaxAddrPerMsg {
+		return nil, fmt.Errorf("Decode Addr failed, too many addresses: %d", count.Data)
+	}
+	b = b[len(count.Encode()):]
+	if uint64(len(b)) != count.Data*uint64(common.TimedNetAddrLen) {
+		return nil, fmt.Errorf("Decode Addr failed, invalid input: %v", b)
+	}
+	addrList := []*common.TimedNetAddr{}
+	for i := 0; uint64(i) < count.Data; i++ {
+		var arr [common.TimedNetAddrLen]byte
+		copy(arr[:], b[i*common.TimedNetAddrLen:(i+1)*common.TimedNetAddrLen])
+		addrList = append(addrList, common.DecodeTimedNetAddr(arr))
+	}
+	return &Addr{
+		Count:    count,
+		AddrList: addrList,
+	}, nil
+}
+
+// CommandName return "addr".
+func (a *Addr) CommandName() string {
+	return "addr"
+}
+
+// Encode encode addr message to byte slice.
+func (a *Addr) Encode() []byte {
+	addrBytes := [][]byte{}
+	for _, addr := range a.AddrList {
+		encoded := addr.Encode()
+		addrBytes = append(addrBytes, encoded[:])
+	}
+	return bytes.Join([][]byte{
+		a.Count.Encode(),
+		bytes.Join(addrBytes, []byte{}),
+	}, []byte{})
+}
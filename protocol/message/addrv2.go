@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// AddrV2 means addrv2 message.
+// https://github.com/bitcoin/bips/blob/master/bip-0155.mediawiki
+type AddrV2 struct {
+	Count    *common.VarInt
+	AddrList []*common.NetAddrV2
+}
+
+// NewAddrV2 create new addrv2 message.
+func NewAddrV2(addrList []*common.NetAddrV2) *AddrV2 {
+	return &AddrV2{
+		Count:    common.NewVarInt(uint64(len(addrList))),
+		AddrList: addrList,
+	}
+}
+
+// DecodeAddrV2 decode byte slice to AddrV2.
+func DecodeAddrV2(b []byte) (*AddrV2, error) {
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if count.Data > MaxAddrPerMsg {
+		return nil, fmt.Errorf("Decode AddrV2 failed, too many addresses: %d", count.Data)
+	}
+	b = b[len(count.Encode()):]
+	addrList := []*common.NetAddrV2{}
+	for i := 0; uint64(i) < count.Data; i++ {
+		addr, err := common.DecodeNetAddrV2(b)
+		if err != nil {
+			return nil, err
+		}
+		addrList = append(addrList, addr)
+		b = b[len(addr.Encode()):]
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("Decode AddrV2 failed, %d bytes left", len(b))
+	}
+	return &AddrV2{
+		Count:    count,
+		AddrList: addrList,
+	}, nil
+}
+
+// CommandName return "addrv2".
+func (a *AddrV2) CommandName() string {
+	return "addrv2"
+}
+
+// Encode encode addrv2 message to byte slice.
+func (a *AddrV2) Encode() []byte {
+	addrBytes := [][]byte{}
+	for _, addr := range a.AddrList {
+		addrBytes = append(addrBytes, addr.Encode())
+	}
+	return bytes.Join([][]byte{
+		a.Count.Encode(),
+		bytes.Join(addrBytes, []byte{}),
+	}, []byte{})
+}
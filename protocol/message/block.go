@@ -0,0 +1,200 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// witnessCommitmentHeader means OP_RETURN, push 36 bytes and the commitment header 0xaa21a9ed. (BIP141)
+var witnessCommitmentHeader = []byte{common.OpReturn, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// Block means block message which contains the header and all transactions.
+// https://en.bitcoin.it/wiki/Protocol_documentation#block
+type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+}
+
+// NewBlock create new block of the header and the transactions.
+func NewBlock(header *BlockHeader, txs []*Transaction) *Block {
+	return &Block{
+		BlockHeader:  *header,
+		Transactions: txs,
+	}
+}
+
+// DecodeBlock decode byte slice to Block.
+// Transactions can be serialized with or without witness.
+func DecodeBlock(b []byte) (*Block, error) {
+	header, err := DecodeBlockHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	b = b[BlockHeaderLen:]
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if count.Data == 0 || count.Data > maxTxPerBlock {
+		return nil, fmt.Errorf("Invalid number of transactions in block: %d", count.Data)
+	}
+	b = b[len(count.Encode()):]
+	txs := []*Transaction{}
+	for i := uint64(0); i < count.Data; i++ {
+		tx, size, err := decodeTransactionPrefix(b)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("Decode block failed, %d bytes left", len(b))
+	}
+	return NewBlock(header, txs), nil
+}
+
+// CommandName return "block".
+func (b *Block) CommandName() string {
+	return "block"
+}
+
+// Encode encode the block. Transactions with witness are encoded in BIP144 format.
+func (b *Block) Encode() []byte {
+	res := [][]byte{b.BlockHeader.Encode(), common.NewVarInt(uint64(len(b.Transactions))).Encode()}
+	for _, tx := range b.Transactions {
+		res = append(res, tx.EncodeWitness())
+	}
+	return bytes.Join(res, []byte{})
+}
+
+// TxIDs return the ids of the transactions in the block.
+func (b *Block) TxIDs() [][32]byte {
+	txIDs := [][32]byte{}
+	for _, tx := range b.Transactions {
+		txIDs = append(txIDs, tx.ID())
+	}
+	return txIDs
+}
+
+// Validate checks the transactions are committed by the block header.
+// The peer can't change the transactions without breaking the proof of work.
+// The witness commitment is checked only if witness is true, because the blocks requested
+// without witness have the commitment in the coinbase but the witness is stripped.
+func (b *Block) Validate(witness bool) error {
+	if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinBase() {
+		return fmt.Errorf("First transaction of block is not coinbase")
+	}
+	for _, tx := range b.Transactions[1:] {
+		if tx.IsCoinBase() {
+			return fmt.Errorf("Block has more than one coinbase")
+		}
+	}
+	if err := b.CheckMerkleRoot(); err != nil {
+		return err
+	}
+	if !witness {
+		return nil
+	}
+	return b.CheckWitnessCommitment()
+}
+
+// CheckMerkleRoot recalculate the merkle root of the transactions and compare it with the header.
+// Duplicated transactions which give the same merkle root are rejected. (CVE-2012-2459)
+func (b *Block) CheckMerkleRoot() error {
+	root, mutated := calcMerkleRootMutated(b.TxIDs())
+	if mutated {
+		return ErrDuplicateMerkleHash
+	}
+	if root != b.MerkleRoot {
+		return fmt.Errorf("Merkle root mismatch")
+	}
+	return nil
+}
+
+// CheckWitnessCommitment checks the witness of the transactions are committed by the coinbase.
+// Blocks without the commitment must not have witness.
+// https://github.com/bitcoin/bips/blob/master/bip-0141.mediawiki#commitment-structure
+func (b *Block) CheckWitnessCommitment() error {
+	coinbase := b.Transactions[0]
+	commitment := b.witnessCommitment()
+	if commitment == nil {
+		for _, tx := range b.Transactions {
+			if tx.HasWitness() {
+				return fmt.Errorf("Block has witness without commitment")
+			}
+		}
+		return nil
+	}
+	// coinbaseのwitnessは32byteのreserved valueだけ
+	witness := coinbase.TxIn[0].Witness
+	if len(witness) != 1 || len(witness[0]) != 32 {
+		return fmt.Errorf("Invalid witness reserved value of coinbase")
+	}
+	// coinbaseのwtxidは0とする
+	wtxIDs := [][32]byte{{}}
+	for _, tx := range b.Transactions[1:] {
+		wtxIDs = append(wtxIDs, tx.WitnessHash())
+	}
+	root := CalcMerkleRoot(wtxIDs)
+	expected := util.Hash256(bytes.Join([][]byte{root[:], witness[0]}, []byte{}))
+	if !bytes.Equal(commitment, expected) {
+		return fmt.Errorf("Witness commitment mismatch")
+	}
+	return nil
+}
+
+// witnessCommitment return the commitment in the last matched output of the coinbase, or nil.
+func (b *Block) witnessCommitment() []byte {
+	var commitment []byte
+	for _, txOut := range b.Transactions[0].TxOut {
+		script := txOut.PkScript.Data
+		if len(script) >= 38 && bytes.HasPrefix(script, witnessCommitmentHeader) {
+			commitment = script[6:38]
+		}
+	}
+	return commitment
+}
+
+// NewBlockGetData create getdata of blocks for the hashes.
+// Blocks with witness are requested if witness is true, otherwise the peer strips witness.
+func NewBlockGetData(hashes [][32]byte, witness bool) *GetData {
+	invType := InvTypeMsgBlock
+	if witness {
+		invType = InvTypeMsgWitnessBlock
+	}
+	inventory := []*InvVect{}
+	for _, hash := range hashes {
+		inventory = append(inventory, NewInvVect(invType, hash))
+	}
+	return NewGetData(inventory)
+}
+
+// calcMerkleRootMutated calculate the merkle root and checks any level has
+// the same hashes as a pair, same as bitcoin core's ComputeMerkleRoot.
+func calcMerkleRootMutated(hashes [][32]byte) ([32]byte, bool) {
+	if len(hashes) == 0 {
+		return [32]byte{}, false
+	}
+	mutated := false
+	level := append([][32]byte{}, hashes...)
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := [][32]byte{}
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, hashMerkleBranches(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0], mutated
+}
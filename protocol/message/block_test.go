@@ -0,0 +1,179 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// testTx create a transaction spending prev, with the witness if it is not nil.
+func testTx(prev OutPoint, witness [][]byte) *Transaction {
+	txIn := &TxIn{
+		PreviousOutput:  &prev,
+		SignatureScript: common.NewVarStr([]byte{}),
+		Sequence:        0xFFFFFFFF,
+		Witness:         witness,
+	}
+	txOut := &TxOut{Value: 1000, PkScript: common.NewVarStr([]byte{0x00, 0x14})}
+	return NewTransaction(uint32(2), []*TxIn{txIn}, []*TxOut{txOut}, uint32(0))
+}
+
+// testBlock create a block which has the coinbase and the transactions.
+// The witness commitment is added if any transaction has witness.
+func testBlock(txs ...*Transaction) *Block {
+	coinbase := testTx(OutPoint{Hash: ZeroHash, Index: 0xFFFFFFFF}, nil)
+	block := NewBlock(&BlockHeader{Version: 4}, append([]*Transaction{coinbase}, txs...))
+	for _, tx := range txs {
+		if tx.HasWitness() {
+			reserved := make([]byte, 32)
+			coinbase.TxIn[0].Witness = [][]byte{reserved}
+			wtxIDs := [][32]byte{{}}
+			for _, tx := range txs {
+				wtxIDs = append(wtxIDs, tx.WitnessHash())
+			}
+			root := CalcMerkleRoot(wtxIDs)
+			commitment := util.Hash256(append(root[:], reserved...))
+			coinbase.TxOut = append(coinbase.TxOut, &TxOut{PkScript: common.NewVarStr(append(witnessCommitmentHeader, commitment...))})
+			coinbase.TxOutCount = common.NewVarInt(uint64(len(coinbase.TxOut)))
+			break
+		}
+	}
+	block.MerkleRoot = CalcMerkleRoot(block.TxIDs())
+	return block
+}
+
+func TestDecodeBlock(t *testing.T) {
+	// testnet3のgenesis block
+	b, _ := hex.DecodeString("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff001d1aa4ae180101000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000")
+	block, err := DecodeBlock(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := block.BlockHash()
+	if actual := hex.EncodeToString(util.ReverseBytes(hash[:])); actual != "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943" {
+		t.Errorf("unexpected block hash: %s", actual)
+	}
+	if err := block.Validate(true); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(block.Encode(), b) {
+		t.Errorf("encoded block differs")
+	}
+	if _, err := DecodeBlock(b[:len(b)-1]); err == nil {
+		t.Errorf("truncated block should be rejected")
+	}
+}
+
+func TestBlockWitness(t *testing.T) {
+	legacy := testTx(OutPoint{Hash: [32]byte{0x01}}, nil)
+	segwit := testTx(OutPoint{Hash: [32]byte{0x02}}, [][]byte{{0x30, 0x01}, bytes.Repeat([]byte{0x02}, 33)})
+	block := testBlock(legacy, segwit)
+	if err := block.Validate(true); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBlock(block.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Validate(true); err != nil {
+		t.Fatal(err)
+	}
+	// txidはwitnessを含まない
+	if decoded.Transactions[2].ID() != segwit.ID() || decoded.Transactions[2].WitnessHash() == segwit.ID() {
+		t.Errorf("witness should be committed only by wtxid")
+	}
+	if legacy.WitnessHash() != legacy.ID() {
+		t.Errorf("wtxid of legacy transaction should be txid")
+	}
+
+	// witnessを書き換えるとcommitmentが合わなくなる
+	decoded.Transactions[2].TxIn[0].Witness[0] = []byte{0x31}
+	if err := decoded.Validate(true); err == nil {
+		t.Errorf("modified witness should be rejected")
+	}
+	// witnessを要求しなかったブロックはcommitmentがあってもwitnessがない
+	stripped, err := DecodeBlock(block.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range stripped.Transactions {
+		for _, txIn := range tx.TxIn {
+			txIn.Witness = nil
+		}
+	}
+	if err := stripped.Validate(false); err != nil {
+		t.Errorf("stripped block should be valid without witness: %v", err)
+	}
+	if err := stripped.Validate(true); err == nil {
+		t.Errorf("stripped block should be rejected when witness is requested")
+	}
+	// commitmentのないブロックはwitnessを持てない
+	noCommitment := testBlock(legacy)
+	noCommitment.Transactions = append(noCommitment.Transactions, segwit)
+	noCommitment.MerkleRoot = CalcMerkleRoot(noCommitment.TxIDs())
+	if err := noCommitment.Validate(true); err == nil {
+		t.Errorf("witness without commitment should be rejected")
+	}
+}
+
+func TestBlockMerkleRoot(t *testing.T) {
+	a := testTx(OutPoint{Hash: [32]byte{0x01}}, nil)
+	b := testTx(OutPoint{Hash: [32]byte{0x02}}, nil)
+	block := testBlock(a, b)
+	block.MerkleRoot[0]++
+	if err := block.Validate(true); err == nil {
+		t.Errorf("merkle root mismatch should be rejected")
+	}
+	// 最後のtxを複製しても同じmerkle rootになる
+	mutated := testBlock(a, b)
+	root := mutated.MerkleRoot
+	mutated.Transactions = append(mutated.Transactions, b)
+	if CalcMerkleRoot(mutated.TxIDs()) != root {
+		t.Fatalf("duplicated transaction should give the same merkle root")
+	}
+	if err := mutated.Validate(true); err != ErrDuplicateMerkleHash {
+		t.Errorf("expected %v, actual %v", ErrDuplicateMerkleHash, err)
+	}
+	noCoinbase := testBlock()
+	noCoinbase.Transactions = []*Transaction{a}
+	noCoinbase.MerkleRoot = CalcMerkleRoot(noCoinbase.TxIDs())
+	if err := noCoinbase.Validate(true); err == nil {
+		t.Errorf("block without coinbase should be rejected")
+	}
+}
+
+func TestDecodeWitnessTransaction(t *testing.T) {
+	tx := testTx(OutPoint{Hash: [32]byte{0x01}}, [][]byte{{0x01}})
+	decoded, err := DecodeTransaction(tx.EncodeWitness())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.EncodeWitness(), tx.EncodeWitness()) || !bytes.Equal(decoded.Encode(), tx.Encode()) {
+		t.Errorf("decoded transaction differs")
+	}
+	// 空のwitnessにflagを付けてはいけない
+	tx.TxIn[0].Witness = [][]byte{}
+	legacy := tx.Encode()
+	superfluous := append(append(append([]byte{}, legacy[:4]...), 0x00, 0x01), legacy[4:len(legacy)-4]...)
+	superfluous = append(superfluous, 0x00)
+	superfluous = append(superfluous, legacy[len(legacy)-4:]...)
+	if _, err := DecodeTransaction(superfluous); err == nil {
+		t.Errorf("superfluous witness flag should be rejected")
+	}
+}
+
+func TestTransactionWeight(t *testing.T) {
+	legacy := testTx(OutPoint{Hash: [32]byte{0x01}}, nil)
+	size := uint64(len(legacy.Encode()))
+	if legacy.Weight() != size*4 || legacy.VSize() != size {
+		t.Errorf("legacy weight should be 4 times size: %d %d", legacy.Weight(), legacy.VSize())
+	}
+	// markerとflag、witnessの数、要素の長さと値の5バイトは1倍で数える
+	witness := testTx(OutPoint{Hash: [32]byte{0x01}}, [][]byte{{0x01}})
+	if witness.Weight() != size*4+5 || witness.VSize() != size+2 {
+		t.Errorf("witness bytes should be discounted: %d %d", witness.Weight(), witness.VSize())
+	}
+}
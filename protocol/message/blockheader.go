@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// BlockHeaderLen means byte size of block header.
+const BlockHeaderLen = 80
+
+// BlockHeader means block header.
+// https://en.bitcoin.it/wiki/Block_hashing_algorithm
+type BlockHeader struct {
+	Version    uint32
+	PrevBlock  [32]byte // 前のブロックのハッシュ値
+	MerkleRoot [32]byte // マークルルート
+	Timestamp  uint32
+	Bits       uint32 // 難易度
+	Nonce      uint32
+}
+
+// DecodeBlockHeader decode byte slice to BlockHeader.
+func DecodeBlockHeader(b []byte) (*BlockHeader, error) {
+	if len(b) < BlockHeaderLen {
+		return nil, fmt.Errorf("Decode block header failed, invalid input: %v", b)
+	}
+	header := &BlockHeader{
+		Version:   binary.LittleEndian.Uint32(b[0:4]),
+		Timestamp: binary.LittleEndian.Uint32(b[68:72]),
+		Bits:      binary.LittleEndian.Uint32(b[72:76]),
+		Nonce:     binary.LittleEndian.Uint32(b[76:80]),
+	}
+	copy(header.PrevBlock[:], b[4:36])
+	copy(header.MerkleRoot[:], b[36:68])
+	return header, nil
+}
+
+// Encode encode block header to 80 bytes.
+func (h *BlockHeader) Encode() []byte {
+	versionByte := make([]byte, 4)
+	timestampByte := make([]byte, 4)
+	bitsByte := make([]byte, 4)
+	nonceByte := make([]byte, 4)
+
+	binary.LittleEndian.PutUint32(versionByte, h.Version)
+	binary.LittleEndian.PutUint32(timestampByte, h.Timestamp)
+	binary.LittleEndian.PutUint32(bitsByte, h.Bits)
+	binary.LittleEndian.PutUint32(nonceByte, h.Nonce)
+
+	return bytes.Join([][]byte{
+		versionByte,
+		h.PrevBlock[:],
+		h.MerkleRoot[:],
+		timestampByte,
+		bitsByte,
+		nonceByte,
+	}, []byte{})
+}
+
+// BlockHash return hash256 of the header.
+func (h *BlockHeader) BlockHash() [32]byte {
+	var res [32]byte
+	copy(res[:], util.Hash256(h.Encode()))
+	return res
+}
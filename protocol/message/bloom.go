@@ -0,0 +1,158 @@
+package message
+
+import (
+	"math"
+
+	"github.com/spaolacci/murmur3"
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+const (
+	// MaxBloomFilterSize means the max byte size of the bloom filter. (BIP37)
+	MaxBloomFilterSize = 36000
+	// MaxBloomHashFuncs means the max number of the hash functions. (BIP37)
+	MaxBloomHashFuncs = 50
+
+	// ln2Squared is (ln 2)^2 to calculate the optimal filter size.
+	ln2Squared = math.Ln2 * math.Ln2
+)
+
+const (
+	// BloomUpdateNone means the peer doesn't update the filter.
+	BloomUpdateNone = uint8(0)
+	// BloomUpdateAll means the peer adds the outpoint of every matched output to the filter.
+	BloomUpdateAll = uint8(1)
+	// BloomUpdateP2PubKeyOnly means the peer adds the outpoint only if the matched output is p2pk or multisig.
+	BloomUpdateP2PubKeyOnly = uint8(2)
+)
+
+// BloomFilter means BIP37 bloom filter sent to the peer by filterload.
+// https://github.com/bitcoin/bips/blob/master/bip-0037.mediawiki
+type BloomFilter struct {
+	data      []byte
+	hashFuncs uint32
+	tweak     uint32 // ハッシュ関数を生成する乱数
+	flags     uint8
+	inserted  uint32 // 挿入した要素の数、誤検出率の見積もりに使う
+}
+
+// NewBloomFilter create new empty bloom filter which has the false positive rate fpRate
+// when elements items are inserted. The size and the number of hash functions are
+// calculated as bitcoin core does.
+// https://github.com/bitcoin/bitcoin/blob/master/src/common/bloom.cpp
+func NewBloomFilter(elements uint32, fpRate float64, tweak uint32, flags uint8) *BloomFilter {
+	if elements == 0 {
+		elements = 1
+	}
+	size := uint32(math.Min(-1/ln2Squared*float64(elements)*math.Log(fpRate), MaxBloomFilterSize*8) / 8)
+	if size == 0 {
+		size = 1
+	}
+	hashFuncs := uint32(math.Min(float64(size*8/elements)*math.Ln2, MaxBloomHashFuncs))
+	if hashFuncs == 0 {
+		hashFuncs = 1
+	}
+	return &BloomFilter{
+		data:      make([]byte, size),
+		hashFuncs: hashFuncs,
+		tweak:     tweak,
+		flags:     flags,
+	}
+}
+
+// hash return the bit index of the data for the n-th hash function.
+func (f *BloomFilter) hash(n uint32, data []byte) uint32 {
+	// 0xFBA4C795 comes from here
+	// https://github.com/bitcoin/bitcoin/blob/5961b23898ee7c0af2626c46d5d70e80136578d3/src/bloom.cpp#L52-L56
+	seed := n*0xFBA4C795 + f.tweak
+	return murmur3.Sum32WithSeed(data, seed) % (uint32(len(f.data)) * 8)
+}
+
+// Add insert the data to the filter.
+func (f *BloomFilter) Add(data []byte) {
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		idx := f.hash(i, data)
+		f.data[idx>>3] |= 1 << (7 & idx)
+	}
+	f.inserted++
+}
+
+// Matches checks the data may be inserted to the filter.
+func (f *BloomFilter) Matches(data []byte) bool {
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		idx := f.hash(i, data)
+		if f.data[idx>>3]&(1<<(7&idx)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AddOutPoint insert the outpoint to the filter, so transactions spending it are matched.
+func (f *BloomFilter) AddOutPoint(op *OutPoint) {
+	f.Add(op.Encode())
+}
+
+// MatchesOutPoint checks the outpoint may be inserted to the filter.
+func (f *BloomFilter) MatchesOutPoint(op *OutPoint) bool {
+	return f.Matches(op.Encode())
+}
+
+// FalsePositiveRate return the estimated false positive rate for the number of inserted elements.
+func (f *BloomFilter) FalsePositiveRate() float64 {
+	bits := float64(len(f.data) * 8)
+	k := float64(f.hashFuncs)
+	return math.Pow(1-math.Exp(-k*float64(f.inserted)/bits), k)
+}
+
+// MatchTxAndUpdate checks the transaction matches the filter, and insert the outpoints
+// of the matched outputs following the update flags in the same way as the peer.
+// https://github.com/bitcoin/bitcoin/blob/master/src/common/bloom.cpp (IsRelevantAndUpdate)
+func (f *BloomFilter) MatchTxAndUpdate(tx *Transaction) bool {
+	txID := tx.ID()
+	found := f.Matches(txID[:])
+	for i, txOut := range tx.TxOut {
+		// 不正なscriptでもそれまでのpushは検査する
+		ops, _ := common.ParseScript(txOut.PkScript.Data)
+		for _, op := range ops {
+			if len(op.Data) == 0 || !f.Matches(op.Data) {
+				continue
+			}
+			found = true
+			script := txOut.PkScript.Data
+			if f.flags == BloomUpdateAll ||
+				(f.flags == BloomUpdateP2PubKeyOnly && (common.IsPayToPubKey(script) || common.IsMultiSig(script))) {
+				f.AddOutPoint(&OutPoint{Hash: txID, Index: uint32(i)})
+			}
+			break
+		}
+	}
+	if found {
+		return true
+	}
+	for _, txIn := range tx.TxIn {
+		if f.MatchesOutPoint(txIn.PreviousOutput) {
+			return true
+		}
+		ops, _ := common.ParseScript(txIn.SignatureScript.Data)
+		for _, op := range ops {
+			if len(op.Data) > 0 && f.Matches(op.Data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Filterload create filterload message to send the filter to the peer.
+func (f *BloomFilter) Filterload() *Filterload {
+	filter := make([]byte, len(f.data))
+	copy(filter, f.data)
+	return &Filterload{
+		Count:      common.NewVarInt(uint64(len(filter))),
+		Filter:     filter,
+		NHashFuncs: f.hashFuncs,
+		NTweak:     f.tweak,
+		NFlags:     f.flags,
+	}
+}
@@ -0,0 +1,146 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// https://github.com/bitcoin/bitcoin/blob/master/src/test/bloom_tests.cpp
+func TestBloomFilterVectors(t *testing.T) {
+	tests := []struct {
+		tweak    uint32
+		expected string
+	}{
+		{0, "03614e9b050000000000000001"},
+		{2147483649, "03ce4299050000000100008001"},
+	}
+	for _, tt := range tests {
+		f := NewBloomFilter(3, 0.01, tt.tweak, BloomUpdateAll)
+		f.Add(mustDecodeHex(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8"))
+		if !f.Matches(mustDecodeHex(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Errorf("inserted data should match")
+		}
+		if f.Matches(mustDecodeHex(t, "19108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Errorf("data with one different bit should not match")
+		}
+		f.Add(mustDecodeHex(t, "b5a2c786d9ef4658287ced5914b37a1b4aa32eee"))
+		f.Add(mustDecodeHex(t, "b9300670b4c5366e95b2699e8b18bc75e5f729c5"))
+		actual := hex.EncodeToString(f.Filterload().Encode())
+		if actual != tt.expected {
+			t.Errorf("expected: %s, actual: %s", tt.expected, actual)
+		}
+	}
+}
+
+func TestBloomFilterPubKey(t *testing.T) {
+	// 5Kg1gnAjaLfKiwhhPpGS3QfRg2m6awQvaj98JCZBZQ5SuS2F15C の公開鍵とそのhash160
+	f := NewBloomFilter(2, 0.001, 0, BloomUpdateAll)
+	f.Add(mustDecodeHex(t, "045b81f0017e2091e2edcd5eecf10d5bdd120a5514cb3ee65b8447ec18bfc4575c6d5bf415e54e03b1067934a0f0ba76b01c6b9ab227142ee1d543764b69d901e0"))
+	f.Add(mustDecodeHex(t, "477abbacd4113f2e6b100526222eedd953c26a64"))
+	expected := "038fc16b080000000000000001"
+	if actual := hex.EncodeToString(f.Filterload().Encode()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestBloomFilterOutPoint(t *testing.T) {
+	f := NewBloomFilter(10, 0.0001, 5, BloomUpdateNone)
+	op := &OutPoint{Hash: [32]byte{0x01, 0x02}, Index: 1}
+	f.AddOutPoint(op)
+	if !f.MatchesOutPoint(op) {
+		t.Errorf("inserted outpoint should match")
+	}
+	if f.MatchesOutPoint(&OutPoint{Hash: op.Hash, Index: 2}) {
+		t.Errorf("outpoint with different index should not match")
+	}
+}
+
+func TestBloomFilterSize(t *testing.T) {
+	f := NewBloomFilter(100000, 0.000001, 0, BloomUpdateNone)
+	if len(f.data) != MaxBloomFilterSize || f.hashFuncs > MaxBloomHashFuncs {
+		t.Errorf("filter should be limited to BIP37 maximum: %d bytes, %d funcs", len(f.data), f.hashFuncs)
+	}
+}
+
+func TestMatchTxAndUpdate(t *testing.T) {
+	pubKey := bytes.Repeat([]byte{0x02}, 33)
+	pubKeyHash := bytes.Repeat([]byte{0x11}, 20)
+	p2pkh := common.NewVarStr(bytes.Join([][]byte{
+		{common.OpDup, common.OpHash160},
+		common.OpPushData(pubKeyHash),
+		{common.OpEqualVerify, common.OpCheckSig},
+	}, []byte{}))
+	p2pk := common.NewVarStr(append(common.OpPushData(pubKey), common.OpCheckSig))
+	newTx := func(prev *OutPoint, sigScript []byte, pkScripts ...*common.VarStr) *Transaction {
+		txIn := &TxIn{PreviousOutput: prev, SignatureScript: common.NewVarStr(sigScript), Sequence: 0xffffffff}
+		txOuts := []*TxOut{}
+		for _, pkScript := range pkScripts {
+			txOuts = append(txOuts, &TxOut{Value: 1000, PkScript: pkScript})
+		}
+		return NewTransaction(1, []*TxIn{txIn}, txOuts, 0)
+	}
+
+	tests := []struct {
+		flags       uint8
+		pkScript    *common.VarStr
+		addOutPoint bool
+	}{
+		{BloomUpdateNone, p2pkh, false},
+		{BloomUpdateAll, p2pkh, true},
+		{BloomUpdateP2PubKeyOnly, p2pkh, false},
+		{BloomUpdateP2PubKeyOnly, p2pk, true},
+	}
+	for _, tt := range tests {
+		f := NewBloomFilter(10, 0.000001, 0, tt.flags)
+		f.Add(pubKeyHash)
+		f.Add(pubKey)
+		tx := newTx(&OutPoint{Hash: [32]byte{0xff}}, []byte{}, common.NewVarStr([]byte{0x6a}), tt.pkScript)
+		if !f.MatchTxAndUpdate(tx) {
+			t.Errorf("flags %d: transaction paying to the key should match", tt.flags)
+		}
+		op := &OutPoint{Hash: tx.ID(), Index: 1}
+		if f.MatchesOutPoint(op) != tt.addOutPoint {
+			t.Errorf("flags %d: expected outpoint added: %v", tt.flags, tt.addOutPoint)
+		}
+		// outpointを使うtx
+		spend := newTx(op, []byte{}, common.NewVarStr([]byte{0x6a}))
+		if f.MatchTxAndUpdate(spend) != tt.addOutPoint {
+			t.Errorf("flags %d: spending transaction should match only by the added outpoint", tt.flags)
+		}
+	}
+
+	// scriptSigの公開鍵でマッチする
+	f := NewBloomFilter(10, 0.000001, 0, BloomUpdateNone)
+	f.Add(pubKey)
+	spend := newTx(&OutPoint{Hash: [32]byte{0xfe}}, append(common.OpPushData(bytes.Repeat([]byte{0x30}, 71)), common.OpPushData(pubKey)...), common.NewVarStr([]byte{0x6a}))
+	if !f.MatchTxAndUpdate(spend) {
+		t.Errorf("transaction with the public key in scriptSig should match")
+	}
+	if f.MatchTxAndUpdate(newTx(&OutPoint{Hash: [32]byte{0xfd}}, []byte{}, common.NewVarStr([]byte{0x6a}))) {
+		t.Errorf("unrelated transaction should not match")
+	}
+}
+
+func TestFilteradd(t *testing.T) {
+	f, err := NewFilteradd([]byte{0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := hex.EncodeToString(f.Encode()); actual != "020102" {
+		t.Errorf("expected: %s, actual: %s", "020102", actual)
+	}
+	if _, err := NewFilteradd(make([]byte, MaxFilteraddDataSize+1)); err == nil {
+		t.Errorf("too large data should be rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// maxCFCheckpts limits the number of filter headers in cfcheckpt,
+// a message can't be larger than 4MB anyway.
+const maxCFCheckpts = 4000000 / 32
+
+// CFCheckpt means cfcheckpt message. FilterHeaders[i] is the filter header
+// at the height (i+1)*CFCheckptInterval.
+type CFCheckpt struct {
+	FilterType    uint8
+	StopHash      [32]byte
+	FilterHeaders [][32]byte
+}
+
+// NewCFCheckpt create new CFCheckpt.
+func NewCFCheckpt(filterType uint8, stopHash [32]byte, filterHeaders [][32]byte) *CFCheckpt {
+	return &CFCheckpt{
+		FilterType:    filterType,
+		StopHash:      stopHash,
+		FilterHeaders: filterHeaders,
+	}
+}
+
+// DecodeCFCheckpt decode byte slice to CFCheckpt.
+func DecodeCFCheckpt(b []byte) (*CFCheckpt, error) {
+	if len(b) < 33 {
+		return nil, fmt.Errorf("Decode cfcheckpt failed, invalid input: %v", b)
+	}
+	c := &CFCheckpt{FilterType: b[0]}
+	copy(c.StopHash[:], b[1:33])
+	headers, err := decodeHashes(b[33:], maxCFCheckpts)
+	if err != nil {
+		return nil, err
+	}
+	c.FilterHeaders = headers
+	return c, nil
+}
+
+// CommandName return "cfcheckpt".
+func (c *CFCheckpt) CommandName() string {
+	return "cfcheckpt"
+}
+
+// Encode encode cfcheckpt.
+func (c *CFCheckpt) Encode() []byte {
+	return bytes.Join([][]byte{
+		{c.FilterType},
+		c.StopHash[:],
+		encodeHashes(c.FilterHeaders),
+	}, []byte{})
+}
@@ -0,0 +1,90 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// CFHeaders means cfheaders message. It contains the filter hashes of the blocks
+// and the filter header of the block before them, so the receiver can
+// calculate the filter headers.
+type CFHeaders struct {
+	FilterType         uint8
+	StopHash           [32]byte
+	PreviousFilterHead [32]byte // 最初のブロックの前のブロックのフィルタヘッダ
+	FilterHashes       [][32]byte
+}
+
+// NewCFHeaders create new CFHeaders.
+func NewCFHeaders(filterType uint8, stopHash [32]byte, prev [32]byte, filterHashes [][32]byte) *CFHeaders {
+	return &CFHeaders{
+		FilterType:         filterType,
+		StopHash:           stopHash,
+		PreviousFilterHead: prev,
+		FilterHashes:       filterHashes,
+	}
+}
+
+// DecodeCFHeaders decode byte slice to CFHeaders.
+func DecodeCFHeaders(b []byte) (*CFHeaders, error) {
+	if len(b) < 65 {
+		return nil, fmt.Errorf("Decode cfheaders failed, invalid input: %v", b)
+	}
+	c := &CFHeaders{FilterType: b[0]}
+	copy(c.StopHash[:], b[1:33])
+	copy(c.PreviousFilterHead[:], b[33:65])
+	hashes, err := decodeHashes(b[65:], MaxCFHeadersPerMsg)
+	if err != nil {
+		return nil, err
+	}
+	c.FilterHashes = hashes
+	return c, nil
+}
+
+// CommandName return "cfheaders".
+func (c *CFHeaders) CommandName() string {
+	return "cfheaders"
+}
+
+// Encode encode cfheaders.
+func (c *CFHeaders) Encode() []byte {
+	return bytes.Join([][]byte{
+		{c.FilterType},
+		c.StopHash[:],
+		c.PreviousFilterHead[:],
+		encodeHashes(c.FilterHashes),
+	}, []byte{})
+}
+
+// decodeHashes decode the count and the hashes which must fill the rest of the input.
+func decodeHashes(b []byte, max uint64) ([][32]byte, error) {
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if count.Data > max {
+		return nil, fmt.Errorf("Too many hashes: %d", count.Data)
+	}
+	b = b[len(count.Encode()):]
+	if uint64(len(b)) != count.Data*32 {
+		return nil, fmt.Errorf("Decode hashes failed, expected %d hashes, %d bytes", count.Data, len(b))
+	}
+	hashes := [][32]byte{}
+	for i := uint64(0); i < count.Data; i++ {
+		var hash [32]byte
+		copy(hash[:], b[i*32:(i+1)*32])
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func encodeHashes(hashes [][32]byte) []byte {
+	res := [][]byte{common.NewVarInt(uint64(len(hashes))).Encode()}
+	for _, hash := range hashes {
+		h := hash
+		res = append(res, h[:])
+	}
+	return bytes.Join(res, []byte{})
+}
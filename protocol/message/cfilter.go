@@ -0,0 +1,59 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// FilterTypeBasic means the basic filter type. (BIP158)
+const FilterTypeBasic = uint8(0)
+
+// CFilter means cfilter message which contains the compact filter of the block.
+type CFilter struct {
+	FilterType uint8
+	BlockHash  [32]byte
+	Filter     []byte // 要素数から始まるGCSフィルタ
+}
+
+// NewCFilter create new CFilter.
+func NewCFilter(filterType uint8, blockHash [32]byte, filter []byte) *CFilter {
+	return &CFilter{
+		FilterType: filterType,
+		BlockHash:  blockHash,
+		Filter:     filter,
+	}
+}
+
+// DecodeCFilter decode byte slice to CFilter.
+func DecodeCFilter(b []byte) (*CFilter, error) {
+	if len(b) < 33 {
+		return nil, fmt.Errorf("Decode cfilter failed, invalid input: %v", b)
+	}
+	c := &CFilter{FilterType: b[0]}
+	copy(c.BlockHash[:], b[1:33])
+	filter, err := common.DecodeVarStr(b[33:])
+	if err != nil {
+		return nil, err
+	}
+	if len(filter.Encode()) != len(b[33:]) {
+		return nil, fmt.Errorf("Decode cfilter failed, %d bytes left", len(b[33:])-len(filter.Encode()))
+	}
+	c.Filter = filter.Data
+	return c, nil
+}
+
+// CommandName return "cfilter".
+func (c *CFilter) CommandName() string {
+	return "cfilter"
+}
+
+// Encode encode cfilter.
+func (c *CFilter) Encode() []byte {
+	return bytes.Join([][]byte{
+		{c.FilterType},
+		c.BlockHash[:],
+		common.NewVarStr(c.Filter).Encode(),
+	}, []byte{})
+}
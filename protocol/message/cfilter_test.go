@@ -0,0 +1,63 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestGetCFHeadersEncode(t *testing.T) {
+	g := NewGetCFHeaders(FilterTypeBasic, 1000, [32]byte{0x01})
+	expected := "00e8030000" + "01" + hex.EncodeToString(make([]byte, 31))
+	if actual := hex.EncodeToString(g.Encode()); actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+	if g.CommandName() != "getcfheaders" {
+		t.Errorf("unexpected command name: %s", g.CommandName())
+	}
+}
+
+func TestCFilterDecode(t *testing.T) {
+	c := NewCFilter(FilterTypeBasic, [32]byte{0x01}, []byte{0x01, 0x9d, 0xfc, 0xa8})
+	decoded, err := DecodeCFilter(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockHash != c.BlockHash || !bytes.Equal(decoded.Filter, c.Filter) {
+		t.Errorf("decoded cfilter differs")
+	}
+	if _, err := DecodeCFilter(append(c.Encode(), 0x00)); err == nil {
+		t.Errorf("trailing bytes should be rejected")
+	}
+	if _, err := DecodeCFilter(c.Encode()[:35]); err == nil {
+		t.Errorf("truncated filter should be rejected")
+	}
+}
+
+func TestCFHeadersDecode(t *testing.T) {
+	c := NewCFHeaders(FilterTypeBasic, [32]byte{0x01}, [32]byte{0x02}, [][32]byte{{0x03}, {0x04}})
+	decoded, err := DecodeCFHeaders(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), c.Encode()) {
+		t.Errorf("decoded cfheaders differs")
+	}
+	if _, err := DecodeCFHeaders(c.Encode()[:len(c.Encode())-1]); err == nil {
+		t.Errorf("truncated hashes should be rejected")
+	}
+}
+
+func TestCFCheckptDecode(t *testing.T) {
+	c := NewCFCheckpt(FilterTypeBasic, [32]byte{0x01}, [][32]byte{{0x03}})
+	decoded, err := DecodeCFCheckpt(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), c.Encode()) {
+		t.Errorf("decoded cfcheckpt differs")
+	}
+	if _, err := DecodeCFCheckpt(append(c.Encode(), 0x00)); err == nil {
+		t.Errorf("trailing bytes should be rejected")
+	}
+}
@@ -0,0 +1,32 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FeeFilter means feefilter message. The peer doesn't announce transactions
+// which fee rate is below FeeRate in satoshis per 1000 virtual bytes. (BIP133)
+type FeeFilter struct {
+	FeeRate uint64
+}
+
+// DecodeFeeFilter decode byte slice to FeeFilter.
+func DecodeFeeFilter(b []byte) (*FeeFilter, error) {
+	if len(b) != 8 {
+		return nil, fmt.Errorf("Decode feefilter failed, invalid input: %v", b)
+	}
+	return &FeeFilter{FeeRate: binary.LittleEndian.Uint64(b)}, nil
+}
+
+// CommandName return "feefilter".
+func (f *FeeFilter) CommandName() string {
+	return "feefilter"
+}
+
+// Encode encode feefilter.
+func (f *FeeFilter) Encode() []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, f.FeeRate)
+	return b
+}
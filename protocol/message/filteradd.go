@@ -0,0 +1,33 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// MaxFilteraddDataSize follows bitcoin core's MAX_SCRIPT_ELEMENT_SIZE.
+const MaxFilteraddDataSize = 520
+
+// Filteradd means filteradd message which adds the data to the bloom filter of the peer.
+type Filteradd struct {
+	Data *common.VarStr
+}
+
+// NewFilteradd create new Filteradd.
+func NewFilteradd(data []byte) (*Filteradd, error) {
+	if len(data) > MaxFilteraddDataSize {
+		return nil, fmt.Errorf("Filteradd data is too large: %d bytes", len(data))
+	}
+	return &Filteradd{Data: common.NewVarStr(data)}, nil
+}
+
+// CommandName return "filteradd".
+func (f *Filteradd) CommandName() string {
+	return "filteradd"
+}
+
+// Encode encode filteradd.
+func (f *Filteradd) Encode() []byte {
+	return f.Data.Encode()
+}
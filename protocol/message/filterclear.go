@@ -0,0 +1,14 @@
+package message
+
+// Filterclear means filterclear message which removes the bloom filter from the peer.
+type Filterclear struct{}
+
+// CommandName return "filterclear".
+func (f *Filterclear) CommandName() string {
+	return "filterclear"
+}
+
+// Encode encode filterclear.
+func (f *Filterclear) Encode() []byte {
+	return []byte{}
+}
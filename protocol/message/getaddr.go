@@ -0,0 +1,14 @@
+package message
+
+// GetAddr means getaddr message, which requests known active peers.
+type GetAddr struct{}
+
+// CommandName return "getaddr".
+func (g *GetAddr) CommandName() string {
+	return "getaddr"
+}
+
+// Encode encode getaddr.
+func (g *GetAddr) Encode() []byte {
+	return []byte{}
+}
@@ -0,0 +1,34 @@
+package message
+
+import "bytes"
+
+// CFCheckptInterval means the interval of the heights of the filter headers in cfcheckpt. (BIP157)
+const CFCheckptInterval = 1000
+
+// GetCFCheckpt means getcfcheckpt message which requests the filter headers
+// at every CFCheckptInterval blocks up to StopHash.
+type GetCFCheckpt struct {
+	FilterType uint8
+	StopHash   [32]byte
+}
+
+// NewGetCFCheckpt create new GetCFCheckpt.
+func NewGetCFCheckpt(filterType uint8, stopHash [32]byte) *GetCFCheckpt {
+	return &GetCFCheckpt{
+		FilterType: filterType,
+		StopHash:   stopHash,
+	}
+}
+
+// CommandName return "getcfcheckpt".
+func (g *GetCFCheckpt) CommandName() string {
+	return "getcfcheckpt"
+}
+
+// Encode encode getcfcheckpt.
+func (g *GetCFCheckpt) Encode() []byte {
+	return bytes.Join([][]byte{
+		{g.FilterType},
+		g.StopHash[:],
+	}, []byte{})
+}
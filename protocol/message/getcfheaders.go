@@ -0,0 +1,23 @@
+package message
+
+// MaxCFHeadersPerMsg means the max number of filter hashes in one cfheaders. (BIP157)
+const MaxCFHeadersPerMsg = 2000
+
+// GetCFHeaders means getcfheaders message which requests the filter hashes
+// of the blocks from StartHeight to StopHash.
+// The format is same as getcfilters.
+type GetCFHeaders struct {
+	GetCFilters
+}
+
+// NewGetCFHeaders create new GetCFHeaders.
+func NewGetCFHeaders(filterType uint8, startHeight uint32, stopHash [32]byte) *GetCFHeaders {
+	return &GetCFHeaders{
+		GetCFilters: *NewGetCFilters(filterType, startHeight, stopHash),
+	}
+}
+
+// CommandName return "getcfheaders".
+func (g *GetCFHeaders) CommandName() string {
+	return "getcfheaders"
+}
@@ -0,0 +1,43 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MaxGetCFiltersReqRange means the max number of filters requested by one getcfilters. (BIP157)
+const MaxGetCFiltersReqRange = 1000
+
+// GetCFilters means getcfilters message which requests the compact filters
+// of the blocks from StartHeight to StopHash.
+// https://github.com/bitcoin/bips/blob/master/bip-0157.mediawiki
+type GetCFilters struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    [32]byte
+}
+
+// NewGetCFilters create new GetCFilters.
+func NewGetCFilters(filterType uint8, startHeight uint32, stopHash [32]byte) *GetCFilters {
+	return &GetCFilters{
+		FilterType:  filterType,
+		StartHeight: startHeight,
+		StopHash:    stopHash,
+	}
+}
+
+// CommandName return "getcfilters".
+func (g *GetCFilters) CommandName() string {
+	return "getcfilters"
+}
+
+// Encode encode getcfilters.
+func (g *GetCFilters) Encode() []byte {
+	startHeightByte := make([]byte, 4)
+	binary.LittleEndian.PutUint32(startHeightByte, g.StartHeight)
+	return bytes.Join([][]byte{
+		{g.FilterType},
+		startHeightByte,
+		g.StopHash[:],
+	}, []byte{})
+}
@@ -0,0 +1,19 @@
+package message
+
+// Getheaders means getheaders message.
+// The format is same as getblocks.
+type Getheaders struct {
+	Getblocks
+}
+
+// NewGetHeaders create new Getheaders.
+func NewGetHeaders(version uint32, blockLocatorHashes [][32]byte, hashStop [32]byte) *Getheaders {
+	return &Getheaders{
+		Getblocks: *NewGetBlocks(version, blockLocatorHashes, hashStop),
+	}
+}
+
+// CommandName return "getheaders"
+func (g *Getheaders) CommandName() string {
+	return "getheaders"
+}
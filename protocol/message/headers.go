@@ -0,0 +1,70 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+)
+
+// MaxHeadersPerMsg means the max number of headers in one headers message.
+const MaxHeadersPerMsg = 2000
+
+// Headers means headers message.
+type Headers struct {
+	Headers []*BlockHeader
+}
+
+// NewHeaders create new Headers.
+func NewHeaders(headers []*BlockHeader) *Headers {
+	return &Headers{
+		Headers: headers,
+	}
+}
+
+// CommandName return "headers"
+func (h *Headers) CommandName() string {
+	return "headers"
+}
+
+// DecodeHeaders decode byte slice to Headers.
+// Each header is followed by transaction count which is always 0.
+func DecodeHeaders(b []byte) (*Headers, error) {
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	if count.Data > MaxHeadersPerMsg {
+		return nil, fmt.Errorf("Too many headers: %d", count.Data)
+	}
+	b = b[len(count.Encode()):]
+	headers := []*BlockHeader{}
+	for i := uint64(0); i < count.Data; i++ {
+		header, err := DecodeBlockHeader(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[BlockHeaderLen:]
+		txCount, err := common.DecodeVarInt(b)
+		if err != nil {
+			return nil, err
+		}
+		if txCount.Data != 0 {
+			return nil, fmt.Errorf("Headers message has non zero transaction count: %d", txCount.Data)
+		}
+		b = b[len(txCount.Encode()):]
+		headers = append(headers, header)
+	}
+	return &Headers{
+		Headers: headers,
+	}, nil
+}
+
+// Encode encode headers message.
+func (h *Headers) Encode() []byte {
+	res := [][]byte{common.NewVarInt(uint64(len(h.Headers))).Encode()}
+	for _, header := range h.Headers {
+		res = append(res, header.Encode(), []byte{0x00})
+	}
+	return bytes.Join(res, []byte{})
+}
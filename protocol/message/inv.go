@@ -24,6 +24,15 @@ const (
 	// InvTypeMsgCmpctBlock means inv type MSG_CMPCT_BLOCK.
 	InvTypeMsgCmpctBlock = uint32(4)
 
+	// InvTypeMsgWitnessFlag means the flag to request the object with witness data. (BIP144)
+	InvTypeMsgWitnessFlag = uint32(1 << 30)
+
+	// InvTypeMsgWitnessTx means inv type MSG_WITNESS_TX.
+	InvTypeMsgWitnessTx = InvTypeMsgTx | InvTypeMsgWitnessFlag
+
+	// InvTypeMsgWitnessBlock means inv type MSG_WITNESS_BLOCK.
+	InvTypeMsgWitnessBlock = InvTypeMsgBlock | InvTypeMsgWitnessFlag
+
 	// InvvectSize means invvect's byte size.
 	InvvectSize = 36
 )
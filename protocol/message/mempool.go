@@ -0,0 +1,15 @@
+package message
+
+// MemPool means mempool message which requests the transactions in the mempool of the peer. (BIP35)
+// The peer announces them by inv, filtered by the bloom filter if it is loaded.
+type MemPool struct{}
+
+// CommandName return "mempool".
+func (m *MemPool) CommandName() string {
+	return "mempool"
+}
+
+// Encode encode mempool.
+func (m *MemPool) Encode() []byte {
+	return []byte{}
+}
@@ -3,8 +3,8 @@ package message
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"math"
 
 	"github.com/tanishiking/btcwallet/protocol/common"
 	"github.com/tanishiking/btcwallet/util"
@@ -13,12 +13,7 @@ import (
 // Merkleblock means filtered block.
 // https://en.bitcoin.it/wiki/Protocol_documentation#filterload.2C_filteradd.2C_filterclear.2C_merkleblock
 type Merkleblock struct {
-	Version           uint32
-	PrevBlock         [32]byte // 前のブロックのハッシュ値
-	MerkleRoot        [32]byte // マークルルート
-	Timestamp         uint32
-	Bits              uint32 // 難易度
-	Nonce             uint32
+	BlockHeader
 	TotalTransactions uint32 // ブロックに含まれるトランザクションの数
 	NHashes           *common.VarInt
 	Hashes            [][32]byte // マークルパスを構築するためのハッシュ列
@@ -31,49 +26,18 @@ func (m *Merkleblock) CommandName() string {
 	return "merkleblock"
 }
 
-// BlockHash return hash of this merkleblock.
-// hash256 of version to nonce.
-func (m *Merkleblock) BlockHash() [32]byte {
-	var res [32]byte
-	versionByte := make([]byte, 4)
-	timestampByte := make([]byte, 4)
-	bitsByte := make([]byte, 4)
-	nonceByte := make([]byte, 4)
-
-	binary.LittleEndian.PutUint32(versionByte, m.Version)
-	binary.LittleEndian.PutUint32(timestampByte, m.Timestamp)
-	binary.LittleEndian.PutUint32(bitsByte, m.Bits)
-	binary.LittleEndian.PutUint32(nonceByte, m.Nonce)
-
-	bs := bytes.Join([][]byte{
-		versionByte,
-		m.PrevBlock[:],
-		m.MerkleRoot[:],
-		timestampByte,
-		bitsByte,
-		nonceByte,
-	}, []byte{})
-
-	copy(res[:], util.Hash256(bs))
-	return res
-}
-
 // DecodeMerkleBlock decode byte slice to merkleblock
 func DecodeMerkleBlock(b []byte) (*Merkleblock, error) {
-	if len(b) < 84 {
+	if len(b) < BlockHeaderLen+4 {
 		return nil, fmt.Errorf("Decode merkle block failed, invalid input: %v", b)
 	}
-	version := binary.LittleEndian.Uint32(b[0:4])
-	var prevBlockArr [32]byte
-	var merkleRootArr [32]byte
-	copy(prevBlockArr[:], b[4:36])
-	copy(merkleRootArr[:], b[36:68])
-	timestamp := binary.LittleEndian.Uint32(b[68:72])
-	bits := binary.LittleEndian.Uint32(b[72:76])
-	nonce := binary.LittleEndian.Uint32(b[76:80])
-	totalTransactions := binary.LittleEndian.Uint32(b[80:84])
+	header, err := DecodeBlockHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	totalTransactions := binary.LittleEndian.Uint32(b[BlockHeaderLen : BlockHeaderLen+4])
 
-	b = b[84:]
+	b = b[BlockHeaderLen+4:]
 
 	nHashes, err := common.DecodeVarInt(b)
 	if err != nil {
@@ -81,6 +45,9 @@ func DecodeMerkleBlock(b []byte) (*Merkleblock, error) {
 	}
 	hashes := [][32]byte{}
 	b = b[len(nHashes.Encode()):]
+	if nHashes.Data > uint64(len(b)/32) {
+		return nil, fmt.Errorf("Decode merkle block failed, too few hashes: %d", nHashes.Data)
+	}
 	for i := 0; uint64(i) < nHashes.Data; i++ {
 		var byteArray [32]byte
 		copy(byteArray[:], b[:32])
@@ -93,15 +60,13 @@ func DecodeMerkleBlock(b []byte) (*Merkleblock, error) {
 		return nil, err
 	}
 	b = b[len(nFlags.Encode()):]
+	if uint64(len(b)) < nFlags.Data {
+		return nil, fmt.Errorf("Decode merkle block failed, too few flags: %d", nFlags.Data)
+	}
 	flags := b[:nFlags.Data]
 
 	return &Merkleblock{
-		Version:           version,
-		PrevBlock:         prevBlockArr,
-		MerkleRoot:        merkleRootArr,
-		Timestamp:         timestamp,
-		Bits:              bits,
-		Nonce:             nonce,
+		BlockHeader:       *header,
 		TotalTransactions: totalTransactions,
 		NHashes:           nHashes,
 		Hashes:            hashes,
@@ -110,109 +75,76 @@ func DecodeMerkleBlock(b []byte) (*Merkleblock, error) {
 	}, nil
 }
 
-// FlagBits return flags of the merkleblock.
-func (m *Merkleblock) FlagBits() []bool {
-	res := []bool{}
-	for _, flagByte := range m.Flags {
-		byteInt := uint8(flagByte)
-		for i := 0; i < 8; i++ {
-			// 各バイトの最下位bitからflag列を構築する
-			if (byteInt/uint8(math.Exp2(float64(i))))%uint8(2) == 0x01 {
-				res = append(res, true)
-			} else {
-				res = append(res, false)
-			}
-		}
+// NewMerkleBlock create new merkleblock of the header with the merkle path.
+func NewMerkleBlock(header *BlockHeader, tree *PartialMerkleTree) *Merkleblock {
+	return &Merkleblock{
+		BlockHeader:       *header,
+		TotalTransactions: tree.TotalTransactions,
+		NHashes:           common.NewVarInt(uint64(len(tree.Hashes))),
+		Hashes:            tree.Hashes,
+		NFlags:            common.NewVarInt(uint64(len(tree.Flags))),
+		Flags:             tree.Flags,
 	}
-	return res
 }
 
-// Validate validate the merkle path and return matched transaction ids
-// if the merkle path is valid.
-func (m *Merkleblock) Validate() [][32]byte {
-	hashes := m.Hashes
-	flags := m.FlagBits()
-	height := int(math.Ceil(math.Log2(float64(m.TotalTransactions))))
-	// マークルパスからrootを計算して m.merkleRoot と一致するか計算
-
-	matchedTxs := [][32]byte{}
-	rootHash := calcHash(&hashes, &flags, height, 0, int(m.TotalTransactions), &matchedTxs)
-	if bytes.Equal(rootHash[:], m.MerkleRoot[:]) {
-		return matchedTxs
+// NewTxOutProof build merkleblock which proves the transactions are included in the block,
+// in the same format as gettxoutproof of bitcoin core.
+// txIDs is all transactions in the block, and matched is the transactions to prove.
+func NewTxOutProof(header *BlockHeader, txIDs [][32]byte, matched [][32]byte) (*Merkleblock, error) {
+	if CalcMerkleRoot(txIDs) != header.MerkleRoot {
+		return nil, fmt.Errorf("Transactions don't match the merkle root of the block")
 	}
-	return [][32]byte{}
+	matches := make([]bool, len(txIDs))
+	for _, m := range matched {
+		found := false
+		for i, txID := range txIDs {
+			if txID == m {
+				matches[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Transaction %s is not in the block", hex.EncodeToString(util.ReverseBytes(m[:])))
+		}
+	}
+	return NewMerkleBlock(header, NewPartialMerkleTree(txIDs, matches)), nil
 }
 
-// https://bitcoin.org/en/developer-reference#merkleblock
-func calcHash(hashes *[][32]byte, flags *[]bool, height int, pos int, totalTransactions int, matchedTxs *[][32]byte) [32]byte {
-	if !(*flags)[0] {
-		// フラグが0のとき
-		// 先頭のハッシュをこのノードのtxId/ハッシュとする、これより下のノードは探索しない
-		*flags = (*flags)[1:]
-		h := (*hashes)[0]
-		*hashes = (*hashes)[1:]
-		return h
+// Encode encode the merkleblock.
+func (m *Merkleblock) Encode() []byte {
+	totalTransactionsByte := make([]byte, 4)
+	binary.LittleEndian.PutUint32(totalTransactionsByte, m.TotalTransactions)
+	res := [][]byte{
+		m.BlockHeader.Encode(),
+		totalTransactionsByte,
+		common.NewVarInt(uint64(len(m.Hashes))).Encode(),
 	}
-	if height == 0 {
-		// フラグが1で高さ0(葉ノード)の場合
-		// 先頭のハッシュをこのノードのtxIdとして、このトランザクションはマッチ
-		*flags = (*flags)[1:]
-		h := (*hashes)[0]
-		*hashes = (*hashes)[1:]
-		*matchedTxs = append(*matchedTxs, h)
-		return h
+	for _, hash := range m.Hashes {
+		h := hash
+		res = append(res, h[:])
 	}
-	// calculate left hash
-	*flags = (*flags)[1:]
-	left := calcHash(hashes, flags, height-1, pos*2, totalTransactions, matchedTxs)
-	// calculate right hash if not beyond the end of the array - copy left hash otherwise
-	var right [32]byte
-	if pos*2+1 < calcTreeWidth(uint(height-1), totalTransactions) {
-		right = calcHash(hashes, flags, height-1, pos*2+1, totalTransactions, matchedTxs)
-	} else {
-		copy(right[:], left[:])
-	}
-	// combine subhashes
-	hash := util.Hash256(bytes.Join([][]byte{left[:], right[:]}, []byte{}))
-	var res [32]byte
-	copy(res[:], hash)
-	return res
-}
-
-func calcTreeWidth(height uint, totalTransactions int) int {
-	// refer: https://github.com/bitcoin/bitcoin/blob/5961b23898ee7c0af2626c46d5d70e80136578d3/src/merkleblock.h#L65-L68
-	return (totalTransactions + (1 << height) - 1) >> height
-}
-
-// Merkleblocks is wrapper of slice of merkleblocks
-type Merkleblocks struct {
-	blocks []*Merkleblock
+	res = append(res, common.NewVarInt(uint64(len(m.Flags))).Encode(), m.Flags)
+	return bytes.Join(res, []byte{})
 }
 
-// NewMerkleBlocks create new Merkleblocks struct.
-func NewMerkleBlocks() *Merkleblocks {
-	return &Merkleblocks{
-		[]*Merkleblock{},
+// PartialMerkleTree return the merkle path of the merkleblock.
+func (m *Merkleblock) PartialMerkleTree() *PartialMerkleTree {
+	return &PartialMerkleTree{
+		TotalTransactions: m.TotalTransactions,
+		Hashes:            m.Hashes,
+		Flags:             m.Flags,
 	}
 }
 
-// Add add Merkleblock to the slice.
-func (m *Merkleblocks) Add(b *Merkleblock) {
-	m.blocks = append(m.blocks, b)
-}
-
-// Size return the size of merkleblocks.
-func (m *Merkleblocks) Size() int {
-	return len(m.blocks)
-}
-
-// LatestBlock return latest merkleblock in the slice.
-func (m *Merkleblocks) LatestBlock() *Merkleblock {
-	var latest *Merkleblock
-	for _, block := range m.blocks {
-		if latest == nil || block.Timestamp < latest.Timestamp {
-			latest = block
-		}
+// Validate validate the merkle path and return matched transaction ids
+// if the merkle path is valid and its root is the merkle root of the block.
+func (m *Merkleblock) Validate() ([][32]byte, error) {
+	root, matches, err := m.PartialMerkleTree().ExtractMatches()
+	if err != nil {
+		return nil, err
+	}
+	if root != m.MerkleRoot {
+		return nil, fmt.Errorf("Merkle root mismatch")
 	}
-	return latest
+	return matches, nil
 }
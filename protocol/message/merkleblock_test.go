@@ -0,0 +1,37 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestTxOutProofEncode(t *testing.T) {
+	txIDs := testTxIDs(10)
+	header := &BlockHeader{Version: 4, Timestamp: 1296688602, Bits: 0x207fffff, MerkleRoot: CalcMerkleRoot(txIDs)}
+	mb, err := NewTxOutProof(header, txIDs, [][32]byte{txIDs[2], txIDs[9]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := mb.Encode()
+	if !bytes.Equal(encoded[:BlockHeaderLen], header.Encode()) {
+		t.Errorf("proof should start with the block header")
+	}
+	decoded, err := DecodeMerkleBlock(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Encode(), encoded) {
+		t.Errorf("expected: %s, actual: %s", hex.EncodeToString(encoded), hex.EncodeToString(decoded.Encode()))
+	}
+	matches, err := decoded.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0] != txIDs[2] || matches[1] != txIDs[9] {
+		t.Errorf("proven transactions mismatch")
+	}
+	if _, err := NewTxOutProof(header, txIDs[:9], nil); err == nil {
+		t.Errorf("transactions which don't match the merkle root should be rejected")
+	}
+}
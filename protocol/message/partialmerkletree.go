@@ -0,0 +1,178 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// maxTxPerBlock follows bitcoin core's MAX_BLOCK_WEIGHT / MIN_TRANSACTION_WEIGHT.
+const maxTxPerBlock = 4000000 / 240
+
+// ErrDuplicateMerkleHash is returned when both children of a node are the same hash.
+// It makes different transaction lists have the same merkle root. (CVE-2012-2459)
+var ErrDuplicateMerkleHash = errors.New("Merkle tree has duplicated hashes")
+
+// PartialMerkleTree means the merkle path of the matched transactions in merkleblock.
+// https://github.com/bitcoin/bitcoin/blob/master/src/merkleblock.h
+type PartialMerkleTree struct {
+	TotalTransactions uint32
+	Hashes            [][32]byte
+	Flags             []byte // 最下位bitから順にdepth-firstでのフラグ
+}
+
+// NewPartialMerkleTree build the merkle path of the transactions.
+// matches[i] means txIDs[i] is included as matched transaction.
+func NewPartialMerkleTree(txIDs [][32]byte, matches []bool) *PartialMerkleTree {
+	t := &PartialMerkleTree{
+		TotalTransactions: uint32(len(txIDs)),
+		Hashes:            [][32]byte{},
+	}
+	bits := []bool{}
+	t.build(t.height(), 0, txIDs, matches, &bits)
+	t.Flags = make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			t.Flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return t
+}
+
+// CalcMerkleRoot calculate the merkle root of the transactions.
+func CalcMerkleRoot(txIDs [][32]byte) [32]byte {
+	if len(txIDs) == 0 {
+		return [32]byte{}
+	}
+	t := &PartialMerkleTree{TotalTransactions: uint32(len(txIDs))}
+	return t.calcHash(t.height(), 0, txIDs)
+}
+
+// ExtractMatches validate the merkle path and return the merkle root and the matched transactions.
+// It returns error instead of panicking for any malformed input.
+func (t *PartialMerkleTree) ExtractMatches() ([32]byte, [][32]byte, error) {
+	var root [32]byte
+	if t.TotalTransactions == 0 {
+		return root, nil, fmt.Errorf("Merkle tree has no transactions")
+	}
+	if t.TotalTransactions > maxTxPerBlock {
+		return root, nil, fmt.Errorf("Merkle tree has too many transactions: %d", t.TotalTransactions)
+	}
+	if uint32(len(t.Hashes)) > t.TotalTransactions {
+		return root, nil, fmt.Errorf("Merkle tree has more hashes than transactions: %d", len(t.Hashes))
+	}
+	if len(t.Flags)*8 < len(t.Hashes) {
+		return root, nil, fmt.Errorf("Merkle tree has fewer flags than hashes: %d", len(t.Flags)*8)
+	}
+	e := &merkleExtractor{tree: t, matches: [][32]byte{}}
+	root, err := e.traverse(t.height(), 0)
+	if err != nil {
+		return root, nil, err
+	}
+	// 余ったフラグのbyteやハッシュがあってはいけない
+	if (e.bitsUsed+7)/8 != len(t.Flags) {
+		return root, nil, fmt.Errorf("Merkle tree has unused flag bytes: %d used bits, %d bytes", e.bitsUsed, len(t.Flags))
+	}
+	if e.hashesUsed != len(t.Hashes) {
+		return root, nil, fmt.Errorf("Merkle tree has unused hashes: %d used, %d hashes", e.hashesUsed, len(t.Hashes))
+	}
+	return root, e.matches, nil
+}
+
+// height return the height of the tree, 0 means the tree has only one transaction.
+func (t *PartialMerkleTree) height() int {
+	height := 0
+	for t.treeWidth(height) > 1 {
+		height++
+	}
+	return height
+}
+
+// treeWidth return the number of nodes at the height.
+// https://github.com/bitcoin/bitcoin/blob/5961b23898ee7c0af2626c46d5d70e80136578d3/src/merkleblock.h#L65-L68
+func (t *PartialMerkleTree) treeWidth(height int) int {
+	return (int(t.TotalTransactions) + (1 << uint(height)) - 1) >> uint(height)
+}
+
+// calcHash calculate the hash of the node at the height and the position.
+func (t *PartialMerkleTree) calcHash(height int, pos int, txIDs [][32]byte) [32]byte {
+	if height == 0 {
+		return txIDs[pos]
+	}
+	left := t.calcHash(height-1, pos*2, txIDs)
+	right := left
+	if pos*2+1 < t.treeWidth(height-1) {
+		right = t.calcHash(height-1, pos*2+1, txIDs)
+	}
+	return hashMerkleBranches(left, right)
+}
+
+// build add the hashes and flags of the node in depth-first order.
+func (t *PartialMerkleTree) build(height int, pos int, txIDs [][32]byte, matches []bool, bits *[]bool) {
+	// このノードの下にマッチしたtxがあるか
+	parentOfMatch := false
+	for p := pos << uint(height); p < (pos+1)<<uint(height) && p < len(txIDs); p++ {
+		parentOfMatch = parentOfMatch || matches[p]
+	}
+	*bits = append(*bits, parentOfMatch)
+	if height == 0 || !parentOfMatch {
+		t.Hashes = append(t.Hashes, t.calcHash(height, pos, txIDs))
+		return
+	}
+	t.build(height-1, pos*2, txIDs, matches, bits)
+	if pos*2+1 < t.treeWidth(height-1) {
+		t.build(height-1, pos*2+1, txIDs, matches, bits)
+	}
+}
+
+// merkleExtractor holds the state of the traversal of the partial merkle tree.
+type merkleExtractor struct {
+	tree       *PartialMerkleTree
+	bitsUsed   int
+	hashesUsed int
+	matches    [][32]byte
+}
+
+func (e *merkleExtractor) traverse(height int, pos int) ([32]byte, error) {
+	var res [32]byte
+	if e.bitsUsed >= len(e.tree.Flags)*8 {
+		return res, fmt.Errorf("Merkle tree has too few flags")
+	}
+	parentOfMatch := e.tree.Flags[e.bitsUsed/8]&(1<<uint(e.bitsUsed%8)) != 0
+	e.bitsUsed++
+	if height == 0 || !parentOfMatch {
+		// フラグが0のとき、もしくは葉ノードの場合は先頭のハッシュをこのノードのハッシュとする
+		if e.hashesUsed >= len(e.tree.Hashes) {
+			return res, fmt.Errorf("Merkle tree has too few hashes")
+		}
+		res = e.tree.Hashes[e.hashesUsed]
+		e.hashesUsed++
+		if height == 0 && parentOfMatch {
+			e.matches = append(e.matches, res)
+		}
+		return res, nil
+	}
+	left, err := e.traverse(height-1, pos*2)
+	if err != nil {
+		return res, err
+	}
+	right := left
+	if pos*2+1 < e.tree.treeWidth(height-1) {
+		if right, err = e.traverse(height-1, pos*2+1); err != nil {
+			return res, err
+		}
+		// 右の子が存在するのに左と同じハッシュは不正
+		if right == left {
+			return res, ErrDuplicateMerkleHash
+		}
+	}
+	return hashMerkleBranches(left, right), nil
+}
+
+func hashMerkleBranches(left, right [32]byte) [32]byte {
+	var res [32]byte
+	copy(res[:], util.Hash256(bytes.Join([][]byte{left[:], right[:]}, []byte{})))
+	return res
+}
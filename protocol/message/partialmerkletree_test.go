@@ -0,0 +1,130 @@
+package message
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/util"
+)
+
+func decodeHash(t *testing.T, s string) [32]byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res [32]byte
+	copy(res[:], util.ReverseBytes(b))
+	return res
+}
+
+func testTxIDs(n int) [][32]byte {
+	txIDs := [][32]byte{}
+	for i := 0; i < n; i++ {
+		txIDs = append(txIDs, [32]byte{byte(i), byte(i >> 8), 0x01})
+	}
+	return txIDs
+}
+
+func TestCalcMerkleRoot(t *testing.T) {
+	// mainnet block 100000
+	txIDs := [][32]byte{
+		decodeHash(t, "8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87"),
+		decodeHash(t, "fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4"),
+		decodeHash(t, "6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4"),
+		decodeHash(t, "e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d"),
+	}
+	expected := decodeHash(t, "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766")
+	if CalcMerkleRoot(txIDs) != expected {
+		t.Errorf("merkle root mismatch")
+	}
+}
+
+func TestPartialMerkleTree(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 7, 16, 17, 100} {
+		txIDs := testTxIDs(n)
+		root := CalcMerkleRoot(txIDs)
+		for _, step := range []int{1, 2, 3, 7, n + 1} {
+			matches := make([]bool, n)
+			expected := [][32]byte{}
+			for i := 0; i < n; i += step {
+				matches[i] = true
+				expected = append(expected, txIDs[i])
+			}
+			actualRoot, actual, err := NewPartialMerkleTree(txIDs, matches).ExtractMatches()
+			if err != nil {
+				t.Fatalf("%d txs, step %d: %v", n, step, err)
+			}
+			if actualRoot != root {
+				t.Errorf("%d txs, step %d: root mismatch", n, step)
+			}
+			if len(actual) != len(expected) {
+				t.Fatalf("%d txs, step %d: expected: %d matches, actual: %d", n, step, len(expected), len(actual))
+			}
+			for i := range expected {
+				if actual[i] != expected[i] {
+					t.Errorf("%d txs, step %d: match %d mismatch", n, step, i)
+				}
+			}
+		}
+	}
+}
+
+func TestPartialMerkleTreeMalformed(t *testing.T) {
+	valid := func() *PartialMerkleTree {
+		return NewPartialMerkleTree(testTxIDs(7), []bool{false, true, false, false, false, true, false})
+	}
+	tests := []struct {
+		name   string
+		mutate func(tree *PartialMerkleTree)
+	}{
+		{"no transactions", func(tree *PartialMerkleTree) { tree.TotalTransactions = 0 }},
+		{"too many transactions", func(tree *PartialMerkleTree) { tree.TotalTransactions = maxTxPerBlock + 1 }},
+		{"more hashes than transactions", func(tree *PartialMerkleTree) { tree.TotalTransactions = 1 }},
+		{"too few hashes", func(tree *PartialMerkleTree) { tree.Hashes = tree.Hashes[:len(tree.Hashes)-1] }},
+		{"unused hash", func(tree *PartialMerkleTree) { tree.Hashes = append(tree.Hashes, [32]byte{}) }},
+		{"too few flags", func(tree *PartialMerkleTree) { tree.Flags = tree.Flags[:1] }},
+		{"unused flag byte", func(tree *PartialMerkleTree) { tree.Flags = append(tree.Flags, 0x00) }},
+		{"no flags", func(tree *PartialMerkleTree) { tree.Flags = []byte{} }},
+		{"no hashes", func(tree *PartialMerkleTree) { tree.Hashes = [][32]byte{} }},
+	}
+	for _, tt := range tests {
+		tree := valid()
+		tt.mutate(tree)
+		if _, _, err := tree.ExtractMatches(); err == nil {
+			t.Errorf("%s: should be rejected", tt.name)
+		}
+	}
+}
+
+func TestPartialMerkleTreeDuplicatedHash(t *testing.T) {
+	// [a, b, c] と [a, b, c, c] はmerkle rootが同じになる (CVE-2012-2459)
+	txIDs := testTxIDs(3)
+	mutated := append(testTxIDs(3), txIDs[2])
+	if CalcMerkleRoot(txIDs) != CalcMerkleRoot(mutated) {
+		t.Fatalf("mutated transactions should have the same merkle root")
+	}
+	tree := NewPartialMerkleTree(mutated, []bool{false, false, true, true})
+	if _, _, err := tree.ExtractMatches(); err != ErrDuplicateMerkleHash {
+		t.Errorf("expected: %v, actual: %v", ErrDuplicateMerkleHash, err)
+	}
+}
+
+func TestMerkleblockValidate(t *testing.T) {
+	txIDs := testTxIDs(5)
+	header := &BlockHeader{Version: 4, MerkleRoot: CalcMerkleRoot(txIDs)}
+	mb := NewMerkleBlock(header, NewPartialMerkleTree(txIDs, []bool{false, false, false, true, false}))
+	matches, err := mb.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0] != txIDs[3] {
+		t.Errorf("matched transaction mismatch")
+	}
+	if mb.BlockHash() != header.BlockHash() {
+		t.Errorf("block hash mismatch")
+	}
+	mb.MerkleRoot = [32]byte{0x01}
+	if _, err := mb.Validate(); err == nil {
+		t.Errorf("merkleblock with wrong merkle root should be rejected")
+	}
+}
@@ -6,6 +6,30 @@ import (
 	"github.com/tanishiking/btcwallet/protocol/common"
 )
 
+// reject codes.
+// https://github.com/bitcoin/bips/blob/master/bip-0061.mediawiki
+const (
+	RejectMalformed       = uint8(0x01)
+	RejectInvalid         = uint8(0x10)
+	RejectObsolete        = uint8(0x11)
+	RejectDuplicate       = uint8(0x12)
+	RejectNonstandard     = uint8(0x40)
+	RejectDust            = uint8(0x41)
+	RejectInsufficientFee = uint8(0x42)
+	RejectCheckpoint      = uint8(0x43)
+)
+
+var rejectCodeNames = map[uint8]string{
+	RejectMalformed:       "malformed",
+	RejectInvalid:         "invalid",
+	RejectObsolete:        "obsolete",
+	RejectDuplicate:       "duplicate",
+	RejectNonstandard:     "nonstandard",
+	RejectDust:            "dust",
+	RejectInsufficientFee: "insufficient fee",
+	RejectCheckpoint:      "checkpoint",
+}
+
 // Reject means reject message.
 type Reject struct {
 	Message *common.VarStr
@@ -21,6 +45,9 @@ func DecodeReject(b []byte) (*Reject, error) {
 		return nil, err
 	}
 	length := len(message.Encode())
+	if len(b) < length+1 {
+		return nil, fmt.Errorf("Decode reject failed, invalid input: %v", b)
+	}
 	code := b[length]
 	b = b[length+1:]
 
@@ -38,6 +65,30 @@ func DecodeReject(b []byte) (*Reject, error) {
 	}, nil
 }
 
+// IsKnownCode checks the code is defined in BIP61.
+func (reject *Reject) IsKnownCode() bool {
+	_, ok := rejectCodeNames[reject.Code]
+	return ok
+}
+
+// CodeName return human readable name of the code.
+func (reject *Reject) CodeName() string {
+	if name, ok := rejectCodeNames[reject.Code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%X)", reject.Code)
+}
+
+// Hash return the hash of rejected tx or block in data field if exists.
+func (reject *Reject) Hash() ([32]byte, bool) {
+	var hash [32]byte
+	if len(reject.Data) != 32 {
+		return hash, false
+	}
+	copy(hash[:], reject.Data)
+	return hash, true
+}
+
 // String stringify reject message.
 func (reject *Reject) String() string {
 	return fmt.Sprintf("ccode: %X, message: %s, reason: %s, data: %v", reject.Code, string(reject.Message.Data), string(reject.Reason.Data), reject.Data)
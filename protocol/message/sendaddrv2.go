@@ -0,0 +1,15 @@
+package message
+
+// SendAddrV2 means sendaddrv2 message, which signals support for addrv2 (BIP155).
+// It must be sent between version and verack.
+type SendAddrV2 struct{}
+
+// CommandName return "sendaddrv2".
+func (s *SendAddrV2) CommandName() string {
+	return "sendaddrv2"
+}
+
+// Encode encode sendaddrv2.
+func (s *SendAddrV2) Encode() []byte {
+	return []byte{}
+}
@@ -36,19 +36,43 @@ func NewTransaction(version uint32, txIn []*TxIn, txOut []*TxOut, lockTime uint3
 
 // DecodeTransaction decode byte slice to Transaction.
 func DecodeTransaction(b []byte) (*Transaction, error) {
+	tx, size, err := decodeTransactionPrefix(b)
+	if err != nil {
+		return nil, err
+	}
+	if size != len(b) {
+		return nil, fmt.Errorf("decode Transaction failed, invalid input: %v", b)
+	}
+	return tx, nil
+}
+
+// decodeTransactionPrefix decode the transaction at the head of the byte slice
+// and return it with its byte size. Transactions in a block are decoded by this.
+// Both the legacy and the BIP144 witness serialization are accepted.
+func decodeTransactionPrefix(b []byte) (*Transaction, int, error) {
+	if len(b) < 4 {
+		return nil, 0, fmt.Errorf("decode Transaction failed, invalid input: %v", b)
+	}
+	size := len(b)
 	version := binary.LittleEndian.Uint32(b[0:4])
 	b = b[4:]
 
+	// 入力数0の代わりにmarker 0x00とflag 0x01が続く場合はwitnessを持つ
+	segwit := len(b) >= 2 && b[0] == 0x00 && b[1] == 0x01
+	if segwit {
+		b = b[2:]
+	}
+
 	txInArr := []*TxIn{}
 	txInCount, err := common.DecodeVarInt(b)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	b = b[len(txInCount.Encode()):]
 	for i := 0; uint64(i) < txInCount.Data; i++ {
 		txIn, err := DecodeTxIn(b)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		txInArr = append(txInArr, txIn)
 		len := len(txIn.Encode())
@@ -58,20 +82,36 @@ func DecodeTransaction(b []byte) (*Transaction, error) {
 	txOutArr := []*TxOut{}
 	txOutCount, err := common.DecodeVarInt(b)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	b = b[len(txOutCount.Encode()):]
 	for i := 0; uint64(i) < txOutCount.Data; i++ {
 		txOut, err := DecodeTxOut(b)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		txOutArr = append(txOutArr, txOut)
 		len := len(txOut.Encode())
 		b = b[len:]
 	}
-	if len(b) != 4 {
-		return nil, fmt.Errorf("decode Transaction failed, invalid input: %v", b)
+	if segwit {
+		hasWitness := false
+		for _, txIn := range txInArr {
+			witness, rest, err := decodeWitness(b)
+			if err != nil {
+				return nil, 0, err
+			}
+			txIn.Witness = witness
+			hasWitness = hasWitness || len(witness) > 0
+			b = rest
+		}
+		// witnessが全て空ならflagを付けてはいけない
+		if !hasWitness {
+			return nil, 0, fmt.Errorf("Transaction has superfluous witness flag")
+		}
+	}
+	if len(b) < 4 {
+		return nil, 0, fmt.Errorf("decode Transaction failed, invalid input: %v", b)
 	}
 	lockTime := binary.LittleEndian.Uint32(b[0:4])
 	return &Transaction{
@@ -81,7 +121,30 @@ func DecodeTransaction(b []byte) (*Transaction, error) {
 		TxOutCount: txOutCount,
 		TxOut:      txOutArr,
 		LockTime:   lockTime,
-	}, nil
+	}, size - len(b) + 4, nil
+}
+
+// decodeWitness decode the witness items of a input and return the rest of the byte slice.
+func decodeWitness(b []byte) ([][]byte, []byte, error) {
+	count, err := common.DecodeVarInt(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[len(count.Encode()):]
+	// 各要素は少なくとも1byte使う
+	if count.Data > uint64(len(b)) {
+		return nil, nil, fmt.Errorf("Too many witness items: %d", count.Data)
+	}
+	witness := [][]byte{}
+	for i := uint64(0); i < count.Data; i++ {
+		item, err := common.DecodeVarStr(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		witness = append(witness, item.Data)
+		b = b[len(item.Encode()):]
+	}
+	return witness, b, nil
 }
 
 // HasOutPoint checks the transaction has outpoint as the tx's previous output.
@@ -111,6 +174,39 @@ func (tx *Transaction) FindP2khIndex(fromPubKeyHashed []byte) (int, error) {
 	return 0, fmt.Errorf("No txOut matched to input: %v", fromPubKeyHashed)
 }
 
+// IsCoinBase checks the transaction is the coinbase, which has only one input without previous output.
+func (tx *Transaction) IsCoinBase() bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutput.Hash == ZeroHash && tx.TxIn[0].PreviousOutput.Index == 0xFFFFFFFF
+}
+
+// HasWitness checks any input of the transaction has witness.
+func (tx *Transaction) HasWitness() bool {
+	for _, txIn := range tx.TxIn {
+		if len(txIn.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WitnessHash return wtxid, the hash of the transaction including witness. (BIP141)
+// It is same as the id if the transaction has no witness.
+func (tx *Transaction) WitnessHash() TxID {
+	var res [32]byte
+	copy(res[:], util.Hash256(tx.EncodeWitness()))
+	return res
+}
+
+// Weight return the weight of the transaction, non-witness bytes count 4 and witness bytes count 1. (BIP141)
+func (tx *Transaction) Weight() uint64 {
+	return uint64(len(tx.Encode())*3 + len(tx.EncodeWitness()))
+}
+
+// VSize return the virtual size of the transaction, the weight divided by 4 and rounded up.
+func (tx *Transaction) VSize() uint64 {
+	return (tx.Weight() + 3) / 4
+}
+
 // ID return Transaction id
 func (tx *Transaction) ID() TxID {
 	var res [32]byte
@@ -146,6 +242,26 @@ func (tx *Transaction) Encode() []byte {
 	}, []byte{})
 }
 
+// EncodeWitness encode the transaction with witness in BIP144 format.
+// Transactions without witness are encoded in the legacy format.
+// https://github.com/bitcoin/bips/blob/master/bip-0144.mediawiki
+func (tx *Transaction) EncodeWitness() []byte {
+	if !tx.HasWitness() {
+		return tx.Encode()
+	}
+	legacy := tx.Encode()
+	// 入出力はlegacyと同じで、その前にmarkerとflag、後ろにwitnessを入れる
+	res := [][]byte{legacy[:4], {0x00, 0x01}, legacy[4 : len(legacy)-4]}
+	for _, txIn := range tx.TxIn {
+		res = append(res, common.NewVarInt(uint64(len(txIn.Witness))).Encode())
+		for _, item := range txIn.Witness {
+			res = append(res, common.NewVarStr(item).Encode())
+		}
+	}
+	res = append(res, legacy[len(legacy)-4:])
+	return bytes.Join(res, []byte{})
+}
+
 // CommandName return message's command name.
 func (tx *Transaction) CommandName() string {
 	return "tx"
@@ -173,10 +289,14 @@ type TxIn struct {
 	PreviousOutput  *OutPoint
 	SignatureScript *common.VarStr
 	Sequence        uint32
+	Witness         [][]byte // segwitの入力の証拠、Encodeには含まない
 }
 
 // DecodeTxIn decode byte slice to transaction input.
 func DecodeTxIn(b []byte) (*TxIn, error) {
+	if len(b) < 36 {
+		return nil, fmt.Errorf("Decode TxIn failed, invalid input: %v", b)
+	}
 	var hash [32]byte
 	copy(hash[:], b[0:32])
 	index := binary.LittleEndian.Uint32(b[32:36])
@@ -191,6 +311,9 @@ func DecodeTxIn(b []byte) (*TxIn, error) {
 	}
 	length := len(signatureScript.Encode())
 	b = b[length:]
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Decode TxIn failed, no sequence")
+	}
 	sequence := binary.LittleEndian.Uint32(b[:4])
 	return &TxIn{
 		PreviousOutput:  out,
@@ -218,8 +341,14 @@ type TxOut struct {
 
 // DecodeTxOut decode byte slice to TxOut
 func DecodeTxOut(b []byte) (*TxOut, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("Decode TxOut failed, invalid input: %v", b)
+	}
 	value := binary.LittleEndian.Uint64(b[0:8])
-	pkScript, _ := common.DecodeVarStr(b[8:])
+	pkScript, err := common.DecodeVarStr(b[8:])
+	if err != nil {
+		return nil, err
+	}
 	return &TxOut{
 		Value:    value,
 		PkScript: pkScript,
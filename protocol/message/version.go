@@ -8,6 +8,32 @@ import (
 	"github.com/tanishiking/btcwallet/protocol/common"
 )
 
+const (
+	// ProtocolVersion means the protocol version this wallet speaks.
+	ProtocolVersion = uint32(70016)
+
+	// WtxidRelayVersion means the version which introduced wtxidrelay (BIP339).
+	WtxidRelayVersion = uint32(70016)
+
+	// SFNodeNetwork means the node can serve full blocks.
+	SFNodeNetwork = uint64(1)
+
+	// SFNodeBloom means the node supports bloom filtering (BIP111).
+	SFNodeBloom = uint64(1 << 2)
+
+	// SFNodeWitness means the node can serve witness data (BIP144).
+	SFNodeWitness = uint64(1 << 3)
+
+	// SFNodeCompactFilters means the node serves compact block filters (BIP157).
+	SFNodeCompactFilters = uint64(1 << 6)
+
+	// SFNodeNetworkLimited means the node serves only the last 288 blocks (BIP159).
+	SFNodeNetworkLimited = uint64(1 << 10)
+
+	// SFNodeP2PV2 means the node supports BIP324 v2 transport.
+	SFNodeP2PV2 = uint64(1 << 11)
+)
+
 // Version means version message.
 type Version struct {
 	Version     uint32          // ノードで使われているプロトコルのバージョン番号
@@ -35,11 +61,9 @@ func DecodeVersion(b []byte) (*Version, error) {
 
 	copy(addrRecvArr[:], b[20:46])
 	addrRecv := common.DecodeNetAddr(addrRecvArr)
-	fmt.Println("addrRecv ip: ", addrRecv.IP, addrRecv.Port)
 
 	copy(addrFromArr[:], b[46:72])
 	addrFrom := common.DecodeNetAddr(addrFromArr)
-	fmt.Println("addrFrom ip: ", addrFrom.IP, addrFrom.Port)
 
 	nonce := binary.LittleEndian.Uint64(b[72:80])
 
@@ -49,7 +73,6 @@ func DecodeVersion(b []byte) (*Version, error) {
 		return nil, err
 	}
 	varstrLen := len(userAgent.Encode())
-	fmt.Println("UserAgent: ", string(userAgent.Data))
 
 	if length < 85+varstrLen {
 		return nil, fmt.Errorf("Invalid version message: %#v", b)
@@ -75,6 +98,11 @@ func DecodeVersion(b []byte) (*Version, error) {
 	}, nil
 }
 
+// HasServices checks the node advertises all of the services.
+func (v *Version) HasServices(services uint64) bool {
+	return v.Services&services == services
+}
+
 // CommandName return version.
 func (v *Version) CommandName() string {
 	return "version"
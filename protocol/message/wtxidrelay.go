@@ -0,0 +1,15 @@
+package message
+
+// WtxidRelay means wtxidrelay message, which signals that the node prefers
+// transaction announcement by wtxid (BIP339). It must be sent between version and verack.
+type WtxidRelay struct{}
+
+// CommandName return "wtxidrelay".
+func (w *WtxidRelay) CommandName() string {
+	return "wtxidrelay"
+}
+
+// Encode encode wtxidrelay.
+func (w *WtxidRelay) Encode() []byte {
+	return []byte{}
+}
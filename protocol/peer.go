@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/protocol/v2transport"
+)
+
+const (
+	// testnetPort means default port of testnet.
+	testnetPort = 18333
+
+	// 接続を試すアドレスの最大数
+	maxConnectAttempts = 10
+
+	dialTimeout = 5 * time.Second
+
+	// banThreshold follows bitcoin core's DISCOURAGEMENT_THRESHOLD.
+	banThreshold = 100
+)
+
+// testnetDNSSeeds are used to bootstrap the address book.
+var testnetDNSSeeds = []string{
+	"testnet-seed.bitcoin.jonasschnelli.ch",
+	"seed.tbtc.petertodd.org",
+	"seed.testnet.bitcoin.sprovoost.nl",
+	"testnet-seed.bluematt.me",
+}
+
+// Peer means the remote node which finished version handshake with us.
+type Peer struct {
+	conn            net.Conn
+	transport       Transport         // v1 or BIP324 v2
+	version         *message.Version  // remote peerから受け取ったversion
+	protocolVersion uint32            // 自分とremote peerのうち小さい方のprotocol version
+	addr            *common.NetAddrV2 // remote peerのアドレス
+	addrManager     *AddrManager
+	wtxidRelay      bool // remote peerがwtxidrelayを送ってきたか
+	sendAddrV2      bool // remote peerがsendaddrv2を送ってきたか
+
+	banManager  *BanManager
+	banDuration time.Duration
+	mtx         sync.Mutex
+	banScore    int           // misbehaviorの累計スコア
+	feeFilter   uint64        // remote peerがfeefilterで送ってきた手数料率 sat/kvB
+	quit        chan struct{} // 切断されたらcloseされる
+	closeOnce   sync.Once
+}
+
+// newPeer create the peer on the connection.
+func newPeer(conn net.Conn, transport Transport, addr *common.NetAddrV2, cfg *Config) *Peer {
+	return &Peer{
+		conn:        conn,
+		transport:   transport,
+		addr:        addr,
+		banDuration: cfg.BanDuration,
+		quit:        make(chan struct{}),
+	}
+}
+
+// String return the address of the peer.
+func (p *Peer) String() string {
+	if p.addr != nil {
+		return p.addr.String()
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// Disconnect close the connection to the peer.
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		p.conn.Close()
+		close(p.quit)
+	})
+}
+
+// Misbehaving increase the misbehavior score of the peer.
+// When the score reaches banThreshold, the peer is banned and disconnected.
+// It returns true if the peer was disconnected.
+func (p *Peer) Misbehaving(howMuch int, reason string) bool {
+	p.mtx.Lock()
+	p.banScore += howMuch
+	score := p.banScore
+	p.mtx.Unlock()
+	fmt.Printf("Misbehaving peer %s: %s (score: %d)\n", p, reason, score)
+	if score < banThreshold {
+		return false
+	}
+	// proxy経由でseedに繋いだ場合はアドレスが分からないので切断だけする
+	if p.banManager != nil && p.addr != nil {
+		if err := p.banManager.Ban(p.addr.Host(), p.banDuration, reason); err != nil {
+			fmt.Println("Failed to save ban list: ", err.Error())
+		}
+		fmt.Printf("Banned %s for %v\n", p.addr.Host(), p.banDuration)
+	}
+	p.Disconnect()
+	return true
+}
+
+// handleReject interpret the reject message from the peer.
+// https://github.com/bitcoin/bips/blob/master/bip-0061.mediawiki
+func (p *Peer) handleReject(reject *message.Reject) {
+	if !reject.IsKnownCode() {
+		p.Misbehaving(10, fmt.Sprintf("unknown reject code %X", reject.Code))
+		return
+	}
+	command := string(reject.Message.Data)
+	switch command {
+	case "tx", "block":
+		hash, ok := reject.Hash()
+		if !ok {
+			p.Misbehaving(10, fmt.Sprintf("reject %s without hash", command))
+			return
+		}
+		fmt.Printf("%s %s rejected: %s, %s\n", command, hex.EncodeToString(hash[:]), reject.CodeName(), string(reject.Reason.Data))
+	default:
+		fmt.Printf("%s rejected: %s, %s\n", command, reject.CodeName(), string(reject.Reason.Data))
+		if reject.Code == message.RejectMalformed || reject.Code == message.RejectObsolete {
+			// 自分のメッセージを受け付けないpeerとはこれ以上通信できない
+			p.Misbehaving(banThreshold, fmt.Sprintf("peer rejected %s as %s", command, reject.CodeName()))
+		}
+	}
+}
+
+// handleFeeFilter record the fee rate below which the peer doesn't relay transactions. (BIP133)
+func (p *Peer) handleFeeFilter(f *message.FeeFilter) {
+	p.mtx.Lock()
+	p.feeFilter = f.FeeRate
+	p.mtx.Unlock()
+	fmt.Printf("Peer %s fee filter: %d sat/kvB\n", p, f.FeeRate)
+}
+
+// FeeFilterRate return the fee rate in sat/vB, rounded up, which the peer requires to relay transactions.
+// It is 0 if the peer sent no feefilter.
+func (p *Peer) FeeFilterRate() uint64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return (p.feeFilter + 999) / 1000
+}
+
+// handleAddr add the addresses advertised by the peer to the address book.
+func (p *Peer) handleAddr(addrs []*common.NetAddrV2) {
+	if p.addrManager == nil {
+		return
+	}
+	p.addrManager.AddAddresses(addrs, p.addr)
+	fmt.Printf("Learned %d addresses, known: %d\n", len(addrs), p.addrManager.NumAddresses())
+}
+
+// bootstrapFromDNS resolve DNS seeds and add the results to the address book.
+func bootstrapFromDNS(m *AddrManager) {
+	for _, seed := range testnetDNSSeeds {
+		ips, err := net.LookupIP(seed)
+		if err != nil {
+			fmt.Printf("DNS seed %s lookup failed: %v\n", seed, err)
+			continue
+		}
+		addrs := []*common.NetAddrV2{}
+		for _, ip := range ips {
+			addr := &common.TimedNetAddr{
+				Timestamp: uint32(time.Now().Unix()),
+				NetAddr:   common.NewNetAddr(uint64(1), ip, testnetPort),
+			}
+			addrs = append(addrs, addr.ToV2())
+		}
+		m.AddAddresses(addrs, nil)
+	}
+}
+
+// connectPeer choose the address from the address book, connect to it and
+// finish the version handshake. DNS seeds are used only if the address book
+// is empty or all attempts failed.
+func connectPeer(m *AddrManager, bans *BanManager, cfg *Config) (*Peer, error) {
+	if cfg.Dialer.ResolvesNames() {
+		// proxy経由の場合、DNSの問い合わせが漏れないようにseedのホスト名をそのままproxyに渡す
+		p, err := connectKnownAddress(m, bans, cfg)
+		if err == nil {
+			return p, nil
+		}
+		fmt.Println(err.Error())
+		return connectSeedViaProxy(m, bans, cfg)
+	}
+	if m.NumAddresses() == 0 {
+		bootstrapFromDNS(m)
+	}
+	p, err := connectKnownAddress(m, bans, cfg)
+	if err == nil {
+		return p, nil
+	}
+	fmt.Println(err.Error())
+	bootstrapFromDNS(m)
+	return connectKnownAddress(m, bans, cfg)
+}
+
+func connectKnownAddress(m *AddrManager, bans *BanManager, cfg *Config) (*Peer, error) {
+	reachable := func(addr *common.NetAddrV2) bool {
+		return cfg.Dialer.Reachable(addr) && !bans.IsBannedAddr(addr)
+	}
+	for i := 0; i < maxConnectAttempts; i++ {
+		ka := m.GetAddress(reachable)
+		if ka == nil {
+			break
+		}
+		m.Attempt(ka.Addr)
+		p, err := connectAddress(ka.Addr.String(), ka.Addr, cfg)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		m.Good(ka.Addr)
+		p.addrManager = m
+		p.banManager = bans
+		return p, nil
+	}
+	return nil, fmt.Errorf("Failed to connect to any known peer")
+}
+
+// connectSeedViaProxy connect to DNS seed host names through the proxy.
+// The proxy resolves the name, so we don't know the address of the peer.
+func connectSeedViaProxy(m *AddrManager, bans *BanManager, cfg *Config) (*Peer, error) {
+	for _, seed := range testnetDNSSeeds {
+		p, err := connectAddress(net.JoinHostPort(seed, strconv.Itoa(testnetPort)), nil, cfg)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		p.addrManager = m
+		p.banManager = bans
+		return p, nil
+	}
+	return nil, fmt.Errorf("Failed to connect to any DNS seed via proxy")
+}
+
+// connectAddress dial addr and finish the version handshake.
+// If v2 transport is enabled, it tries BIP324 first and reconnects with v1 when it fails.
+func connectAddress(addr string, remoteAddr *common.NetAddrV2, cfg *Config) (*Peer, error) {
+	var (
+		conn      net.Conn
+		transport Transport
+		err       error
+	)
+	if cfg.V2Transport {
+		conn, transport, err = dialV2(addr, cfg)
+		if err != nil {
+			fmt.Printf("v2 connection to %s failed, fallback to v1: %v\n", addr, err)
+		}
+	}
+	if transport == nil {
+		conn, err = cfg.Dialer.Dial(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to peer %s: %v", addr, err)
+		}
+		transport = newV1Transport(conn)
+	}
+	fmt.Printf("Connected: %#v \n", addr)
+	p, err := handshake(conn, transport, remoteAddr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Handshake with %s failed: %v", addr, err)
+	}
+	return p, nil
+}
+
+// dialV2 dial addr and finish BIP324 handshake.
+func dialV2(addr string, cfg *Config) (net.Conn, Transport, error) {
+	conn, err := cfg.Dialer.Dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := v2transport.NewTransport(conn, networkMagic(), true)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = t.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	fmt.Printf("v2 transport established, session id: %x\n", t.SessionID())
+	return conn, t, nil
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// decodeHash decode the hash in the byte order of bitcoin core's RPC.
+func decodeHash(s string) ([32]byte, error) {
+	var hash [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, fmt.Errorf("Invalid hash %s", s)
+	}
+	copy(hash[:], util.ReverseBytes(b))
+	return hash, nil
+}
+
+// txOutProof build the proof of the transaction in the block in the format of gettxoutproof.
+func txOutProof(block *message.Block, txID [32]byte) ([]byte, error) {
+	mb, err := message.NewTxOutProof(&block.BlockHeader, block.TxIDs(), [][32]byte{txID})
+	if err != nil {
+		return nil, err
+	}
+	return mb.Encode(), nil
+}
+
+// getTxOutProof sync the headers and download the full block to build the proof of the transaction.
+func getTxOutProof(p *Peer, headerChain *chain.HeaderChain, txID [32]byte, blockHash [32]byte) ([]byte, error) {
+	headersCh := make(chan *message.Headers)
+	blockCh := make(chan *message.Merkleblock)
+	txCh := make(chan *message.Transaction)
+	cfCh := newCFChannels()
+
+	go dispatch(p, headerChain, headersCh, blockCh, txCh, cfCh)
+	if config.CheckpointSync {
+		if err := startFromCheckpoint(p, headerChain, headersCh); err != nil {
+			return nil, err
+		}
+	}
+	if err := syncHeaders(p, headerChain, headersCh); err != nil {
+		return nil, err
+	}
+	go followHeaders(p, headerChain, headersCh)
+	// 証明に関係のないtxは捨てる
+	go func() {
+		for range txCh {
+		}
+	}()
+	if !headerChain.IsInBestChain(blockHash) {
+		return nil, fmt.Errorf("Block %s is not in the best header chain", hex.EncodeToString(util.ReverseBytes(blockHash[:])))
+	}
+
+	// bloom filterに対応していないpeerもあるのでブロック全体から証明を作る
+	var proof []byte
+	var proofErr error
+	err := fetchBlocks(p, []*chain.HeaderNode{headerChain.Lookup(blockHash)}, cfCh.block, func(node *chain.HeaderNode, block *message.Block) {
+		proof, proofErr = txOutProof(block, txID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proof, proofErr
+}
+
+// GetTxOutProof download the block and print the hex proof that the transaction is included in it,
+// in the same format as gettxoutproof of bitcoin core.
+// The txid and the block hash are in the byte order of bitcoin core's RPC.
+func GetTxOutProof(txIDHex string, blockHashHex string) error {
+	txID, err := decodeTxID(txIDHex)
+	if err != nil {
+		return err
+	}
+	blockHash, err := decodeHash(blockHashHex)
+	if err != nil {
+		return err
+	}
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		proof, err := getTxOutProof(p, c, txID, blockHash)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hex.EncodeToString(proof))
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
+
+// verifyProof validate the merkle proof in merkleblock format and check the block is in the best chain.
+// It returns the block and the proven transactions.
+func verifyProof(c *chain.HeaderChain, proof []byte) (*chain.HeaderNode, [][32]byte, error) {
+	mb, err := message.DecodeMerkleBlock(proof)
+	if err != nil {
+		return nil, nil, err
+	}
+	txIDs, err := mb.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := mb.BlockHash()
+	node := c.Lookup(hash)
+	if node == nil || !c.IsInBestChain(hash) {
+		return nil, nil, fmt.Errorf("Block %s is not in the best header chain", hex.EncodeToString(util.ReverseBytes(hash[:])))
+	}
+	return node, txIDs, nil
+}
+
+// VerifyProof verify the proof exported by gettxoutproof against the synced headers,
+// and print the transactions included in the block.
+func VerifyProof(proofHex string) error {
+	proof, err := hex.DecodeString(proofHex)
+	if err != nil {
+		return err
+	}
+	c, err := chain.LoadHeaderChain(chain.TestNet3Params, chain.HeaderFilePath)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	node, txIDs, err := verifyProof(c, proof)
+	if err != nil {
+		return err
+	}
+	hash := node.Hash
+	fmt.Printf("block: %s\theight: %d\tconfirmations: %d\n",
+		hex.EncodeToString(util.ReverseBytes(hash[:])), node.Height, c.Tip().Height-node.Height+1)
+	for _, txID := range txIDs {
+		fmt.Println(encodeTxID(txID))
+	}
+	return nil
+}
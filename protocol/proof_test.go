@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestVerifyProof(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	txIDs := [][32]byte{{0x01}, {0x02}, {0x03}}
+	header := &message.BlockHeader{
+		Version:    4,
+		PrevBlock:  c.Tip().Hash,
+		MerkleRoot: message.CalcMerkleRoot(txIDs),
+		Timestamp:  c.Tip().Header.Timestamp + 600,
+		Bits:       chain.RegressionNetParams.PowLimitBits,
+	}
+	for chain.CheckProofOfWork(header.BlockHash(), header.Bits, chain.RegressionNetParams.PowLimit) != nil {
+		header.Nonce++
+	}
+	if _, err := c.AddHeader(header); err != nil {
+		t.Fatal(err)
+	}
+
+	mb, err := message.NewTxOutProof(header, txIDs, [][32]byte{txIDs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, proven, err := verifyProof(c, mb.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Hash != header.BlockHash() || len(proven) != 1 || proven[0] != txIDs[1] {
+		t.Errorf("proof should prove the transaction in the block")
+	}
+
+	// ヘッダを持っていないブロックの証明は受け付けない
+	unknown := *header
+	unknown.Nonce++
+	mb, _ = message.NewTxOutProof(&unknown, txIDs, [][32]byte{txIDs[1]})
+	if _, _, err := verifyProof(c, mb.Encode()); err == nil {
+		t.Errorf("proof of unknown block should be rejected")
+	}
+	if _, err := message.NewTxOutProof(header, txIDs, [][32]byte{{0x04}}); err == nil {
+		t.Errorf("transaction not in the block can't be proven")
+	}
+}
+
+func TestTxOutProof(t *testing.T) {
+	txs := []*message.Transaction{p2pkhTx([32]byte{0x01}, 1000), p2pkhTx([32]byte{0x02}, 2000), p2pkhTx([32]byte{0x03}, 3000)}
+	txIDs := [][32]byte{}
+	for _, tx := range txs {
+		txIDs = append(txIDs, tx.ID())
+	}
+	block := message.NewBlock(&message.BlockHeader{Version: 4, MerkleRoot: message.CalcMerkleRoot(txIDs)}, txs)
+	proof, err := txOutProof(block, txIDs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := message.DecodeMerkleBlock(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proven, err := mb.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mb.BlockHash() != block.BlockHash() || len(proven) != 1 || proven[0] != txIDs[2] {
+		t.Errorf("proof should prove only the transaction in the block")
+	}
+	if _, err := txOutProof(block, [32]byte{0x04}); err == nil {
+		t.Errorf("transaction not in the block can't be proven")
+	}
+	if hash, err := decodeHash("00000000000004f2dc41845771909db57e04191714ed8c963f7e56713a7b6cea"); err != nil || hash[31] != 0 || hash[0] != 0xea {
+		t.Errorf("hash should be decoded in RPC byte order")
+	}
+}
@@ -2,17 +2,24 @@ package protocol
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
-	"time"
 
+	"github.com/tanishiking/btcwallet/protocol/chain"
 	"github.com/tanishiking/btcwallet/protocol/common"
 	"github.com/tanishiking/btcwallet/protocol/message"
 	"github.com/tanishiking/btcwallet/util"
 )
 
+const (
+	// testnetMagic means magic value of testnet3 (0x0B110907 in network byte order).
+	testnetMagic = uint32(0x0709110B)
+
+	// maxMessagePayload follows bitcoin core's MAX_PROTOCOL_MESSAGE_LENGTH.
+	maxMessagePayload = 4 * 1000 * 1000
+)
+
 // CreateMessageHeader create messageheader from message.
 func CreateMessageHeader(msg Message) *common.MessageHeader {
 	var (
@@ -23,7 +30,7 @@ func CreateMessageHeader(msg Message) *common.MessageHeader {
 	copy(commandNameBytes[:], []byte(msg.CommandName()))
 	copy(checksum[:], hashedMsg[0:4])
 	return &common.MessageHeader{
-		Magic:    binary.LittleEndian.Uint32([]byte{0x0B, 0x11, 0x09, 0x07}), // testnet magic value
+		Magic:    testnetMagic,
 		Command:  commandNameBytes,
 		Length:   uint32(len(msg.Encode())),
 		Checksum: checksum,
@@ -36,13 +43,37 @@ func RecvMessage(conn net.Conn, size uint32) ([]byte, error) {
 		return []byte{}, nil
 	}
 	buf := make([]byte, size)
-	_, err := conn.Read(buf)
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return []byte{}, err
 	}
 	return buf, nil
 }
 
+// ReadMessage read a whole message from the connection and verify its header.
+func ReadMessage(conn net.Conn) (*common.MessageHeader, []byte, error) {
+	var header [common.MessageHeaderLen]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, nil, err
+	}
+	mh := common.DecodeMessageHeader(header)
+	if mh.Magic != testnetMagic {
+		return nil, nil, fmt.Errorf("Invalid magic value: %x", mh.Magic)
+	}
+	if mh.Length > maxMessagePayload {
+		return nil, nil, fmt.Errorf("Too large message %s: %d bytes", mh.CommandName(), mh.Length)
+	}
+	payload, err := RecvMessage(conn, mh.Length)
+	if err != nil {
+		return nil, nil, err
+	}
+	checksum := util.Hash256(payload)[:4]
+	if !bytes.Equal(checksum, mh.Checksum[:]) {
+		return nil, nil, fmt.Errorf("Invalid checksum of %s message", mh.CommandName())
+	}
+	return mh, payload, nil
+}
+
 // SendMessage send the message to remote peer via the connection.
 func SendMessage(conn net.Conn, msg Message) error {
 	header := CreateMessageHeader(msg)
@@ -58,106 +89,47 @@ func SendMessage(conn net.Conn, msg Message) error {
 	return nil
 }
 
-// WithBitcoinConnection connect to fallback node in testnet and then
-// do the received function using the connection with the node.
-func WithBitcoinConnection(fn func(net.Conn, *message.Version)) {
-	conn, err := net.Dial("tcp", "testnet-seed.bitcoin.jonasschnelli.ch:18333")
+// WithBitcoinConnection connect to a node in testnet chosen from the address book
+// (or DNS seeds on the first run), finish the version handshake and then do the
+// received function with the peer.
+// The header chain stored locally is loaded first to advertise its tip height to the peer,
+// and passed to the function.
+// The error of the function is returned after the address book and the ban list are saved.
+func WithBitcoinConnection(fn func(*Peer, *chain.HeaderChain) error) error {
+	addrManager, err := LoadAddrManager(addrManagerFilePath)
 	if err != nil {
-		fmt.Println("Failed to connect to peer: ", err.Error())
-		return
+		fmt.Println(err.Error())
+		addrManager = NewAddrManager(addrManagerFilePath)
 	}
-	fmt.Printf("Connected: %#v \n", conn.RemoteAddr().String())
-
-	verackCh := make(chan *message.Verack)
-	versionCh := make(chan *message.Version)
-	errCh := make(chan error)
-
-	go func(conn net.Conn, verackCh chan *message.Verack, versioinCh chan *message.Version, errCh chan error) {
-		var header [common.MessageHeaderLen]byte
-		recvVerack := false
-		recvVersion := false
-		buf := make([]byte, common.MessageHeaderLen)
-	Loop:
-		for {
-			if recvVerack && recvVersion {
-				break Loop
-			}
-			n, err := conn.Read(buf)
-			if err != nil && err != io.EOF {
-				errCh <- err
-				continue
-			}
-			if n == common.MessageHeaderLen {
-				copy(header[:], buf)
-				mh := common.DecodeMessageHeader(header)
-				command := string(mh.Command[:])
-				fmt.Printf("Recv: %s %d\n", command, mh.Length)
-				payload, err := RecvMessage(conn, mh.Length)
-				if err != nil {
-					errCh <- err
-				}
-				if bytes.HasPrefix(mh.Command[:], []byte("verack")) {
-					verackCh <- &message.Verack{}
-					recvVerack = true
-				} else if bytes.HasPrefix(mh.Command[:], []byte("version")) {
-					v, err := message.DecodeVersion(payload)
-					if err != nil {
-						errCh <- err
-						continue
-					}
-					versionCh <- v
-					recvVersion = true
-				}
-			}
+	defer func() {
+		if err := addrManager.Save(); err != nil {
+			fmt.Println("Failed to save address book: ", err.Error())
 		}
-	}(conn, verackCh, versionCh, errCh)
+	}()
 
-	addrFrom := &common.NetAddr{
-		Services: uint64(1),
-		IP: [16]byte{
-			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x7F, 0x00, 0x00, 0x01,
-		}, // 127.0.0.1 https://en.bitcoin.it/wiki/Protocol_documentation#Network_address
-		Port: 8333,
-	}
-	v := &message.Version{
-		Version:     uint32(70015),
-		Services:    uint64(1),
-		Timestamp:   uint64(time.Now().Unix()),
-		AddrRecv:    addrFrom, // 適当、remote peer はconnection時にこのフィールド見てない？
-		AddrFrom:    addrFrom,
-		Nonce:       uint64(0), //  connection時のnonceこれでいいのか
-		UserAgent:   common.NewVarStr([]byte("")),
-		StartHeight: uint32(0),
-		Relay:       false,
-	}
-	err = SendMessage(conn, v)
+	banManager, err := LoadBanManager(banListFilePath)
 	if err != nil {
 		fmt.Println(err.Error())
-		return
+		banManager = NewBanManager(banListFilePath)
 	}
-
-	recvVerack := false
-	recvVersion := false
-	var receivedVersion *message.Version
-	// Wait for the verack message or timeout in case of failure.
-Loop:
-	for {
-		if recvVerack && recvVersion {
-			fn(conn, receivedVersion)
-			break Loop
-		}
-		select {
-		case <-verackCh:
-			recvVerack = true
-		case receivedVersion = <-versionCh:
-			recvVersion = true
-			SendMessage(conn, &message.Verack{})
-		case err := <-errCh:
-			fmt.Println(err.Error())
-			return
-		case <-time.After(time.Second * 5):
-			fmt.Printf("Peer Connection: verack/version timeout")
-			return
+	defer func() {
+		if err := banManager.Save(); err != nil {
+			fmt.Println("Failed to save ban list: ", err.Error())
 		}
+	}()
+
+	// 前回同期したヘッダの続きから同期する
+	headerChain, err := chain.LoadHeaderChain(chain.TestNet3Params, chain.HeaderFilePath)
+	if err != nil {
+		return err
+	}
+	defer headerChain.Close()
+	config.StartHeight = headerChain.Tip().Height
+
+	p, err := connectPeer(addrManager, banManager, config)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to peer: %v", err)
 	}
+	p.SendMessage(&message.GetAddr{})
+	return fn(p, headerChain)
 }
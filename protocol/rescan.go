@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
+)
+
+// birthdayWindow follows bitcoin core's TIMESTAMP_WINDOW.
+// Block timestamps can be earlier than the transactions in them by this seconds.
+const birthdayWindow = 2 * 60 * 60
+
+// defaultScanHeight is the height the wallet was scanned from before keys had birthday.
+// Keys without birthday can have transactions after it, so they are scanned from the checkpoint before it.
+const defaultScanHeight = 1261780
+
+// Rescan rebuild the wallet from the blocks at the height or the time, and show the balance.
+func Rescan(from *key.Birthday) error {
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		wallet, err := syncWallet(p, c, from)
+		if err != nil {
+			return err
+		}
+		printBalances(wallet.Balances())
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
+
+// scanCheckpoint return the checkpoint which keys without birthday are scanned after,
+// or nil if the network has no checkpoint before defaultScanHeight.
+func scanCheckpoint(params *chain.Params) *chain.Checkpoint {
+	return params.CheckpointBefore(defaultScanHeight)
+}
+
+// scanStart return the block to scan the wallet after, when the wallet has never been synced.
+// Keys without birthday are scanned from the checkpoint before defaultScanHeight,
+// or from the root of the chain if there is no such checkpoint.
+func scanStart(c *chain.HeaderChain, birthday *key.Birthday) (*chain.HeaderNode, error) {
+	if birthday != nil {
+		return birthdayStart(c, birthday)
+	}
+	checkpoint := scanCheckpoint(c.Params())
+	if checkpoint == nil {
+		return c.Root(), nil
+	}
+	if root := c.Root(); checkpoint.Height < root.Height {
+		return nil, fmt.Errorf("Headers before height %d are not synced, sync headers with -checkpointsync=false", root.Height)
+	}
+	// peerの申告する高さではなく検証済みのヘッダの高さを使う
+	start := c.NodeByHeight(checkpoint.Height)
+	if start == nil || start.Hash != checkpoint.Hash {
+		return nil, fmt.Errorf("Start block is not in the best header chain")
+	}
+	return start, nil
+}
+
+// birthdayStart return the block before the first block which can include transactions of the key.
+// It returns error if the headers before the birthday are not synced.
+func birthdayStart(c *chain.HeaderChain, birthday *key.Birthday) (*chain.HeaderNode, error) {
+	root := c.Root()
+	tip := c.Tip()
+	height := birthday.Height
+	if !birthday.IsHeight() {
+		// タイムスタンプは前後するのでそれまでの最大値で比べる
+		limit := birthday.Time.Unix() - birthdayWindow
+		height = tip.Height + 1
+		maxTime := int64(0)
+		for h := root.Height; h <= tip.Height; h++ {
+			if t := int64(c.NodeByHeight(h).Header.Timestamp); t > maxTime {
+				maxTime = t
+			}
+			if maxTime >= limit {
+				height = h
+				break
+			}
+		}
+	}
+	// まだ誕生日のブロックがなければtipまで走査済みとする
+	if height > tip.Height {
+		return tip, nil
+	}
+	// genesisのcoinbaseは使えないので走査しない
+	if height == 0 {
+		height = 1
+	}
+	if height-1 < root.Height {
+		return nil, fmt.Errorf("Headers before height %d are not synced, sync headers with -checkpointsync=false", root.Height)
+	}
+	return c.NodeByHeight(height - 1), nil
+}
+
+// scanProgress stringify how many blocks are scanned from start to tip.
+func scanProgress(start, height, tip uint32) string {
+	percent := 100.0
+	if tip > start {
+		percent = float64(height-start) * 100 / float64(tip-start)
+	}
+	return fmt.Sprintf("height %d/%d (%.1f%%)", height, tip, percent)
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func TestBirthdayStart(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	for i := uint32(0); i < 30; i++ {
+		mineBlock(t, c, c.Tip(), i)
+	}
+	genesis := c.NodeByHeight(0)
+	if start, err := birthdayStart(c, key.NewBirthdayHeight(10)); err != nil || start.Height != 9 {
+		t.Errorf("scan should start after height 9: %v", err)
+	}
+	if start, err := birthdayStart(c, key.NewBirthdayHeight(0)); err != nil || start != genesis {
+		t.Errorf("scan should start after genesis: %v", err)
+	}
+	if start, err := birthdayStart(c, key.NewBirthdayHeight(100)); err != nil || start != c.Tip() {
+		t.Errorf("future birthday should not scan any block: %v", err)
+	}
+	// ブロックは600秒ごと、タイムスタンプが2時間前以降の最初のブロックは20
+	birthday := key.NewBirthdayAt(time.Unix(int64(genesis.Header.Timestamp)+600*32, 0))
+	if start, err := birthdayStart(c, birthday); err != nil || start.Height != 19 {
+		t.Errorf("scan should start 2 hours before the birthday: %v", err)
+	}
+}
+
+func TestScanStart(t *testing.T) {
+	// checkpointが無ければrootの次から走査する
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	for i := uint32(0); i < 5; i++ {
+		mineBlock(t, c, c.Tip(), i)
+	}
+	if start, err := scanStart(c, nil); err != nil || start != c.Root() {
+		t.Errorf("scan should start after the root: %v", err)
+	}
+	if start, err := scanStart(c, key.NewBirthdayHeight(3)); err != nil || start.Height != 2 {
+		t.Errorf("scan should start before the birthday: %v", err)
+	}
+
+	// defaultScanHeightより後のcheckpointは使わない
+	params := *chain.RegressionNetParams
+	params.Checkpoints = []chain.Checkpoint{
+		{Height: 3, Hash: c.NodeByHeight(3).Hash},
+		{Height: defaultScanHeight + 1, Hash: [32]byte{0x01}},
+	}
+	withCheckpoints := chain.NewHeaderChain(&params)
+	for h := uint32(1); h <= 5; h++ {
+		if _, err := withCheckpoints.AddHeader(c.NodeByHeight(h).Header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if start, err := scanStart(withCheckpoints, nil); err != nil || start.Height != 3 {
+		t.Errorf("scan should start after the checkpoint before defaultScanHeight: %v", err)
+	}
+}
+
+func TestWalletRewind(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	spending := p2pkhTx(funding.ID(), 900)
+	unconfirmed := p2pkhTx([32]byte{0x02}, 2000)
+	w.AddTx(funding)
+	w.AddTx(spending)
+	w.AddTx(unconfirmed)
+	b1 := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(b1, []message.TxID{funding.ID()})
+	b2 := mineBlock(t, c, b1, 1)
+	w.ConnectBlock(b2, []message.TxID{spending.ID()})
+
+	w.Rewind(b1)
+	if w.SyncTip() != b1 {
+		t.Errorf("sync tip should be rewound")
+	}
+	if utxos := w.UTXOs(); len(utxos) != 1 || utxos[0].tx.ID() != funding.ID() {
+		t.Errorf("funding output should be unspent after rewind")
+	}
+	if len(w.txs) != 1 {
+		t.Errorf("transactions after the block should be forgotten: %d", len(w.txs))
+	}
+	// 走査し直すと再度使用される
+	w.AddTx(spending)
+	w.ConnectBlock(b2, []message.TxID{spending.ID()})
+	if utxos := w.UTXOs(); len(utxos) != 1 || utxos[0].tx.ID() != spending.ID() {
+		t.Errorf("funding output should be spent again")
+	}
+}
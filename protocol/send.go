@@ -3,100 +3,121 @@ package protocol
 import (
 	"bytes"
 	"fmt"
-	"io"
-	"net"
-	"os"
 
 	secp256k1 "github.com/toxeus/go-secp256k1"
 
 	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/chain"
 	"github.com/tanishiking/btcwallet/protocol/common"
 	"github.com/tanishiking/btcwallet/protocol/message"
 	"github.com/tanishiking/btcwallet/util"
 )
 
-// Send send bitcoint to toAddr with amount and fee.
-func Send(toAddr string, amount int, fee int) {
-	fn := func(conn net.Conn, v *message.Version) {
-		utxos := collectUTXO(conn, v)
-		value := uint64(0)
-		utxoInput := []*utxo{}
-		for _, unspent := range utxos {
-			utxoInput = append(utxoInput, unspent)
-			value += unspent.tx.TxOut[unspent.index].Value
-			if uint64(amount+fee) <= value {
-				break
-			}
+// Send send bitcoint to toAddr with amount at the fee rate in sat/vB.
+// The outputs to spend are chosen by the selector, and the fee over maxFee is rejected.
+func Send(toAddr string, amount uint64, feeRate uint64, maxFee uint64, selector CoinSelector) error {
+	fn := func(p *Peer, c *chain.HeaderChain) error {
+		if feeRate < minRelayFeeRate {
+			return fmt.Errorf("Fee rate %d sat/vB is below min relay fee rate %d sat/vB", feeRate, minRelayFeeRate)
+		}
+		wallet, err := syncWallet(p, c, nil)
+		if err != nil {
+			return err
 		}
-		if value < uint64(amount+fee) {
-			fmt.Printf("Balance is not enough, balance: %v, amount: %v, fee: %v\n", value, amount, fee)
-			os.Exit(1)
+		// feefilterより低い手数料率のtxはpeerがrelayしない
+		if floor := p.FeeFilterRate(); feeRate < floor {
+			return fmt.Errorf("Fee rate %d sat/vB is below the fee filter of the peer %d sat/vB", feeRate, floor)
 		}
-		txOut, err := createTxOut(toAddr, amount, value, fee)
+		toScript, changeScript, err := paymentScripts(toAddr, wallet.pubKey)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
+			return err
+		}
+		// 署名できるのはP2PKHの出力だけ
+		utxos := wallet.SignableUTXOs()
+		input, err := estimateInputSize(ScriptP2PKH, wallet.pubKey)
+		if err != nil {
+			return err
 		}
+		selection, fee, err := fundTx(utxos, selector, input, amount, feeRate, toScript, changeScript)
+		if err != nil {
+			return err
+		}
+		if fee > maxFee {
+			return fmt.Errorf("Fee %d exceeds max fee %d", fee, maxFee)
+		}
+		fmt.Printf("Selected %d inputs: value %d, change %d, fee %d, waste %d\n",
+			len(selection.Inputs), selection.Value, selection.Change, fee, selection.Waste)
+		txOut := createTxOut(toScript, changeScript, amount, selection.Change)
 
-		txIn, err := createTxIn(utxoInput, txOut)
+		txIn, err := createTxIn(selection.Inputs, txOut)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(1)
+			return err
 		}
 		transaction := message.NewTransaction(uint32(1), txIn, txOut, uint32(0))
+		fmt.Printf("Transaction %d vB, %.1f sat/vB\n", transaction.VSize(), float64(fee)/float64(transaction.VSize()))
 
-		inv := message.NewInv(
-			common.NewVarInt(uint64(1)),
-			[]*message.InvVect{message.NewInvVect(message.InvTypeMsgTx, transaction.ID())},
-		)
-		SendMessage(conn, inv)
-
-		var header [common.MessageHeaderLen]byte
-		buf := make([]byte, common.MessageHeaderLen)
-	Loop:
-		for {
-			n, err := conn.Read(buf)
-			if err != nil && err != io.EOF {
-				fmt.Println(err.Error())
-				break Loop
-			}
-			if n == common.MessageHeaderLen {
-				copy(header[:], buf)
-				mh := common.DecodeMessageHeader(header)
-				msgBytes, err := RecvMessage(conn, mh.Length)
-				if err != nil {
-					fmt.Println(err.Error())
+		broadcastTx(p, wallet, transaction)
+		return nil
+	}
+	return WithBitcoinConnection(fn)
+}
+
+// broadcastTx announce the transaction to the peer and send it when the peer requests it.
+// The transaction is tracked by the wallet as unconfirmed after it is sent.
+func broadcastTx(p *Peer, wallet *Wallet, transaction *message.Transaction) {
+	inv := message.NewInv(
+		common.NewVarInt(uint64(1)),
+		[]*message.InvVect{message.NewInvVect(message.InvTypeMsgTx, transaction.ID())},
+	)
+	p.SendMessage(inv)
+
+Loop:
+	for {
+		command, msgBytes, err := p.ReadMessage()
+		if err != nil {
+			fmt.Println(err.Error())
+			break Loop
+		}
+		fmt.Printf("Recv: %s %d\n", command, len(msgBytes))
+		switch command {
+		case "getdata":
+			getData, err := message.DecodeGetData(msgBytes)
+			if err != nil {
+				if p.Misbehaving(20, "malformed getdata: "+err.Error()) {
 					break Loop
 				}
-				fmt.Printf("Recv: %s %d\n", string(mh.Command[:]), mh.Length)
-				if bytes.HasPrefix(mh.Command[:], []byte("getdata")) {
-					getData, err := message.DecodeGetData(msgBytes)
-					if err != nil {
-						fmt.Println(err.Error())
-						break Loop
-					}
-					invs := getData.FilterInventoryWithType(message.InvTypeMsgTx)
-					for _, invvect := range invs {
-						txID := transaction.ID()
-						if bytes.Equal(invvect.Hash[:], txID[:]) {
-							fmt.Println("transaction send!")
-							SendMessage(conn, transaction)
-						}
-					}
-				} else if bytes.HasPrefix(mh.Command[:], []byte("reject")) {
-					reject, err := message.DecodeReject(msgBytes)
-					if err != nil {
+				continue
+			}
+			invs := getData.FilterInventoryWithType(message.InvTypeMsgTx)
+			for _, invvect := range invs {
+				txID := transaction.ID()
+				if bytes.Equal(invvect.Hash[:], txID[:]) {
+					fmt.Println("transaction send!")
+					p.SendMessage(transaction)
+					// 承認されるまで未承認のtxとして追跡する
+					wallet.AddTx(transaction)
+					if err := wallet.Save(); err != nil {
 						fmt.Println(err.Error())
-						break Loop
 					}
-					fmt.Println(reject.String())
 				}
 			}
+		case "reject":
+			reject, err := message.DecodeReject(msgBytes)
+			if err != nil {
+				if p.Misbehaving(10, "malformed reject: "+err.Error()) {
+					break Loop
+				}
+				continue
+			}
+			p.handleReject(reject)
 		}
 	}
-	WithBitcoinConnection(fn)
 }
 
+// rbfSequence signals the transaction can be replaced by one paying higher fee. (BIP125)
+// Every input has it, and it is committed in the signature like the other fields.
+const rbfSequence = 0xFFFFFFFD
+
 func createTxIn(unspentTxs []*utxo, txOut []*message.TxOut) ([]*message.TxIn, error) {
 	fromPrivateKey, err := key.ReadOrGeneratePrivateKey()
 	if err != nil {
@@ -129,7 +150,7 @@ func createTxIn(unspentTxs []*utxo, txOut []*message.TxOut) ([]*message.TxIn, er
 				tmpTxIn := &message.TxIn{
 					PreviousOutput:  output,
 					SignatureScript: previousOutput.PkScript,
-					Sequence:        0xFFFFFFFF, // ignored
+					Sequence:        rbfSequence,
 				}
 				txCopyInput = append(txCopyInput, tmpTxIn)
 			} else {
@@ -145,7 +166,7 @@ func createTxIn(unspentTxs []*utxo, txOut []*message.TxOut) ([]*message.TxIn, er
 				tmpTxIn := &message.TxIn{
 					PreviousOutput:  otherOutput,
 					SignatureScript: emptyScript,
-					Sequence:        0xFFFFFFFF, // ignored
+					Sequence:        rbfSequence,
 				}
 				txCopyInput = append(txCopyInput, tmpTxIn)
 			}
@@ -185,51 +206,83 @@ func createTxIn(unspentTxs []*utxo, txOut []*message.TxOut) ([]*message.TxIn, er
 		input := &message.TxIn{
 			PreviousOutput:  output,
 			SignatureScript: unlockingScript,
-			Sequence:        0xFFFFFFFF, // ignored
+			Sequence:        rbfSequence,
 		}
 		res = append(res, input)
 	}
 	return res, nil
 }
 
-func createTxOut(toAddr string, amount int, balance uint64, fee int) ([]*message.TxOut, error) {
-	toPubKeyHashed, err := key.DecodeBitcoinAddr(toAddr)
-	if err != nil {
-		return nil, err
+// maxFundingIterations bounds how many times the coins are selected again to cover the size.
+const maxFundingIterations = 10
+
+// fundTx select the inputs to pay amount to toScript at the fee rate, and return the selection and the fee.
+// The target grows until the fee covers the estimated size of the transaction built from the selection,
+// because the counts of inputs and outputs change the size.
+func fundTx(utxos []*utxo, selector CoinSelector, input *inputSize, amount, feeRate uint64,
+	toScript, changeScript []byte) (*CoinSelection, uint64, error) {
+	changeFee := feeRate * outputVSize(changeScript)
+	params := &CoinSelectionParams{
+		// 入力のない取引の手数料を先に含める
+		Target:          amount + feeRate*estimateVSize(nil, [][]byte{toScript}),
+		FeeRate:         feeRate,
+		LongTermFeeRate: longTermFeeRate,
+		InputSize:       input.vsize(),
+		ChangeFee:       changeFee,
+		CostOfChange:    changeFee + longTermFeeRate*input.vsize(),
+		MinChange:       dustThreshold,
 	}
-	fromPrivateKey, err := key.ReadOrGeneratePrivateKey()
-	if err != nil {
-		return nil, err
+	for i := 0; i < maxFundingIterations; i++ {
+		selection, err := selector.Select(utxos, params)
+		if err != nil {
+			return nil, 0, err
+		}
+		inputs := []*inputSize{}
+		for range selection.Inputs {
+			inputs = append(inputs, input)
+		}
+		outputs := [][]byte{toScript}
+		if selection.Change > 0 {
+			outputs = append(outputs, changeScript)
+		}
+		fee := selection.Value - amount - selection.Change
+		required := feeRate * estimateVSize(inputs, outputs)
+		if fee >= required {
+			return selection, fee, nil
+		}
+		params.Target += required - fee
 	}
-	fromPubKey, err := key.GeneratePubKey(fromPrivateKey)
+	return nil, 0, fmt.Errorf("Failed to fund the transaction at %d sat/vB", feeRate)
+}
+
+// paymentScripts return the output script of toAddr and the change script of the key.
+func paymentScripts(toAddr string, fromPubKey []byte) ([]byte, []byte, error) {
+	toPubKeyHashed, err := key.DecodeBitcoinAddr(toAddr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	fromPubKeyHashed := util.Hash160(fromPubKey)
-
 	// P2SH
-	lockingScript1 := common.NewVarStr(bytes.Join([][]byte{
+	toScript := bytes.Join([][]byte{
 		[]byte{common.OpHash160},
 		common.OpPushData(toPubKeyHashed),
 		[]byte{common.OpEqual},
-	}, []byte{}))
-
+	}, []byte{})
 	// P2PKH
-	lockingScript2 := common.NewVarStr(bytes.Join([][]byte{
-		[]byte{common.OpDup},
-		[]byte{common.OpHash160},
-		common.OpPushData(fromPubKeyHashed),
-		[]byte{common.OpEqualVerify},
-		[]byte{common.OpCheckSig},
-	}, []byte{}))
+	return toScript, p2pkhScript(util.Hash160(fromPubKey)), nil
+}
 
+// createTxOut create the output to toScript and the change output if change is not 0.
+func createTxOut(toScript, changeScript []byte, amount uint64, change uint64) []*message.TxOut {
 	txOut1 := &message.TxOut{
-		Value:    uint64(amount),
-		PkScript: lockingScript1,
+		Value:    amount,
+		PkScript: common.NewVarStr(toScript),
+	}
+	if change == 0 {
+		return []*message.TxOut{txOut1}
 	}
 	txOut2 := &message.TxOut{
-		Value:    balance - uint64(amount+fee),
-		PkScript: lockingScript2,
+		Value:    change,
+		PkScript: common.NewVarStr(changeScript),
 	}
-	return []*message.TxOut{txOut1, txOut2}, nil
+	return []*message.TxOut{txOut1, txOut2}
 }
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// Transport frames messages on the connection to the peer.
+// v1 is plaintext with 24 bytes message header, v2 is BIP324 encrypted transport.
+type Transport interface {
+	WriteMessage(command string, payload []byte) error
+	ReadMessage() (string, []byte, error)
+}
+
+// v1Transport is the original unencrypted transport.
+type v1Transport struct {
+	conn net.Conn
+}
+
+func newV1Transport(conn net.Conn) *v1Transport {
+	return &v1Transport{conn: conn}
+}
+
+func (t *v1Transport) WriteMessage(command string, payload []byte) error {
+	var (
+		commandNameBytes [12]byte
+		checksum         [4]byte
+	)
+	copy(commandNameBytes[:], []byte(command))
+	copy(checksum[:], util.Hash256(payload)[0:4])
+	header := &common.MessageHeader{
+		Magic:    testnetMagic,
+		Command:  commandNameBytes,
+		Length:   uint32(len(payload)),
+		Checksum: checksum,
+	}
+	_, err := t.conn.Write(bytes.Join([][]byte{header.Encode(), payload}, []byte{}))
+	return err
+}
+
+func (t *v1Transport) ReadMessage() (string, []byte, error) {
+	mh, payload, err := ReadMessage(t.conn)
+	if err != nil {
+		return "", nil, err
+	}
+	return mh.CommandName(), payload, nil
+}
+
+// networkMagic return the magic bytes as they appear on the wire.
+func networkMagic() [4]byte {
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], testnetMagic)
+	return magic
+}
+
+// SendMessage send the message to the peer through its transport.
+func (p *Peer) SendMessage(msg Message) error {
+	payload := msg.Encode()
+	if err := p.transport.WriteMessage(msg.CommandName(), payload); err != nil {
+		fmt.Printf("Message send failed %v \n", msg)
+		return err
+	}
+	fmt.Printf("Send %s: %d bytes\n", msg.CommandName(), len(payload))
+	return nil
+}
+
+// ReadMessage receive next message from the peer through its transport.
+func (p *Peer) ReadMessage() (string, []byte, error) {
+	return p.transport.ReadMessage()
+}
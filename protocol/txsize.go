@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/tanishiking/btcwallet/key"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+const (
+	// maxSigSize means the size of the largest DER signature with the sighash type.
+	// Signatures are estimated at the largest so the fee rate is never below the target.
+	maxSigSize = 72
+	// schnorrSigSize means the size of BIP340 signature with the default sighash type.
+	schnorrSigSize = 64
+	// minRelayFeeRate follows bitcoin core's DEFAULT_MIN_RELAY_TX_FEE in sat/vB.
+	minRelayFeeRate = 1
+	// longTermFeeRate follows bitcoin core's DEFAULT_CONSOLIDATE_FEERATE, the fee rate to spend outputs in the future.
+	longTermFeeRate = 10
+	// DefaultMaxFee follows bitcoin core's DEFAULT_TRANSACTION_MAXFEE, 0.1 BTC.
+	DefaultMaxFee = 10000000
+)
+
+// inputSize means the estimated size of a signed input.
+type inputSize struct {
+	weight  uint64
+	witness bool // witnessを持つ入力
+}
+
+// estimateInputSize return the size of the input spending the output of the script type, signed by the key.
+func estimateInputSize(scriptType ScriptType, pubKey []byte) (*inputSize, error) {
+	compressed, err := key.CompressPubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, maxSigSize)
+	scriptSig := []byte{}
+	witness := [][]byte{}
+	switch scriptType {
+	case ScriptP2PK:
+		scriptSig = common.OpPushData(sig)
+	case ScriptP2PKH:
+		scriptSig = append(common.OpPushData(sig), common.OpPushData(pubKey)...)
+	case ScriptP2WPKH:
+		witness = [][]byte{sig, compressed}
+	case ScriptP2SHP2WPKH:
+		// redeem scriptのP2WPKHをpushする
+		redeem := append([]byte{0x00}, common.OpPushData(util.Hash160(compressed))...)
+		scriptSig = common.OpPushData(redeem)
+		witness = [][]byte{sig, compressed}
+	case ScriptP2TR:
+		witness = [][]byte{make([]byte, schnorrSigSize)}
+	default:
+		return nil, fmt.Errorf("Can't estimate the input size of %s", scriptType)
+	}
+	txIn := &message.TxIn{
+		PreviousOutput:  &message.OutPoint{},
+		SignatureScript: common.NewVarStr(scriptSig),
+	}
+	size := &inputSize{weight: uint64(len(txIn.Encode())) * 4}
+	if len(witness) > 0 {
+		size.witness = true
+		size.weight += witnessSize(witness)
+	}
+	return size, nil
+}
+
+// vsize return the virtual size of the input, rounded up.
+func (s *inputSize) vsize() uint64 {
+	return (s.weight + 3) / 4
+}
+
+// witnessSize return the serialized size of the witness of an input.
+func witnessSize(witness [][]byte) uint64 {
+	size := uint64(len(common.NewVarInt(uint64(len(witness))).Encode()))
+	for _, item := range witness {
+		size += uint64(len(common.NewVarStr(item).Encode()))
+	}
+	return size
+}
+
+// outputVSize return the size of the output paying to the script.
+func outputVSize(script []byte) uint64 {
+	return uint64(len((&message.TxOut{PkScript: common.NewVarStr(script)}).Encode()))
+}
+
+// estimateVSize return the virtual size of the transaction signed with the inputs and paying to the scripts.
+func estimateVSize(inputs []*inputSize, outputs [][]byte) uint64 {
+	// versionとlocktime、入出力の数
+	weight := uint64(4+4+len(common.NewVarInt(uint64(len(inputs))).Encode())+len(common.NewVarInt(uint64(len(outputs))).Encode())) * 4
+	hasWitness := false
+	for _, in := range inputs {
+		weight += in.weight
+		hasWitness = hasWitness || in.witness
+	}
+	if hasWitness {
+		// markerとflag、witnessのない入力の空のwitness
+		weight += 2
+		for _, in := range inputs {
+			if !in.witness {
+				weight++
+			}
+		}
+	}
+	for _, script := range outputs {
+		weight += outputVSize(script) * 4
+	}
+	return (weight + 3) / 4
+}
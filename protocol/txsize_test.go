@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEstimateInputSize(t *testing.T) {
+	tests := []struct {
+		scriptType ScriptType
+		pubKey     []byte
+		weight     uint64
+	}{
+		{ScriptP2PK, testPubKey, 114 * 4},
+		{ScriptP2PKH, testPubKey, 180 * 4},
+		{ScriptP2WPKH, testPubKey, 272},
+		{ScriptP2SHP2WPKH, testPubKey, 364},
+		{ScriptP2TR, testPubKey, 230},
+	}
+	for _, tt := range tests {
+		size, err := estimateInputSize(tt.scriptType, tt.pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size.weight != tt.weight {
+			t.Errorf("%s: expected weight %d, actual %d", tt.scriptType, tt.weight, size.weight)
+		}
+	}
+	if _, err := estimateInputSize(ScriptMultiSig, testPubKey); err == nil {
+		t.Errorf("multisig input size should not be estimated")
+	}
+}
+
+func TestEstimateVSize(t *testing.T) {
+	p2pkh, _ := estimateInputSize(ScriptP2PKH, testPubKey)
+	p2wpkh, _ := estimateInputSize(ScriptP2WPKH, testPubKey)
+	out := p2pkhScript(testPubKeyHash)
+	// 10 + 180 + 34*2
+	if v := estimateVSize([]*inputSize{p2pkh}, [][]byte{out, out}); v != 258 {
+		t.Errorf("expected legacy vsize 258, actual %d", v)
+	}
+	// (40 + 2 + 272 + 34*2*4) / 4を切り上げ
+	if v := estimateVSize([]*inputSize{p2wpkh}, [][]byte{out, out}); v != 147 {
+		t.Errorf("expected segwit vsize 147, actual %d", v)
+	}
+	// witnessのない入力には空のwitnessが付く
+	if v := estimateVSize([]*inputSize{p2wpkh, p2pkh}, [][]byte{out}); v != (40+2+272+1+720+34*4+3)/4 {
+		t.Errorf("unexpected mixed vsize %d", v)
+	}
+}
+
+func TestFundTx(t *testing.T) {
+	input, _ := estimateInputSize(ScriptP2PKH, testPubKey)
+	toScript := p2shScript(bytes.Repeat([]byte{0x22}, 20))
+	changeScript := p2pkhScript(testPubKeyHash)
+	utxos := testUTXOs(20000, 30000, 50000)
+	for _, name := range []string{"bnb", "knapsack", "srd", "largest"} {
+		selector, _ := NewCoinSelector(name)
+		selection, fee, err := fundTx(utxos, selector, input, 60000, 5, toScript, changeScript)
+		if err != nil {
+			// bnbはおつりなしの組み合わせがなければ失敗する
+			if name != "bnb" {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		outputs := [][]byte{toScript}
+		if selection.Change > 0 {
+			outputs = append(outputs, changeScript)
+		}
+		inputs := []*inputSize{}
+		for range selection.Inputs {
+			inputs = append(inputs, input)
+		}
+		if required := 5 * estimateVSize(inputs, outputs); fee < required {
+			t.Errorf("%s: fee %d is below %d", name, fee, required)
+		}
+		if selection.Value != 60000+fee+selection.Change {
+			t.Errorf("%s: value should be amount + fee + change: %+v", name, selection)
+		}
+	}
+	if _, _, err := fundTx(utxos, largestFirst{}, input, 100000, 5, toScript, changeScript); err == nil {
+		t.Errorf("insufficient funds should be error")
+	}
+}
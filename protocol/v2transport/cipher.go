@@ -0,0 +1,102 @@
+package v2transport
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// rekeyInterval means how many chunks/packets are encrypted with the same key.
+const rekeyInterval = 224
+
+// fsChaCha20 is forward secure ChaCha20 stream cipher used to encrypt packet length.
+// https://github.com/bitcoin/bips/blob/master/bip-0324.mediawiki#rekeying-wrappers-fschacha20poly1305-and-fschacha20
+type fsChaCha20 struct {
+	key          [32]byte
+	chunkCounter uint64
+	cipher       *chacha20.Cipher
+}
+
+func newFSChaCha20(key [32]byte) *fsChaCha20 {
+	c := &fsChaCha20{key: key}
+	c.resetCipher()
+	return c
+}
+
+// resetCipher create the keystream for current key and rekey epoch.
+func (c *fsChaCha20) resetCipher() {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.chunkCounter/rekeyInterval)
+	cipher, err := chacha20.NewUnauthenticatedCipher(c.key[:], nonce[:])
+	if err != nil {
+		// keyとnonceの長さは固定なのでエラーにならない
+		panic(err)
+	}
+	c.cipher = cipher
+}
+
+// crypt encrypt or decrypt the chunk.
+func (c *fsChaCha20) crypt(chunk []byte) []byte {
+	res := make([]byte, len(chunk))
+	c.cipher.XORKeyStream(res, chunk)
+	if (c.chunkCounter+1)%rekeyInterval == 0 {
+		// 次の32byteのkeystreamを新しい鍵にする
+		var newKey [32]byte
+		c.cipher.XORKeyStream(newKey[:], newKey[:])
+		c.key = newKey
+		c.chunkCounter++
+		c.resetCipher()
+		return res
+	}
+	c.chunkCounter++
+	return res
+}
+
+// fsChaCha20Poly1305 is forward secure AEAD used to encrypt packet contents.
+type fsChaCha20Poly1305 struct {
+	key           [32]byte
+	packetCounter uint64
+}
+
+func newFSChaCha20Poly1305(key [32]byte) *fsChaCha20Poly1305 {
+	return &fsChaCha20Poly1305{key: key}
+}
+
+func (c *fsChaCha20Poly1305) nonce() [12]byte {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint32(nonce[0:4], uint32(c.packetCounter%rekeyInterval))
+	binary.LittleEndian.PutUint64(nonce[4:], c.packetCounter/rekeyInterval)
+	return nonce
+}
+
+// next advance the packet counter and rekey if needed.
+func (c *fsChaCha20Poly1305) next(nonce [12]byte) {
+	if (c.packetCounter+1)%rekeyInterval == 0 {
+		rekeyNonce := nonce
+		binary.LittleEndian.PutUint32(rekeyNonce[0:4], 0xFFFFFFFF)
+		aead, _ := chacha20poly1305.New(c.key[:])
+		var zero [32]byte
+		copy(c.key[:], aead.Seal(nil, rekeyNonce[:], zero[:], nil)[:32])
+	}
+	c.packetCounter++
+}
+
+func (c *fsChaCha20Poly1305) encrypt(aad []byte, plaintext []byte) []byte {
+	nonce := c.nonce()
+	aead, _ := chacha20poly1305.New(c.key[:])
+	res := aead.Seal(nil, nonce[:], plaintext, aad)
+	c.next(nonce)
+	return res
+}
+
+func (c *fsChaCha20Poly1305) decrypt(aad []byte, ciphertext []byte) ([]byte, error) {
+	nonce := c.nonce()
+	aead, _ := chacha20poly1305.New(c.key[:])
+	res, err := aead.Open(nil, nonce[:], ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.next(nonce)
+	return res, nil
+}
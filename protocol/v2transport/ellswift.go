@@ -0,0 +1,146 @@
+package v2transport
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/tanishiking/btcwallet/util/curve"
+)
+
+// EllswiftPubKeyLen means length of ElligatorSwift encoded public key.
+const EllswiftPubKeyLen = 64
+
+// minus3Sqrt is a square root of -3 in the field.
+var minus3Sqrt, _ = new(big.Int).SetString("0A2D2BA93507F1DF233770C2A797962CC61F6D15DA14ECD47D8D27AE1CD5F852", 16)
+
+var ellswiftTag = []byte("bip324_ellswift_xonly_ecdh")
+
+// xSwiftEC decode field elements (u, t) to x coordinate on the curve.
+// https://github.com/bitcoin/bips/blob/master/bip-0324.mediawiki#elligatorswift-encoding-of-curve-x-coordinates
+func xSwiftEC(u, t fe) fe {
+	if u.Sign() == 0 {
+		u = feInt(1)
+	}
+	if t.Sign() == 0 {
+		t = feInt(1)
+	}
+	if feAdd(curve.Y2(u), feMul(t, t)).Sign() == 0 {
+		t = feMul(feInt(2), t)
+	}
+	// X = (u^3 + 7 - t^2) / (2t)
+	x := feDiv(feSub(curve.Y2(u), feMul(t, t)), feMul(feInt(2), t))
+	// Y = (X + t) / (sqrt(-3) * u)
+	y := feDiv(feAdd(x, t), feMul(minus3Sqrt, u))
+	candidates := []fe{
+		feAdd(u, feMul(feInt(4), feMul(y, y))),
+		feDiv(feSub(feNeg(feDiv(x, y)), u), feInt(2)),
+		feDiv(feSub(feDiv(x, y), u), feInt(2)),
+	}
+	for _, c := range candidates {
+		if curve.Sqrt(curve.Y2(c)) != nil {
+			return c
+		}
+	}
+	// 数学的にここには到達しない
+	panic("xSwiftEC: no valid x coordinate")
+}
+
+// xSwiftECInv find t such that xSwiftEC(u, t) = x, or return nil.
+// c selects one of the 8 branches.
+func xSwiftECInv(x, u fe, c int) fe {
+	var v, s fe
+	if c&2 == 0 {
+		if curve.LiftX(feNeg(feAdd(x, u))) != nil {
+			return nil
+		}
+		v = x
+		// s = -(u^3 + 7) / (u^2 + uv + v^2)
+		s = feNeg(feDiv(curve.Y2(u), feAdd(feAdd(feMul(u, u), feMul(u, v)), feMul(v, v))))
+	} else {
+		s = feSub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		// r = sqrt(-s(4(u^3 + 7) + 3su^2))
+		r := curve.Sqrt(feNeg(feMul(s, feAdd(feMul(feInt(4), curve.Y2(u)), feMul(feMul(feInt(3), s), feMul(u, u))))))
+		if r == nil {
+			return nil
+		}
+		if c&1 == 1 && r.Sign() == 0 {
+			return nil
+		}
+		v = feDiv(feSub(feDiv(r, s), u), feInt(2))
+	}
+	w := curve.Sqrt(s)
+	if w == nil {
+		return nil
+	}
+	// u(1-sqrt(-3))/2 and u(1+sqrt(-3))/2
+	uOneMinusC := feDiv(feMul(u, feSub(feInt(1), minus3Sqrt)), feInt(2))
+	uOnePlusC := feDiv(feMul(u, feAdd(feInt(1), minus3Sqrt)), feInt(2))
+	switch c & 5 {
+	case 0:
+		return feNeg(feMul(w, feAdd(uOneMinusC, v)))
+	case 1:
+		return feMul(w, feAdd(uOnePlusC, v))
+	case 4:
+		return feMul(w, feAdd(uOneMinusC, v))
+	default:
+		return feNeg(feMul(w, feAdd(uOnePlusC, v)))
+	}
+}
+
+// ellswiftEncode encode x coordinate into random 64 bytes.
+func ellswiftEncode(x fe) ([EllswiftPubKeyLen]byte, error) {
+	var res [EllswiftPubKeyLen]byte
+	for {
+		var rnd [33]byte
+		if _, err := rand.Read(rnd[:]); err != nil {
+			return res, err
+		}
+		u := feFromBytes(rnd[:32])
+		t := xSwiftECInv(x, u, int(rnd[32]&7))
+		if t == nil {
+			continue
+		}
+		ub, tb := feBytes(u), feBytes(t)
+		copy(res[:32], ub[:])
+		copy(res[32:], tb[:])
+		return res, nil
+	}
+}
+
+// ellswiftDecode decode 64 bytes to x coordinate.
+func ellswiftDecode(b [EllswiftPubKeyLen]byte) fe {
+	return xSwiftEC(feFromBytes(b[:32]), feFromBytes(b[32:]))
+}
+
+// ellswiftCreate generate new private key and its ElligatorSwift encoded public key.
+func ellswiftCreate() (*big.Int, [EllswiftPubKeyLen]byte, error) {
+	priv, err := newPrivateKey()
+	if err != nil {
+		return nil, [EllswiftPubKeyLen]byte{}, err
+	}
+	pub := curve.ScalarBaseMult(priv)
+	encoded, err := ellswiftEncode(pub.X)
+	if err != nil {
+		return nil, [EllswiftPubKeyLen]byte{}, err
+	}
+	return priv, encoded, nil
+}
+
+// ellswiftXDH calculate BIP324 shared secret.
+// ellswiftA is always the initiator's public key and ellswiftB is the responder's.
+func ellswiftXDH(priv *big.Int, ellswiftTheirs, ellswiftA, ellswiftB [EllswiftPubKeyLen]byte) ([32]byte, error) {
+	theirs := curve.LiftX(ellswiftDecode(ellswiftTheirs))
+	if theirs == nil {
+		return [32]byte{}, fmt.Errorf("v2transport: invalid ellswift public key")
+	}
+	shared := curve.ScalarMult(priv, theirs)
+	if shared == nil {
+		return [32]byte{}, fmt.Errorf("v2transport: ECDH resulted in point at infinity")
+	}
+	x := feBytes(shared.X)
+	return curve.TaggedHash(ellswiftTag, ellswiftA[:], ellswiftB[:], x[:]), nil
+}
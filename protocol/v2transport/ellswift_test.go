@@ -0,0 +1,224 @@
+package v2transport
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/util/curve"
+)
+
+// BIP324 test vectors for XSwiftEC.
+// https://github.com/bitcoin/bips/blob/master/bip-0324/ellswift_decode_test_vectors.csv
+var xSwiftECVectors = []struct {
+	ellswift string
+	x        string
+}{
+	{
+		ellswift: "00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+		x:        "edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c",
+	},
+	{
+		ellswift: "000000000000000000000000000000000000000000000000000000000000000001d3475bf7655b0fb2d852921035b2ef607f49069b97454e6795251062741771",
+		x:        "b5da00b73cd6560520e7c364086e7cd23a34bf60d0e707be9fc34d4cd5fdfa2c",
+	},
+	{
+		ellswift: "000000000000000000000000000000000000000000000000000000000000000082277c4a71f9d22e66ece523f8fa08741a7c0912c66a69ce68514bfd3515b49f",
+		x:        "f482f2e241753ad0fb89150d8491dc1e34ff0b8acfbb442cfe999e2e5e6fd1d2",
+	},
+	{
+		ellswift: "00000000000000000000000000000000000000000000000000000000000000008421cc930e77c9f514b6915c3dbe2a94c6d8f690b5b739864ba6789fb8a55dd0",
+		x:        "9f59c40275f5085a006f05dae77eb98c6fd0db1ab4a72ac47eae90a4fc9e57e0",
+	},
+	{
+		ellswift: "0000000000000000000000000000000000000000000000000000000000000000bde70df51939b94c9c24979fa7dd04ebd9b3572da7802290438af2a681895441",
+		x:        "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa9fffffd6b",
+	},
+	{
+		ellswift: "0000000000000000000000000000000000000000000000000000000000000000d19c182d2759cd99824228d94799f8c6557c38a1c0d6779b9d4b729c6f1ccc42",
+		x:        "70720db7e238d04121f5b1afd8cc5ad9d18944c6bdc94881f502b7a3af3aecff",
+	},
+	{
+		ellswift: "0000000000000000000000000000000000000000000000000000000000000000fffffffffffffffffffffffffffffffffffffffffffffffffffffffff3113ad9",
+		x:        "7eed6b70e7b0767c7d7feac04e57aa2a12fef5e0f48f878fcbb88b3b6b5e0783",
+	},
+	{
+		ellswift: "0a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f8530000000000000000000000000000000000000000000000000000000000000000",
+		x:        "532167c11200b08c0e84a354e74dcc40f8b25f4fe686e30869526366278a0688",
+	},
+	{
+		ellswift: "0a2d2ba93507f1df233770c2a797962cc61f6d15da14ecd47d8d27ae1cd5f853fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f",
+		x:        "532167c11200b08c0e84a354e74dcc40f8b25f4fe686e30869526366278a0688",
+	},
+	{
+		ellswift: "0ffde9ca81d751e9cdaffc1a50779245320b28996dbaf32f822f20117c22fbd6c74d99efceaa550f1ad1c0f43f46e7ff1ee3bd0162b7bf55f2965da9c3450646",
+		x:        "74e880b3ffd18fe3cddf7902522551ddf97fa4a35a3cfda8197f947081a57b8f",
+	},
+	{
+		ellswift: "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffe7bc1f8dfffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f",
+		x:        "16c2ccb54352ff4bd794f6efd613c72197ab7082da5b563bdf9cb3edaafe74c2",
+	},
+	{
+		ellswift: "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffef64d162750546ce42b0431361e52d4f5242d8f24f33e6b1f99b591647cbc808f462af51",
+		x:        "d41244d11ca4f65240687759f95ca9efbab767ededb38fd18c36e18cd3b6f6a9",
+	},
+	{
+		ellswift: "fffffffffffffffffffffffffffffffffffffffffffffffffffffffff0e5be52372dd6e894b2a326fc3605a6e8f3c69c710bf27d630dfe2004988b78eb6eab36",
+		x:        "64bf84dd5e03670fdb24c0f5d3c2c365736f51db6c92d95010716ad2d36134c8",
+	},
+	{
+		ellswift: "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffefbb982fffffffffffffffffffffffffffffffffffffffffffffffffffffffff6d6db1f",
+		x:        "1c92ccdfcf4ac550c28db57cff0c8515cb26936c786584a70114008d6c33a34b",
+	},
+}
+
+// BIP324 test vectors for XSwiftECInv, empty string means no t exists for the case.
+// https://github.com/bitcoin/bips/blob/master/bip-0324/xswiftec_inv_test_vectors.csv
+var xSwiftECInvVectors = []struct {
+	u     string
+	x     string
+	cases []string
+}{
+	{
+		u: "05ff6bdad900fc3261bc7fe34e2fb0f569f06e091ae437d3a52e9da0cbfb9590",
+		x: "80cdf63774ec7022c89a5a8558e373a279170285e0ab27412dbce510bdfe23fc",
+		cases: []string{
+			"",
+			"",
+			"45654798ece071ba79286d04f7f3eb1c3f1d17dd883610f2ad2efd82a287466b",
+			"0aeaa886f6b76c7158452418cbf5033adc5747e9e9b5d3b2303db96936528557",
+			"",
+			"",
+			"ba9ab867131f8e4586d792fb080c14e3c0e2e82277c9ef0d52d1027c5d78b5c4",
+			"f51557790948938ea7badbe7340afcc523a8b816164a2c4dcfc24695c9ad76d8",
+		},
+	},
+	{
+		u: "1737a85f4c8d146cec96e3ffdca76d9903dcf3bd53061868d478c78c63c2aa9e",
+		x: "39e48dd150d2f429be088dfd5b61882e7e8407483702ae9a5ab35927b15f85ea",
+		cases: []string{
+			"1be8cc0b04be0c681d0c6a68f733f82c6c896e0c8a262fcd392918e303a7abf4",
+			"605b5814bf9b8cb066667c9e5480d22dc5b6c92f14b4af3ee0a9eb83b03685e3",
+			"",
+			"",
+			"e41733f4fb41f397e2f3959708cc07d3937691f375d9d032c6d6e71bfc58503b",
+			"9fa4a7eb4064734f99998361ab7f2dd23a4936d0eb4b50c11f56147b4fc9764c",
+			"",
+			"",
+		},
+	},
+	{
+		u: "1aaa1ccebf9c724191033df366b36f691c4d902c228033ff4516d122b2564f68",
+		x: "c75541259d3ba98f207eaa30c69634d187d0b6da594e719e420f4898638fc5b0",
+		cases: []string{
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+			"",
+		},
+	},
+	{
+		u: "2323a1d079b0fd72fc8bb62ec34230a815cb0596c2bfac998bd6b84260f5dc26",
+		x: "239342dfb675500a34a196310b8d87d54f49dcac9da50c1743ceab41a7b249ff",
+		cases: []string{
+			"f63580b8aa49c4846de56e39e1b3e73f171e881eba8c66f614e67e5c975dfc07",
+			"b6307b332e699f1cf77841d90af25365404deb7fed5edb3090db49e642a156b6",
+			"",
+			"",
+			"09ca7f4755b63b7b921a91c61e4c18c0e8e177e145739909eb1981a268a20028",
+			"49cf84ccd19660e30887be26f50dac9abfb2148012a124cf6f24b618bd5ea579",
+			"",
+			"",
+		},
+	},
+	{
+		u: "2dc90e640cb646ae9164c0b5a9ef0169febe34dc4437d6e46acb0e27e219d1e8",
+		x: "d236f19bf349b9516e9b3f4a5610fe960141cb23bbc8291b9534f1d71de62a47",
+		cases: []string{
+			"e69df7d9c026c36600ebdf588072675847c0c431c8eb730682533e964b6252c9",
+			"4f18bbdf7c2d6c5f818c18802fa35cd069eaa79fff74e4fc837c80d93fece2f8",
+			"",
+			"",
+			"196208263fd93c99ff1420a77f8d98a7b83f3bce37148cf97dacc168b49da966",
+			"b0e7442083d293a07e73e77fd05ca32f96155860008b1b037c837f25c0131937",
+			"",
+			"",
+		},
+	},
+}
+
+func mustFe(t *testing.T, s string) fe {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feFromBytes(b)
+}
+
+func TestXSwiftEC(t *testing.T) {
+	for _, v := range xSwiftECVectors {
+		b, err := hex.DecodeString(v.ellswift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var arr [EllswiftPubKeyLen]byte
+		copy(arr[:], b)
+		x := feBytes(ellswiftDecode(arr))
+		if hex.EncodeToString(x[:]) != v.x {
+			t.Errorf("expected: %s, actual: %x", v.x, x)
+		}
+	}
+}
+
+func TestXSwiftECInv(t *testing.T) {
+	for _, v := range xSwiftECInvVectors {
+		u := mustFe(t, v.u)
+		x := mustFe(t, v.x)
+		for c, expected := range v.cases {
+			actual := xSwiftECInv(x, u, c)
+			if actual == nil {
+				if expected != "" {
+					t.Errorf("u: %s case %d: expected: %s, actual: nil", v.u, c, expected)
+				}
+				continue
+			}
+			b := feBytes(actual)
+			if hex.EncodeToString(b[:]) != expected {
+				t.Errorf("u: %s case %d: expected: %s, actual: %x", v.u, c, expected, b)
+			}
+			// 逆変換した結果は元のxに戻る
+			if xSwiftEC(u, actual).Cmp(x) != 0 {
+				t.Errorf("u: %s case %d: xSwiftEC(u, t) != x", v.u, c)
+			}
+		}
+	}
+}
+
+func TestEllswiftXDH(t *testing.T) {
+	privA, pubA, err := ellswiftCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privB, pubB, err := ellswiftCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ellswiftDecode(pubA).Cmp(curve.ScalarBaseMult(privA).X) != 0 {
+		t.Errorf("ellswift encoding should decode to the public key")
+	}
+	secretA, err := ellswiftXDH(privA, pubB, pubA, pubB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretB, err := ellswiftXDH(privB, pubA, pubA, pubB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secretA[:], secretB[:]) {
+		t.Errorf("shared secrets differ: %x, %x", secretA, secretB)
+	}
+}
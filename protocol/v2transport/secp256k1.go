@@ -0,0 +1,60 @@
+package v2transport
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/tanishiking/btcwallet/util/curve"
+)
+
+// fe means field element of secp256k1, always kept in [0, p).
+type fe = *big.Int
+
+func feFromBytes(b []byte) fe {
+	return new(big.Int).Mod(new(big.Int).SetBytes(b), curve.P)
+}
+
+func feBytes(a fe) [32]byte {
+	var res [32]byte
+	a.FillBytes(res[:])
+	return res
+}
+
+func feInt(i int64) fe {
+	return new(big.Int).Mod(big.NewInt(i), curve.P)
+}
+
+func feAdd(a, b fe) fe {
+	return new(big.Int).Mod(new(big.Int).Add(a, b), curve.P)
+}
+
+func feSub(a, b fe) fe {
+	return new(big.Int).Mod(new(big.Int).Sub(a, b), curve.P)
+}
+
+func feMul(a, b fe) fe {
+	return new(big.Int).Mod(new(big.Int).Mul(a, b), curve.P)
+}
+
+func feNeg(a fe) fe {
+	return new(big.Int).Mod(new(big.Int).Neg(a), curve.P)
+}
+
+// feDiv return a/b. b must not be zero.
+func feDiv(a, b fe) fe {
+	return feMul(a, new(big.Int).ModInverse(b, curve.P))
+}
+
+// newPrivateKey generate random scalar in [1, n).
+func newPrivateKey() (*big.Int, error) {
+	for {
+		var b [32]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		k := new(big.Int).SetBytes(b[:])
+		if k.Sign() > 0 && k.Cmp(curve.N) < 0 {
+			return k, nil
+		}
+	}
+}
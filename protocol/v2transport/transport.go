@@ -0,0 +1,351 @@
+// Package v2transport implements BIP324 version 2 P2P encrypted transport.
+// https://github.com/bitcoin/bips/blob/master/bip-0324.mediawiki
+package v2transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MaxGarbageLen means the max length of garbage sent after the public key.
+	MaxGarbageLen = 4095
+
+	garbageTerminatorLen = 16
+	lengthFieldLen       = 3
+	headerLen            = 1
+	tagLen               = 16
+
+	ignoreBit = byte(0x80)
+
+	// maxContentsLen follows bitcoin core's MAX_PROTOCOL_MESSAGE_LENGTH + message type.
+	maxContentsLen = 4*1000*1000 + 1 + commandLen
+
+	commandLen = 12
+
+	// v1PrefixLen means length of v1 version message header prefix (magic + "version\x00\x00\x00\x00\x00").
+	v1PrefixLen = 16
+)
+
+var (
+	// ErrV1Peer is returned by responder when the initiator speaks v1 protocol.
+	ErrV1Peer = errors.New("v2transport: peer uses v1 protocol")
+
+	// ErrNoV2Response is returned by initiator when the peer closed the connection
+	// before sending its public key, which usually means it only supports v1.
+	ErrNoV2Response = errors.New("v2transport: peer didn't respond to v2 handshake")
+)
+
+// shortIDs means 1-byte message type ids of BIP324.
+var shortIDs = []string{
+	"", // 0 means 12 bytes command follows
+	"addr", "block", "blocktxn", "cmpctblock", "feefilter", "filteradd", "filterclear",
+	"filterload", "getblocks", "getblocktxn", "getdata", "getheaders", "headers", "inv",
+	"mempool", "merkleblock", "notfound", "ping", "pong", "sendcmpct", "tx", "getcfilters",
+	"cfilter", "getcfheaders", "cfheaders", "getcfcheckpt", "cfcheckpt", "addrv2",
+}
+
+var shortIDIndex = func() map[string]byte {
+	m := map[string]byte{}
+	for i, cmd := range shortIDs {
+		if cmd != "" {
+			m[cmd] = byte(i)
+		}
+	}
+	return m
+}()
+
+// Transport is BIP324 encrypted connection.
+// Use Handshake before WriteMessage and ReadMessage.
+type Transport struct {
+	conn      net.Conn
+	magic     [4]byte
+	initiator bool
+
+	sendMtx sync.Mutex
+	sendL   *fsChaCha20
+	sendP   *fsChaCha20Poly1305
+	recvL   *fsChaCha20
+	recvP   *fsChaCha20Poly1305
+
+	sendGarbage           []byte
+	recvGarbage           []byte
+	sendGarbageTerminator [garbageTerminatorLen]byte
+	recvGarbageTerminator [garbageTerminatorLen]byte
+	sessionID             [32]byte
+
+	// 鍵交換後の最初のパケットのaadにはgarbageを使う
+	sentFirstPacket bool
+	recvFirstPacket bool
+}
+
+// NewTransport create new v2 transport on the connection.
+// magic is the network magic bytes as they appear on the wire.
+func NewTransport(conn net.Conn, magic [4]byte, initiator bool) *Transport {
+	return &Transport{
+		conn:      conn,
+		magic:     magic,
+		initiator: initiator,
+	}
+}
+
+// SessionID return the session id which both sides can compare to detect MITM.
+func (t *Transport) SessionID() [32]byte {
+	return t.sessionID
+}
+
+// Handshake exchange keys, garbage and version packets with the peer.
+func (t *Transport) Handshake() error {
+	priv, ours, err := ellswiftCreate()
+	if err != nil {
+		return err
+	}
+	garbage, err := randomGarbage()
+	if err != nil {
+		return err
+	}
+	t.sendGarbage = garbage
+
+	var theirs [EllswiftPubKeyLen]byte
+	if t.initiator {
+		if _, err := t.conn.Write(append(ours[:], garbage...)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(t.conn, theirs[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF || isConnReset(err) {
+				return ErrNoV2Response
+			}
+			return err
+		}
+	} else {
+		if _, err := io.ReadFull(t.conn, theirs[:v1PrefixLen]); err != nil {
+			return err
+		}
+		if bytes.Equal(theirs[:v1PrefixLen], t.v1Prefix()) {
+			return ErrV1Peer
+		}
+		if _, err := io.ReadFull(t.conn, theirs[v1PrefixLen:]); err != nil {
+			return err
+		}
+		if _, err := t.conn.Write(append(ours[:], garbage...)); err != nil {
+			return err
+		}
+	}
+
+	if err := t.initializeCiphers(priv, ours, theirs); err != nil {
+		return err
+	}
+
+	// garbage terminator と version packet を送る
+	if _, err := t.conn.Write(t.sendGarbageTerminator[:]); err != nil {
+		return err
+	}
+	if err := t.writePacket([]byte{}, false); err != nil {
+		return err
+	}
+
+	if err := t.readGarbage(); err != nil {
+		return err
+	}
+	// decoy packetを読み飛ばして version packet を受け取る
+	// version packet の内容は将来の拡張用なので無視する
+	for {
+		_, ignore, err := t.readPacket()
+		if err != nil {
+			return err
+		}
+		if !ignore {
+			return nil
+		}
+	}
+}
+
+// v1Prefix return the first 16 bytes of v1 version message.
+func (t *Transport) v1Prefix() []byte {
+	prefix := make([]byte, v1PrefixLen)
+	copy(prefix, t.magic[:])
+	copy(prefix[4:], []byte("version"))
+	return prefix
+}
+
+// initializeCiphers derive the keys from ECDH shared secret.
+func (t *Transport) initializeCiphers(priv *big.Int, ours, theirs [EllswiftPubKeyLen]byte) error {
+	initiatorPub, responderPub := ours, theirs
+	if !t.initiator {
+		initiatorPub, responderPub = theirs, ours
+	}
+	secret, err := ellswiftXDH(priv, theirs, initiatorPub, responderPub)
+	if err != nil {
+		return err
+	}
+	salt := append([]byte("bitcoin_v2_shared_secret"), t.magic[:]...)
+	prk := hkdf.Extract(sha256.New, secret[:], salt)
+	expand := func(info string) [32]byte {
+		var res [32]byte
+		io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), res[:])
+		return res
+	}
+	initiatorL, initiatorP := expand("initiator_L"), expand("initiator_P")
+	responderL, responderP := expand("responder_L"), expand("responder_P")
+	terminators := expand("garbage_terminators")
+	t.sessionID = expand("session_id")
+
+	if t.initiator {
+		t.sendL, t.sendP = newFSChaCha20(initiatorL), newFSChaCha20Poly1305(initiatorP)
+		t.recvL, t.recvP = newFSChaCha20(responderL), newFSChaCha20Poly1305(responderP)
+		copy(t.sendGarbageTerminator[:], terminators[:garbageTerminatorLen])
+		copy(t.recvGarbageTerminator[:], terminators[garbageTerminatorLen:])
+	} else {
+		t.sendL, t.sendP = newFSChaCha20(responderL), newFSChaCha20Poly1305(responderP)
+		t.recvL, t.recvP = newFSChaCha20(initiatorL), newFSChaCha20Poly1305(initiatorP)
+		copy(t.sendGarbageTerminator[:], terminators[garbageTerminatorLen:])
+		copy(t.recvGarbageTerminator[:], terminators[:garbageTerminatorLen])
+	}
+	return nil
+}
+
+// readGarbage read the peer's garbage until its garbage terminator.
+func (t *Transport) readGarbage() error {
+	buf := make([]byte, 0, MaxGarbageLen+garbageTerminatorLen)
+	b := make([]byte, 1)
+	for len(buf) < MaxGarbageLen+garbageTerminatorLen {
+		if _, err := io.ReadFull(t.conn, b); err != nil {
+			return err
+		}
+		buf = append(buf, b[0])
+		if len(buf) >= garbageTerminatorLen && bytes.Equal(buf[len(buf)-garbageTerminatorLen:], t.recvGarbageTerminator[:]) {
+			t.recvGarbage = buf[:len(buf)-garbageTerminatorLen]
+			return nil
+		}
+	}
+	return fmt.Errorf("v2transport: garbage terminator not found")
+}
+
+// writePacket encrypt the contents and send it.
+func (t *Transport) writePacket(contents []byte, ignore bool) error {
+	t.sendMtx.Lock()
+	defer t.sendMtx.Unlock()
+	if len(contents) > maxContentsLen {
+		return fmt.Errorf("v2transport: too large packet %d bytes", len(contents))
+	}
+	aad := []byte{}
+	if !t.sentFirstPacket {
+		aad = t.sendGarbage
+		t.sentFirstPacket = true
+	}
+	header := byte(0x00)
+	if ignore {
+		header = ignoreBit
+	}
+	ciphertext := t.sendP.encrypt(aad, append([]byte{header}, contents...))
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(contents)))
+	encLength := t.sendL.crypt(length[:lengthFieldLen])
+	_, err := t.conn.Write(append(encLength, ciphertext...))
+	return err
+}
+
+// readPacket receive and decrypt a packet.
+func (t *Transport) readPacket() ([]byte, bool, error) {
+	var encLength [lengthFieldLen]byte
+	if _, err := io.ReadFull(t.conn, encLength[:]); err != nil {
+		return nil, false, err
+	}
+	var length [4]byte
+	copy(length[:], t.recvL.crypt(encLength[:]))
+	contentsLen := binary.LittleEndian.Uint32(length[:])
+	if contentsLen > maxContentsLen {
+		return nil, false, fmt.Errorf("v2transport: too large packet %d bytes", contentsLen)
+	}
+	ciphertext := make([]byte, headerLen+int(contentsLen)+tagLen)
+	if _, err := io.ReadFull(t.conn, ciphertext); err != nil {
+		return nil, false, err
+	}
+	aad := []byte{}
+	if !t.recvFirstPacket {
+		aad = t.recvGarbage
+		t.recvFirstPacket = true
+	}
+	plaintext, err := t.recvP.decrypt(aad, ciphertext)
+	if err != nil {
+		return nil, false, fmt.Errorf("v2transport: packet authentication failed")
+	}
+	return plaintext[headerLen:], plaintext[0]&ignoreBit != 0, nil
+}
+
+// WriteDecoy send a decoy packet which the peer ignores.
+func (t *Transport) WriteDecoy(size int) error {
+	contents := make([]byte, size)
+	rand.Read(contents)
+	return t.writePacket(contents, true)
+}
+
+// WriteMessage send the message with command and payload.
+func (t *Transport) WriteMessage(command string, payload []byte) error {
+	var contents []byte
+	if id, ok := shortIDIndex[command]; ok {
+		contents = append([]byte{id}, payload...)
+	} else {
+		if len(command) > commandLen {
+			return fmt.Errorf("v2transport: too long command %s", command)
+		}
+		cmd := make([]byte, commandLen)
+		copy(cmd, command)
+		contents = append(append([]byte{0x00}, cmd...), payload...)
+	}
+	return t.writePacket(contents, false)
+}
+
+// ReadMessage receive next message, skipping decoy packets.
+func (t *Transport) ReadMessage() (string, []byte, error) {
+	for {
+		contents, ignore, err := t.readPacket()
+		if err != nil {
+			return "", nil, err
+		}
+		if ignore {
+			continue
+		}
+		if len(contents) == 0 {
+			return "", nil, fmt.Errorf("v2transport: empty message")
+		}
+		if contents[0] != 0x00 {
+			if int(contents[0]) >= len(shortIDs) {
+				return "", nil, fmt.Errorf("v2transport: unknown message type %d", contents[0])
+			}
+			return shortIDs[contents[0]], contents[1:], nil
+		}
+		if len(contents) < 1+commandLen {
+			return "", nil, fmt.Errorf("v2transport: invalid message")
+		}
+		command := string(bytes.TrimRight(contents[1:1+commandLen], "\x00"))
+		return command, contents[1+commandLen:], nil
+	}
+}
+
+func randomGarbage() ([]byte, error) {
+	var l [2]byte
+	if _, err := rand.Read(l[:]); err != nil {
+		return nil, err
+	}
+	garbage := make([]byte, int(binary.LittleEndian.Uint16(l[:]))%(MaxGarbageLen+1))
+	if _, err := rand.Read(garbage); err != nil {
+		return nil, err
+	}
+	return garbage, nil
+}
+
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
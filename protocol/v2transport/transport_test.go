@@ -0,0 +1,206 @@
+package v2transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testnetMagic = [4]byte{0x0b, 0x11, 0x09, 0x07}
+
+// pipeBuffer is one direction of memConn. Write never blocks.
+type pipeBuffer struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mtx)
+	return b
+}
+
+func (b *pipeBuffer) Read(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *pipeBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Broadcast()
+	return n, err
+}
+
+func (b *pipeBuffer) Close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// memConn is in-memory net.Conn with unbounded buffer.
+// net.Pipe is synchronous so both sides can't send their keys at the same time.
+type memConn struct {
+	r, w *pipeBuffer
+}
+
+func memPipe() (*memConn, *memConn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &memConn{r: a, w: b}, &memConn{r: b, w: a}
+}
+
+func (c *memConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *memConn) Write(p []byte) (int, error)        { return c.w.Write(p) }
+func (c *memConn) Close() error                       { c.r.Close(); c.w.Close(); return nil }
+func (c *memConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *memConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// handshakePair run handshake on both ends of in-memory connection.
+func handshakePair(t *testing.T) (*Transport, *Transport) {
+	c1, c2 := memPipe()
+	initiator := NewTransport(c1, testnetMagic, true)
+	responder := NewTransport(c2, testnetMagic, false)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- responder.Handshake()
+	}()
+	if err := initiator.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func TestHandshake(t *testing.T) {
+	initiator, responder := handshakePair(t)
+	if initiator.SessionID() != responder.SessionID() {
+		t.Errorf("session ids differ: %x, %x", initiator.SessionID(), responder.SessionID())
+	}
+	if initiator.sendGarbageTerminator != responder.recvGarbageTerminator {
+		t.Errorf("garbage terminators differ")
+	}
+}
+
+func TestWriteReadMessage(t *testing.T) {
+	initiator, responder := handshakePair(t)
+	tests := []struct {
+		command string
+		payload []byte
+	}{
+		{"inv", []byte{0x01, 0x02, 0x03}}, // short id
+		{"version", []byte("payload")},    // 12 bytes command
+		{"sendaddrv2", []byte{}},          // 12 bytes command with empty payload
+		{"merkleblock", bytes.Repeat([]byte{0xff}, 5000)},
+	}
+	for _, tt := range tests {
+		if err := initiator.WriteDecoy(10); err != nil {
+			t.Fatal(err)
+		}
+		if err := initiator.WriteMessage(tt.command, tt.payload); err != nil {
+			t.Fatal(err)
+		}
+		command, payload, err := responder.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != tt.command {
+			t.Errorf("expected: %s, actual: %s", tt.command, command)
+		}
+		if !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: payload mismatch", tt.command)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	initiator, responder := handshakePair(t)
+	// rekeyInterval を超えて送受信できること
+	for i := 0; i < rekeyInterval*2+10; i++ {
+		payload := []byte{byte(i), byte(i >> 8)}
+		if err := responder.WriteMessage("ping", payload); err != nil {
+			t.Fatal(err)
+		}
+		command, actual, err := initiator.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != "ping" || !bytes.Equal(actual, payload) {
+			t.Fatalf("message %d mismatch: %s %x", i, command, actual)
+		}
+	}
+}
+
+func TestTamperedPacket(t *testing.T) {
+	c1, c2 := memPipe()
+	initiator := NewTransport(c1, testnetMagic, true)
+	responder := NewTransport(c2, testnetMagic, false)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- responder.Handshake()
+	}()
+	if err := initiator.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.WriteMessage("ping", []byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	// 暗号文の最後のバイトを書き換える
+	c2.r.mtx.Lock()
+	b := c2.r.buf.Bytes()
+	b[len(b)-1] ^= 0x01
+	c2.r.mtx.Unlock()
+	if _, _, err := responder.ReadMessage(); err == nil {
+		t.Errorf("tampered packet should be rejected")
+	}
+}
+
+func TestV1Peer(t *testing.T) {
+	c1, c2 := memPipe()
+	responder := NewTransport(c2, testnetMagic, false)
+	// v1 version message header
+	header := append(testnetMagic[:], []byte("version\x00\x00\x00\x00\x00")...)
+	header = append(header, make([]byte, 8)...)
+	c1.Write(header)
+	if err := responder.Handshake(); err != ErrV1Peer {
+		t.Errorf("expected: %v, actual: %v", ErrV1Peer, err)
+	}
+}
+
+func TestNoV2Response(t *testing.T) {
+	c1, c2 := memPipe()
+	initiator := NewTransport(c1, testnetMagic, true)
+	go func() {
+		// v1しか話せないpeerは不明なデータを受け取ると切断する
+		buf := make([]byte, EllswiftPubKeyLen)
+		io.ReadFull(c2, buf)
+		c2.Close()
+	}()
+	if err := initiator.Handshake(); err != ErrNoV2Response {
+		t.Errorf("expected: %v, actual: %v", ErrNoV2Response, err)
+	}
+}
@@ -0,0 +1,513 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// TxNotificationType means what happened to the wallet transaction.
+type TxNotificationType int
+
+const (
+	// TxConfirmed means the transaction was included in a block of the best chain.
+	TxConfirmed TxNotificationType = iota
+	// TxUnconfirmed means the block including the transaction was disconnected by reorg.
+	TxUnconfirmed
+	// TxEvicted means the unconfirmed transaction was removed because it conflicts with a confirmed one.
+	TxEvicted
+	// TxReplaced means the unconfirmed transaction was replaced by a conflicting unconfirmed one. (BIP125)
+	TxReplaced
+)
+
+// coinbaseMaturity follows bitcoin core's wallet, which spends coinbase outputs
+// after COINBASE_MATURITY+1 confirmations.
+const coinbaseMaturity = 100
+
+// TxNotification means the change of the confirmation of wallet transaction.
+type TxNotification struct {
+	Type       TxNotificationType
+	TxID       message.TxID
+	BlockHash  [32]byte
+	Height     uint32
+	ReplacedBy message.TxID // TxReplacedの場合のみ
+}
+
+// String stringify the notification.
+func (n *TxNotification) String() string {
+	txID := n.TxID
+	blockHash := n.BlockHash
+	switch n.Type {
+	case TxConfirmed:
+		return fmt.Sprintf("tx %s confirmed in block %s (height %d)",
+			encodeTxID(txID), hex.EncodeToString(util.ReverseBytes(blockHash[:])), n.Height)
+	case TxEvicted:
+		return fmt.Sprintf("tx %s evicted, it conflicts with a confirmed transaction", encodeTxID(txID))
+	case TxReplaced:
+		return fmt.Sprintf("tx %s replaced by %s", encodeTxID(txID), encodeTxID(n.ReplacedBy))
+	default:
+		return fmt.Sprintf("tx %s unconfirmed, block %s (height %d) was disconnected",
+			encodeTxID(txID), hex.EncodeToString(util.ReverseBytes(blockHash[:])), n.Height)
+	}
+}
+
+// Balances means the balance of the wallet by the state of the outputs.
+type Balances struct {
+	Confirmed   uint64 // 承認済みで使用できる
+	Unconfirmed uint64 // 未承認のtxのoutput
+	Immature    uint64 // 成熟していないcoinbaseのoutput
+}
+
+// outputState means whether the unspent output of the wallet can be spent.
+type outputState int
+
+const (
+	outputConfirmed outputState = iota
+	outputUnconfirmed
+	outputImmature
+)
+
+// walletTx means the transaction related to the wallet.
+type walletTx struct {
+	tx    *message.Transaction // txを受信するまではnil
+	block *chain.HeaderNode    // 未承認の場合はnil
+}
+
+// replacement means the unconfirmed transaction replaced by the other.
+// The replaced transaction is kept, because it can be confirmed instead of the replacement.
+type replacement struct {
+	tx *message.Transaction
+	by message.TxID
+}
+
+// Wallet tracks transactions related to the key and which block confirms them.
+// Only transactions confirmed in the best chain are counted, so blocks
+// disconnected by reorg roll back the transactions and their outputs.
+type Wallet struct {
+	mtx      sync.Mutex
+	filePath string // 保存しない場合は空
+	pubKey   []byte
+	matcher  *outputMatcher
+	txs      map[message.TxID]*walletTx
+	blocks   map[[32]byte][]message.TxID       // 各ブロックで承認されたtx
+	spent    map[message.OutPoint]message.TxID // 承認済みのtxが使ったoutputとそのtx
+	replaced map[message.TxID]*replacement     // 置き換えられた未承認のtx
+	tip      *chain.HeaderNode                 // 走査済みの最後のブロック
+	notify   func(*TxNotification)
+}
+
+// NewWallet create new empty wallet for the public key.
+// Outputs paying to the key in any supported script type belong to the wallet.
+// notify is called when the confirmation of a transaction changes, it can be nil.
+func NewWallet(pubKey []byte, notify func(*TxNotification)) *Wallet {
+	return &Wallet{
+		pubKey:   pubKey,
+		matcher:  newOutputMatcher(pubKey),
+		txs:      map[message.TxID]*walletTx{},
+		blocks:   map[[32]byte][]message.TxID{},
+		spent:    map[message.OutPoint]message.TxID{},
+		replaced: map[message.TxID]*replacement{},
+		notify:   notify,
+	}
+}
+
+// ConnectBlock mark the transactions as confirmed in the block.
+func (w *Wallet) ConnectBlock(node *chain.HeaderNode, txIDs []message.TxID) {
+	w.mtx.Lock()
+	notifications := []*TxNotification{}
+	for _, txID := range txIDs {
+		wtx, ok := w.txs[txID]
+		if !ok {
+			wtx = &walletTx{}
+			// 置き換えられたtxが先に承認された場合は置き換えたtxの代わりに戻す
+			if r, ok := w.replaced[txID]; ok {
+				wtx.tx = r.tx
+				delete(w.replaced, txID)
+			}
+			w.txs[txID] = wtx
+		}
+		if wtx.block == node {
+			continue
+		}
+		wtx.block = node
+		w.markSpent(txID, wtx)
+		notifications = append(notifications, &TxNotification{
+			Type:      TxConfirmed,
+			TxID:      txID,
+			BlockHash: node.Hash,
+			Height:    node.Height,
+		})
+		notifications = append(notifications, w.evictConflicts(txID, wtx)...)
+	}
+	w.blocks[node.Hash] = txIDs
+	if w.tip == nil || node.Height > w.tip.Height {
+		w.tip = node
+	}
+	w.mtx.Unlock()
+	w.sendNotifications(notifications)
+}
+
+// DisconnectBlock mark the transactions confirmed in the block as unconfirmed.
+func (w *Wallet) DisconnectBlock(node *chain.HeaderNode) {
+	w.mtx.Lock()
+	notifications := []*TxNotification{}
+	for _, txID := range w.blocks[node.Hash] {
+		wtx, ok := w.txs[txID]
+		if !ok || wtx.block != node {
+			continue
+		}
+		wtx.block = nil
+		w.unmarkSpent(txID, wtx)
+		notifications = append(notifications, &TxNotification{
+			Type:      TxUnconfirmed,
+			TxID:      txID,
+			BlockHash: node.Hash,
+			Height:    node.Height,
+		})
+	}
+	delete(w.blocks, node.Hash)
+	// 走査済みのブロックが切り離されたら親から走査し直す
+	if w.tip == node {
+		w.tip = node.Parent
+	}
+	w.mtx.Unlock()
+	w.sendNotifications(notifications)
+}
+
+// HandleTipChange roll back the transactions in the disconnected blocks.
+// The connected blocks are applied by ConnectBlock when their merkleblocks arrive,
+// or when they match the compact filters in followFilters.
+func (w *Wallet) HandleTipChange(change *chain.TipChange) {
+	for _, node := range change.Disconnected {
+		w.DisconnectBlock(node)
+	}
+}
+
+// AddTx add the transaction data to the wallet.
+// Transactions not confirmed yet are tracked as unconfirmed, unless they conflict
+// with confirmed transactions or were replaced already.
+// An unconfirmed transaction conflicting with other unconfirmed ones replaces them,
+// because peers relay only the transactions accepted to their mempool.
+func (w *Wallet) AddTx(tx *message.Transaction) {
+	w.mtx.Lock()
+	txID := tx.ID()
+	wtx, ok := w.txs[txID]
+	if !ok {
+		wtx = &walletTx{}
+	}
+	if wtx.block == nil {
+		if _, ok := w.replaced[txID]; ok || w.conflictsWithConfirmed(txID, tx) {
+			w.mtx.Unlock()
+			return
+		}
+	}
+	w.txs[txID] = wtx
+	wtx.tx = tx
+	if wtx.block != nil {
+		w.markSpent(txID, wtx)
+	}
+	notifications := w.evictConflicts(txID, wtx)
+	w.mtx.Unlock()
+	w.sendNotifications(notifications)
+}
+
+// ReplacedBy return the transaction which replaced the transaction.
+func (w *Wallet) ReplacedBy(txID message.TxID) (message.TxID, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	r, ok := w.replaced[txID]
+	if !ok {
+		return message.TxID{}, false
+	}
+	return r.by, true
+}
+
+// SyncTip return the last block scanned for the wallet, or nil if no block is scanned.
+func (w *Wallet) SyncTip() *chain.HeaderNode {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.tip
+}
+
+// SetSyncTip mark the blocks up to the node as scanned.
+func (w *Wallet) SetSyncTip(node *chain.HeaderNode) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.tip = node
+}
+
+// Rewind forget the unconfirmed transactions and the transactions confirmed after the node,
+// and make the node the sync tip, so the blocks after it are scanned again.
+func (w *Wallet) Rewind(node *chain.HeaderNode) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for txID, wtx := range w.txs {
+		if wtx.block != nil && wtx.block.Height <= node.Height {
+			continue
+		}
+		w.unmarkSpent(txID, wtx)
+		delete(w.txs, txID)
+	}
+	w.blocks = map[[32]byte][]message.TxID{}
+	for txID, wtx := range w.txs {
+		w.blocks[wtx.block.Hash] = append(w.blocks[wtx.block.Hash], txID)
+	}
+	w.tip = node
+}
+
+// IsRelevant checks the transaction pays to the wallet or spends an output of the wallet.
+// Spent transactions must be added before.
+func (w *Wallet) IsRelevant(tx *message.Transaction) bool {
+	if len(w.matcher.MatchTx(tx)) > 0 {
+		return true
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, txIn := range tx.TxIn {
+		if w.isWalletOutput(txIn.PreviousOutput) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWalletOutput checks the outpoint is an output of the wallet transaction paying to the wallet.
+func (w *Wallet) isWalletOutput(op *message.OutPoint) bool {
+	wtx, ok := w.txs[op.Hash]
+	if !ok || wtx.tx == nil || int(op.Index) >= len(wtx.tx.TxOut) {
+		return false
+	}
+	_, ok = w.matcher.Match(wtx.tx.TxOut[op.Index].PkScript.Data)
+	return ok
+}
+
+// Scripts return the output scripts of the wallet, which are matched against compact filters.
+// Blocks spending the outputs also match them because the filter has the spent scripts.
+func (w *Wallet) Scripts() [][]byte {
+	return w.matcher.Scripts()
+}
+
+// FilterElements return the data to add to the bloom filter to match the outputs of the wallet.
+func (w *Wallet) FilterElements() [][]byte {
+	return w.matcher.FilterElements()
+}
+
+// OutputIndexes return the indexes of all outputs of the transaction paying to the wallet.
+func (w *Wallet) OutputIndexes(tx *message.Transaction) []uint32 {
+	return w.matcher.MatchTx(tx)
+}
+
+// MissingTxIDs return the confirmed transactions which data is not received yet.
+func (w *Wallet) MissingTxIDs() []message.TxID {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	res := []message.TxID{}
+	for txID, wtx := range w.txs {
+		if wtx.block != nil && wtx.tx == nil {
+			res = append(res, txID)
+		}
+	}
+	return res
+}
+
+// IsMissing checks the transaction is confirmed in a block but its data is not received yet.
+func (w *Wallet) IsMissing(txID message.TxID) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	wtx, ok := w.txs[txID]
+	return ok && wtx.block != nil && wtx.tx == nil
+}
+
+// UTXOs return the unspent outputs of the confirmed transactions which can be spent.
+// Outputs spent by unconfirmed transactions and immature coinbase outputs are excluded.
+func (w *Wallet) UTXOs() []*utxo {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	utxos := []*utxo{}
+	for u, state := range w.unspentOutputs() {
+		if state == outputConfirmed {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos
+}
+
+// SignableUTXOs return the confirmed unspent outputs of the P2PKH address of the key,
+// which send can sign.
+func (w *Wallet) SignableUTXOs() []*utxo {
+	script := p2pkhScript(util.Hash160(w.pubKey))
+	utxos := []*utxo{}
+	for _, u := range w.UTXOs() {
+		if bytes.Equal(u.tx.TxOut[u.index].PkScript.Data, script) {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos
+}
+
+// Balances return the balance of the confirmed, unconfirmed and immature outputs.
+func (w *Wallet) Balances() *Balances {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	b := &Balances{}
+	for u, state := range w.unspentOutputs() {
+		value := u.tx.TxOut[u.index].Value
+		switch state {
+		case outputConfirmed:
+			b.Confirmed += value
+		case outputUnconfirmed:
+			b.Unconfirmed += value
+		default:
+			b.Immature += value
+		}
+	}
+	return b
+}
+
+// unspentOutputs return the outputs paying to the wallet which no wallet transaction spends.
+func (w *Wallet) unspentOutputs() map[*utxo]outputState {
+	// 未承認のtxが使ったoutputも使用済みとする
+	pending := map[message.OutPoint]bool{}
+	for _, wtx := range w.txs {
+		if wtx.block == nil && wtx.tx != nil {
+			for _, txIn := range wtx.tx.TxIn {
+				pending[*txIn.PreviousOutput] = true
+			}
+		}
+	}
+	res := map[*utxo]outputState{}
+	for txID, wtx := range w.txs {
+		if wtx.tx == nil {
+			continue
+		}
+		state := outputConfirmed
+		switch {
+		case wtx.block == nil:
+			state = outputUnconfirmed
+		case wtx.tx.IsCoinBase() && w.confirmations(wtx.block) <= coinbaseMaturity:
+			state = outputImmature
+		}
+		for _, index := range w.matcher.MatchTx(wtx.tx) {
+			outPoint := message.OutPoint{Hash: txID, Index: index}
+			if _, ok := w.spent[outPoint]; ok || pending[outPoint] {
+				continue
+			}
+			res[&utxo{tx: wtx.tx, index: index}] = state
+		}
+	}
+	return res
+}
+
+// confirmations return the number of blocks up to the sync tip from the block.
+func (w *Wallet) confirmations(block *chain.HeaderNode) uint32 {
+	if w.tip == nil || w.tip.Height < block.Height {
+		return 1
+	}
+	return w.tip.Height - block.Height + 1
+}
+
+// conflictsWithConfirmed checks the transaction spends an output spent by other confirmed transaction.
+func (w *Wallet) conflictsWithConfirmed(txID message.TxID, tx *message.Transaction) bool {
+	for _, txIn := range tx.TxIn {
+		if spentBy, ok := w.spent[*txIn.PreviousOutput]; ok && spentBy != txID {
+			return true
+		}
+	}
+	return false
+}
+
+// evictConflicts remove the unconfirmed transactions which spend the same outputs as
+// the transaction, and the unconfirmed transactions depending on them.
+// If the transaction is unconfirmed, the conflicting ones are recorded as replaced by it.
+func (w *Wallet) evictConflicts(txID message.TxID, wtx *walletTx) []*TxNotification {
+	if wtx.tx == nil {
+		return nil
+	}
+	inputs := map[message.OutPoint]bool{}
+	for _, txIn := range wtx.tx.TxIn {
+		inputs[*txIn.PreviousOutput] = true
+	}
+	spent := map[message.OutPoint]bool{}
+	for op := range inputs {
+		spent[op] = true
+	}
+	notifications := []*TxNotification{}
+	// 取り除いたtxのoutputを使うtxも取り除く
+	for evicted := true; evicted; {
+		evicted = false
+		for id, conflict := range w.txs {
+			if id == txID || conflict.block != nil || conflict.tx == nil || !spendsAny(conflict.tx, spent) {
+				continue
+			}
+			delete(w.txs, id)
+			for i := range conflict.tx.TxOut {
+				spent[message.OutPoint{Hash: id, Index: uint32(i)}] = true
+			}
+			n := &TxNotification{Type: TxEvicted, TxID: id}
+			if wtx.block == nil && spendsAny(conflict.tx, inputs) {
+				w.replaced[id] = &replacement{tx: conflict.tx, by: txID}
+				n = &TxNotification{Type: TxReplaced, TxID: id, ReplacedBy: txID}
+			}
+			notifications = append(notifications, n)
+			evicted = true
+		}
+	}
+	return notifications
+}
+
+func spendsAny(tx *message.Transaction, outPoints map[message.OutPoint]bool) bool {
+	for _, txIn := range tx.TxIn {
+		if outPoints[*txIn.PreviousOutput] {
+			return true
+		}
+	}
+	return false
+}
+
+// markSpent mark the outputs spent by the confirmed transaction.
+func (w *Wallet) markSpent(txID message.TxID, wtx *walletTx) {
+	if wtx.tx == nil {
+		return
+	}
+	for _, txIn := range wtx.tx.TxIn {
+		w.spent[*txIn.PreviousOutput] = txID
+	}
+}
+
+// unmarkSpent make the outputs spent by the unconfirmed transaction unspent again.
+func (w *Wallet) unmarkSpent(txID message.TxID, wtx *walletTx) {
+	if wtx.tx == nil {
+		return
+	}
+	for _, txIn := range wtx.tx.TxIn {
+		if w.spent[*txIn.PreviousOutput] == txID {
+			delete(w.spent, *txIn.PreviousOutput)
+		}
+	}
+}
+
+// p2pkhScript return the P2PKH output script paying to the public key hash.
+func p2pkhScript(pubKeyHash []byte) []byte {
+	return bytes.Join([][]byte{
+		{common.OpDup},
+		{common.OpHash160},
+		common.OpPushData(pubKeyHash),
+		{common.OpEqualVerify},
+		{common.OpCheckSig},
+	}, []byte{})
+}
+
+func (w *Wallet) sendNotifications(notifications []*TxNotification) {
+	if w.notify == nil {
+		return
+	}
+	for _, n := range notifications {
+		w.notify(n)
+	}
+}
@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/common"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+// testPubKey means the uncompressed generator point of secp256k1.
+var testPubKey, _ = hex.DecodeString("04" +
+	"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" +
+	"483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+
+var testPubKeyHash = util.Hash160(testPubKey)
+
+// mineBlock add new regtest header on the parent to the chain.
+func mineBlock(t *testing.T, c *chain.HeaderChain, parent *chain.HeaderNode, salt uint32) *chain.HeaderNode {
+	header := &message.BlockHeader{
+		Version:    4,
+		PrevBlock:  parent.Hash,
+		MerkleRoot: [32]byte{byte(salt)},
+		Timestamp:  parent.Header.Timestamp + 600,
+		Bits:       chain.RegressionNetParams.PowLimitBits,
+	}
+	for chain.CheckProofOfWork(header.BlockHash(), header.Bits, chain.RegressionNetParams.PowLimit) != nil {
+		header.Nonce++
+	}
+	node, err := c.AddHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// p2pkhTx create a transaction which pays value to testPubKeyHash.
+func p2pkhTx(prev message.TxID, value uint64) *message.Transaction {
+	pkScript := common.NewVarStr(bytes.Join([][]byte{
+		[]byte{common.OpDup},
+		[]byte{common.OpHash160},
+		common.OpPushData(testPubKeyHash),
+		[]byte{common.OpEqualVerify},
+		[]byte{common.OpCheckSig},
+	}, []byte{}))
+	txIn := &message.TxIn{
+		PreviousOutput:  &message.OutPoint{Hash: prev, Index: 0},
+		SignatureScript: common.NewVarStr([]byte{}),
+		Sequence:        0xFFFFFFFF,
+	}
+	txOut := &message.TxOut{Value: value, PkScript: pkScript}
+	return message.NewTransaction(uint32(1), []*message.TxIn{txIn}, []*message.TxOut{txOut}, uint32(0))
+}
+
+func TestWalletReorg(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	notifications := []*TxNotification{}
+	w := NewWallet(testPubKey, func(n *TxNotification) {
+		notifications = append(notifications, n)
+	})
+	c.AddListener(w.HandleTipChange)
+
+	tx1 := p2pkhTx([32]byte{0x01}, 1000)
+	tx2 := p2pkhTx([32]byte{0x02}, 2000)
+	w.AddTx(tx1)
+	w.AddTx(tx2)
+
+	fork := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(fork, []message.TxID{tx1.ID()})
+	stale := mineBlock(t, c, fork, 1)
+	w.ConnectBlock(stale, []message.TxID{tx2.ID()})
+	if len(w.UTXOs()) != 2 {
+		t.Fatalf("expected: %d utxos, actual: %d", 2, len(w.UTXOs()))
+	}
+
+	// 分岐したチェーンの方が長くなりstaleが切り離される
+	newBlock := mineBlock(t, c, fork, 2)
+	mineBlock(t, c, newBlock, 3)
+	if c.IsInBestChain(stale.Hash) {
+		t.Fatalf("stale block should be disconnected")
+	}
+	utxos := w.UTXOs()
+	if len(utxos) != 1 || utxos[0].tx.ID() != tx1.ID() {
+		t.Errorf("tx in the disconnected block should be rolled back")
+	}
+	last := notifications[len(notifications)-1]
+	if last.Type != TxUnconfirmed || last.TxID != tx2.ID() || last.BlockHash != stale.Hash {
+		t.Errorf("unconfirmed notification should be sent: %v", last)
+	}
+
+	// 新しいチェーンのブロックで再度承認される
+	w.ConnectBlock(newBlock, []message.TxID{tx2.ID()})
+	if len(w.UTXOs()) != 2 {
+		t.Errorf("tx should be re-applied on the new branch")
+	}
+	last = notifications[len(notifications)-1]
+	if last.Type != TxConfirmed || last.TxID != tx2.ID() || last.Height != newBlock.Height {
+		t.Errorf("confirmed notification should be sent: %v", last)
+	}
+}
+
+func TestWalletSpentInDisconnectedBlock(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+	c.AddListener(w.HandleTipChange)
+
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	spending := p2pkhTx(funding.ID(), 900)
+	w.AddTx(funding)
+	w.AddTx(spending)
+
+	fork := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(fork, []message.TxID{funding.ID()})
+	stale := mineBlock(t, c, fork, 1)
+	w.ConnectBlock(stale, []message.TxID{spending.ID()})
+	if utxos := w.UTXOs(); len(utxos) != 1 || utxos[0].tx.ID() != spending.ID() {
+		t.Fatalf("funding output should be spent")
+	}
+
+	mineBlock(t, c, mineBlock(t, c, fork, 2), 3)
+	// 使用したtxが切り離されて未承認に戻る、未承認のtxが使ったoutputは使えない
+	if utxos := w.UTXOs(); len(utxos) != 0 {
+		t.Errorf("funding output spent by unconfirmed tx should not be spendable: %d", len(utxos))
+	}
+	if b := w.Balances(); b.Confirmed != 0 || b.Unconfirmed != 900 {
+		t.Errorf("spending output should be unconfirmed after reorg: %+v", b)
+	}
+}
+
+func TestWalletEvictConflict(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	notifications := []*TxNotification{}
+	w := NewWallet(testPubKey, func(n *TxNotification) {
+		notifications = append(notifications, n)
+	})
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	w.AddTx(funding)
+	b1 := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(b1, []message.TxID{funding.ID()})
+
+	// 未承認のtxとそれに依存するtx
+	spending := p2pkhTx(funding.ID(), 900)
+	child := p2pkhTx(spending.ID(), 800)
+	w.AddTx(spending)
+	w.AddTx(child)
+	if b := w.Balances(); b.Confirmed != 0 || b.Unconfirmed != 800 {
+		t.Fatalf("unexpected balances: %+v", b)
+	}
+
+	// 同じoutputを使う別のtxが承認される
+	conflict := p2pkhTx(funding.ID(), 700)
+	conflict.TxOut[0].PkScript = common.NewVarStr(p2pkhScript(bytes.Repeat([]byte{0x22}, 20)))
+	w.AddTx(conflict)
+	w.ConnectBlock(mineBlock(t, c, b1, 1), []message.TxID{conflict.ID()})
+	if _, ok := w.txs[spending.ID()]; ok {
+		t.Errorf("conflicting tx should be evicted")
+	}
+	if _, ok := w.txs[child.ID()]; ok {
+		t.Errorf("tx depending on the evicted tx should be evicted")
+	}
+	if b := w.Balances(); b.Confirmed != 0 || b.Unconfirmed != 0 {
+		t.Errorf("unexpected balances after eviction: %+v", b)
+	}
+	// ブロックのtxは承認される前に追加されるので、競合するtxは置き換えられたことになる
+	evicted, replaced := 0, 0
+	for _, n := range notifications {
+		switch n.Type {
+		case TxEvicted:
+			evicted++
+		case TxReplaced:
+			replaced++
+		}
+	}
+	if evicted != 1 || replaced != 1 {
+		t.Errorf("expected 1 evicted and 1 replaced notifications, actual %d %d", evicted, replaced)
+	}
+	// 承認済みのtxと競合する未承認のtxは追加しない
+	w.AddTx(spending)
+	if _, ok := w.txs[spending.ID()]; ok {
+		t.Errorf("tx conflicting with confirmed tx should not be added")
+	}
+}
+
+func TestWalletReplaceTx(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	notifications := []*TxNotification{}
+	w := NewWallet(testPubKey, func(n *TxNotification) {
+		notifications = append(notifications, n)
+	})
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	w.AddTx(funding)
+	b1 := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(b1, []message.TxID{funding.ID()})
+
+	original := p2pkhTx(funding.ID(), 900)
+	child := p2pkhTx(original.ID(), 800)
+	w.AddTx(original)
+	w.AddTx(child)
+	// 手数料を上げた未承認のtxが元のtxを置き換える
+	replacement := p2pkhTx(funding.ID(), 700)
+	w.AddTx(replacement)
+	if replacedBy, ok := w.ReplacedBy(original.ID()); !ok || replacedBy != replacement.ID() {
+		t.Errorf("original tx should be replaced by the replacement")
+	}
+	if _, ok := w.txs[child.ID()]; ok {
+		t.Errorf("tx depending on the replaced tx should be evicted")
+	}
+	if b := w.Balances(); b.Confirmed != 0 || b.Unconfirmed != 700 {
+		t.Errorf("unexpected balances after replacement: %+v", b)
+	}
+	if len(notifications) != 3 || notifications[1].Type != TxReplaced || notifications[1].ReplacedBy != replacement.ID() ||
+		notifications[2].Type != TxEvicted {
+		t.Errorf("unexpected notifications: %v", notifications)
+	}
+	// 置き換えられたtxが再びrelayされても追加しない
+	w.AddTx(original)
+	if _, ok := w.txs[original.ID()]; ok {
+		t.Errorf("replaced tx should not be added again")
+	}
+
+	// 元のtxが先に承認された場合は置き換えたtxを取り除く
+	w.AddTx(original)
+	w.ConnectBlock(mineBlock(t, c, b1, 1), []message.TxID{original.ID()})
+	if _, ok := w.ReplacedBy(original.ID()); ok {
+		t.Errorf("confirmed tx should not be replaced")
+	}
+	if _, ok := w.txs[replacement.ID()]; ok {
+		t.Errorf("replacement conflicting with the confirmed tx should be evicted")
+	}
+	if b := w.Balances(); b.Confirmed != 900 || b.Unconfirmed != 0 {
+		t.Errorf("unexpected balances after original is confirmed: %+v", b)
+	}
+}
+
+func TestWalletImmatureCoinbase(t *testing.T) {
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w := NewWallet(testPubKey, nil)
+	coinbase := p2pkhTx(message.ZeroHash, 5000)
+	coinbase.TxIn[0].PreviousOutput.Index = 0xFFFFFFFF
+	w.AddTx(coinbase)
+	node := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(node, []message.TxID{coinbase.ID()})
+	for i := uint32(1); i < coinbaseMaturity; i++ {
+		node = mineBlock(t, c, node, i)
+	}
+	w.SetSyncTip(node)
+	if b := w.Balances(); b.Immature != 5000 || b.Confirmed != 0 || len(w.UTXOs()) != 0 {
+		t.Errorf("coinbase with %d confirmations should be immature: %+v", coinbaseMaturity, b)
+	}
+	w.SetSyncTip(mineBlock(t, c, node, coinbaseMaturity))
+	if b := w.Balances(); b.Immature != 0 || b.Confirmed != 5000 {
+		t.Errorf("coinbase should be mature: %+v", b)
+	}
+}
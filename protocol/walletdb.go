@@ -0,0 +1,358 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+	"github.com/tanishiking/btcwallet/util"
+)
+
+const (
+	walletFilePath = "wallet.json"
+
+	// walletDBVersion means the schema version of the wallet file written by this code.
+	walletDBVersion = 3
+)
+
+// walletMigrations upgrade the raw wallet file of the version i+1 to i+2.
+// Add a migration here and bump walletDBVersion when the schema changes.
+var walletMigrations = []func(map[string]json.RawMessage) error{
+	migrateWalletV1,
+	migrateWalletV2,
+}
+
+// migrateWalletV1 replace the public key hashes with their P2PKH scripts,
+// because the wallet matches all script types since version 2.
+func migrateWalletV1(raw map[string]json.RawMessage) error {
+	pubKeyHashes := []string{}
+	if err := json.Unmarshal(raw["PubKeyHashes"], &pubKeyHashes); err != nil {
+		return err
+	}
+	scripts := []string{}
+	for _, h := range pubKeyHashes {
+		pubKeyHash, err := hex.DecodeString(h)
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, hex.EncodeToString(p2pkhScript(pubKeyHash)))
+	}
+	delete(raw, "PubKeyHashes")
+	data, err := json.Marshal(scripts)
+	if err != nil {
+		return err
+	}
+	raw["Scripts"] = data
+	return nil
+}
+
+// migrateWalletV2 add the empty replacements, which are recorded since version 3.
+func migrateWalletV2(raw map[string]json.RawMessage) error {
+	raw["Replacements"] = json.RawMessage("[]")
+	return nil
+}
+
+// serializedWallet means the schema of the wallet file.
+type serializedWallet struct {
+	Version      int
+	Scripts      []string // walletの出力スクリプトのindex
+	Tip          *serializedBlock
+	Transactions []*serializedTx
+	Outputs      []*serializedOutput // walletが受け取ったoutputと使用したtx
+	Replacements []*serializedReplacement
+}
+
+// serializedReplacement means the unconfirmed transaction replaced by the other. (BIP125)
+type serializedReplacement struct {
+	TxID       string
+	Raw        string
+	ReplacedBy string
+}
+
+// serializedBlock means the block hash in RPC byte order and its height.
+type serializedBlock struct {
+	Hash   string
+	Height uint32
+}
+
+type serializedTx struct {
+	TxID  string
+	Raw   string           // 未受信の場合は空
+	Block *serializedBlock // 未承認の場合はnil
+}
+
+type serializedOutput struct {
+	TxID    string
+	Index   uint32
+	Value   uint64
+	SpentBy string `json:",omitempty"`
+}
+
+// LoadWallet read Wallet of the public key from the file, or create new one if the file doesn't exist.
+// Blocks which are not in the best header chain anymore are rolled back, and the sync tip is
+// moved back to the fork point, so the blocks of the new branch are scanned again.
+func LoadWallet(filePath string, c *chain.HeaderChain, pubKey []byte, notify func(*TxNotification)) (*Wallet, error) {
+	w := NewWallet(pubKey, notify)
+	w.filePath = filePath
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := decodeWalletFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load wallet %s: %v", filePath, err)
+	}
+	// 古いwalletにもあるP2PKHのスクリプトで鍵を確かめる
+	if !containsString(s.Scripts, hex.EncodeToString(p2pkhScript(util.Hash160(pubKey)))) {
+		return nil, fmt.Errorf("Wallet %s belongs to other key", filePath)
+	}
+	if err := w.restore(s, c); err != nil {
+		return nil, fmt.Errorf("Failed to load wallet %s: %v", filePath, err)
+	}
+	return w, nil
+}
+
+// decodeWalletFile migrate the wallet file to walletDBVersion and decode it.
+func decodeWalletFile(data []byte) (*serializedWallet, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	version := 0
+	if err := json.Unmarshal(raw["Version"], &version); err != nil {
+		return nil, fmt.Errorf("Invalid wallet version: %v", err)
+	}
+	if version < 1 || version > walletDBVersion {
+		return nil, fmt.Errorf("Unsupported wallet version %d", version)
+	}
+	for ; version < walletDBVersion; version++ {
+		if err := walletMigrations[version-1](raw); err != nil {
+			return nil, fmt.Errorf("Failed to migrate wallet from version %d: %v", version, err)
+		}
+	}
+	raw["Version"], _ = json.Marshal(version)
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	s := &serializedWallet{}
+	if err := json.Unmarshal(migrated, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore apply the serialized wallet on the header chain.
+func (w *Wallet) restore(s *serializedWallet, c *chain.HeaderChain) error {
+	for _, stx := range s.Transactions {
+		txID, err := decodeStoredTxID(stx.TxID)
+		if err != nil {
+			return err
+		}
+		wtx := &walletTx{}
+		if stx.Raw != "" {
+			b, err := hex.DecodeString(stx.Raw)
+			if err != nil {
+				return err
+			}
+			if wtx.tx, err = message.DecodeTransaction(b); err != nil {
+				return err
+			}
+			if wtx.tx.ID() != txID {
+				return fmt.Errorf("Transaction %s doesn't match its data", stx.TxID)
+			}
+		}
+		w.txs[txID] = wtx
+		// 保存後にreorgで切り離されたブロックのtxは未承認に戻す
+		node, err := lookupSerializedBlock(c, stx.Block)
+		if err != nil {
+			return err
+		}
+		if node != nil && c.IsInBestChain(node.Hash) {
+			wtx.block = node
+			w.blocks[node.Hash] = append(w.blocks[node.Hash], txID)
+		}
+	}
+	for _, o := range s.Outputs {
+		if o.SpentBy == "" {
+			continue
+		}
+		txID, err := decodeStoredTxID(o.TxID)
+		if err != nil {
+			return err
+		}
+		spentBy, err := decodeStoredTxID(o.SpentBy)
+		if err != nil {
+			return err
+		}
+		if wtx, ok := w.txs[spentBy]; ok && wtx.block != nil {
+			w.spent[message.OutPoint{Hash: txID, Index: o.Index}] = spentBy
+		}
+	}
+	tip, err := lookupSerializedBlock(c, s.Tip)
+	if err != nil {
+		return err
+	}
+	// 切り離されたブロックまで走査済みなら分岐点まで戻す
+	for tip != nil && !c.IsInBestChain(tip.Hash) {
+		tip = tip.Parent
+	}
+	w.tip = tip
+	for _, r := range s.Replacements {
+		b, err := hex.DecodeString(r.Raw)
+		if err != nil {
+			return err
+		}
+		tx, err := message.DecodeTransaction(b)
+		if err != nil {
+			return err
+		}
+		if encodeStoredTxID(tx.ID()) != r.TxID {
+			return fmt.Errorf("Replaced transaction %s doesn't match its data", r.TxID)
+		}
+		replacedBy, err := decodeStoredTxID(r.ReplacedBy)
+		if err != nil {
+			return err
+		}
+		w.replaced[tx.ID()] = &replacement{tx: tx, by: replacedBy}
+	}
+	return nil
+}
+
+// Save write the wallet to the file.
+func (w *Wallet) Save() error {
+	if w.filePath == "" {
+		return fmt.Errorf("Wallet has no file to save")
+	}
+	data, err := json.MarshalIndent(w.serialize(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.filePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.filePath)
+}
+
+func (w *Wallet) serialize() *serializedWallet {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	s := &serializedWallet{
+		Version:      walletDBVersion,
+		Scripts:      []string{},
+		Tip:          serializeBlock(w.tip),
+		Transactions: []*serializedTx{},
+		Outputs:      []*serializedOutput{},
+		Replacements: []*serializedReplacement{},
+	}
+	for txID, r := range w.replaced {
+		s.Replacements = append(s.Replacements, &serializedReplacement{
+			TxID:       encodeStoredTxID(txID),
+			Raw:        hex.EncodeToString(r.tx.Encode()),
+			ReplacedBy: encodeStoredTxID(r.by),
+		})
+	}
+	for _, script := range w.matcher.Scripts() {
+		s.Scripts = append(s.Scripts, hex.EncodeToString(script))
+	}
+	for txID, wtx := range w.txs {
+		stx := &serializedTx{
+			TxID:  encodeStoredTxID(txID),
+			Block: serializeBlock(wtx.block),
+		}
+		if wtx.tx != nil {
+			stx.Raw = hex.EncodeToString(wtx.tx.Encode())
+		}
+		s.Transactions = append(s.Transactions, stx)
+		if wtx.tx == nil {
+			continue
+		}
+		for _, index := range w.matcher.MatchTx(wtx.tx) {
+			o := &serializedOutput{
+				TxID:  encodeStoredTxID(txID),
+				Index: index,
+				Value: wtx.tx.TxOut[index].Value,
+			}
+			if spentBy, ok := w.spent[message.OutPoint{Hash: txID, Index: index}]; ok {
+				o.SpentBy = encodeStoredTxID(spentBy)
+			}
+			s.Outputs = append(s.Outputs, o)
+		}
+	}
+	return s
+}
+
+func serializeBlock(node *chain.HeaderNode) *serializedBlock {
+	if node == nil {
+		return nil
+	}
+	hash := node.Hash
+	return &serializedBlock{
+		Hash:   hex.EncodeToString(util.ReverseBytes(hash[:])),
+		Height: node.Height,
+	}
+}
+
+// lookupSerializedBlock return the node of the block, or nil if the header is unknown.
+func lookupSerializedBlock(c *chain.HeaderChain, b *serializedBlock) (*chain.HeaderNode, error) {
+	if b == nil {
+		return nil, nil
+	}
+	hash, err := hex.DecodeString(b.Hash)
+	if err != nil || len(hash) != 32 {
+		return nil, fmt.Errorf("Invalid block hash %s", b.Hash)
+	}
+	var h [32]byte
+	copy(h[:], util.ReverseBytes(hash))
+	node := c.Lookup(h)
+	if node != nil && node.Height != b.Height {
+		return nil, fmt.Errorf("Block %s is not at height %d", b.Hash, b.Height)
+	}
+	return node, nil
+}
+
+// encodeTxID encode the txid in the byte order of bitcoin core's RPC and block explorers.
+// It is used for all txids shown to or given by the user.
+func encodeTxID(txID message.TxID) string {
+	return hex.EncodeToString(util.ReverseBytes(txID[:]))
+}
+
+func decodeTxID(s string) (message.TxID, error) {
+	txID, err := decodeHash(s)
+	if err != nil {
+		return txID, fmt.Errorf("Invalid txid %s", s)
+	}
+	return txID, nil
+}
+
+// encodeStoredTxID encode the txid in the internal byte order, which is used only in the saved files.
+func encodeStoredTxID(txID message.TxID) string {
+	return hex.EncodeToString(txID[:])
+}
+
+func decodeStoredTxID(s string) (message.TxID, error) {
+	var txID message.TxID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(txID) {
+		return txID, fmt.Errorf("Invalid txid %s", s)
+	}
+	copy(txID[:], b)
+	return txID, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tanishiking/btcwallet/protocol/chain"
+	"github.com/tanishiking/btcwallet/protocol/message"
+)
+
+func tempWalletPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "wallet.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestWalletPersist(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.SyncTip() != nil {
+		t.Errorf("new wallet should have no sync tip")
+	}
+
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	spending := p2pkhTx(funding.ID(), 900)
+	other := p2pkhTx([32]byte{0x02}, 2000)
+	w.AddTx(funding)
+	w.AddTx(spending)
+	w.AddTx(other)
+	b1 := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(b1, []message.TxID{funding.ID(), other.ID()})
+	b2 := mineBlock(t, c, b1, 1)
+	w.ConnectBlock(b2, []message.TxID{spending.ID()})
+	b3 := mineBlock(t, c, b2, 2)
+	w.SetSyncTip(b3)
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SyncTip() != b3 {
+		t.Errorf("sync tip should be restored")
+	}
+	utxos := loaded.UTXOs()
+	if len(utxos) != 2 {
+		t.Fatalf("expected 2 utxos, actual %d", len(utxos))
+	}
+	for _, u := range utxos {
+		if u.tx.ID() == funding.ID() {
+			t.Errorf("spent output should not be restored as utxo")
+		}
+	}
+
+	// 2Gの圧縮公開鍵
+	otherPubKey, _ := hex.DecodeString("02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5")
+	if _, err := LoadWallet(path, c, otherPubKey, nil); err == nil {
+		t.Errorf("wallet of other key should be rejected")
+	}
+}
+
+func TestLoadWalletAfterReorg(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	spending := p2pkhTx(funding.ID(), 900)
+	w.AddTx(funding)
+	w.AddTx(spending)
+	fork := mineBlock(t, c, c.Tip(), 0)
+	w.ConnectBlock(fork, []message.TxID{funding.ID()})
+	stale := mineBlock(t, c, fork, 1)
+	w.ConnectBlock(stale, []message.TxID{spending.ID()})
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存後にstaleが切り離される
+	mineBlock(t, c, mineBlock(t, c, fork, 2), 3)
+	loaded, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SyncTip() != fork {
+		t.Errorf("sync tip should be moved back to the fork point")
+	}
+	// 使用したtxは未承認として残る
+	if b := loaded.Balances(); b.Confirmed != 0 || b.Unconfirmed != 900 {
+		t.Errorf("spending tx should be unconfirmed after reorg: %+v", b)
+	}
+}
+
+func TestLoadWalletVersion(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	for _, data := range []string{`{"Version": 0}`, `{"Version": 99}`, `{}`} {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadWallet(path, c, testPubKey, nil); err == nil {
+			t.Errorf("unsupported version should be rejected: %s", data)
+		}
+	}
+}
+
+func TestLoadWalletV1(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	// version 1は公開鍵ハッシュで鍵を記録していた
+	data := `{"Version": 1, "PubKeyHashes": ["` + hex.EncodeToString(testPubKeyHash) + `"], "Transactions": [], "Outputs": []}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWallet(path, c, testPubKey, nil); err != nil {
+		t.Errorf("migrated wallet should be loaded: %v", err)
+	}
+}
+
+func TestWalletPersistReplacement(t *testing.T) {
+	path, cleanup := tempWalletPath(t)
+	defer cleanup()
+	c := chain.NewHeaderChain(chain.RegressionNetParams)
+	w, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funding := p2pkhTx([32]byte{0x01}, 1000)
+	original := p2pkhTx(funding.ID(), 900)
+	replacement := p2pkhTx(funding.ID(), 700)
+	w.AddTx(funding)
+	w.AddTx(original)
+	w.AddTx(replacement)
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadWallet(path, c, testPubKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacedBy, ok := loaded.ReplacedBy(original.ID()); !ok || replacedBy != replacement.ID() {
+		t.Errorf("replacement should be restored")
+	}
+	// 置き換えられたtxのデータも復元する
+	loaded.ConnectBlock(mineBlock(t, c, c.Tip(), 0), []message.TxID{funding.ID(), original.ID()})
+	if b := loaded.Balances(); b.Confirmed != 900 || b.Unconfirmed != 0 {
+		t.Errorf("restored replaced tx should be confirmed: %+v", b)
+	}
+}
+
+func TestEncodeTxID(t *testing.T) {
+	txID := message.TxID{0x01, 0x02}
+	// ユーザーに見せるtxidはRPCと同じ順序、保存するtxidは内部の順序
+	s := encodeTxID(txID)
+	if s[len(s)-4:] != "0201" {
+		t.Errorf("txid should be encoded in RPC byte order: %s", s)
+	}
+	if decoded, err := decodeTxID(s); err != nil || decoded != txID {
+		t.Errorf("txid should be decoded in RPC byte order: %v", err)
+	}
+	stored := encodeStoredTxID(txID)
+	if stored[:4] != "0102" {
+		t.Errorf("stored txid should be in internal byte order: %s", stored)
+	}
+	if decoded, err := decodeStoredTxID(stored); err != nil || decoded != txID {
+		t.Errorf("stored txid should be decoded in internal byte order: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Package curve implements the arithmetic on secp256k1 used by BIP324 and BIP86.
+// It is not constant time, so it must not be used for signing.
+package curve
+
+import (
+	"crypto/sha256"
+	"math/big"
+)
+
+// secp256k1 curve parameters.
+// y^2 = x^3 + 7 over the field of size P, and N is the order of the generator.
+var (
+	P, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	N, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+
+	gx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	gy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+
+	curveB = big.NewInt(7)
+
+	// sqrtExp is (p+1)/4, p = 3 mod 4 so a^((p+1)/4) is a square root of a if it exists.
+	sqrtExp = new(big.Int).Rsh(new(big.Int).Add(P, big.NewInt(1)), 2)
+)
+
+// Point means affine point on secp256k1. nil means the point at infinity.
+type Point struct {
+	X, Y *big.Int
+}
+
+func mod(a *big.Int) *big.Int {
+	return a.Mod(a, P)
+}
+
+// Sqrt return square root of a or nil if a is not a square. a must be in [0, p).
+func Sqrt(a *big.Int) *big.Int {
+	r := new(big.Int).Exp(a, sqrtExp, P)
+	if mod(new(big.Int).Mul(r, r)).Cmp(a) != 0 {
+		return nil
+	}
+	return r
+}
+
+// Y2 return x^3 + 7.
+func Y2(x *big.Int) *big.Int {
+	return mod(new(big.Int).Add(new(big.Int).Exp(x, big.NewInt(3), P), curveB))
+}
+
+// LiftX return the point with even y which x coordinate is x, or nil.
+func LiftX(x *big.Int) *Point {
+	if x.Sign() < 0 || x.Cmp(P) >= 0 {
+		return nil
+	}
+	y := Sqrt(Y2(x))
+	if y == nil {
+		return nil
+	}
+	if y.Bit(0) == 1 {
+		y.Sub(P, y)
+	}
+	return &Point{X: new(big.Int).Set(x), Y: y}
+}
+
+// Add return p1+p2.
+func Add(p1, p2 *Point) *Point {
+	if p1 == nil {
+		return p2
+	}
+	if p2 == nil {
+		return p1
+	}
+	var lambda *big.Int
+	if p1.X.Cmp(p2.X) == 0 {
+		if mod(new(big.Int).Add(p1.Y, p2.Y)).Sign() == 0 {
+			return nil
+		}
+		// doubling: lambda = 3x^2 / 2y
+		num := mod(new(big.Int).Mul(big.NewInt(3), new(big.Int).Mul(p1.X, p1.X)))
+		den := mod(new(big.Int).Mul(big.NewInt(2), p1.Y))
+		lambda = mod(num.Mul(num, den.ModInverse(den, P)))
+	} else {
+		num := mod(new(big.Int).Sub(p2.Y, p1.Y))
+		den := mod(new(big.Int).Sub(p2.X, p1.X))
+		lambda = mod(num.Mul(num, den.ModInverse(den, P)))
+	}
+	x := mod(new(big.Int).Sub(new(big.Int).Sub(new(big.Int).Mul(lambda, lambda), p1.X), p2.X))
+	y := mod(new(big.Int).Sub(new(big.Int).Mul(lambda, new(big.Int).Sub(p1.X, x)), p1.Y))
+	return &Point{X: x, Y: y}
+}
+
+// ScalarMult return k*p with double-and-add.
+func ScalarMult(k *big.Int, p *Point) *Point {
+	var res *Point
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		res = Add(res, res)
+		if k.Bit(i) == 1 {
+			res = Add(res, p)
+		}
+	}
+	return res
+}
+
+// ScalarBaseMult return k*G.
+func ScalarBaseMult(k *big.Int) *Point {
+	return ScalarMult(k, &Point{X: gx, Y: gy})
+}
+
+// TaggedHash calculate BIP340 tagged hash.
+func TaggedHash(tag []byte, data ...[]byte) [32]byte {
+	tagHash := sha256.Sum256(tag)
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	var res [32]byte
+	copy(res[:], h.Sum(nil))
+	return res
+}
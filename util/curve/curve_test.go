@@ -0,0 +1,40 @@
+package curve
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestScalarBaseMult(t *testing.T) {
+	g := ScalarBaseMult(big.NewInt(1))
+	if g.X.Cmp(gx) != 0 || g.Y.Cmp(gy) != 0 {
+		t.Errorf("1*G should be G")
+	}
+	// 2G
+	x2, _ := new(big.Int).SetString("C6047F9441ED7D6D3045406E95C07CD85C778E4B8CEF3CA7ABAC09B95C709EE5", 16)
+	y2, _ := new(big.Int).SetString("1AE168FEA63DC339A3C58419466CEAEEF7F632653266D0E1236431A950CFE52A", 16)
+	p := ScalarBaseMult(big.NewInt(2))
+	if p.X.Cmp(x2) != 0 || p.Y.Cmp(y2) != 0 {
+		t.Errorf("expected: (%x, %x), actual: (%x, %x)", x2, y2, p.X, p.Y)
+	}
+	if Add(p, g).X.Cmp(ScalarBaseMult(big.NewInt(3)).X) != 0 {
+		t.Errorf("2G+G should be 3G")
+	}
+	if ScalarBaseMult(N) != nil {
+		t.Errorf("n*G should be infinity")
+	}
+}
+
+func TestLiftX(t *testing.T) {
+	p := LiftX(gx)
+	if p == nil || p.Y.Cmp(gy) != 0 {
+		t.Errorf("G has even y and should be lifted")
+	}
+	// x = 5は曲線上にない
+	if LiftX(big.NewInt(5)) != nil {
+		t.Errorf("x not on the curve should be nil")
+	}
+	if LiftX(P) != nil {
+		t.Errorf("x out of the field should be nil")
+	}
+}